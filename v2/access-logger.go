@@ -2,34 +2,338 @@ package httpserver
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/rclancey/logging"
 )
 
 var addrRe = regexp.MustCompile("^(.*):([0-9]+)$")
 
+// AccessLogRule excludes or samples the access log lines for requests
+// matching a route template, a path prefix, or both.  Sampled out
+// requests are still logged if they fail with a 5xx status.
+type AccessLogRule struct {
+	Route   string  `json:"route"`
+	Prefix  string  `json:"prefix"`
+	Exclude bool    `json:"exclude"`
+	Sample  float64 `json:"sample"`
+}
+
+func (rule *AccessLogRule) match(route, path string) bool {
+	if rule.Route != "" && rule.Route != route {
+		return false
+	}
+	if rule.Prefix != "" && !strings.HasPrefix(path, rule.Prefix) {
+		return false
+	}
+	return true
+}
+
+// AccessLogConfig controls what goes into the access log.  Format is
+// one of "default", "common", "combined" or "json", or else a
+// text/template executed against an AccessLogEntry.  With Async, lines
+// are queued and written in the background, and dropped if the queue
+// fills up, so a slow disk never holds up a response.
+type AccessLogConfig struct {
+	Format     string           `json:"format"      arg:"format"`
+	Async      bool             `json:"async"       arg:"async"`
+	BufferSize int              `json:"buffer_size" arg:"buffer-size"`
+	Rules      []*AccessLogRule `json:"rules"       arg:"-"`
+	format     AccessLogFormat
+}
+
+func (cfg *AccessLogConfig) Init() error {
+	format, err := ParseAccessLogFormat(cfg.Format)
+	if err != nil {
+		return err
+	}
+	cfg.format = format
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 1024
+	}
+	for _, rule := range cfg.Rules {
+		if rule.Route == "" && rule.Prefix == "" {
+			return errors.New("access log rule needs a route or prefix")
+		}
+		if rule.Sample < 0 || rule.Sample > 1 {
+			return errors.Errorf("access log sample rate for %s%s must be between 0 and 1", rule.Route, rule.Prefix)
+		}
+	}
+	return nil
+}
+
+func (cfg *AccessLogConfig) shouldLog(rl *ResponseLogger) bool {
+	route := ContextRequestVars(rl.r.Context())["route"]
+	for _, rule := range cfg.Rules {
+		if !rule.match(route, rl.r.URL.Path) {
+			continue
+		}
+		if rule.Exclude {
+			return false
+		}
+		if rule.Sample == 0 || rl.status() >= 500 {
+			return true
+		}
+		return rand.Float64() < rule.Sample
+	}
+	return true
+}
+
+func (cfg *AccessLogConfig) getFormat() AccessLogFormat {
+	if cfg.format == nil {
+		return formatDefault
+	}
+	return cfg.format
+}
+
+// UpstreamAttempt records one request a proxy made on behalf of the
+// client
+type UpstreamAttempt struct {
+	Addr   string  `json:"addr"`
+	Status int     `json:"status"`
+	Time   float64 `json:"time"`
+}
+
+// AccessLogTiming breaks down where the time went, in seconds
+type AccessLogTiming struct {
+	Total     float64 `json:"total"`
+	FirstByte float64 `json:"first_byte"`
+	Upstream  float64 `json:"upstream,omitempty"`
+}
+
+// AccessLogEntry is everything known about a request once it's done
+type AccessLogEntry struct {
+	Time       time.Time         `json:"time"`
+	RemoteAddr string            `json:"remote_addr"`
+	User       string            `json:"user,omitempty"`
+	Method     string            `json:"method"`
+	Host       string            `json:"host"`
+	URI        string            `json:"uri"`
+	Proto      string            `json:"proto"`
+	Route      string            `json:"route,omitempty"`
+	Status     int               `json:"status"`
+	BytesIn    int64             `json:"bytes_in"`
+	BytesOut   int64             `json:"bytes_out"`
+	Referer    string            `json:"referer,omitempty"`
+	UserAgent  string            `json:"user_agent,omitempty"`
+	RequestID  string            `json:"request_id,omitempty"`
+	TraceID    string            `json:"trace_id,omitempty"`
+	TLS        string            `json:"tls,omitempty"`
+	Upgraded   bool              `json:"upgraded,omitempty"`
+	Upstreams  []UpstreamAttempt `json:"upstreams,omitempty"`
+	Timing     AccessLogTiming   `json:"timing"`
+}
+
+// AccessLogFormat writes one access log line
+type AccessLogFormat func(w io.Writer, e *AccessLogEntry) error
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatDefault(w io.Writer, e *AccessLogEntry) error {
+	format := `%s [%s] "%s %s" %d %d %.3f "%s" "%s"`
+	args := []interface{}{
+		e.RemoteAddr,
+		e.Time.Format("2006-01-02 15:04:05 -0700"),
+		e.Method,
+		e.URI,
+		e.Status,
+		e.BytesOut,
+		e.Timing.Total * 1000,
+		e.Referer,
+		e.UserAgent,
+	}
+	if e.Upgraded {
+		// upgraded connections also log what the client sent after the
+		// handshake
+		format += " rx=%d"
+		args = append(args, e.BytesIn)
+	}
+	if e.RequestID != "" {
+		format += " id=%s"
+		args = append(args, e.RequestID)
+	}
+	if e.TraceID != "" {
+		format += " trace=%s"
+		args = append(args, e.TraceID)
+	}
+	_, err := fmt.Fprintf(w, format + "\n", args...)
+	return err
+}
+
+func formatCommon(w io.Writer, e *AccessLogEntry) error {
+	_, err := fmt.Fprintf(w, "%s\n", commonLine(e))
+	return err
+}
+
+func formatCombined(w io.Writer, e *AccessLogEntry) error {
+	_, err := fmt.Fprintf(w, "%s %q %q\n", commonLine(e), dash(e.Referer), dash(e.UserAgent))
+	return err
+}
+
+func commonLine(e *AccessLogEntry) string {
+	size := "-"
+	if e.BytesOut > 0 {
+		size = fmt.Sprintf("%d", e.BytesOut)
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s`,
+		e.RemoteAddr,
+		dash(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method,
+		e.URI,
+		e.Proto,
+		e.Status,
+		size,
+	)
+}
+
+func formatJSON(w io.Writer, e *AccessLogEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "can't serialize access log entry")
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+var accessLogFormats = map[string]AccessLogFormat{
+	"": formatDefault,
+	"default": formatDefault,
+	"common": formatCommon,
+	"combined": formatCombined,
+	"json": formatJSON,
+}
+
+// ParseAccessLogFormat returns the named format, or treats name as a
+// template if it isn't one
+func ParseAccessLogFormat(name string) (AccessLogFormat, error) {
+	format, ok := accessLogFormats[strings.ToLower(name)]
+	if ok {
+		return format, nil
+	}
+	if !strings.Contains(name, "{{") {
+		return nil, errors.Errorf("unknown access log format %s", name)
+	}
+	if !strings.HasSuffix(name, "\n") {
+		name += "\n"
+	}
+	tmpl, err := template.New("access-log").Parse(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad access log template")
+	}
+	format = func(w io.Writer, e *AccessLogEntry) error {
+		buf := &strings.Builder{}
+		err := tmpl.Execute(buf, e)
+		if err != nil {
+			return errors.Wrap(err, "can't render access log template")
+		}
+		_, err = io.WriteString(w, buf.String())
+		return err
+	}
+	return format, nil
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1.0",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// countingBody counts how much of the request body the handler read
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
 type ResponseLogger struct {
 	w http.ResponseWriter
 	r *http.Request
 	start time.Time
+	firstByte time.Time
 	bytesWritten int
 	statusCode int
+	body *countingBody
+	hijacked *countingConn
+	mutex *sync.Mutex
+	user string
+	upstreams []UpstreamAttempt
 }
 
 func NewResponseLogger(w http.ResponseWriter, r *http.Request) *ResponseLogger {
-	return &ResponseLogger{
+	rl := &ResponseLogger{
 		w: w,
-		r: r,
 		start: time.Now(),
 		bytesWritten: 0,
 		statusCode: 0,
+		mutex: &sync.Mutex{},
+	}
+	rl.r = r.WithContext(context.WithValue(r.Context(), reqCtxKey("accessLog"), rl))
+	if r.Body != nil {
+		rl.body = &countingBody{ReadCloser: r.Body}
+		rl.r.Body = rl.body
+	}
+	return rl
+}
+
+// Request returns the request to pass on to the handler, which counts
+// the body bytes read and lets handlers add to the log entry
+func (rl *ResponseLogger) Request() *http.Request {
+	return rl.r
+}
+
+func contextResponseLogger(ctx context.Context) *ResponseLogger {
+	rl, ok := ctx.Value(reqCtxKey("accessLog")).(*ResponseLogger)
+	if !ok {
+		return nil
+	}
+	return rl
+}
+
+// SetRequestUser records who made the request in the access log, and
+// turns on debug logging for the request if there's a rule for the user
+func SetRequestUser(r *http.Request, user string) {
+	if rl := contextResponseLogger(r.Context()); rl != nil {
+		rl.mutex.Lock()
+		rl.user = user
+		rl.mutex.Unlock()
+	}
+	if srv := contextServer(r.Context()); srv != nil && srv.debugRules.match(r, user) {
+		srv.cfg.Logging.enableDebug(logging.FromContext(r.Context()))
+	}
+}
+
+// recordUpstream notes a request a proxy made to addr
+func recordUpstream(ctx context.Context, addr string, status int, dt time.Duration) {
+	if rl := contextResponseLogger(ctx); rl != nil {
+		rl.mutex.Lock()
+		rl.upstreams = append(rl.upstreams, UpstreamAttempt{Addr: addr, Status: status, Time: dt.Seconds()})
+		rl.mutex.Unlock()
 	}
 }
 
@@ -44,34 +348,90 @@ func (rl *ResponseLogger) ip() string {
 	return rl.r.RemoteAddr
 }
 
-func (rl *ResponseLogger) WriteLog(w io.Writer) {
-	dt := time.Now().Sub(rl.start)
-	format := `%s [%s] "%s %s" %d %d %.3f "%s" "%s"` + "\n"
-	args := []interface{}{
-		rl.ip(),
-		rl.start.Format("2006-01-02 15:04:05 -0700"),
-		//rl.start.Format("02/Jan/2006:15:04:05 -0700"),
-		rl.r.Method,
-		rl.r.URL.String(),
-		rl.statusCode,
-		rl.bytesWritten,
-		float64(dt) / 1.0e6,
-		rl.r.Referer(),
-		rl.r.UserAgent(),
+func (rl *ResponseLogger) status() int {
+	if rl.statusCode == 0 {
+		return http.StatusOK
+	}
+	return rl.statusCode
+}
+
+// Entry collects what's known about the request so far
+func (rl *ResponseLogger) Entry() *AccessLogEntry {
+	now := time.Now()
+	ctx := rl.r.Context()
+	e := &AccessLogEntry{
+		Time: rl.start,
+		RemoteAddr: rl.ip(),
+		Method: rl.r.Method,
+		Host: rl.r.Host,
+		URI: rl.r.URL.RequestURI(),
+		Proto: rl.r.Proto,
+		Route: ContextRequestVars(ctx)["route"],
+		Status: rl.status(),
+		BytesOut: int64(rl.bytesWritten),
+		Referer: rl.r.Referer(),
+		UserAgent: rl.r.UserAgent(),
+		RequestID: ContextRequestId(ctx),
+		TraceID: ContextTraceID(ctx),
+		Timing: AccessLogTiming{Total: now.Sub(rl.start).Seconds()},
+	}
+	if rl.body != nil {
+		e.BytesIn = atomic.LoadInt64(&rl.body.n)
+	}
+	if !rl.firstByte.IsZero() {
+		e.Timing.FirstByte = rl.firstByte.Sub(rl.start).Seconds()
 	}
-	w.Write([]byte(fmt.Sprintf(format, args...)))
+	if rl.r.TLS != nil {
+		e.TLS = tlsVersions[rl.r.TLS.Version]
+	}
+	if rl.hijacked != nil {
+		rx, tx := rl.hijacked.Counts()
+		e.Upgraded = true
+		e.BytesIn += rx
+		e.BytesOut += tx
+	}
+	rl.mutex.Lock()
+	e.User = rl.user
+	if len(rl.upstreams) > 0 {
+		e.Upstreams = append([]UpstreamAttempt{}, rl.upstreams...)
+		for _, att := range rl.upstreams {
+			e.Timing.Upstream += att.Time
+		}
+	}
+	rl.mutex.Unlock()
+	if e.User == "" {
+		e.User, _, _ = rl.r.BasicAuth()
+	}
+	return e
+}
+
+func (rl *ResponseLogger) WriteLog(w io.Writer) {
+	formatDefault(w, rl.Entry())
+}
+
+// WriteLogFormat writes the log line for the request in the given format
+func (rl *ResponseLogger) WriteLogFormat(w io.Writer, format AccessLogFormat) error {
+	return format(w, rl.Entry())
 }
 
 func (rl *ResponseLogger) Header() http.Header {
 	return rl.w.Header()
 }
 
+func (rl *ResponseLogger) started() {
+	if rl.firstByte.IsZero() {
+		rl.firstByte = time.Now()
+	}
+}
+
 func (rl *ResponseLogger) WriteHeader(statusCode int) {
+	rl.started()
 	rl.statusCode = statusCode
 	rl.w.WriteHeader(statusCode)
 }
 
 func (rl *ResponseLogger) Write(data []byte) (int, error) {
+	rl.started()
 	if rl.statusCode == 0 {
 		rl.statusCode = http.StatusOK
 	}
@@ -80,10 +440,96 @@ func (rl *ResponseLogger) Write(data []byte) (int, error) {
 	return n, err
 }
 
+func (rl *ResponseLogger) Flush() {
+	rl.started()
+	if rl.statusCode == 0 {
+		rl.statusCode = http.StatusOK
+	}
+	f, ok := rl.w.(http.Flusher)
+	if ok {
+		f.Flush()
+	}
+}
+
 func (rl *ResponseLogger) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	hj, ok := rl.w.(http.Hijacker)
 	if !ok {
 		return nil, nil, errors.New("webserver doesn't support hijacking")
 	}
-	return hj.Hijack()
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	rl.started()
+	if rl.statusCode == 0 {
+		rl.statusCode = http.StatusSwitchingProtocols
+	}
+	rl.hijacked = newCountingConn(conn)
+	// what the server already read ahead is part of the upgraded stream,
+	// and writes through rw have to be counted too
+	atomic.AddInt64(&rl.hijacked.read, int64(rw.Reader.Buffered()))
+	rw = bufio.NewReadWriter(rw.Reader, bufio.NewWriter(rl.hijacked))
+	return rl.hijacked, rw, nil
+}
+
+// asyncWriter queues writes for a background goroutine.  Writes never
+// block: if the queue is full, the line is dropped and onDrop is called.
+type asyncWriter struct {
+	w io.Writer
+	ch chan []byte
+	done chan bool
+	mutex *sync.Mutex
+	closed bool
+	onDrop func()
+}
+
+func newAsyncWriter(w io.Writer, size int, onDrop func()) *asyncWriter {
+	aw := &asyncWriter{
+		w: w,
+		ch: make(chan []byte, size),
+		done: make(chan bool),
+		mutex: &sync.Mutex{},
+		onDrop: onDrop,
+	}
+	go aw.run()
+	return aw
+}
+
+func (aw *asyncWriter) run() {
+	for data := range aw.ch {
+		aw.w.Write(data)
+	}
+	close(aw.done)
+}
+
+func (aw *asyncWriter) Write(data []byte) (int, error) {
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	aw.mutex.Lock()
+	defer aw.mutex.Unlock()
+	if aw.closed {
+		return 0, errors.New("access log closed")
+	}
+	select {
+	case aw.ch <- buf:
+	default:
+		if aw.onDrop != nil {
+			aw.onDrop()
+		}
+	}
+	return len(data), nil
+}
+
+// Close waits for queued lines to be written
+func (aw *asyncWriter) Close() error {
+	aw.mutex.Lock()
+	if aw.closed {
+		aw.mutex.Unlock()
+		return nil
+	}
+	aw.closed = true
+	close(aw.ch)
+	aw.mutex.Unlock()
+	<-aw.done
+	return nil
 }
@@ -0,0 +1,175 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type AccessLogSuite struct {}
+
+var _ = Suite(&AccessLogSuite{})
+
+func (s *AccessLogSuite) TestFormats(c *C) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+	p := NewReverseProxy(target)
+
+	req := httptest.NewRequest("POST", "/api/items?x=1", strings.NewReader("hello world"))
+	req.RemoteAddr = "10.1.2.3:5555"
+	req.Header.Set("User-Agent", "tester")
+	req = req.WithContext(context.WithValue(req.Context(), reqCtxKey("vars"), map[string]string{"route": "/api/items"}))
+	rl := NewResponseLogger(httptest.NewRecorder(), req)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetRequestUser(r, "frank")
+		c.Check(w, Implements, new(http.Flusher))
+		p.ServeHTTP(w, r)
+	})
+	h.ServeHTTP(rl, rl.Request())
+
+	buf := &bytes.Buffer{}
+	f, err := ParseAccessLogFormat("common")
+	c.Assert(err, IsNil)
+	c.Assert(rl.WriteLogFormat(buf, f), IsNil)
+	c.Check(buf.String(), Matches, `10\.1\.2\.3 - frank \[\d\d/[A-Z][a-z]{2}/\d{4}:\d\d:\d\d:\d\d [-+]\d{4}\] "POST /api/items\?x=1 HTTP/1.1" 201 7\n`)
+
+	buf.Reset()
+	f, _ = ParseAccessLogFormat("combined")
+	c.Assert(rl.WriteLogFormat(buf, f), IsNil)
+	c.Check(buf.String(), Matches, `.*" 201 7 "-" "tester"\n`)
+
+	buf.Reset()
+	f, _ = ParseAccessLogFormat("json")
+	c.Assert(rl.WriteLogFormat(buf, f), IsNil)
+	e := &AccessLogEntry{}
+	c.Assert(json.Unmarshal(buf.Bytes(), e), IsNil)
+	c.Check(e.Route, Equals, "/api/items")
+	c.Check(e.User, Equals, "frank")
+	c.Check(e.BytesIn, Equals, int64(11))
+	c.Check(e.BytesOut, Equals, int64(7))
+	c.Assert(e.Upstreams, HasLen, 1)
+	c.Check(e.Upstreams[0].Addr, Equals, target.Host)
+	c.Check(e.Upstreams[0].Status, Equals, http.StatusCreated)
+	c.Check(e.Timing.Upstream > 0, Equals, true)
+	c.Check(e.Timing.Total >= e.Timing.FirstByte, Equals, true)
+
+	buf.Reset()
+	f, err = ParseAccessLogFormat("{{.Method}} {{.Route}} {{.Status}} in={{.BytesIn}}")
+	c.Assert(err, IsNil)
+	c.Assert(rl.WriteLogFormat(buf, f), IsNil)
+	c.Check(buf.String(), Equals, "POST /api/items 201 in=11\n")
+
+	_, err = ParseAccessLogFormat("apache")
+	c.Check(err, NotNil)
+}
+
+func (s *AccessLogSuite) TestRules(c *C) {
+	cfg := &AccessLogConfig{
+		Rules: []*AccessLogRule{
+			&AccessLogRule{Prefix: "/metrics", Exclude: true},
+			&AccessLogRule{Route: "/healthz", Sample: 0.01},
+		},
+	}
+	c.Assert(cfg.Init(), IsNil)
+	logged := func(path, route string, status int) int {
+		n := 0
+		for i := 0; i < 100; i++ {
+			req := httptest.NewRequest("GET", path, nil)
+			req = req.WithContext(context.WithValue(req.Context(), reqCtxKey("vars"), map[string]string{"route": route}))
+			rl := NewResponseLogger(httptest.NewRecorder(), req)
+			rl.WriteHeader(status)
+			if cfg.shouldLog(rl) {
+				n++
+			}
+		}
+		return n
+	}
+	c.Check(logged("/metrics", "", 200), Equals, 0)
+	c.Check(logged("/metrics", "", 500), Equals, 0)
+	c.Check(logged("/healthz", "/healthz", 200) < 20, Equals, true)
+	c.Check(logged("/healthz", "/healthz", 503), Equals, 100)
+	c.Check(logged("/api", "/api", 200), Equals, 100)
+	c.Check((&AccessLogConfig{Rules: []*AccessLogRule{&AccessLogRule{Exclude: true}}}).Init(), NotNil)
+}
+
+type slowWriter struct {
+	mutex sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *slowWriter) Write(data []byte) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.buf.Write(data)
+}
+
+func (s *AccessLogSuite) TestAsync(c *C) {
+	out := &slowWriter{}
+	dropped := 0
+	aw := newAsyncWriter(out, 2, func() { dropped++ })
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		aw.Write([]byte("line\n"))
+	}
+	c.Check(time.Since(start) < 50 * time.Millisecond, Equals, true)
+	c.Assert(aw.Close(), IsNil)
+	c.Check(strings.Count(out.buf.String(), "line\n") + dropped, Equals, 10)
+	c.Check(dropped > 0, Equals, true)
+	_, err := aw.Write([]byte("late\n"))
+	c.Check(err, NotNil)
+	c.Check(strings.Contains(out.buf.String(), "late"), Equals, false)
+}
+
+func (s *AccessLogSuite) TestHijack(c *C) {
+	cfg := &ServerConfig{AccessLog: AccessLogConfig{Format: "json"}}
+	srv := newTestServer(c, cfg)
+	h := srv.AccessLoggerMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+		line, _ := rw.ReadString('\n')
+		conn.Write([]byte("echo " + line))
+	}))
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: example.com\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+	conn.Write([]byte("hello\n"))
+	data, _ := ioutil.ReadAll(conn)
+	c.Check(string(data), Matches, "(?s)HTTP/1.1 101 .*\r\n\r\necho hello\n")
+
+	// the line is written once the handler returns
+	var e *AccessLogEntry
+	for i := 0; i < 100 && e == nil; i++ {
+		logData, _ := ioutil.ReadFile(cfg.Logging.AccessLog)
+		if len(logData) > 0 {
+			e = &AccessLogEntry{}
+			c.Assert(json.Unmarshal(logData, e), IsNil)
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	c.Assert(e, NotNil)
+	c.Check(e.Status, Equals, http.StatusSwitchingProtocols)
+	c.Check(e.Upgraded, Equals, true)
+	c.Check(e.BytesIn, Equals, int64(len("hello\n")))
+	c.Check(e.BytesOut, Equals, int64(len(data)))
+}
@@ -0,0 +1,141 @@
+package httpserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AdminConfig enables the admin endpoints, which let operators inspect
+// and control a running server.  With a Port (bound to Host, which
+// defaults to the loopback address) or a unix Socket, they get their own
+// listener, so they can be kept off the public one; the metrics endpoint
+// moves there too, unless it has a port of its own.  The endpoints
+// require auth, unless NoAuth is set, which is only allowed on their own
+// listener.
+type AdminConfig struct {
+	Enabled bool   `json:"enabled" arg:"enabled"`
+	Path    string `json:"path"    arg:"path"`
+	Host    string `json:"host"    arg:"host"`
+	Port    int    `json:"port"    arg:"port"`
+	Socket  string `json:"socket"  arg:"socket"`
+	NoAuth  bool   `json:"no_auth" arg:"no-auth"`
+}
+
+func (cfg *AdminConfig) Init() error {
+	if cfg.Path == "" {
+		cfg.Path = "/admin"
+	}
+	cfg.Path = path.Clean("/" + cfg.Path)
+	if cfg.Host == "" {
+		cfg.Host = "127.0.0.1"
+	}
+	if cfg.Port != 0 && cfg.Socket != "" {
+		return errors.New("admin endpoints can have a port or a socket, not both")
+	}
+	if cfg.NoAuth && cfg.Enabled && !cfg.separate() {
+		return errors.New("admin endpoints can only skip auth on their own listener")
+	}
+	return nil
+}
+
+// separate reports whether the admin endpoints get their own listener
+func (cfg *AdminConfig) separate() bool {
+	return cfg.Enabled && (cfg.Port != 0 || cfg.Socket != "")
+}
+
+func (cfg *AdminConfig) listen() (net.Listener, error) {
+	if cfg.Socket != "" {
+		// clear out a socket left behind by an unclean exit
+		st, err := os.Lstat(cfg.Socket)
+		if err == nil && st.Mode() & os.ModeSocket != 0 {
+			os.Remove(cfg.Socket)
+		}
+		l, err := net.Listen("unix", cfg.Socket)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't listen on admin socket " + cfg.Socket)
+		}
+		err = os.Chmod(cfg.Socket, 0600)
+		if err != nil {
+			l.Close()
+			return nil, errors.Wrap(err, "can't set permissions on admin socket " + cfg.Socket)
+		}
+		return l, nil
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't listen for admin on " + addr)
+	}
+	return l, nil
+}
+
+// Admin returns the router the admin endpoints are attached to, or nil
+// if they aren't enabled.  Applications can add their own endpoints to
+// it; they get the same auth as the built in ones.
+func (srv *Server) Admin() Router {
+	return srv.adminRouter
+}
+
+func (srv *Server) setupAdmin() {
+	cfg := &srv.cfg.Admin
+	if !cfg.Enabled {
+		return
+	}
+	prefix := cfg.Path
+	if prefix == "" {
+		prefix = "/admin"
+	}
+	if cfg.separate() {
+		srv.adminRoot = NewRouter()
+		srv.adminRouter = srv.adminRoot.Prefix(prefix)
+	} else {
+		srv.adminRouter = srv.router.Prefix(prefix)
+	}
+	if !cfg.NoAuth {
+		srv.adminRouter.Use(func(h http.Handler) http.Handler {
+			return srv.requireAuth(h, "admin endpoint")
+		})
+	}
+	srv.attachLogEndpoints(srv.adminRouter)
+	srv.attachDiagnostics(srv.adminRouter)
+	if srv.capture != nil {
+		srv.capture.AttachEndpoint(srv.adminRouter)
+	}
+	if srv.cache != nil {
+		srv.cache.AttachEndpoint(srv.adminRouter)
+	}
+	if srv.health != nil {
+		srv.health.attachReportEndpoint(srv.adminRouter)
+	}
+	if !srv.cfg.Metrics.Disabled && srv.cfg.Metrics.Port == 0 && !srv.cfg.Metrics.Public {
+		path := srv.cfg.Metrics.Path
+		if path == "" {
+			path = "/metrics"
+		}
+		srv.adminRouter.GET(path, srv.metrics.Handler())
+	}
+}
+
+// routerHandler serves requests from a router on its own, for listeners
+// that don't go through the server's middleware or document root
+type routerHandler struct {
+	router Router
+}
+
+func (rh *routerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(path.Clean(r.URL.Path), "/"), "/")
+	handler, params := rh.router.Lookup(r.Method, parts)
+	if handler == nil {
+		sendError(w, r, NotFound.Errorf("no admin endpoint %s %s", r.Method, r.URL.Path))
+		return
+	}
+	ctx := context.WithValue(r.Context(), reqCtxKey("vars"), params)
+	handler.ServeHTTP(w, r.Clone(ctx))
+}
@@ -27,6 +27,7 @@ func (a *Authenticator) MakeMiddleware() H.Middleware {
 				return
 			}
 			xr := r.WithContext(withUserContext(r.Context(), claims))
+			H.SetRequestUser(xr, claims.GetUsername())
 			handler.ServeHTTP(w, xr)
 		}
 		return http.HandlerFunc(fnc)
@@ -1,56 +1,39 @@
 package auth
 
 import (
-	"io/ioutil"
-	htmltpl "html/template"
-	"os"
-	texttpl "text/template"
+	"net/http"
+
+	H "github.com/rclancey/httpserver/v2"
 )
 
-func readFileText(fn string) (string, error) {
-	f, err := os.Open(fn)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-	data, err := ioutil.ReadAll(f)
-	if err != nil {
-		return "", err
-	}
-	return string(data), nil
+func init() {
+	H.RegisterViewHelper("currentUser", func(r *http.Request) interface{} {
+		return UserFromRequest(r)
+	})
 }
 
-func makeTextTemplateFromFile(name, fn string) (Template, error) {
-	text, err := readFileText(fn)
-	if err != nil {
-		return nil, err
-	}
-	return texttpl.New(name).Parse(text)
-}
-
-func makeHtmlTemplateFromFile(name, fn string) (Template, error) {
-	text, err := readFileText(fn)
-	if err != nil {
-		return nil, err
-	}
-	return htmltpl.New(name).Parse(text)
+// GetTemplates loads the configured templates with the default template
+// loader, so that they share a cache (and dev mode reloading) with the
+// server's views
+func (cfg *TemplateConfig) GetTemplates() (text, html, sms Template, err error) {
+	return cfg.GetTemplatesFrom(H.DefaultTemplateLoader())
 }
 
-func (cfg *TemplateConfig) GetTemplates() (text, html, sms Template, err error) {
+func (cfg *TemplateConfig) GetTemplatesFrom(loader *H.TemplateLoader) (text, html, sms Template, err error) {
 	if cfg.Text != "" {
-		text, err = makeTextTemplateFromFile("text", cfg.Text)
+		text, err = loader.TextFile("text", cfg.Text)
 		if err != nil {
 			return
 		}
 	}
 	if cfg.HTML != "" {
-		html, err = makeHtmlTemplateFromFile("html", cfg.HTML)
+		html, err = loader.HTMLFile("html", cfg.HTML)
 		if err != nil {
 			return
 		}
 	}
 	if cfg.SMS != "" {
-		sms, err = makeTextTemplateFromFile("sms", cfg.SMS)
+		sms, err = loader.TextFile("sms", cfg.SMS)
 		if err != nil {
 			return
 		}
@@ -0,0 +1,1002 @@
+package httpserver
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/logging"
+)
+
+const (
+	DefaultCacheMemoryEntries = 1000
+	DefaultCacheDiskEntries = 10000
+	DefaultCacheMaxEntrySize = 10 * 1024 * 1024
+	cacheSweepInterval = time.Minute
+)
+
+// CacheConfig configures the response cache.  At most MemoryEntries
+// responses are kept in memory, and at most DiskEntries in Directory.
+// Responses with an ETag or Last-Modified header can be revalidated, so
+// they aren't dropped when they expire; instead the disk is swept at most
+// once a minute, and the entries that were stored longest ago go first.
+type CacheConfig struct {
+	Directory     string `json:"directory"      arg:"dir"`
+	MemoryEntries int    `json:"memory_entries" arg:"memory-entries"`
+	DiskEntries   int    `json:"disk_entries"   arg:"disk-entries"`
+	MaxEntrySize  int64  `json:"max_entry_size" arg:"max-entry-size"`
+	DefaultTTL    int    `json:"default_ttl"    arg:"default-ttl"`
+	DefaultProxy  bool   `json:"default_proxy"  arg:"default-proxy"`
+}
+
+func (cfg *CacheConfig) Init(cacheDir string) error {
+	if cfg.Directory == "" {
+		return nil
+	}
+	dn, err := MakeRootAbs(cacheDir, cfg.Directory)
+	if err != nil {
+		return errors.Wrap(err, "can't make abs path for response cache directory " + cfg.Directory)
+	}
+	err = checkWritableDir(dn)
+	if err != nil {
+		return errors.Wrapf(err, "response cache directory %s not writable", dn)
+	}
+	cfg.Directory = dn
+	return nil
+}
+
+var cacheableStatus = map[int]bool{
+	http.StatusOK: true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent: true,
+	http.StatusMultipleChoices: true,
+	http.StatusMovedPermanently: true,
+	http.StatusPermanentRedirect: true,
+	http.StatusNotFound: true,
+	http.StatusMethodNotAllowed: true,
+	http.StatusGone: true,
+	http.StatusRequestURITooLong: true,
+	http.StatusNotImplemented: true,
+}
+
+func parseCacheControl(s string) map[string]string {
+	cc := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		k := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) == 2 {
+			cc[k] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		} else {
+			cc[k] = ""
+		}
+	}
+	return cc
+}
+
+func ccSeconds(cc map[string]string, key string) (time.Duration, bool) {
+	v, ok := cc[key]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+type cacheEntry struct {
+	Key                  string        `json:"key"`
+	Host                 string        `json:"host"`
+	URI                  string        `json:"uri"`
+	Variant              string        `json:"variant"`
+	Vary                 []string      `json:"vary,omitempty"`
+	Status               int           `json:"status"`
+	Header               http.Header   `json:"header"`
+	Tags                 []string      `json:"tags,omitempty"`
+	Stored               time.Time     `json:"stored"`
+	Expires              time.Time     `json:"expires"`
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate"`
+	StaleIfError         time.Duration `json:"stale_if_error"`
+	Public               bool          `json:"public"`
+	body []byte
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+func (e *cacheEntry) usableWhileRevalidating(now time.Time) bool {
+	return now.Before(e.Expires.Add(e.StaleWhileRevalidate))
+}
+
+func (e *cacheEntry) usableOnError(now time.Time) bool {
+	return now.Before(e.Expires.Add(e.StaleIfError))
+}
+
+func (e *cacheEntry) dead(now time.Time) bool {
+	if e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != "" {
+		// can still be revalidated
+		return false
+	}
+	return !e.usableWhileRevalidating(now) && !e.usableOnError(now)
+}
+
+// shareable reports whether the entry can be sent in answer to r.  A
+// request with cookies may be for a page rendered for one user, so it only
+// gets responses that were explicitly marked public.
+func (e *cacheEntry) shareable(r *http.Request) bool {
+	return e.Public || r.Header.Get("Cookie") == ""
+}
+
+func (e *cacheEntry) hasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// cachePolicy decides whether a response may be stored, and for how long
+func cachePolicy(status int, h http.Header, defaultTTL time.Duration, now time.Time) (bool, time.Time, time.Duration, time.Duration) {
+	if !cacheableStatus[status] {
+		return false, now, 0, 0
+	}
+	if h.Get("Set-Cookie") != "" || strings.TrimSpace(h.Get("Vary")) == "*" {
+		return false, now, 0, 0
+	}
+	if strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+		return false, now, 0, 0
+	}
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return false, now, 0, 0
+	}
+	if _, ok := cc["private"]; ok {
+		return false, now, 0, 0
+	}
+	swr, _ := ccSeconds(cc, "stale-while-revalidate")
+	sie, _ := ccSeconds(cc, "stale-if-error")
+	validators := h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+	if _, ok := cc["no-cache"]; ok {
+		return validators, now, 0, sie
+	}
+	ttl, ok := ccSeconds(cc, "s-maxage")
+	if !ok {
+		ttl, ok = ccSeconds(cc, "max-age")
+	}
+	if !ok {
+		exp := h.Get("Expires")
+		if exp != "" {
+			ok = true
+			t, err := http.ParseTime(exp)
+			if err == nil {
+				ttl = t.Sub(now)
+			}
+		}
+	}
+	if !ok {
+		ttl = defaultTTL
+	}
+	if ttl <= 0 && swr <= 0 && sie <= 0 && !validators {
+		return false, now, 0, 0
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	return true, now.Add(ttl), swr, sie
+}
+
+// explicitlyPublic reports whether a response says it may be shared
+// between users even if the request carried credentials
+func explicitlyPublic(h http.Header) bool {
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	_, public := cc["public"]
+	_, smaxage := cc["s-maxage"]
+	return public || smaxage
+}
+
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	_, ok := parseCacheControl(r.Header.Get("Cache-Control"))["no-store"]
+	return !ok
+}
+
+func cachePrimaryKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+func cacheVariantKey(r *http.Request, primary string, vary []string) string {
+	if len(vary) == 0 {
+		return primary
+	}
+	parts := []string{primary}
+	for _, k := range vary {
+		parts = append(parts, k + ": " + strings.Join(r.Header.Values(k), ","))
+	}
+	return strings.Join(parts, "\n")
+}
+
+func cacheHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseVary(h http.Header) []string {
+	vary := []string{}
+	for _, v := range h.Values("Vary") {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if k != "" {
+				vary = append(vary, k)
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary
+}
+
+func parseTags(h http.Header) []string {
+	tags := []string{}
+	for _, v := range h.Values("Cache-Tag") {
+		for _, tag := range strings.Split(v, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// detachedContext keeps a request's values but not its cancellation, for
+// revalidating in the background after the client has been answered
+type detachedContext struct {
+	parent context.Context
+}
+
+func (ctx detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (ctx detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (ctx detachedContext) Err() error {
+	return nil
+}
+
+func (ctx detachedContext) Value(key interface{}) interface{} {
+	return ctx.parent.Value(key)
+}
+
+var errCacheEntryTooBig = errors.New("response too big to cache")
+
+// cacheRecorder captures a response.  With a ResponseWriter it tees the
+// response through to the client; without one it only buffers, up to max
+// bytes.  A buffered response that outgrows that is handed over to spill
+// and streamed from then on, or if there's no spill writer, cut off.
+type cacheRecorder struct {
+	w http.ResponseWriter
+	spill http.ResponseWriter
+	header http.Header
+	status int
+	body *bytes.Buffer
+	max int64
+	overflow bool
+}
+
+func newCacheRecorder(w http.ResponseWriter, max int64) *cacheRecorder {
+	rec := &cacheRecorder{
+		w: w,
+		body: &bytes.Buffer{},
+		max: max,
+	}
+	if w == nil {
+		rec.header = http.Header{}
+	}
+	return rec
+}
+
+func (rec *cacheRecorder) Header() http.Header {
+	if rec.w != nil {
+		return rec.w.Header()
+	}
+	return rec.header
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status != 0 {
+		return
+	}
+	rec.status = status
+	if rec.w != nil {
+		rec.header = rec.w.Header().Clone()
+		rec.w.Header().Del("Cache-Tag")
+		rec.w.WriteHeader(status)
+	}
+}
+
+func (rec *cacheRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	tooBig := int64(rec.body.Len() + len(data)) > rec.max
+	if rec.w != nil {
+		if !rec.overflow {
+			if tooBig {
+				rec.overflow = true
+				rec.body.Reset()
+			} else {
+				rec.body.Write(data)
+			}
+		}
+		return rec.w.Write(data)
+	}
+	if !tooBig {
+		return rec.body.Write(data)
+	}
+	rec.overflow = true
+	if rec.spill == nil {
+		rec.body.Reset()
+		return 0, errCacheEntryTooBig
+	}
+	rec.w = rec.spill
+	rec.writeHeaderTo(rec.w)
+	_, err := rec.w.Write(rec.body.Bytes())
+	rec.body.Reset()
+	if err != nil {
+		return 0, err
+	}
+	return rec.w.Write(data)
+}
+
+func (rec *cacheRecorder) Flush() {
+	if rec.w == nil {
+		return
+	}
+	f, isa := rec.w.(http.Flusher)
+	if isa {
+		f.Flush()
+	}
+}
+
+func (rec *cacheRecorder) writeHeaderTo(w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range rec.header {
+		if k != "Cache-Tag" {
+			h[k] = v
+		}
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	w.WriteHeader(rec.status)
+}
+
+func (rec *cacheRecorder) writeTo(w http.ResponseWriter, r *http.Request) {
+	rec.writeHeaderTo(w)
+	if r.Method != http.MethodHead {
+		w.Write(rec.body.Bytes())
+	}
+}
+
+// ResponseCache is a shared HTTP cache for GET and HEAD responses.
+// Responses are kept in an in-memory LRU and, if a directory is
+// configured, on disk.
+type ResponseCache struct {
+	cfg *CacheConfig
+	mutex *sync.Mutex
+	lru *list.List
+	entries map[string]*list.Element
+	varies map[string][]string
+	calls map[string]chan bool
+	revalidating map[string]bool
+	lastSweep time.Time
+	sweeping bool
+}
+
+func NewResponseCache(cfg *CacheConfig) *ResponseCache {
+	if cfg == nil {
+		cfg = &CacheConfig{}
+	}
+	return &ResponseCache{
+		cfg: cfg,
+		mutex: &sync.Mutex{},
+		lru: list.New(),
+		entries: map[string]*list.Element{},
+		varies: map[string][]string{},
+		calls: map[string]chan bool{},
+		revalidating: map[string]bool{},
+	}
+}
+
+func (c *ResponseCache) maxEntrySize() int64 {
+	if c.cfg.MaxEntrySize > 0 {
+		return c.cfg.MaxEntrySize
+	}
+	return DefaultCacheMaxEntrySize
+}
+
+func (c *ResponseCache) memoryEntries() int {
+	if c.cfg.MemoryEntries > 0 {
+		return c.cfg.MemoryEntries
+	}
+	return DefaultCacheMemoryEntries
+}
+
+func (c *ResponseCache) diskEntries() int {
+	if c.cfg.DiskEntries > 0 {
+		return c.cfg.DiskEntries
+	}
+	return DefaultCacheDiskEntries
+}
+
+func (c *ResponseCache) path(hash, ext string) string {
+	return filepath.Join(c.cfg.Directory, hash + ext)
+}
+
+func (c *ResponseCache) getVary(primary string) []string {
+	c.mutex.Lock()
+	vary, ok := c.varies[primary]
+	c.mutex.Unlock()
+	if ok || c.cfg.Directory == "" {
+		return vary
+	}
+	data, err := ioutil.ReadFile(c.path(cacheHash(primary), ".vary"))
+	if err != nil {
+		return nil
+	}
+	json.Unmarshal(data, &vary)
+	return vary
+}
+
+func (c *ResponseCache) remember(entry *cacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.varies[entry.Key] = entry.Vary
+	el, ok := c.entries[entry.Variant]
+	if ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[entry.Variant] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.memoryEntries() {
+		old := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, old.Variant)
+	}
+}
+
+func (c *ResponseCache) get(variant string) *cacheEntry {
+	c.mutex.Lock()
+	el, ok := c.entries[variant]
+	if ok {
+		c.lru.MoveToFront(el)
+		c.mutex.Unlock()
+		return el.Value.(*cacheEntry)
+	}
+	c.mutex.Unlock()
+	if c.cfg.Directory == "" {
+		return nil
+	}
+	hash := cacheHash(variant)
+	data, err := ioutil.ReadFile(c.path(hash, ".json"))
+	if err != nil {
+		return nil
+	}
+	entry := &cacheEntry{}
+	err = json.Unmarshal(data, entry)
+	if err != nil {
+		return nil
+	}
+	entry.body, err = ioutil.ReadFile(c.path(hash, ".body"))
+	if err != nil {
+		return nil
+	}
+	c.remember(entry)
+	return entry
+}
+
+func writeFileAtomic(fn string, data []byte) error {
+	tmp := fn + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+func (c *ResponseCache) store(entry *cacheEntry) {
+	c.remember(entry)
+	if c.cfg.Directory == "" {
+		return
+	}
+	hash := cacheHash(entry.Variant)
+	meta, err := json.Marshal(entry)
+	if err == nil {
+		err = writeFileAtomic(c.path(hash, ".body"), entry.body)
+	}
+	if err == nil {
+		err = writeFileAtomic(c.path(hash, ".json"), meta)
+	}
+	if err == nil && len(entry.Vary) > 0 {
+		vary, _ := json.Marshal(entry.Vary)
+		err = writeFileAtomic(c.path(cacheHash(entry.Key), ".vary"), vary)
+	}
+	if err != nil {
+		logging.Errorln(context.Background(), "error writing response cache entry:", err)
+	}
+	c.maybeSweep()
+}
+
+func (c *ResponseCache) maybeSweep() {
+	c.mutex.Lock()
+	due := !c.sweeping && time.Since(c.lastSweep) > cacheSweepInterval
+	if due {
+		c.sweeping = true
+		c.lastSweep = time.Now()
+	}
+	c.mutex.Unlock()
+	if due {
+		go func() {
+			c.sweep()
+			c.mutex.Lock()
+			c.sweeping = false
+			c.mutex.Unlock()
+		}()
+	}
+}
+
+// sweep removes the dead entries from the disk, and then the oldest ones
+// until there are no more than DiskEntries left.  It returns the number
+// of entries removed.
+func (c *ResponseCache) sweep() int {
+	fns, _ := filepath.Glob(filepath.Join(c.cfg.Directory, "*.json"))
+	now := time.Now()
+	live := []*cacheEntry{}
+	removed := []*cacheEntry{}
+	for _, fn := range fns {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			continue
+		}
+		entry := &cacheEntry{}
+		if json.Unmarshal(data, entry) != nil {
+			continue
+		}
+		if entry.dead(now) {
+			removed = append(removed, entry)
+		} else {
+			live = append(live, entry)
+		}
+	}
+	if len(live) > c.diskEntries() {
+		sort.Slice(live, func(i, j int) bool {
+			return live[i].Stored.Before(live[j].Stored)
+		})
+		n := len(live) - c.diskEntries()
+		removed = append(removed, live[:n]...)
+		live = live[n:]
+	}
+	keys := map[string]bool{}
+	for _, entry := range live {
+		keys[entry.Key] = true
+	}
+	for _, entry := range removed {
+		c.remove(entry.Variant)
+		if !keys[entry.Key] {
+			os.Remove(c.path(cacheHash(entry.Key), ".vary"))
+		}
+	}
+	return len(removed)
+}
+
+func (c *ResponseCache) remove(variant string) {
+	c.mutex.Lock()
+	el, ok := c.entries[variant]
+	if ok {
+		c.lru.Remove(el)
+		delete(c.entries, variant)
+	}
+	c.mutex.Unlock()
+	if c.cfg.Directory != "" {
+		hash := cacheHash(variant)
+		os.Remove(c.path(hash, ".json"))
+		os.Remove(c.path(hash, ".body"))
+	}
+}
+
+func (c *ResponseCache) newEntry(r *http.Request, rec *cacheRecorder) *cacheEntry {
+	if rec.overflow || r.Method != http.MethodGet {
+		return nil
+	}
+	now := time.Now()
+	ok, expires, swr, sie := cachePolicy(rec.status, rec.header, time.Duration(c.cfg.DefaultTTL) * time.Second, now)
+	if !ok {
+		return nil
+	}
+	primary := cachePrimaryKey(r)
+	vary := parseVary(rec.header)
+	h := rec.header.Clone()
+	h.Del("Cache-Tag")
+	h.Del("Content-Length")
+	entry := &cacheEntry{
+		Key: primary,
+		Host: r.Host,
+		URI: r.URL.RequestURI(),
+		Vary: vary,
+		Status: rec.status,
+		Header: h,
+		Tags: parseTags(rec.header),
+		Stored: now,
+		Expires: expires,
+		StaleWhileRevalidate: swr,
+		StaleIfError: sie,
+		Public: explicitlyPublic(rec.header),
+		body: rec.body.Bytes(),
+	}
+	if !entry.shareable(r) {
+		return nil
+	}
+	entry.Variant = cacheVariantKey(r, primary, vary)
+	return entry
+}
+
+// refresh updates a stored entry from a 304 Not Modified response
+func (c *ResponseCache) refresh(r *http.Request, entry *cacheEntry, rec *cacheRecorder) *cacheEntry {
+	h := entry.Header.Clone()
+	for k, v := range rec.header {
+		switch k {
+		case "Content-Length", "Content-Type", "Content-Encoding":
+		default:
+			h[k] = v
+		}
+	}
+	if len(h.Values("Cache-Tag")) == 0 && len(entry.Tags) > 0 {
+		h.Set("Cache-Tag", strings.Join(entry.Tags, ", "))
+	}
+	updated := &cacheRecorder{
+		header: h,
+		status: entry.Status,
+		body: bytes.NewBuffer(entry.body),
+	}
+	return c.newEntry(r, updated)
+}
+
+// conditional makes a copy of r that asks the handler whether entry is
+// still current
+func conditional(r *http.Request, entry *cacheEntry, ctx context.Context) *http.Request {
+	cr := r.Clone(ctx)
+	cr.Method = http.MethodGet
+	cr.Header.Del("If-Match")
+	cr.Header.Del("If-Unmodified-Since")
+	cr.Header.Del("If-Range")
+	cr.Header.Del("If-None-Match")
+	cr.Header.Del("If-Modified-Since")
+	if entry != nil {
+		etag := entry.Header.Get("ETag")
+		if etag != "" {
+			cr.Header.Set("If-None-Match", etag)
+		}
+		lastMod := entry.Header.Get("Last-Modified")
+		if lastMod != "" {
+			cr.Header.Set("If-Modified-Since", lastMod)
+		}
+	}
+	return cr
+}
+
+// fetch runs the handler for a request that couldn't be answered from a
+// fresh entry.  If there's nothing stale to fall back on, the response is
+// teed straight to the client; otherwise it's buffered, so that a 304 can
+// be turned back into the stored response and a 5xx can be replaced by
+// the stale one.  A buffered response too big to cache is streamed to the
+// client instead.  It returns the entry the client should be sent, or nil
+// if the response has already been written.
+func (c *ResponseCache) fetch(handler http.Handler, w http.ResponseWriter, r *http.Request, stale *cacheEntry) *cacheEntry {
+	if stale == nil {
+		rec := newCacheRecorder(w, c.maxEntrySize())
+		handler.ServeHTTP(rec, r)
+		entry := c.newEntry(r, rec)
+		if entry != nil {
+			c.store(entry)
+		}
+		return nil
+	}
+	rec := newCacheRecorder(nil, c.maxEntrySize())
+	rec.spill = w
+	cr := conditional(r, stale, r.Context())
+	handler.ServeHTTP(rec, cr)
+	if rec.overflow {
+		c.remove(stale.Variant)
+		return nil
+	}
+	if rec.status >= 500 && stale.usableOnError(time.Now()) {
+		return stale
+	}
+	var entry *cacheEntry
+	if rec.status == http.StatusNotModified {
+		entry = c.refresh(cr, stale, rec)
+		if entry == nil {
+			c.remove(stale.Variant)
+			return stale
+		}
+	} else {
+		entry = c.newEntry(cr, rec)
+	}
+	if entry == nil {
+		c.remove(stale.Variant)
+		rec.writeTo(w, r)
+		return nil
+	}
+	c.store(entry)
+	return entry
+}
+
+func (c *ResponseCache) revalidate(handler http.Handler, r *http.Request, entry *cacheEntry) {
+	c.mutex.Lock()
+	if c.revalidating[entry.Variant] {
+		c.mutex.Unlock()
+		return
+	}
+	c.revalidating[entry.Variant] = true
+	c.mutex.Unlock()
+	go func() {
+		defer func() {
+			c.mutex.Lock()
+			delete(c.revalidating, entry.Variant)
+			c.mutex.Unlock()
+		}()
+		// there's no one to stream to, so a response that's too big to
+		// store is cut off, and the entry it would have replaced dropped
+		rec := newCacheRecorder(nil, c.maxEntrySize())
+		cr := conditional(r, entry, detachedContext{r.Context()})
+		handler.ServeHTTP(rec, cr)
+		if rec.status >= 500 {
+			return
+		}
+		var updated *cacheEntry
+		if rec.status == http.StatusNotModified {
+			updated = c.refresh(cr, entry, rec)
+		} else {
+			updated = c.newEntry(cr, rec)
+		}
+		if updated != nil {
+			c.store(updated)
+		} else {
+			c.remove(entry.Variant)
+		}
+	}()
+}
+
+func (c *ResponseCache) serve(w http.ResponseWriter, r *http.Request, entry *cacheEntry, status string) {
+	h := w.Header()
+	for k, v := range entry.Header {
+		h[k] = v
+	}
+	age := int64(time.Since(entry.Stored) / time.Second)
+	if age < 0 {
+		age = 0
+	}
+	h.Set("Age", strconv.FormatInt(age, 10))
+	h.Set("X-Cache", status)
+	if entry.Status == http.StatusOK {
+		var modTime time.Time
+		lastMod := entry.Header.Get("Last-Modified")
+		if lastMod != "" {
+			modTime, _ = http.ParseTime(lastMod)
+		}
+		ch := CheckIfNoneMatch(r, entry.Header.Get("ETag"))
+		if ch == nil {
+			ch = CheckIfModifiedSince(r, modTime)
+		}
+		if ch != nil && *ch == false {
+			h.Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	h.Set("Content-Length", strconv.Itoa(len(entry.body)))
+	w.WriteHeader(entry.Status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.body)
+	}
+}
+
+func (c *ResponseCache) lookup(r *http.Request) (*cacheEntry, string) {
+	primary := cachePrimaryKey(r)
+	variant := cacheVariantKey(r, primary, c.getVary(primary))
+	entry := c.get(variant)
+	if entry != nil && entry.dead(time.Now()) {
+		c.remove(variant)
+		entry = nil
+	}
+	if entry != nil && !entry.shareable(r) {
+		entry = nil
+	}
+	return entry, variant
+}
+
+// Middleware caches the responses of the handlers it wraps.  It can be
+// added to a route group with Router.Use, or wrapped around a default
+// handler.
+func (c *ResponseCache) Middleware(handler http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if !cacheableRequest(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		entry, variant := c.lookup(r)
+		now := time.Now()
+		_, noCache := parseCacheControl(r.Header.Get("Cache-Control"))["no-cache"]
+		if entry != nil && !noCache {
+			if entry.fresh(now) {
+				c.serve(w, r, entry, "HIT")
+				return
+			}
+			if entry.usableWhileRevalidating(now) {
+				c.revalidate(handler, r, entry)
+				c.serve(w, r, entry, "STALE")
+				return
+			}
+		}
+		if r.Method == http.MethodHead {
+			// a HEAD response can't be stored, so don't make GETs wait on it
+			result := c.fetch(handler, w, r, entry)
+			if result != nil {
+				c.serve(w, r, result, "MISS")
+			}
+			return
+		}
+		// only one request at a time goes to the handler for each variant;
+		// the rest wait and then use whatever it stored
+		c.mutex.Lock()
+		done, ok := c.calls[variant]
+		if ok {
+			c.mutex.Unlock()
+			select {
+			case <-done:
+			case <-r.Context().Done():
+				return
+			}
+			entry, _ = c.lookup(r)
+			if entry != nil && entry.fresh(time.Now()) {
+				c.serve(w, r, entry, "HIT")
+			} else {
+				handler.ServeHTTP(w, r)
+			}
+			return
+		}
+		done = make(chan bool)
+		c.calls[variant] = done
+		c.mutex.Unlock()
+		defer func() {
+			c.mutex.Lock()
+			delete(c.calls, variant)
+			c.mutex.Unlock()
+			close(done)
+		}()
+		result := c.fetch(handler, w, r, entry)
+		if result == entry && result != nil {
+			c.serve(w, r, result, "STALE")
+		} else if result != nil {
+			c.serve(w, r, result, "MISS")
+		}
+	}
+	return http.HandlerFunc(f)
+}
+
+func (c *ResponseCache) purge(match func(*cacheEntry) bool) int {
+	n := 0
+	c.mutex.Lock()
+	for variant, el := range c.entries {
+		entry := el.Value.(*cacheEntry)
+		if match(entry) {
+			c.lru.Remove(el)
+			delete(c.entries, variant)
+			delete(c.varies, entry.Key)
+			n += 1
+		}
+	}
+	c.mutex.Unlock()
+	if c.cfg.Directory == "" {
+		return n
+	}
+	fns, _ := filepath.Glob(filepath.Join(c.cfg.Directory, "*.json"))
+	for _, fn := range fns {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			continue
+		}
+		entry := &cacheEntry{}
+		if json.Unmarshal(data, entry) != nil || !match(entry) {
+			continue
+		}
+		if os.Remove(fn) == nil {
+			n += 1
+		}
+		os.Remove(strings.TrimSuffix(fn, ".json") + ".body")
+		os.Remove(c.path(cacheHash(entry.Key), ".vary"))
+	}
+	return n
+}
+
+// Purge removes every variant of the response for key, which is either a
+// request URI or a host followed by a request URI.  It returns the number
+// of entries removed (counting memory and disk copies separately).
+func (c *ResponseCache) Purge(key string) int {
+	return c.purge(func(entry *cacheEntry) bool {
+		return entry.Key == key || entry.URI == key
+	})
+}
+
+// PurgeTag removes every response that was tagged with tag by a Cache-Tag
+// response header
+func (c *ResponseCache) PurgeTag(tag string) int {
+	return c.purge(func(entry *cacheEntry) bool {
+		return entry.hasTag(tag)
+	})
+}
+
+func (c *ResponseCache) PurgeAll() int {
+	return c.purge(func(entry *cacheEntry) bool {
+		return true
+	})
+}
+
+type cachePurgeRequest struct {
+	Keys []string `json:"keys"`
+	Tags []string `json:"tags"`
+	All  bool     `json:"all"`
+}
+
+func (c *ResponseCache) purgeHandler(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	preq := &cachePurgeRequest{}
+	err := ReadJSON(req, preq)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	if preq.All {
+		n = c.PurgeAll()
+	}
+	for _, key := range preq.Keys {
+		n += c.Purge(key)
+	}
+	for _, tag := range preq.Tags {
+		n += c.PurgeTag(tag)
+	}
+	return map[string]int{"purged": n}, nil
+}
+
+// AttachEndpoint adds a POST /cache/purge endpoint to router, taking a
+// JSON body like {"keys": ["/some/path"], "tags": ["users"]}.  It should
+// only be attached to a router that's protected or not publicly exposed.
+func (c *ResponseCache) AttachEndpoint(router Router) {
+	router.POST("/cache/purge", HandlerFunc(c.purgeHandler))
+}
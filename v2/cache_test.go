@@ -0,0 +1,278 @@
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type CacheSuite struct {}
+
+var _ = Suite(&CacheSuite{})
+
+func cacheGet(h http.Handler, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/things?x=1", nil)
+	for i := 0; i + 1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i + 1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func (s *CacheSuite) TestHitAndPurge(c *C) {
+	dn := c.MkDir()
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Cache-Tag", "things, users")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprintf(w, "%s %d", r.Header.Get("Accept-Language"), n)
+	})
+	cache := NewResponseCache(&CacheConfig{Directory: dn})
+	h := cache.Middleware(handler)
+	w := cacheGet(h, "Accept-Language", "en")
+	c.Check(w.Body.String(), Equals, "en 1")
+	c.Check(w.Header().Get("Cache-Tag"), Equals, "")
+	w = cacheGet(h, "Accept-Language", "en")
+	c.Check(w.Body.String(), Equals, "en 1")
+	c.Check(w.Header().Get("X-Cache"), Equals, "HIT")
+	w = cacheGet(h, "Accept-Language", "fr")
+	c.Check(w.Body.String(), Equals, "fr 2")
+
+	// a new cache on the same directory finds the entries on disk
+	h = NewResponseCache(&CacheConfig{Directory: dn}).Middleware(handler)
+	w = cacheGet(h, "Accept-Language", "fr")
+	c.Check(w.Body.String(), Equals, "fr 2")
+	c.Check(cache.PurgeTag("users") > 0, Equals, true)
+	w = cacheGet(cache.Middleware(handler), "Accept-Language", "en")
+	c.Check(w.Body.String(), Equals, "en 3")
+	c.Check(cache.Purge("/things?x=1") > 0, Equals, true)
+	w = cacheGet(cache.Middleware(handler), "Accept-Language", "en")
+	c.Check(w.Body.String(), Equals, "en 4")
+}
+
+func (s *CacheSuite) TestStale(c *C) {
+	var calls int32
+	var fail int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&fail) != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprintf(w, "body %d", n)
+	})
+	h := NewResponseCache(nil).Middleware(handler)
+	c.Check(cacheGet(h).Body.String(), Equals, "body 1")
+	w := cacheGet(h)
+	c.Check(w.Body.String(), Equals, "body 1")
+	c.Check(w.Header().Get("X-Cache"), Equals, "STALE")
+	for i := 0; i < 100 && atomic.LoadInt32(&calls) < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(atomic.LoadInt32(&calls), Equals, int32(2))
+
+	calls = 0
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&fail) != 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+		fmt.Fprintf(w, "body %d", n)
+	})
+	h = NewResponseCache(nil).Middleware(handler)
+	c.Check(cacheGet(h).Body.String(), Equals, "body 1")
+	c.Check(cacheGet(h).Body.String(), Equals, "body 2")
+	atomic.StoreInt32(&fail, 1)
+	w = cacheGet(h)
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Body.String(), Equals, "body 2")
+	c.Check(w.Header().Get("X-Cache"), Equals, "STALE")
+}
+
+func (s *CacheSuite) TestCollapse(c *C) {
+	var calls int32
+	release := make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("slow"))
+	})
+	h := NewResponseCache(nil).Middleware(handler)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(cacheGet(h).Body.String(), Equals, "slow")
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	c.Check(atomic.LoadInt32(&calls), Equals, int32(1))
+}
+
+func (s *CacheSuite) TestCookies(c *C) {
+	public := false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if public {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		}
+		cookie, err := r.Cookie("session")
+		if err != nil {
+			w.Write([]byte("anonymous"))
+			return
+		}
+		w.Write([]byte("hello " + cookie.Value))
+	})
+	h := NewResponseCache(&CacheConfig{DefaultTTL: 60}).Middleware(handler)
+	c.Check(cacheGet(h, "Cookie", "session=alice").Body.String(), Equals, "hello alice")
+	w := cacheGet(h, "Cookie", "session=bob")
+	c.Check(w.Body.String(), Equals, "hello bob")
+	c.Check(w.Header().Get("X-Cache"), Equals, "")
+	c.Check(cacheGet(h, "Cookie", "session=alice").Body.String(), Equals, "hello alice")
+
+	// an anonymous response isn't sent to someone who's logged in
+	c.Check(cacheGet(h).Body.String(), Equals, "anonymous")
+	c.Check(cacheGet(h).Header().Get("X-Cache"), Equals, "HIT")
+	c.Check(cacheGet(h, "Cookie", "session=bob").Body.String(), Equals, "hello bob")
+
+	// unless it says it may be
+	public = true
+	h = NewResponseCache(&CacheConfig{}).Middleware(handler)
+	c.Check(cacheGet(h, "Cookie", "session=alice").Body.String(), Equals, "hello alice")
+	w = cacheGet(h, "Cookie", "session=bob")
+	c.Check(w.Body.String(), Equals, "hello alice")
+	c.Check(w.Header().Get("X-Cache"), Equals, "HIT")
+}
+
+func (s *CacheSuite) TestTooBig(c *C) {
+	var calls int32
+	var big int32
+	var cutoff int32
+	swr := ""
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=0" + swr)
+		w.Header().Set("ETag", `"v1"`)
+		if atomic.LoadInt32(&big) == 0 {
+			w.Write([]byte("small"))
+			return
+		}
+		for i := 0; i < 100; i++ {
+			_, err := w.Write([]byte("0123456789"))
+			if err != nil {
+				atomic.AddInt32(&cutoff, 1)
+				return
+			}
+		}
+	})
+
+	// a response that replaces a stale entry is streamed once it's too
+	// big to keep
+	cache := NewResponseCache(&CacheConfig{MaxEntrySize: 16})
+	h := cache.Middleware(handler)
+	c.Check(cacheGet(h).Body.String(), Equals, "small")
+	atomic.StoreInt32(&big, 1)
+	w := cacheGet(h)
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Body.Len(), Equals, 1000)
+	c.Check(w.Header().Get("ETag"), Equals, `"v1"`)
+	c.Check(atomic.LoadInt32(&cutoff), Equals, int32(0))
+	entry, _ := cache.lookup(httptest.NewRequest(http.MethodGet, "/things?x=1", nil))
+	c.Check(entry, IsNil)
+
+	// and one fetched in the background is cut off
+	atomic.StoreInt32(&big, 0)
+	atomic.StoreInt32(&calls, 0)
+	swr = ", stale-while-revalidate=60"
+	cache = NewResponseCache(&CacheConfig{MaxEntrySize: 16})
+	h = cache.Middleware(handler)
+	c.Check(cacheGet(h).Body.String(), Equals, "small")
+	atomic.StoreInt32(&big, 1)
+	w = cacheGet(h)
+	c.Check(w.Body.String(), Equals, "small")
+	c.Check(w.Header().Get("X-Cache"), Equals, "STALE")
+	for i := 0; i < 100; i++ {
+		cache.mutex.Lock()
+		n := len(cache.revalidating)
+		cache.mutex.Unlock()
+		if n == 0 && atomic.LoadInt32(&calls) == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(atomic.LoadInt32(&cutoff), Equals, int32(1))
+	entry, _ = cache.lookup(httptest.NewRequest(http.MethodGet, "/things?x=1", nil))
+	c.Check(entry, IsNil)
+}
+
+func (s *CacheSuite) TestSweep(c *C) {
+	dn := c.MkDir()
+	cache := NewResponseCache(&CacheConfig{Directory: dn, DiskEntries: 2})
+	now := time.Now()
+	store := func(uri string, age time.Duration, header ...string) {
+		h := http.Header{}
+		for i := 0; i + 1 < len(header); i += 2 {
+			h.Set(header[i], header[i + 1])
+		}
+		cache.store(&cacheEntry{
+			Key: uri,
+			URI: uri,
+			Variant: uri,
+			Status: http.StatusOK,
+			Header: h,
+			Stored: now.Add(-age),
+			Expires: now.Add(-age).Add(time.Minute),
+			body: []byte(uri),
+		})
+	}
+	// nothing's swept in the background until a minute after the last sweep
+	cache.lastSweep = now
+	store("/dead", time.Hour)
+	store("/old", time.Hour, "ETag", `"v1"`)
+	store("/older", 2 * time.Hour, "Last-Modified", now.Add(-3 * time.Hour).Format(http.TimeFormat))
+	store("/new", time.Second, "ETag", `"v2"`)
+	store("/newer", 0)
+	c.Check(cache.sweep(), Equals, 3)
+	c.Check(cache.get("/dead"), IsNil)
+	c.Check(cache.get("/old"), IsNil)
+	c.Check(cache.get("/older"), IsNil)
+	c.Check(cache.get("/new"), NotNil)
+	c.Check(cache.get("/newer"), NotNil)
+	c.Check(cache.sweep(), Equals, 0)
+
+	cache.mutex.Lock()
+	cache.lastSweep = time.Time{}
+	cache.mutex.Unlock()
+	store("/newest", -time.Second)
+	for i := 0; i < 100; i++ {
+		cache.mutex.Lock()
+		done := !cache.sweeping
+		cache.mutex.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(cache.get("/new"), IsNil)
+	c.Check(cache.get("/newer"), NotNil)
+	c.Check(cache.get("/newest"), NotNil)
+}
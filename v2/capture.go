@@ -0,0 +1,455 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/logging"
+)
+
+const redacted = "[REDACTED]"
+
+var DefaultRedactFields = []string{
+	"password",
+	"new_password",
+	"reset_code",
+	"two_factor_code",
+	"token",
+	"client_secret",
+}
+
+var DefaultRedactHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// CaptureConfig controls capturing of request and response bodies for
+// debugging.  Requests are captured if they match one of Routes (route
+// templates), Paths (path prefixes), or carry Header (with Value, if
+// given).  Captures are written as JSON lines to File, in the log
+// directory, and the most recent Keep are available on the admin
+// endpoint.
+type CaptureConfig struct {
+	Enabled       bool     `json:"enabled"        arg:"enabled"`
+	File          string   `json:"file"           arg:"file"`
+	MaxBody       int      `json:"max_body"       arg:"max-body"`
+	Keep          int      `json:"keep"           arg:"keep"`
+	Routes        []string `json:"routes"         arg:"-"`
+	Paths         []string `json:"paths"          arg:"-"`
+	Header        string   `json:"header"         arg:"header"`
+	Value         string   `json:"value"          arg:"value"`
+	RedactFields  []string `json:"redact_fields"  arg:"-"`
+	RedactHeaders []string `json:"redact_headers" arg:"-"`
+}
+
+func (cfg *CaptureConfig) Init(logDir string) error {
+	if cfg.File == "" {
+		cfg.File = "capture.log"
+	}
+	fn, err := MakeRootAbs(logDir, cfg.File)
+	if err != nil {
+		return errors.Wrap(err, "can't make abs capture log file " + cfg.File)
+	}
+	cfg.File = fn
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = 64 * 1024
+	}
+	if cfg.Keep <= 0 {
+		cfg.Keep = 100
+	}
+	if cfg.RedactFields == nil {
+		cfg.RedactFields = DefaultRedactFields
+	}
+	if cfg.RedactHeaders == nil {
+		cfg.RedactHeaders = DefaultRedactHeaders
+	}
+	return nil
+}
+
+func (cfg *CaptureConfig) match(r *http.Request) bool {
+	if cfg.Header != "" {
+		v := r.Header.Get(cfg.Header)
+		if v != "" && (cfg.Value == "" || v == cfg.Value) {
+			return true
+		}
+	}
+	route := ContextRequestVars(r.Context())["route"]
+	for _, rt := range cfg.Routes {
+		if rt == route {
+			return true
+		}
+	}
+	for _, p := range cfg.Paths {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Capture is a redacted record of one request and its response
+type Capture struct {
+	ID              int64        `json:"id"`
+	Time            time.Time    `json:"time"`
+	RequestID       string       `json:"request_id,omitempty"`
+	RemoteAddr      string       `json:"remote_addr"`
+	Method          string       `json:"method"`
+	URL             string       `json:"url"`
+	Route           string       `json:"route,omitempty"`
+	RequestHeaders  http.Header  `json:"request_headers"`
+	RequestBody     *CaptureBody `json:"request_body,omitempty"`
+	Status          int          `json:"status"`
+	ResponseHeaders http.Header  `json:"response_headers"`
+	ResponseBody    *CaptureBody `json:"response_body,omitempty"`
+	Duration        float64      `json:"duration"`
+}
+
+// CaptureBody is the start of a body.  Bodies that aren't text are
+// base64 encoded.
+type CaptureBody struct {
+	Data      string `json:"data"`
+	Encoding  string `json:"encoding,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// capBuffer keeps the first max bytes written to it
+type capBuffer struct {
+	buf bytes.Buffer
+	max int
+	truncated bool
+}
+
+func (cb *capBuffer) add(data []byte) {
+	n := cb.max - cb.buf.Len()
+	if n <= 0 {
+		if len(data) > 0 {
+			cb.truncated = true
+		}
+		return
+	}
+	if len(data) > n {
+		data = data[:n]
+		cb.truncated = true
+	}
+	cb.buf.Write(data)
+}
+
+type captureReader struct {
+	io.ReadCloser
+	cb *capBuffer
+}
+
+func (cr *captureReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.cb.add(p[:n])
+	return n, err
+}
+
+type captureWriter struct {
+	http.ResponseWriter
+	cb *capBuffer
+	status int
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(data []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.cb.add(data)
+	return cw.ResponseWriter.Write(data)
+}
+
+func (cw *captureWriter) Flush() {
+	f, ok := cw.ResponseWriter.(http.Flusher)
+	if ok {
+		f.Flush()
+	}
+}
+
+func (cw *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.Errorf("underlying ResponseWriter %T doesn't support hijacking", cw.ResponseWriter)
+	}
+	if cw.status == 0 {
+		cw.status = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
+// BodyCapture records requests and responses to a log file and keeps
+// the most recent ones in memory
+type BodyCapture struct {
+	cfg *CaptureConfig
+	out io.Writer
+	mutex *sync.Mutex
+	fields map[string]bool
+	fieldRes []*regexp.Regexp
+	recent []*Capture
+	next int64
+}
+
+func NewBodyCapture(cfg *CaptureConfig, out io.Writer) *BodyCapture {
+	bc := &BodyCapture{
+		cfg: cfg,
+		out: out,
+		mutex: &sync.Mutex{},
+		fields: map[string]bool{},
+		recent: []*Capture{},
+	}
+	for _, f := range cfg.RedactFields {
+		bc.fields[strings.ToLower(f)] = true
+		// for JSON too broken to parse, like a truncated body; the value
+		// may be a string, possibly cut off, or a number or other literal
+		bc.fieldRes = append(bc.fieldRes, regexp.MustCompile(`(?i)("` + regexp.QuoteMeta(f) + `"\s*:\s*)(?:"(?:[^"\\]|\\.)*(?:"|$)|[^"{\[\s,}\]][^\s,}\]]*)`))
+	}
+	return bc
+}
+
+// Middleware captures requests that match the capture config
+func (bc *BodyCapture) Middleware(handler http.Handler) http.Handler {
+	capture := bc.CaptureAll(handler)
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if bc.cfg.match(r) {
+			capture.ServeHTTP(w, r)
+		} else {
+			handler.ServeHTTP(w, r)
+		}
+	}
+	return http.HandlerFunc(f)
+}
+
+// CaptureAll captures every request to handler, for attaching to
+// individual routes
+func (bc *BodyCapture) CaptureAll(handler http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		reqBuf := &capBuffer{max: bc.cfg.MaxBody}
+		resBuf := &capBuffer{max: bc.cfg.MaxBody}
+		xr := r
+		if r.Body != nil && r.Body != http.NoBody {
+			xr = r.Clone(r.Context())
+			xr.Body = &captureReader{ReadCloser: r.Body, cb: reqBuf}
+		}
+		cw := &captureWriter{ResponseWriter: w, cb: resBuf}
+		handler.ServeHTTP(cw, xr)
+		status := cw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		c := &Capture{
+			Time: start,
+			RequestID: ContextRequestId(r.Context()),
+			RemoteAddr: r.RemoteAddr,
+			Method: r.Method,
+			URL: bc.redactURL(r.URL),
+			Route: ContextRequestVars(r.Context())["route"],
+			RequestHeaders: bc.redactHeaders(r.Header),
+			RequestBody: bc.body(reqBuf, r.Header.Get("Content-Type")),
+			Status: status,
+			ResponseHeaders: bc.redactHeaders(w.Header()),
+			ResponseBody: bc.body(resBuf, w.Header().Get("Content-Type")),
+			Duration: time.Since(start).Seconds(),
+		}
+		err := bc.record(c)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorln("can't write capture:", err)
+		}
+	}
+	return http.HandlerFunc(f)
+}
+
+func (bc *BodyCapture) record(c *Capture) error {
+	bc.mutex.Lock()
+	bc.next++
+	c.ID = bc.next
+	if len(bc.recent) < bc.cfg.Keep {
+		bc.recent = append(bc.recent, c)
+	} else {
+		copy(bc.recent, bc.recent[1:])
+		bc.recent[len(bc.recent) - 1] = c
+	}
+	bc.mutex.Unlock()
+	if bc.out == nil {
+		return nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "can't serialize capture")
+	}
+	_, err = bc.out.Write(append(data, '\n'))
+	return err
+}
+
+// Recent returns up to n of the most recent captures, newest first
+func (bc *BodyCapture) Recent(n int) []*Capture {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	if n <= 0 || n > len(bc.recent) {
+		n = len(bc.recent)
+	}
+	out := make([]*Capture, n)
+	for i := 0; i < n; i++ {
+		out[i] = bc.recent[len(bc.recent) - 1 - i]
+	}
+	return out
+}
+
+func (bc *BodyCapture) redactHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, k := range bc.cfg.RedactHeaders {
+		if _, ok := out[http.CanonicalHeaderKey(k)]; ok {
+			out.Set(k, redacted)
+		}
+	}
+	return out
+}
+
+func (bc *BodyCapture) redactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	xu := *u
+	xu.RawQuery = bc.redactForm(u.RawQuery)
+	return xu.RequestURI()
+}
+
+func (bc *BodyCapture) redactForm(s string) string {
+	q, err := url.ParseQuery(s)
+	if err != nil {
+		return redacted
+	}
+	for k := range q {
+		if bc.fields[strings.ToLower(k)] {
+			q[k] = []string{redacted}
+		}
+	}
+	return q.Encode()
+}
+
+func (bc *BodyCapture) redactValue(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		for k, x := range tv {
+			if bc.fields[strings.ToLower(k)] {
+				tv[k] = redacted
+			} else {
+				tv[k] = bc.redactValue(x)
+			}
+		}
+	case []interface{}:
+		for i, x := range tv {
+			tv[i] = bc.redactValue(x)
+		}
+	}
+	return v
+}
+
+func (bc *BodyCapture) redactJSON(data []byte) []byte {
+	var obj interface{}
+	err := json.Unmarshal(data, &obj)
+	if err == nil {
+		xdata, err := json.Marshal(bc.redactValue(obj))
+		if err == nil {
+			return xdata
+		}
+	}
+	for _, re := range bc.fieldRes {
+		data = re.ReplaceAll(data, []byte(`$1"` + redacted + `"`))
+	}
+	return data
+}
+
+// redactMultipart rewrites a multipart body with the sensitive fields
+// blanked out.  A body that can't be parsed, such as one that was cut
+// off, is dropped altogether.
+func (bc *BodyCapture) redactMultipart(data []byte, boundary string) []byte {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	if mw.SetBoundary(boundary) != nil {
+		return []byte(redacted)
+	}
+	mr := multipart.NewReader(bytes.NewReader(data), boundary)
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return []byte(redacted)
+		}
+		pw, err := mw.CreatePart(part.Header)
+		if err != nil {
+			return []byte(redacted)
+		}
+		if bc.fields[strings.ToLower(part.FormName())] {
+			pw.Write([]byte(redacted))
+		} else if _, err = io.Copy(pw, part); err != nil {
+			return []byte(redacted)
+		}
+	}
+	mw.Close()
+	return buf.Bytes()
+}
+
+func (bc *BodyCapture) body(cb *capBuffer, contentType string) *CaptureBody {
+	if cb.buf.Len() == 0 {
+		return nil
+	}
+	data := cb.buf.Bytes()
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		data = []byte(bc.redactForm(string(data)))
+	case mediaType == "multipart/form-data":
+		data = bc.redactMultipart(data, params["boundary"])
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		data = bc.redactJSON(data)
+	case mediaType == "" && (data[0] == '{' || data[0] == '['):
+		data = bc.redactJSON(data)
+	}
+	body := &CaptureBody{Truncated: cb.truncated}
+	if utf8.Valid(data) {
+		body.Data = string(data)
+	} else {
+		body.Data = base64.StdEncoding.EncodeToString(data)
+		body.Encoding = "base64"
+	}
+	return body
+}
+
+func (bc *BodyCapture) recentHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	return bc.Recent(n), nil
+}
+
+// AttachEndpoint adds a GET /captures endpoint to router, returning the
+// most recent captures, or the last ?n= of them.  It should only be
+// attached to a router that's protected.
+func (bc *BodyCapture) AttachEndpoint(router Router) {
+	router.GET("/captures", HandlerFunc(bc.recentHandler))
+}
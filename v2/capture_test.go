@@ -0,0 +1,175 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type CaptureSuite struct {}
+
+var _ = Suite(&CaptureSuite{})
+
+func newTestCapture(c *C, cfg *CaptureConfig) (*BodyCapture, *bytes.Buffer) {
+	c.Assert(cfg.Init(c.MkDir()), IsNil)
+	out := &bytes.Buffer{}
+	return NewBodyCapture(cfg, out), out
+}
+
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	data, _ := ioutil.ReadAll(r.Body)
+	w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+	w.Header().Set("Set-Cookie", "session=abc")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+func (s *CaptureSuite) TestRedact(c *C) {
+	bc, out := newTestCapture(c, &CaptureConfig{})
+	h := bc.CaptureAll(http.HandlerFunc(echoHandler))
+
+	req := httptest.NewRequest("POST", "/login?token=xyz&next=/home", strings.NewReader(`{"username":"bob","password":"hunter2","nested":[{"reset_code":"123"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=abc")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusCreated)
+	c.Check(strings.Contains(w.Body.String(), "hunter2"), Equals, true)
+
+	caps := bc.Recent(0)
+	c.Assert(caps, HasLen, 1)
+	cp := caps[0]
+	c.Check(cp.Status, Equals, http.StatusCreated)
+	c.Check(cp.URL, Equals, "/login?next=%2Fhome&token=%5BREDACTED%5D")
+	c.Check(cp.RequestHeaders.Get("Authorization"), Equals, redacted)
+	c.Check(cp.RequestHeaders.Get("Cookie"), Equals, redacted)
+	c.Check(cp.ResponseHeaders.Get("Set-Cookie"), Equals, redacted)
+	c.Check(cp.RequestBody.Data, Equals, `{"nested":[{"reset_code":"[REDACTED]"}],"password":"[REDACTED]","username":"bob"}`)
+	c.Check(cp.ResponseBody.Data, Equals, cp.RequestBody.Data)
+	c.Check(strings.Contains(out.String(), "hunter2"), Equals, false)
+	c.Check(strings.Contains(out.String(), "secret"), Equals, false)
+	c.Check(strings.Contains(out.String(), `"status":201`), Equals, true)
+
+	req = httptest.NewRequest("POST", "/reset", strings.NewReader("user=bob&new_password=hunter2"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Check(bc.Recent(1)[0].RequestBody.Data, Equals, "new_password=%5BREDACTED%5D&user=bob")
+
+	form := &bytes.Buffer{}
+	mw := multipart.NewWriter(form)
+	mw.WriteField("user", "bob")
+	mw.WriteField("password", "hunter2")
+	fw, _ := mw.CreateFormFile("avatar", "bob.txt")
+	fw.Write([]byte("a picture of bob"))
+	mw.Close()
+	req = httptest.NewRequest("POST", "/signup", bytes.NewReader(form.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	mr := multipart.NewReader(strings.NewReader(bc.Recent(1)[0].RequestBody.Data), mw.Boundary())
+	fields := map[string]string{}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(part)
+		fields[part.FormName()] = string(data)
+	}
+	c.Check(fields, DeepEquals, map[string]string{"user": "bob", "password": redacted, "avatar": "a picture of bob"})
+}
+
+func (s *CaptureSuite) TestTruncate(c *C) {
+	bc, _ := newTestCapture(c, &CaptureConfig{MaxBody: 32})
+	h := bc.CaptureAll(http.HandlerFunc(echoHandler))
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"user":"bob","password":"hunter2hunter2","more":"stuff"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	// the handler still gets the whole thing
+	c.Check(w.Body.Len(), Equals, 57)
+	cp := bc.Recent(1)[0]
+	c.Check(cp.RequestBody.Truncated, Equals, true)
+	c.Check(cp.RequestBody.Data, Equals, `{"user":"bob","password":"[REDACTED]"`)
+	c.Check(cp.ResponseBody.Truncated, Equals, true)
+
+	// values that aren't strings are found too
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"user":"bob","reset_code": 123456,"more":"stuff"}`))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Check(bc.Recent(1)[0].RequestBody.Data, Equals, `{"user":"bob","reset_code": "[REDACTED]"`)
+
+	// a multipart body that's cut off can't be picked apart
+	form := &bytes.Buffer{}
+	mw := multipart.NewWriter(form)
+	mw.WriteField("password", "hunter2")
+	mw.Close()
+	req = httptest.NewRequest("POST", "/", bytes.NewReader(form.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	cp = bc.Recent(1)[0]
+	c.Check(cp.RequestBody.Truncated, Equals, true)
+	c.Check(cp.RequestBody.Data, Equals, redacted)
+
+	req = httptest.NewRequest("POST", "/", bytes.NewReader([]byte{0xff, 0xfe, 0x00}))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	cp = bc.Recent(1)[0]
+	c.Check(cp.RequestBody.Encoding, Equals, "base64")
+	c.Check(cp.RequestBody.Data, Equals, "//4A")
+	c.Check(cp.RequestBody.Truncated, Equals, false)
+}
+
+func (s *CaptureSuite) TestMatch(c *C) {
+	bc, _ := newTestCapture(c, &CaptureConfig{Keep: 2, Paths: []string{"/api/debug"}, Header: "X-Capture"})
+	h := bc.Middleware(http.HandlerFunc(echoHandler))
+	for _, p := range []string{"/api/quiet", "/api/debug/one", "/api/debug/two", "/api/debug/three"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", p, nil))
+	}
+	req := httptest.NewRequest("GET", "/api/header", nil)
+	req.Header.Set("X-Capture", "1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	caps := bc.Recent(10)
+	c.Assert(caps, HasLen, 2)
+	c.Check(caps[0].URL, Equals, "/api/header")
+	c.Check(caps[0].ID, Equals, int64(4))
+	c.Check(caps[1].URL, Equals, "/api/debug/three")
+}
+
+func (s *CaptureSuite) TestAdmin(c *C) {
+	cfg := &ServerConfig{Admin: AdminConfig{Enabled: true}}
+	cfg.Logging.Capture = CaptureConfig{Enabled: true, Routes: []string{"/api/:x"}}
+	srv := newTestServer(c, cfg)
+	capfile, err := cfg.Logging.CaptureLogger()
+	c.Assert(err, IsNil)
+	defer capfile.Close()
+	srv.SetAuthMiddleware(func(h http.Handler) http.Handler { return h })
+	srv.router.POST("/api/:x", http.HandlerFunc(echoHandler))
+	srv.router.POST("/other", http.HandlerFunc(echoHandler))
+	srv.Prefix("/").Compile(nil)
+
+	for _, p := range []string{"/api/login", "/other"} {
+		req := httptest.NewRequest("POST", p, strings.NewReader(`{"password":"hunter2"}`))
+		req.Header.Set("Content-Type", "application/json")
+		srv.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/admin/captures", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	caps := []*Capture{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &caps), IsNil)
+	c.Assert(caps, HasLen, 1)
+	c.Check(caps[0].Route, Equals, "/api/:x")
+	c.Check(caps[0].RequestID, Not(Equals), "")
+	c.Check(caps[0].RequestBody.Data, Equals, `{"password":"[REDACTED]"}`)
+	logged := readLog(c, filepath.Join(cfg.Logging.Directory, "capture.log"))
+	c.Check(strings.Count(logged, "\n"), Equals, 1)
+	c.Check(strings.Contains(logged, "hunter2"), Equals, false)
+}
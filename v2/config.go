@@ -20,7 +20,6 @@ import (
 
 	"github.com/rclancey/argparse"
 	"github.com/rclancey/logging"
-	"github.com/rclancey/logrotate"
 )
 
 type SSLConfig struct {
@@ -133,8 +132,12 @@ type LogConfig struct {
 	MaxSize      int64            `json:"max_size"      arg:"max-size"`
 	RetainCount  int              `json:"retain"        arg:"retain"`
 	LogLevel     logging.LogLevel `json:"level"         arg:"level"`
+	Capture      CaptureConfig    `json:"capture"       arg:"capture"`
 	errlog       *logging.Logger
-	acclog       *logrotate.RotateFile
+	errfile      *LogFile
+	levels       *logLevels
+	acclog       *LogFile
+	capfile      *LogFile
 }
 
 func (cfg *LogConfig) Init(serverRoot string) error {
@@ -157,25 +160,31 @@ func (cfg *LogConfig) Init(serverRoot string) error {
 		return errors.Wrap(err, "can't make abs error log file " + cfg.ErrorLog)
 	}
 	cfg.ErrorLog = fn
+	err = cfg.Capture.Init(cfg.Directory)
+	if err != nil {
+		return errors.Wrap(err, "can't configure body capture")
+	}
 	return nil
 }
 
 func (cfg *LogConfig) ErrorLogger() (*logging.Logger, error) {
 	if cfg.errlog == nil {
-		rotlog, err := logrotate.Open(cfg.ErrorLog, time.Duration(cfg.RotatePeriod) * time.Minute, cfg.MaxSize, cfg.RetainCount)
+		rotlog, err := OpenLogFile(cfg.ErrorLog, time.Duration(cfg.RotatePeriod) * time.Minute, cfg.MaxSize, cfg.RetainCount)
 		if err != nil {
 			return nil, errors.Wrap(err, "can't create error logger")
 		}
+		cfg.errfile = rotlog
 		cfg.errlog = logging.NewLogger(rotlog, cfg.LogLevel)
+		cfg.levels = newLogLevels(cfg.errlog)
 		logging.SetOutput(rotlog)
 		logging.SetLevel(cfg.LogLevel)
 	}
 	return cfg.errlog, nil
 }
 
-func (cfg *LogConfig) AccessLogger() (*logrotate.RotateFile, error) {
+func (cfg *LogConfig) AccessLogger() (*LogFile, error) {
 	if cfg.acclog == nil {
-		rotlog, err := logrotate.Open(cfg.AccessLog, time.Duration(cfg.RotatePeriod) * time.Minute, cfg.MaxSize, cfg.RetainCount)
+		rotlog, err := OpenLogFile(cfg.AccessLog, time.Duration(cfg.RotatePeriod) * time.Minute, cfg.MaxSize, cfg.RetainCount)
 		if err != nil {
 			return nil, errors.Wrap(err, "can't create access logger")
 		}
@@ -184,15 +193,43 @@ func (cfg *LogConfig) AccessLogger() (*logrotate.RotateFile, error) {
 	return cfg.acclog, nil
 }
 
+func (cfg *LogConfig) CaptureLogger() (*LogFile, error) {
+	if cfg.capfile == nil {
+		rotlog, err := OpenLogFile(cfg.Capture.File, time.Duration(cfg.RotatePeriod) * time.Minute, cfg.MaxSize, cfg.RetainCount)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't create capture logger")
+		}
+		cfg.capfile = rotlog
+	}
+	return cfg.capfile, nil
+}
+
 type ServerConfig struct {
-	ConfigFile          string         `json:"-"               arg:"--config"`//,-c"`
-	ServerRoot          string         `json:"server_root"     arg:"--server-root"`
-	DocumentRoot        string         `json:"document_root"   arg:"--docroot"`
-	DefaultProxy        string         `json:"default_proxy"   arg:"--proxy"`
-	CacheDirectory      string         `json:"cache_directory" arg:"--cache-dir"`
-	PidFile             string         `json:"pidfile"         arg:"--pidfile"`
-	Bind                BindConfig     `json:"bind"            arg:"--bind"`
-	Logging             LogConfig      `json:"log"             arg:"--log"`
+	ConfigFile          string               `json:"-"               arg:"--config"`//,-c"`
+	ServerRoot          string               `json:"server_root"     arg:"--server-root"`
+	DocumentRoot        string               `json:"document_root"   arg:"--docroot"`
+	DefaultProxy        string               `json:"default_proxy"   arg:"--proxy"`
+	CacheDirectory      string               `json:"cache_directory" arg:"--cache-dir"`
+	PidFile             string               `json:"pidfile"         arg:"--pidfile"`
+	Bind                BindConfig           `json:"bind"            arg:"--bind"`
+	Logging             LogConfig            `json:"log"             arg:"--log"`
+	Uploads             UploadConfig         `json:"uploads"         arg:"--uploads"`
+	Tus                 TusConfig            `json:"tus"             arg:"--tus"`
+	Views               ViewConfig           `json:"views"           arg:"--views"`
+	Cache               CacheConfig          `json:"cache"           arg:"--cache"`
+	Compression         CompressionConfig    `json:"compression"     arg:"--compression"`
+	Static              StaticConfig         `json:"static"          arg:"--static"`
+	ProxyTransport      ProxyTransportConfig `json:"proxy_transport" arg:"--proxy-transport"`
+	Upstreams           []*UpstreamConfig    `json:"upstreams"       arg:"-"`
+	ProxyRoutes         []*ProxyRouteConfig  `json:"proxy_routes"    arg:"-"`
+	Metrics             MetricsConfig        `json:"metrics"         arg:"--metrics"`
+	Tracing             TracingConfig        `json:"tracing"         arg:"--tracing"`
+	RequestID           RequestIDConfig      `json:"request_id"      arg:"--request-id"`
+	AccessLog           AccessLogConfig      `json:"access_log"      arg:"--access-log"`
+	Admin               AdminConfig          `json:"admin"           arg:"--admin"`
+	Health              HealthConfig         `json:"health"          arg:"--health"`
+	CORS                CORSConfig           `json:"cors"            arg:"--cors"`
+	CSRF                CSRFConfig           `json:"csrf"            arg:"--csrf"`
 }
 
 func (cfg *ServerConfig) Abs(fn string) (string, error) {
@@ -228,6 +265,89 @@ func (cfg *ServerConfig) Init() error {
 		return errors.Wrapf(err, "cache directory %s not writable", dn)
 	}
 	cfg.CacheDirectory = dn
+	err = cfg.Uploads.Init(cfg.CacheDirectory)
+	if err != nil {
+		return errors.Wrap(err, "can't configure uploads")
+	}
+	err = cfg.Tus.Init(cfg.CacheDirectory)
+	if err != nil {
+		return errors.Wrap(err, "can't configure tus uploads")
+	}
+	err = cfg.Cache.Init(cfg.CacheDirectory)
+	if err != nil {
+		return errors.Wrap(err, "can't configure response cache")
+	}
+	err = cfg.Static.Init(cfg.ServerRoot)
+	if err != nil {
+		return errors.Wrap(err, "can't configure static files")
+	}
+	err = cfg.Views.Init(cfg.ServerRoot)
+	if err != nil {
+		return errors.Wrap(err, "can't configure views")
+	}
+	err = cfg.Metrics.Init()
+	if err != nil {
+		return errors.Wrap(err, "can't configure metrics")
+	}
+	err = cfg.ProxyTransport.Init()
+	if err != nil {
+		return errors.Wrap(err, "can't configure proxy transport")
+	}
+	err = cfg.Tracing.Init()
+	if err != nil {
+		return errors.Wrap(err, "can't configure tracing")
+	}
+	err = cfg.RequestID.Init()
+	if err != nil {
+		return errors.Wrap(err, "can't configure request ids")
+	}
+	err = cfg.AccessLog.Init()
+	if err != nil {
+		return errors.Wrap(err, "can't configure access log")
+	}
+	err = cfg.Admin.Init()
+	if err != nil {
+		return errors.Wrap(err, "can't configure admin endpoints")
+	}
+	if cfg.Admin.Socket != "" {
+		fn, err := cfg.Abs(cfg.Admin.Socket)
+		if err != nil {
+			return errors.Wrap(err, "can't make abs path for admin socket " + cfg.Admin.Socket)
+		}
+		cfg.Admin.Socket = fn
+	}
+	err = cfg.Health.Init()
+	if err != nil {
+		return errors.Wrap(err, "can't configure health checks")
+	}
+	err = cfg.CORS.Init()
+	if err != nil {
+		return errors.Wrap(err, "can't configure cors")
+	}
+	err = cfg.CSRF.Init()
+	if err != nil {
+		return errors.Wrap(err, "can't configure csrf")
+	}
+	names := map[string]bool{}
+	for _, up := range cfg.Upstreams {
+		err = up.Init()
+		if err != nil {
+			return errors.Wrap(err, "can't configure upstreams")
+		}
+		if names[up.Name] {
+			return errors.Errorf("duplicate upstream %s", up.Name)
+		}
+		names[up.Name] = true
+	}
+	for _, route := range cfg.ProxyRoutes {
+		err = route.Init()
+		if err != nil {
+			return errors.Wrap(err, "can't configure proxy routes")
+		}
+		if route.Upstream != "" && !names[route.Upstream] {
+			return errors.Errorf("proxy route %s refers to unknown upstream %s", route.Prefix, route.Upstream)
+		}
+	}
 	fn, err := cfg.Abs(cfg.PidFile)
 	if err != nil {
 		return errors.Wrap(err, "can't make abs path for pid file " + cfg.PidFile)
@@ -339,6 +459,22 @@ func DefaultServerConfig() *ServerConfig {
 			LogLevel: logging.INFO,
 		},
 		CacheDirectory: "var/cache",
+		Uploads: UploadConfig{
+			Directory: "uploads",
+			MaxFileSize: 100 * 1024 * 1024,
+			MaxTotalSize: 1024 * 1024 * 1024,
+		},
+		Cache: CacheConfig{
+			Directory: "responses",
+			MemoryEntries: DefaultCacheMemoryEntries,
+			DiskEntries: DefaultCacheDiskEntries,
+			MaxEntrySize: DefaultCacheMaxEntrySize,
+		},
+		Views: ViewConfig{
+			Directory: "views",
+			Layout: "layout.html",
+			Partials: "partials",
+		},
 		PidFile: "var/server.pid",
 		Bind: BindConfig{
 			Port: 8080,
@@ -0,0 +1,345 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// corsPreflightMaxSize bounds how much of a route's own answer to a
+// preflight request is held back.  OPTIONS responses are small; a bigger
+// one is cut off, and if no policy answers in its place, it's an error.
+const corsPreflightMaxSize = 64 * 1024
+
+var DefaultCORSMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+var DefaultCORSHeaders = []string{
+	"Accept",
+	"Accept-Language",
+	"Authorization",
+	"Content-Language",
+	"Content-Type",
+	"X-Requested-With",
+	DefaultRequestIDHeader,
+	DefaultCSRFHeader,
+}
+
+// CORSConfig is a cross origin resource sharing policy.  Origins are
+// exact ("https://app.example.com"), wildcard subdomains
+// ("https://*.example.com"), regular expressions prefixed with a tilde
+// ("~https://pr-[0-9]+\.example\.com"), which must match the whole
+// origin, or "*" for any origin.  Headers
+// may be "*" to allow whatever the browser asks for.  MaxAge is in
+// seconds.  The policy is off if there are no Origins.
+type CORSConfig struct {
+	Origins       []string `json:"origins"        arg:"origins"`
+	Methods       []string `json:"methods"        arg:"methods"`
+	Headers       []string `json:"headers"        arg:"headers"`
+	ExposeHeaders []string `json:"expose_headers" arg:"expose-headers"`
+	Credentials   bool     `json:"credentials"    arg:"credentials"`
+	MaxAge        int      `json:"max_age"        arg:"max-age"`
+}
+
+func (cfg *CORSConfig) Enabled() bool {
+	return len(cfg.Origins) > 0
+}
+
+func (cfg *CORSConfig) Init() error {
+	for _, origin := range cfg.Origins {
+		if origin == "*" && cfg.Credentials {
+			return errors.New("cors can't allow credentials from any origin")
+		}
+		_, err := compileOrigin(origin)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.MaxAge < 0 {
+		return errors.New("cors max age can't be negative")
+	}
+	return nil
+}
+
+type originMatcher func(origin string) bool
+
+func compileOrigin(pattern string) (originMatcher, error) {
+	pattern = strings.TrimSpace(pattern)
+	switch {
+	case pattern == "*":
+		return func(string) bool { return true }, nil
+	case strings.HasPrefix(pattern, "~"):
+		re, err := regexp.Compile("^(?:" + pattern[1:] + ")$")
+		if err != nil {
+			return nil, errors.Wrap(err, "bad cors origin pattern " + pattern)
+		}
+		return re.MatchString, nil
+	case strings.Contains(pattern, "://*."):
+		parts := strings.SplitN(strings.ToLower(pattern), "://*", 2)
+		prefix := parts[0] + "://"
+		suffix := parts[1]
+		return func(origin string) bool {
+			origin = strings.ToLower(origin)
+			if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+				return false
+			}
+			// at least one label before the domain, and no port or path
+			sub := origin[len(prefix):len(origin) - len(suffix)]
+			return sub != "" && !strings.ContainsAny(sub, ":/@")
+		}, nil
+	case strings.Contains(pattern, "*"):
+		return nil, errors.Errorf("bad cors origin %s: wildcards are only allowed for subdomains", pattern)
+	}
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "/"))
+	return func(origin string) bool {
+		return strings.ToLower(origin) == pattern
+	}, nil
+}
+
+// CORS applies a CORSConfig policy to requests, answering preflight
+// requests itself
+type CORS struct {
+	cfg *CORSConfig
+	origins []originMatcher
+	anyOrigin bool
+	methods []string
+	methodSet map[string]bool
+	headers map[string]bool
+	anyHeader bool
+	expose string
+}
+
+// NewCORS creates a CORS policy.  Origin patterns that don't compile are
+// skipped; CORSConfig.Init reports them.
+func NewCORS(cfg *CORSConfig) *CORS {
+	c := &CORS{
+		cfg: cfg,
+		origins: []originMatcher{},
+		methodSet: map[string]bool{},
+		headers: map[string]bool{},
+		expose: strings.Join(cfg.ExposeHeaders, ", "),
+	}
+	for _, origin := range cfg.Origins {
+		if strings.TrimSpace(origin) == "*" {
+			c.anyOrigin = true
+		}
+		m, err := compileOrigin(origin)
+		if err == nil {
+			c.origins = append(c.origins, m)
+		}
+	}
+	methods := cfg.Methods
+	if len(methods) == 0 {
+		methods = DefaultCORSMethods
+	}
+	c.methods = make([]string, len(methods))
+	for i, method := range methods {
+		c.methods[i] = strings.ToUpper(strings.TrimSpace(method))
+		c.methodSet[c.methods[i]] = true
+	}
+	headers := cfg.Headers
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+	for _, h := range headers {
+		if h == "*" {
+			c.anyHeader = true
+		}
+		c.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	return c
+}
+
+// AllowOrigin reports whether the policy accepts requests from origin
+func (c *CORS) AllowOrigin(origin string) bool {
+	for _, m := range c.origins {
+		if m(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeaders returns the requested headers, or false if any of them
+// aren't allowed
+func (c *CORS) allowHeaders(requested string) (string, bool) {
+	headers := []string{}
+	for _, h := range strings.Split(requested, ",") {
+		h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+		if h == "" {
+			continue
+		}
+		if !c.anyHeader && !c.headers[h] {
+			return "", false
+		}
+		headers = append(headers, h)
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, ", "), true
+}
+
+func (c *CORS) setOrigin(h http.Header, origin string) {
+	if c.anyOrigin && !c.cfg.Credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.cfg.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// corsPreflight collects the policies a preflight request passes through
+type corsPreflight struct {
+	policies []*CORS
+}
+
+// answerPreflight answers a preflight request from the policies that
+// allow its origin.  The innermost of them, attached to the most
+// specific prefix, sets the headers, but the method and headers have to
+// be allowed by all of them, and the shortest max age wins.
+func answerPreflight(w http.ResponseWriter, r *http.Request, policies []*CORS, origin string) bool {
+	allowing := []*CORS{}
+	for _, c := range policies {
+		if c.AllowOrigin(origin) {
+			allowing = append(allowing, c)
+		}
+	}
+	if len(allowing) == 0 {
+		return false
+	}
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	var headers string
+	maxAge := 0
+	for _, c := range allowing {
+		var ok bool
+		headers, ok = c.allowHeaders(r.Header.Get("Access-Control-Request-Headers"))
+		if !c.methodSet[method] || !ok {
+			return false
+		}
+		if c.cfg.MaxAge > 0 && (maxAge == 0 || c.cfg.MaxAge < maxAge) {
+			maxAge = c.cfg.MaxAge
+		}
+	}
+	methods := []string{}
+	for _, m := range allowing[len(allowing) - 1].methods {
+		ok := true
+		for _, c := range allowing {
+			ok = ok && c.methodSet[m]
+		}
+		if ok {
+			methods = append(methods, m)
+		}
+	}
+	h := w.Header()
+	addVary(h, "Origin")
+	addVary(h, "Access-Control-Request-Method")
+	addVary(h, "Access-Control-Request-Headers")
+	allowing[len(allowing) - 1].setOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	if maxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// Middleware applies the policy.  Policies nest: one attached to a
+// Router.Prefix group adds origins to the global one, and when both allow
+// a request, the group's sets the headers.  A preflight request goes on
+// through all of them, and any middleware and handler after them, with
+// the response held back; then the outermost policy answers it, or, if
+// no policy allows it, sends what the route did.  So a group's policy
+// should come before its auth middleware, since browsers don't send
+// credentials with preflight requests.  The route's OPTIONS handler runs
+// even when a policy answers in its place, so it shouldn't do anything
+// it wouldn't want done for a preflight.
+func (c *CORS) Middleware(handler http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		// websocket upgrades check the origin against the same policies
+		policies := append(contextCORS(r.Context()), c)
+		ctx := context.WithValue(r.Context(), reqCtxKey("cors"), policies)
+		h := w.Header()
+		if !c.anyOrigin || c.cfg.Credentials {
+			// the response depends on who's asking
+			addVary(h, "Origin")
+		}
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			handler.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			pf, nested := r.Context().Value(reqCtxKey("corsPreflight")).(*corsPreflight)
+			if nested {
+				pf.policies = policies
+				handler.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+			pf = &corsPreflight{policies: policies}
+			ctx = context.WithValue(ctx, reqCtxKey("corsPreflight"), pf)
+			rec := newCacheRecorder(nil, corsPreflightMaxSize)
+			handler.ServeHTTP(rec, r.WithContext(ctx))
+			if answerPreflight(w, r, pf.policies, origin) {
+				return
+			}
+			if rec.overflow {
+				sendError(w, r, InternalServerError.Errorf("response to OPTIONS %s too big", r.URL.Path))
+				return
+			}
+			rec.writeTo(w, r)
+			return
+		}
+		if c.AllowOrigin(origin) {
+			c.setOrigin(h, origin)
+			if c.expose != "" {
+				h.Set("Access-Control-Expose-Headers", c.expose)
+			}
+		}
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	}
+	return http.HandlerFunc(f)
+}
+
+func contextCORS(ctx context.Context) []*CORS {
+	policies, ok := ctx.Value(reqCtxKey("cors")).([]*CORS)
+	if !ok {
+		return nil
+	}
+	// so appending doesn't share an array with another request
+	return policies[:len(policies):len(policies)]
+}
+
+// checkOrigin accepts websocket upgrades from non-browser clients, the
+// same origin, and origins allowed by the CORS policy for the route
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, c := range contextCORS(r.Context()) {
+		if c.AllowOrigin(origin) {
+			return true
+		}
+	}
+	return false
+}
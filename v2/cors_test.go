@@ -0,0 +1,221 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+type CORSSuite struct {}
+
+var _ = Suite(&CORSSuite{})
+
+func (s *CORSSuite) TestOrigins(c *C) {
+	cfg := &CORSConfig{Origins: []string{
+		"https://app.example.com",
+		"https://*.example.org",
+		`~^https://pr-[0-9]+\.preview\.example\.net$`,
+		`~https://(www|beta)\.example\.io`,
+	}}
+	c.Assert(cfg.Init(), IsNil)
+	cors := NewCORS(cfg)
+	allowed := map[string]bool{
+		"https://app.example.com": true,
+		"HTTPS://APP.EXAMPLE.COM": true,
+		"http://app.example.com": false,
+		"https://app.example.com.evil.com": false,
+		"https://a.example.org": true,
+		"https://a.b.example.org": true,
+		"https://example.org": false,
+		"https://evil.com/.example.org": false,
+		"https://a.example.org:8443": false,
+		"https://pr-12.preview.example.net": true,
+		"https://pr-x.preview.example.net": false,
+		"https://beta.example.io": true,
+		"https://beta.example.io.evil.net": false,
+		"https://evil.net/https://www.example.io": false,
+		"null": false,
+	}
+	for origin, ok := range allowed {
+		c.Check(cors.AllowOrigin(origin), Equals, ok, Commentf("origin %s", origin))
+	}
+
+	c.Check((&CORSConfig{Origins: []string{"*"}, Credentials: true}).Init(), ErrorMatches, ".*credentials from any origin")
+	c.Check((&CORSConfig{Origins: []string{"~("}}).Init(), ErrorMatches, "bad cors origin pattern.*")
+	c.Check((&CORSConfig{Origins: []string{"https://app.*.com"}}).Init(), ErrorMatches, ".*only allowed for subdomains")
+}
+
+func newCORSServer(c *C) *Server {
+	srv := newTestServer(c, &ServerConfig{CORS: CORSConfig{
+		Origins: []string{"https://app.example.com"},
+		ExposeHeaders: []string{"X-Total-Count"},
+		Credentials: true,
+		MaxAge: 600,
+	}})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	srv.router.GET("/api/things", ok)
+	srv.router.POST("/api/things", ok)
+	partner := srv.router.Prefix("/partner")
+	partner.Use(NewCORS(&CORSConfig{Origins: []string{"https://partner.example.org"}, Methods: []string{"get"}}).Middleware)
+	partner.Use(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	partner.GET("/feed", ok)
+	limited := srv.router.Prefix("/limited")
+	limited.Use(NewCORS(&CORSConfig{
+		Origins: []string{"https://app.example.com"},
+		Methods: []string{"GET", "DELETE"},
+		Headers: []string{"Content-Type"},
+		MaxAge: 60,
+	}).Middleware)
+	limited.GET("/things", ok)
+	limited.POST("/things", ok)
+	srv.router.Compile(nil)
+	return srv
+}
+
+func corsRequest(srv *Server, method, path, origin string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Origin", origin)
+	for i := 0; i + 1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	return w
+}
+
+func (s *CORSSuite) TestPreflight(c *C) {
+	srv := newCORSServer(c)
+	w := corsRequest(srv, "OPTIONS", "/api/things", "https://app.example.com",
+		"Access-Control-Request-Method", "POST",
+		"Access-Control-Request-Headers", "content-type, x-request-id")
+	c.Check(w.Code, Equals, http.StatusNoContent)
+	h := w.Header()
+	c.Check(h.Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+	c.Check(h.Get("Access-Control-Allow-Credentials"), Equals, "true")
+	c.Check(h.Get("Access-Control-Allow-Methods"), Equals, "GET, HEAD, POST, PUT, PATCH, DELETE")
+	c.Check(h.Get("Access-Control-Allow-Headers"), Equals, "Content-Type, X-Request-Id")
+	c.Check(h.Get("Access-Control-Max-Age"), Equals, "600")
+	c.Check(h.Values("Vary"), DeepEquals, []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"})
+
+	// not allowed, so the router answers without cors headers
+	w = corsRequest(srv, "OPTIONS", "/api/things", "https://evil.com", "Access-Control-Request-Method", "POST")
+	c.Check(w.Code, Equals, http.StatusNoContent)
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+	c.Check(w.Header().Get("Allow"), Equals, "GET, OPTIONS, POST")
+	w = corsRequest(srv, "OPTIONS", "/api/things", "https://app.example.com",
+		"Access-Control-Request-Method", "POST",
+		"Access-Control-Request-Headers", "X-Secret")
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+
+	// the group's policy adds to the global one, ahead of its auth
+	w = corsRequest(srv, "OPTIONS", "/partner/feed", "https://partner.example.org", "Access-Control-Request-Method", "GET")
+	c.Check(w.Code, Equals, http.StatusNoContent)
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "https://partner.example.org")
+	c.Check(w.Header().Get("Access-Control-Allow-Methods"), Equals, "GET")
+	w = corsRequest(srv, "OPTIONS", "/api/things", "https://partner.example.org", "Access-Control-Request-Method", "GET")
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+	w = corsRequest(srv, "OPTIONS", "/partner/feed", "https://partner.example.org", "Access-Control-Request-Method", "DELETE")
+	c.Check(w.Code, Equals, http.StatusUnauthorized)
+
+	// a group's policy narrows the global one for origins both allow
+	w = corsRequest(srv, "OPTIONS", "/limited/things", "https://app.example.com",
+		"Access-Control-Request-Method", "GET",
+		"Access-Control-Request-Headers", "content-type")
+	c.Check(w.Code, Equals, http.StatusNoContent)
+	h = w.Header()
+	c.Check(h.Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+	c.Check(h.Get("Access-Control-Allow-Credentials"), Equals, "")
+	c.Check(h.Get("Access-Control-Allow-Methods"), Equals, "GET, DELETE")
+	c.Check(h.Get("Access-Control-Max-Age"), Equals, "60")
+	w = corsRequest(srv, "OPTIONS", "/limited/things", "https://app.example.com", "Access-Control-Request-Method", "POST")
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+	c.Check(w.Header().Get("Allow"), Equals, "GET, OPTIONS, POST")
+	w = corsRequest(srv, "OPTIONS", "/limited/things", "https://app.example.com",
+		"Access-Control-Request-Method", "GET",
+		"Access-Control-Request-Headers", "x-request-id")
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+}
+
+func (s *CORSSuite) TestPreflightTooBig(c *C) {
+	written := 0
+	h := NewCORS(&CORSConfig{Origins: []string{"https://app.example.com"}}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		written = 0
+		for i := 0; i < 1024; i++ {
+			n, err := w.Write(make([]byte, 1024))
+			written += n
+			if err != nil {
+				return
+			}
+		}
+	}))
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/things", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// the route's response is cut off instead of held in memory
+	w := preflight("https://app.example.com")
+	c.Check(w.Code, Equals, http.StatusNoContent)
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+	c.Check(written <= corsPreflightMaxSize, Equals, true)
+	w = preflight("https://evil.com")
+	c.Check(w.Code, Equals, http.StatusInternalServerError)
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+	c.Check(written <= corsPreflightMaxSize, Equals, true)
+}
+
+func (s *CORSSuite) TestRequest(c *C) {
+	srv := newCORSServer(c)
+	w := corsRequest(srv, "GET", "/api/things", "https://app.example.com")
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+	c.Check(w.Header().Get("Access-Control-Expose-Headers"), Equals, "X-Total-Count")
+	w = corsRequest(srv, "GET", "/api/things", "https://evil.com")
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+	c.Check(w.Header().Get("Vary"), Equals, "Origin")
+
+	anyOrigin := NewCORS(&CORSConfig{Origins: []string{"*"}})
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "https://anywhere.com")
+	anyOrigin.Middleware(http.NotFoundHandler()).ServeHTTP(w, req)
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "*")
+	c.Check(w.Header().Get("Vary"), Equals, "")
+}
+
+func (s *CORSSuite) TestWebSocketOrigin(c *C) {
+	var allowed bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed = checkOrigin(r)
+	})
+	check := func(h http.Handler, origin string) bool {
+		req := httptest.NewRequest("GET", "http://api.example.com/ws", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		return allowed
+	}
+	c.Check(check(handler, ""), Equals, true)
+	c.Check(check(handler, "http://api.example.com"), Equals, true)
+	c.Check(check(handler, "https://evil.com"), Equals, false)
+	cors := NewCORS(&CORSConfig{Origins: []string{"https://app.example.com"}})
+	c.Check(check(cors.Middleware(handler), "https://app.example.com"), Equals, true)
+	c.Check(check(cors.Middleware(handler), "https://evil.com"), Equals, false)
+}
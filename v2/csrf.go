@@ -0,0 +1,285 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html"
+	htmltpl "html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/logging"
+)
+
+const (
+	DefaultCSRFCookie = "csrf_token"
+	DefaultCSRFHeader = "X-CSRF-Token"
+	DefaultCSRFField = "csrf_token"
+	maxCSRFFormSize = 1024 * 1024
+)
+
+// CSRFConfig sets up cross site request forgery protection for cookie
+// authenticated requests, using the double submit cookie pattern along
+// with Origin/Referer checking.  Unsafe requests must come from the
+// server's own origin or one of TrustedOrigins (patterns as for CORS),
+// and must send the token from Cookie back in Header or, for urlencoded
+// forms, in Field.  Multipart bodies aren't read, since that would use up
+// uploads before the handler gets them, so they must use Header.  Requests carrying any of AuthHeaders (Authorization by
+// default) aren't authenticated by cookie, so they're skipped, as are
+// paths starting with any of Exempt.
+type CSRFConfig struct {
+	Enabled        bool     `json:"enabled"         arg:"enabled"`
+	Cookie         string   `json:"cookie"          arg:"cookie"`
+	Header         string   `json:"header"          arg:"header"`
+	Field          string   `json:"field"           arg:"field"`
+	Secure         bool     `json:"secure"          arg:"secure"`
+	TrustedOrigins []string `json:"trusted_origins" arg:"trusted-origins"`
+	AuthHeaders    []string `json:"auth_headers"    arg:"auth-headers"`
+	Exempt         []string `json:"exempt"          arg:"-"`
+}
+
+func (cfg *CSRFConfig) Init() error {
+	if cfg.Cookie == "" {
+		cfg.Cookie = DefaultCSRFCookie
+	}
+	if cfg.Header == "" {
+		cfg.Header = DefaultCSRFHeader
+	}
+	cfg.Header = http.CanonicalHeaderKey(cfg.Header)
+	if cfg.Field == "" {
+		cfg.Field = DefaultCSRFField
+	}
+	if len(cfg.AuthHeaders) == 0 {
+		cfg.AuthHeaders = []string{"Authorization"}
+	}
+	for _, origin := range cfg.TrustedOrigins {
+		if strings.TrimSpace(origin) == "*" {
+			return errors.New("csrf can't trust every origin")
+		}
+		_, err := compileOrigin(origin)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CSRF checks unsafe requests against a CSRFConfig policy, and makes the
+// token available to views via the csrfToken and csrfField helpers
+type CSRF struct {
+	cfg *CSRFConfig
+	trusted []originMatcher
+}
+
+// NewCSRF creates a CSRF policy.  Trusted origin patterns that don't
+// compile are skipped; CSRFConfig.Init reports them.
+func NewCSRF(cfg *CSRFConfig) *CSRF {
+	if cfg.Cookie == "" || cfg.Header == "" || cfg.Field == "" {
+		cfg.Init()
+	}
+	c := &CSRF{cfg: cfg, trusted: []originMatcher{}}
+	for _, origin := range cfg.TrustedOrigins {
+		m, err := compileOrigin(origin)
+		if err == nil {
+			c.trusted = append(c.trusted, m)
+		}
+	}
+	return c
+}
+
+func newCSRFToken() (string, error) {
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", errors.Wrap(err, "can't generate csrf token")
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// token returns the request's token from its cookie, or makes a new one
+// and sets the cookie
+func (c *CSRF) token(w http.ResponseWriter, r *http.Request) (string, error) {
+	cookie, err := r.Cookie(c.cfg.Cookie)
+	if err == nil && len(cookie.Value) == 43 {
+		_, err = base64.RawURLEncoding.DecodeString(cookie.Value)
+		if err == nil {
+			return cookie.Value, nil
+		}
+	}
+	token, err := newCSRFToken()
+	if err != nil {
+		return "", err
+	}
+	// readable by scripts, so they can send it back in the header
+	http.SetCookie(w, &http.Cookie{
+		Name: c.cfg.Cookie,
+		Value: token,
+		Path: "/",
+		Secure: c.cfg.Secure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token, nil
+}
+
+func (c *CSRF) exempt(r *http.Request) bool {
+	if !isSafeMethod(r.Method) && r.Header.Get("Cookie") == "" {
+		// no ambient credentials to forge, as with webhooks and api keys
+		return true
+	}
+	for _, k := range c.cfg.AuthHeaders {
+		if r.Header.Get(k) != "" {
+			return true
+		}
+	}
+	for _, p := range c.cfg.Exempt {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CSRF) trustOrigin(r *http.Request, origin string) bool {
+	// only the host is compared for our own origin, since TLS may be
+	// terminated in front of us
+	u, err := url.Parse(origin)
+	if err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, m := range c.trusted {
+		if m(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin makes sure the request came from a page we trust.  Without
+// an Origin header, it falls back to the Referer, which is required over
+// https, where browsers always send one unless told not to.
+func (c *CSRF) checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin != "" {
+		if origin == "null" || !c.trustOrigin(r, origin) {
+			return csrfFailed("origin %s not allowed", origin)
+		}
+		return nil
+	}
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		if r.TLS != nil {
+			return csrfFailed("no origin or referer")
+		}
+		return nil
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return csrfFailed("bad referer")
+	}
+	if !c.trustOrigin(r, u.Scheme + "://" + u.Host) {
+		return csrfFailed("referer %s://%s not allowed", u.Scheme, u.Host)
+	}
+	return nil
+}
+
+func (c *CSRF) checkToken(w http.ResponseWriter, r *http.Request, token string) error {
+	sent := r.Header.Get(c.cfg.Header)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if sent == "" && mediaType == "application/x-www-form-urlencoded" {
+		// the handler gets the parsed form, so this limits it too
+		r.Body = http.MaxBytesReader(w, r.Body, maxCSRFFormSize)
+		err := r.ParseForm()
+		if err != nil {
+			return BadRequest.Wrap(err, "Can't read form")
+		}
+		sent = r.PostForm.Get(c.cfg.Field)
+	}
+	if sent == "" && mediaType == "multipart/form-data" {
+		return csrfFailed("missing token; send it in the %s header", c.cfg.Header)
+	}
+	if sent == "" {
+		return csrfFailed("missing token; send it in the %s header or the %s form field", c.cfg.Header, c.cfg.Field)
+	}
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		return csrfFailed("token doesn't match")
+	}
+	return nil
+}
+
+// csrfFailed makes a 403 whose message says what was wrong, since a
+// plain "Forbidden" is hard to debug from the browser
+func csrfFailed(format string, args ...interface{}) HTTPError {
+	err := errors.Errorf(format, args...)
+	return Forbidden.Wrap(err, "CSRF check failed: " + err.Error())
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// Middleware checks unsafe requests.  A request that's already been
+// through a CSRF middleware isn't checked again, so a route group can
+// use one even if it's also set up globally.
+func (c *CSRF) Middleware(handler http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if ContextCSRFToken(r.Context()) != "" || c.exempt(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		// a token check against a cookie that was only just set would
+		// always fail, so check before making one
+		_, cookieErr := r.Cookie(c.cfg.Cookie)
+		token, err := c.token(w, r)
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+		ctx := context.WithValue(r.Context(), reqCtxKey("csrf"), token)
+		ctx = context.WithValue(ctx, reqCtxKey("csrfField"), c.cfg.Field)
+		r = r.WithContext(ctx)
+		if !isSafeMethod(r.Method) {
+			err = c.checkOrigin(r)
+			if err == nil && cookieErr != nil {
+				err = csrfFailed("no token cookie")
+			}
+			if err == nil {
+				err = c.checkToken(w, r, token)
+			}
+			if err != nil {
+				logging.FromContext(r.Context()).Warnln(r.Method, r.URL.Path, err)
+				sendError(w, r, err)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(f)
+}
+
+func contextCSRFField(ctx context.Context) string {
+	field, ok := ctx.Value(reqCtxKey("csrfField")).(string)
+	if !ok {
+		return DefaultCSRFField
+	}
+	return field
+}
+
+// csrfField renders a hidden form input carrying the token, for forms
+// that aren't multipart
+func csrfField(req *http.Request) interface{} {
+	token := ContextCSRFToken(req.Context())
+	if token == "" {
+		return htmltpl.HTML("")
+	}
+	field := contextCSRFField(req.Context())
+	return htmltpl.HTML(`<input type="hidden" name="` + html.EscapeString(field) + `" value="` + html.EscapeString(token) + `">`)
+}
@@ -0,0 +1,183 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type CSRFSuite struct {}
+
+var _ = Suite(&CSRFSuite{})
+
+func newCSRFHandler(c *C, cfg *CSRFConfig) http.Handler {
+	c.Assert(cfg.Init(), IsNil)
+	csrf := NewCSRF(cfg)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " ok " + r.PostFormValue("name")))
+	})
+	// twice, as when a route group adds its own to the global one
+	return csrf.Middleware(csrf.Middleware(h))
+}
+
+func csrfPost(h http.Handler, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "http://app.example.com/password", strings.NewReader(body))
+	for i := 0; i + 1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func (s *CSRFSuite) TestToken(c *C) {
+	h := newCSRFHandler(c, &CSRFConfig{Enabled: true})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://app.example.com/", nil))
+	c.Check(w.Code, Equals, http.StatusOK)
+	cookies := w.Result().Cookies()
+	c.Assert(cookies, HasLen, 1)
+	c.Check(cookies[0].Name, Equals, DefaultCSRFCookie)
+	c.Check(cookies[0].HttpOnly, Equals, false)
+	c.Check(cookies[0].SameSite, Equals, http.SameSiteLaxMode)
+	c.Check(len(cookies[0].Value), Equals, 43)
+	token := cookies[0].Value
+	cookie := DefaultCSRFCookie + "=" + token
+
+	// an existing cookie is kept
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	req.Header.Set("Cookie", cookie)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Result().Cookies(), HasLen, 0)
+
+	w = csrfPost(h, "", "Cookie", cookie, "Origin", "http://app.example.com", "X-CSRF-Token", token)
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Body.String(), Equals, "POST ok ")
+	form := url.Values{"csrf_token": {token}, "name": {"bob"}}.Encode()
+	w = csrfPost(h, form, "Cookie", cookie, "Origin", "http://app.example.com", "Content-Type", "application/x-www-form-urlencoded")
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Body.String(), Equals, "POST ok bob")
+
+	w = csrfPost(h, "", "Cookie", "session=x", "Origin", "http://app.example.com", "X-CSRF-Token", token)
+	c.Check(w.Code, Equals, http.StatusForbidden)
+	c.Check(w.Body.String(), Matches, ".*no token cookie.*")
+	w = csrfPost(h, `{"csrf_token": "x"}`, "Cookie", cookie, "Origin", "http://app.example.com", "Content-Type", "application/json")
+	c.Check(w.Code, Equals, http.StatusForbidden)
+	c.Check(w.Body.String(), Matches, ".*missing token.*X-Csrf-Token.*")
+	w = csrfPost(h, "", "Cookie", cookie, "Origin", "http://app.example.com", "X-CSRF-Token", strings.Repeat("A", 43))
+	c.Check(w.Code, Equals, http.StatusForbidden)
+	c.Check(w.Body.String(), Matches, ".*doesn't match.*")
+}
+
+func (s *CSRFSuite) TestOrigin(c *C) {
+	h := newCSRFHandler(c, &CSRFConfig{Enabled: true, TrustedOrigins: []string{"https://*.example.org"}})
+	token := strings.Repeat("a", 43)
+	cookie := DefaultCSRFCookie + "=" + token
+	post := func(headers ...string) int {
+		return csrfPost(h, "", append([]string{"Cookie", cookie, "X-CSRF-Token", token}, headers...)...).Code
+	}
+	c.Check(post("Origin", "https://app.example.com"), Equals, http.StatusOK)
+	c.Check(post("Origin", "https://evil.com"), Equals, http.StatusForbidden)
+	c.Check(post("Origin", "null"), Equals, http.StatusForbidden)
+	c.Check(post("Origin", "https://www.example.org"), Equals, http.StatusOK)
+	c.Check(post("Referer", "https://app.example.com/settings"), Equals, http.StatusOK)
+	c.Check(post("Referer", "https://evil.com/app.example.com"), Equals, http.StatusForbidden)
+	c.Check(post(), Equals, http.StatusOK)
+
+	req := httptest.NewRequest("POST", "https://app.example.com/password", nil)
+	req.TLS = &tls.ConnectionState{}
+	req.Header.Set("Cookie", cookie)
+	req.Header.Set("X-CSRF-Token", token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusForbidden)
+	c.Check(w.Body.String(), Matches, ".*no origin or referer.*")
+}
+
+func (s *CSRFSuite) TestExempt(c *C) {
+	h := newCSRFHandler(c, &CSRFConfig{Enabled: true, Exempt: []string{"/hooks/"}})
+	c.Check(csrfPost(h, "", "Cookie", "session=x", "Origin", "https://evil.com").Code, Equals, http.StatusForbidden)
+	// not cookie authenticated, so not forgeable
+	c.Check(csrfPost(h, "", "Cookie", "session=x", "Origin", "https://evil.com", "Authorization", "Bearer xyz").Code, Equals, http.StatusOK)
+	w := csrfPost(h, "", "Origin", "https://evil.com", "X-Api-Key", "xyz")
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Result().Cookies(), HasLen, 0)
+	req := httptest.NewRequest("POST", "/hooks/github", nil)
+	req.Header.Set("Cookie", "session=x")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusOK)
+}
+
+func (s *CSRFSuite) TestViewHelpers(c *C) {
+	dn := c.MkDir()
+	writeTemplate(c, dn, "form.html", `<form>{{csrfField}}</form>{{csrfToken}}`)
+	loader := NewTemplateLoader(&ViewConfig{Directory: dn})
+	csrf := NewCSRF(&CSRFConfig{Field: "tok"})
+	h := csrf.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(loader.Render(w, r, "form.html", nil), IsNil)
+	}))
+	tok := strings.Repeat("b", 43)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", DefaultCSRFCookie + "=" + tok)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Body.String(), Equals, `<form><input type="hidden" name="tok" value="` + tok + `"></form>` + tok)
+}
+
+func (s *CSRFSuite) TestUpload(c *C) {
+	cfg := &UploadConfig{Directory: c.MkDir()}
+	csrf := NewCSRF(&CSRFConfig{Enabled: true})
+	h := csrf.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploads, err := ReceiveUploads(r, cfg)
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+		defer uploads.Cleanup()
+		data, _ := ioutil.ReadFile(uploads.File("file").Path)
+		w.Write([]byte(uploads.Values.Get("title") + " " + string(data)))
+	}))
+	token := strings.Repeat("a", 43)
+	upload := func(header bool) *httptest.ResponseRecorder {
+		buf := &bytes.Buffer{}
+		mw := multipart.NewWriter(buf)
+		mw.WriteField("csrf_token", token)
+		mw.WriteField("title", "hello")
+		fw, _ := mw.CreateFormFile("file", "data.txt")
+		fw.Write([]byte("some data"))
+		mw.Close()
+		req := httptest.NewRequest("POST", "http://app.example.com/upload", buf)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Cookie", DefaultCSRFCookie + "=" + token)
+		if header {
+			req.Header.Set(DefaultCSRFHeader, token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	// the body is left for the handler, so the token has to be in the header
+	w := upload(false)
+	c.Check(w.Code, Equals, http.StatusForbidden)
+	c.Check(w.Body.String(), Matches, ".*missing token.*X-Csrf-Token header$")
+	w = upload(true)
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Body.String(), Equals, "hello some data")
+}
+
+func (s *CSRFSuite) TestFormLimit(c *C) {
+	h := newCSRFHandler(c, &CSRFConfig{Enabled: true})
+	token := strings.Repeat("a", 43)
+	form := url.Values{"csrf_token": {token}, "name": {strings.Repeat("x", maxCSRFFormSize)}}.Encode()
+	w := csrfPost(h, form, "Cookie", DefaultCSRFCookie + "=" + token, "Content-Type", "application/x-www-form-urlencoded")
+	c.Check(w.Code, Equals, http.StatusBadRequest)
+}
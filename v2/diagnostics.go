@@ -0,0 +1,278 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	rpprof "runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// secretKeyPattern matches config keys whose values shouldn't be shown,
+// once dashes have been turned into underscores
+var secretKeyPattern = regexp.MustCompile(`(?i)(authorization|cookie|token|secret|password|passwd|credential|private|_?key$)`)
+
+func secretKey(key string) bool {
+	return key != "" && secretKeyPattern.MatchString(strings.Replace(key, "-", "_", -1))
+}
+
+// redactAll replaces every value in v, for headers, which tend to carry
+// credentials under all sorts of names
+func redactAll(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		for k, x := range tv {
+			tv[k] = redactAll(x)
+		}
+	case []interface{}:
+		for i, x := range tv {
+			tv[i] = redactAll(x)
+		}
+	case nil, string:
+		if tv != nil && tv != "" {
+			return redacted
+		}
+	}
+	return v
+}
+
+func redactConfigValue(key string, v interface{}) interface{} {
+	if secretKey(key) {
+		if v == nil || v == "" {
+			return v
+		}
+		return redacted
+	}
+	if strings.Contains(strings.ToLower(key), "header") {
+		return redactAll(v)
+	}
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		for k, x := range tv {
+			tv[k] = redactConfigValue(k, x)
+		}
+	case []interface{}:
+		for i, x := range tv {
+			tv[i] = redactConfigValue("", x)
+		}
+	case string:
+		if strings.Contains(tv, "@") {
+			u, err := url.Parse(tv)
+			if err == nil && u.User != nil {
+				if _, ok := u.User.Password(); ok {
+					u.User = url.UserPassword(u.User.Username(), "REDACTED")
+					return u.String()
+				}
+			}
+		}
+	}
+	return v
+}
+
+// RedactConfig returns a JSON-like copy of a config struct, with values
+// that look like secrets replaced, so it can be shown to operators
+func RedactConfig(cfg interface{}) (interface{}, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't serialize config")
+	}
+	var obj interface{}
+	err = json.Unmarshal(data, &obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't deserialize config")
+	}
+	return redactConfigValue("", obj), nil
+}
+
+type RuntimeStats struct {
+	GoVersion    string    `json:"go_version"`
+	Started      time.Time `json:"started"`
+	Uptime       float64   `json:"uptime"`
+	NumCPU       int       `json:"num_cpu"`
+	GOMAXPROCS   int       `json:"gomaxprocs"`
+	Goroutines   int       `json:"goroutines"`
+	HeapAlloc    uint64    `json:"heap_alloc"`
+	HeapInuse    uint64    `json:"heap_inuse"`
+	HeapObjects  uint64    `json:"heap_objects"`
+	Sys          uint64    `json:"sys"`
+	TotalAlloc   uint64    `json:"total_alloc"`
+	Mallocs      uint64    `json:"mallocs"`
+	Frees        uint64    `json:"frees"`
+	NumGC        uint32    `json:"num_gc"`
+	LastGC       time.Time `json:"last_gc"`
+	NextGC       uint64    `json:"next_gc"`
+	PauseTotal   float64   `json:"pause_total"`
+	RecentPauses []float64 `json:"recent_pauses"`
+}
+
+func (srv *Server) runtimeStats() *RuntimeStats {
+	ms := &runtime.MemStats{}
+	runtime.ReadMemStats(ms)
+	gc := &debug.GCStats{}
+	debug.ReadGCStats(gc)
+	stats := &RuntimeStats{
+		GoVersion: runtime.Version(),
+		Started: srv.started,
+		Uptime: time.Since(srv.started).Seconds(),
+		NumCPU: runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc: ms.HeapAlloc,
+		HeapInuse: ms.HeapInuse,
+		HeapObjects: ms.HeapObjects,
+		Sys: ms.Sys,
+		TotalAlloc: ms.TotalAlloc,
+		Mallocs: ms.Mallocs,
+		Frees: ms.Frees,
+		NumGC: ms.NumGC,
+		LastGC: gc.LastGC,
+		NextGC: ms.NextGC,
+		PauseTotal: gc.PauseTotal.Seconds(),
+		RecentPauses: []float64{},
+	}
+	for i, p := range gc.Pause {
+		if i >= 10 {
+			break
+		}
+		stats.RecentPauses = append(stats.RecentPauses, p.Seconds())
+	}
+	return stats
+}
+
+type HubStats struct {
+	Type    string `json:"type"`
+	Closed  bool   `json:"closed"`
+	Clients *int   `json:"clients"`
+}
+
+func (srv *Server) hubStats() []*HubStats {
+	srv.hubMutex.Lock()
+	hubs := make([]Hub, len(srv.hubs))
+	copy(hubs, srv.hubs)
+	srv.hubMutex.Unlock()
+	stats := make([]*HubStats, len(hubs))
+	for i, hub := range hubs {
+		stats[i] = &HubStats{Type: fmt.Sprintf("%T", hub), Closed: hub.Closed()}
+		// hubs that can't count report null
+		counter, ok := hub.(HubCounter)
+		if ok {
+			n := counter.ClientCount()
+			stats[i].Clients = &n
+		}
+	}
+	return stats
+}
+
+type BuildInfo struct {
+	GoVersion string            `json:"go_version"`
+	Path      string            `json:"path"`
+	Version   string            `json:"version"`
+	Settings  map[string]string `json:"settings"`
+	Deps      map[string]string `json:"deps"`
+}
+
+func buildInfo() *BuildInfo {
+	info := &BuildInfo{GoVersion: runtime.Version(), Settings: map[string]string{}, Deps: map[string]string{}}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Path = bi.Main.Path
+	info.Version = bi.Main.Version
+	for _, s := range bi.Settings {
+		info.Settings[s.Key] = s.Value
+	}
+	for _, dep := range bi.Deps {
+		if dep.Replace != nil {
+			info.Deps[dep.Path] = dep.Version + " => " + dep.Replace.Path + " " + dep.Replace.Version
+		} else {
+			info.Deps[dep.Path] = dep.Version
+		}
+	}
+	return info
+}
+
+type routeInfo struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+func (srv *Server) routeTable() []*routeInfo {
+	routes := srv.router.Routes()
+	out := make([]*routeInfo, len(routes))
+	for i, route := range routes {
+		p := route.Path
+		if p == "" {
+			p = "/"
+		}
+		out[i] = &routeInfo{Method: route.Method, Path: p}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Path == out[j].Path {
+			return out[i].Method < out[j].Method
+		}
+		return out[i].Path < out[j].Path
+	})
+	return out
+}
+
+func pprofIndex(w http.ResponseWriter, r *http.Request) {
+	// the index uses relative links
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path + "/", http.StatusMovedPermanently)
+		return
+	}
+	pprof.Index(w, r)
+}
+
+func pprofProfile(w http.ResponseWriter, r *http.Request) {
+	// pprof.Index only finds profiles under /debug/pprof/
+	pprof.Handler(ContextRequestVars(r.Context())["name"]).ServeHTTP(w, r)
+}
+
+func goroutineDump(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// attachDiagnostics adds pprof, runtime stats, goroutine dumps, the
+// route table, the effective config, websocket hub stats and build info
+// to router, which should be protected or not publicly exposed
+func (srv *Server) attachDiagnostics(router Router) {
+	router.GET("/debug/pprof", http.HandlerFunc(pprofIndex))
+	router.GET("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+	router.GET("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+	router.GET("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+	router.POST("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+	router.GET("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+	router.GET("/debug/pprof/:name", http.HandlerFunc(pprofProfile))
+	router.GET("/runtime", HandlerFunc(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		return srv.runtimeStats(), nil
+	}))
+	router.GET("/goroutines", http.HandlerFunc(goroutineDump))
+	router.GET("/routes", HandlerFunc(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		return srv.routeTable(), nil
+	}))
+	router.GET("/config", HandlerFunc(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		cfg, err := RedactConfig(srv.cfg)
+		if err != nil {
+			return nil, InternalServerError.Wrap(err, "")
+		}
+		return cfg, nil
+	}))
+	router.GET("/hubs", HandlerFunc(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		return srv.hubStats(), nil
+	}))
+	router.GET("/build", HandlerFunc(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		return buildInfo(), nil
+	}))
+}
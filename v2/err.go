@@ -334,6 +334,9 @@ var RequestTimeout = newHerr(http.StatusRequestTimeout, "Request Timeout")
 var Conflict = newHerr(http.StatusConflict, "Conflict")
 var Gone = newHerr(http.StatusGone, "Gone")
 var PreconditionFailed = newHerr(http.StatusPreconditionFailed, "Precondition Failed")
+var RequestEntityTooLarge = newHerr(http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+var UnsupportedMediaType = newHerr(http.StatusUnsupportedMediaType, "Unsupported Media Type")
+var PreconditionRequired = newHerr(http.StatusPreconditionRequired, "Precondition Required")
 var TooManyRequests = newHerr(http.StatusTooManyRequests, "Too Many Requests")
 
 var InternalServerError = newHerr(http.StatusInternalServerError, "Internal Server Error")
@@ -0,0 +1,236 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxETagBufferSize is the largest response ETagMiddleware will hold
+	// in memory; larger responses are sent without an ETag
+	MaxETagBufferSize = 4 * 1024 * 1024
+	fileETagCacheSize = 4096
+)
+
+func strongETag(sum []byte) string {
+	return fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:16]))
+}
+
+type fileETagKey struct {
+	path string
+	modTime int64
+	size int64
+}
+
+var fileETagMutex = &sync.Mutex{}
+var fileETags = map[fileETagKey]string{}
+
+// FileETag returns a strong ETag for the contents of the named file.
+// Results are cached by path, modification time and size, so a file is
+// only hashed again after it changes.
+func FileETag(fn string) (string, error) {
+	st, err := os.Stat(fn)
+	if err != nil {
+		return "", err
+	}
+	return fileETag(fn, st, nil)
+}
+
+func fileETag(fn string, st os.FileInfo, f io.ReadSeeker) (string, error) {
+	if st.IsDir() {
+		return "", errors.Errorf("%s is a directory", fn)
+	}
+	key := fileETagKey{path: fn, modTime: st.ModTime().UnixNano(), size: st.Size()}
+	fileETagMutex.Lock()
+	etag, ok := fileETags[key]
+	fileETagMutex.Unlock()
+	if ok {
+		return etag, nil
+	}
+	if f == nil {
+		xf, err := os.Open(fn)
+		if err != nil {
+			return "", err
+		}
+		defer xf.Close()
+		f = xf
+	} else {
+		defer f.Seek(0, io.SeekStart)
+	}
+	etag = GenEtag(f)
+	fileETagMutex.Lock()
+	if len(fileETags) >= fileETagCacheSize {
+		// crude, but cheap: start over rather than track usage
+		fileETags = map[fileETagKey]string{}
+	}
+	fileETags[key] = etag
+	fileETagMutex.Unlock()
+	return etag, nil
+}
+
+// readSeekerETag returns the ETag and modification time to use for a
+// io.ReadSeeker returned from a HandlerFunc
+func readSeekerETag(obj io.ReadSeeker) (string, time.Time) {
+	var etag string
+	var modTime time.Time
+	eobj, isa := obj.(ETaggable)
+	if isa {
+		etag = eobj.ETag()
+	}
+	dobj, isa := obj.(Datable)
+	if isa {
+		modTime = dobj.LastModified()
+	}
+	f, isa := obj.(*os.File)
+	if isa {
+		st, err := f.Stat()
+		if err == nil && !st.IsDir() {
+			if modTime.IsZero() {
+				modTime = st.ModTime()
+			}
+			if etag == "" {
+				etag, _ = fileETag(f.Name(), st, f)
+			}
+		}
+	}
+	if etag == "" {
+		etag = GenEtag(obj)
+		obj.Seek(0, io.SeekStart)
+	}
+	return etag, modTime
+}
+
+func isJSONContentType(ct string) bool {
+	ct = strings.TrimSpace(strings.Split(ct, ";")[0])
+	return ct == "application/json" || strings.HasSuffix(ct, "+json")
+}
+
+// ETagMiddleware buffers successful JSON responses to GET and HEAD
+// requests, and adds a strong ETag computed from the body.  Requests with
+// a matching If-None-Match get a 304 without the body.  Responses that
+// already have an ETag, aren't JSON, get flushed, or are too big are
+// passed through unchanged.
+func ETagMiddleware(handler http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ew := &etagWriter{
+			w: w,
+			req: r,
+			buf: &bytes.Buffer{},
+		}
+		handler.ServeHTTP(ew, r)
+		ew.finish()
+	}
+	return http.HandlerFunc(f)
+}
+
+type etagWriter struct {
+	w http.ResponseWriter
+	req *http.Request
+	statusCode int
+	buf *bytes.Buffer
+	passthrough bool
+}
+
+func (w *etagWriter) Header() http.Header {
+	return w.w.Header()
+}
+
+func (w *etagWriter) WriteHeader(statusCode int) {
+	if w.statusCode != 0 {
+		return
+	}
+	w.statusCode = statusCode
+	h := w.w.Header()
+	if statusCode != http.StatusOK || h.Get("ETag") != "" || !isJSONContentType(h.Get("Content-Type")) {
+		w.passthrough = true
+		w.w.WriteHeader(statusCode)
+	}
+}
+
+func (w *etagWriter) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.passthrough {
+		return w.w.Write(data)
+	}
+	if w.buf.Len() + len(data) > MaxETagBufferSize {
+		err := w.stopBuffering()
+		if err != nil {
+			return 0, err
+		}
+		return w.w.Write(data)
+	}
+	return w.buf.Write(data)
+}
+
+func (w *etagWriter) stopBuffering() error {
+	if w.passthrough {
+		return nil
+	}
+	w.passthrough = true
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	w.w.WriteHeader(w.statusCode)
+	_, err := w.buf.WriteTo(w.w)
+	return err
+}
+
+func (w *etagWriter) finish() {
+	if w.passthrough {
+		return
+	}
+	if w.statusCode == 0 {
+		// handler never wrote anything
+		return
+	}
+	sum := sha256.Sum256(w.buf.Bytes())
+	etag := strongETag(sum[:])
+	h := w.w.Header()
+	h.Set("ETag", etag)
+	ch := CheckIfNoneMatch(w.req, etag)
+	if ch != nil && *ch == false {
+		h.Del("Content-Length")
+		h.Del("Content-Type")
+		w.w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.w.WriteHeader(w.statusCode)
+	w.buf.WriteTo(w.w)
+}
+
+func (w *etagWriter) Flush() {
+	if w.stopBuffering() != nil {
+		return
+	}
+	f, isa := w.w.(http.Flusher)
+	if isa {
+		f.Flush()
+	}
+}
+
+func (w *etagWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.Errorf("etag child response writer (%T) doesn't support hijacking", w.w)
+	}
+	w.passthrough = true
+	return hj.Hijack()
+}
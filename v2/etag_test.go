@@ -0,0 +1,71 @@
+package httpserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ETagSuite struct {}
+
+var _ = Suite(&ETagSuite{})
+
+type datedObj struct {
+	Name string `json:"name"`
+}
+
+func (obj *datedObj) LastModified() time.Time {
+	return time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+}
+
+func (s *ETagSuite) TestMiddleware(c *C) {
+	h := ETagMiddleware(HandlerFunc(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		return &datedObj{Name: "x"}, nil
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Body.String(), Equals, `{"name":"x"}`)
+	c.Check(w.Header().Get("Last-Modified"), Equals, "Thu, 04 Mar 2021 05:06:07 GMT")
+	etag := w.Header().Get("ETag")
+	c.Check(etag, Matches, `"[0-9a-f]{32}"`)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusNotModified)
+	c.Check(w.Body.Len(), Equals, 0)
+	c.Check(w.Header().Get("ETag"), Equals, etag)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-Modified-Since", "Thu, 04 Mar 2021 05:06:07 GMT")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusNotModified)
+}
+
+func (s *ETagSuite) TestFileETag(c *C) {
+	fn := filepath.Join(c.MkDir(), "file.txt")
+	c.Assert(ioutil.WriteFile(fn, []byte("hello"), 0644), IsNil)
+	mtime := time.Now().Add(-time.Hour)
+	c.Assert(os.Chtimes(fn, mtime, mtime), IsNil)
+	etag, err := FileETag(fn)
+	c.Assert(err, IsNil)
+	// same size and mtime: served from the cache without rehashing
+	c.Assert(ioutil.WriteFile(fn, []byte("jello"), 0644), IsNil)
+	c.Assert(os.Chtimes(fn, mtime, mtime), IsNil)
+	cached, err := FileETag(fn)
+	c.Assert(err, IsNil)
+	c.Check(cached, Equals, etag)
+	c.Assert(os.Chtimes(fn, mtime, mtime.Add(time.Second)), IsNil)
+	changed, err := FileETag(fn)
+	c.Assert(err, IsNil)
+	c.Check(changed, Not(Equals), etag)
+}
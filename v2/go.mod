@@ -1,20 +1,28 @@
 module github.com/rclancey/httpserver/v2
 
-go 1.15
+go 1.16
 
 require (
+	github.com/andybalholm/brotli v1.0.5
 	github.com/danilopolani/gocialite v1.0.2
 	github.com/gofrs/uuid v3.2.0+incompatible
 	github.com/golang-jwt/jwt/v4 v4.1.0
 	github.com/gorilla/websocket v1.4.2
+	github.com/klauspost/compress v1.15.15
+	github.com/oklog/ulid/v2 v2.1.0
 	github.com/oleiade/reflections v1.0.1 // indirect
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.14.0
+	github.com/prometheus/client_model v0.3.0
 	github.com/rclancey/argparse v1.0.1
 	github.com/rclancey/authenticator v0.0.2
 	github.com/rclancey/logging v1.0.1
 	github.com/rclancey/logrotate v1.0.1
-	github.com/stretchr/testify v1.7.0 // indirect
+	go.opentelemetry.io/otel v1.11.2
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.11.2
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.11.2
+	go.opentelemetry.io/otel/sdk v1.11.2
+	go.opentelemetry.io/otel/trace v1.11.2
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
 	gopkg.in/oleiade/reflections.v1 v1.0.0 // indirect
 )
@@ -7,8 +7,13 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 )
 
@@ -16,97 +21,328 @@ const (
 	MinCompressSize = 2048
 )
 
+var DefaultCompressEncodings = []string{"br", "zstd", "gzip", "deflate"}
+
+var DefaultCompressMIMETypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+type CompressionConfig struct {
+	Disabled    bool     `json:"disabled"     arg:"disable"`
+	Encodings   []string `json:"encodings"    arg:"encodings"`
+	GzipLevel   int      `json:"gzip_level"   arg:"gzip-level"`
+	BrotliLevel int      `json:"brotli_level" arg:"brotli-level"`
+	ZstdLevel   int      `json:"zstd_level"   arg:"zstd-level"`
+	MinSize     int      `json:"min_size"     arg:"min-size"`
+	MIMETypes   []string `json:"mime_types"   arg:"mime-types"`
+}
+
 type compressor interface {
 	io.WriteCloser
 	Flush() error
+	Reset(io.Writer)
 }
 
-func CompressMiddleware(handler http.Handler) http.Handler {
+type compressEncoding struct {
+	name string
+	pool *sync.Pool
+}
+
+func (enc *compressEncoding) get(w io.Writer) compressor {
+	cw, _ := enc.pool.Get().(compressor)
+	if cw == nil {
+		return nil
+	}
+	cw.Reset(w)
+	return cw
+}
+
+func (enc *compressEncoding) put(cw compressor) {
+	cw.Reset(nil)
+	enc.pool.Put(cw)
+}
+
+func newCompressEncoding(name string, level int) *compressEncoding {
+	var newf func() interface{}
+	switch name {
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		newf = func() interface{} {
+			cw, err := gzip.NewWriterLevel(nil, level)
+			if err != nil {
+				return nil
+			}
+			return cw
+		}
+	case "deflate":
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		newf = func() interface{} {
+			cw, err := flate.NewWriter(nil, level)
+			if err != nil {
+				return nil
+			}
+			return cw
+		}
+	case "br":
+		if level == 0 {
+			// brotli's default of 6 is too slow for on-the-fly use
+			level = 4
+		}
+		newf = func() interface{} {
+			return brotli.NewWriterLevel(nil, level)
+		}
+	case "zstd":
+		zlevel := zstd.SpeedDefault
+		if level != 0 {
+			zlevel = zstd.EncoderLevelFromZstd(level)
+		}
+		newf = func() interface{} {
+			cw, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zlevel), zstd.WithEncoderConcurrency(1), zstd.WithZeroFrames(true))
+			if err != nil {
+				return nil
+			}
+			return cw
+		}
+	default:
+		return nil
+	}
+	return &compressEncoding{
+		name: name,
+		pool: &sync.Pool{New: newf},
+	}
+}
+
+// Compressor holds the negotiation settings and pooled encoders for
+// CompressResponseWriter
+type Compressor struct {
+	encodings []*compressEncoding
+	minSize int
+	mimeTypes []string
+}
+
+func NewCompressor(cfg *CompressionConfig) *Compressor {
+	if cfg == nil {
+		cfg = &CompressionConfig{}
+	}
+	c := &Compressor{
+		encodings: []*compressEncoding{},
+		minSize: cfg.MinSize,
+		mimeTypes: cfg.MIMETypes,
+	}
+	if cfg.Disabled {
+		return c
+	}
+	if c.minSize <= 0 {
+		c.minSize = MinCompressSize
+	}
+	if len(c.mimeTypes) == 0 {
+		c.mimeTypes = DefaultCompressMIMETypes
+	}
+	names := cfg.Encodings
+	if len(names) == 0 {
+		names = DefaultCompressEncodings
+	}
+	for _, name := range names {
+		var enc *compressEncoding
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip":
+			enc = newCompressEncoding("gzip", cfg.GzipLevel)
+		case "deflate":
+			enc = newCompressEncoding("deflate", cfg.GzipLevel)
+		case "br":
+			enc = newCompressEncoding("br", cfg.BrotliLevel)
+		case "zstd":
+			enc = newCompressEncoding("zstd", cfg.ZstdLevel)
+		}
+		if enc != nil {
+			c.encodings = append(c.encodings, enc)
+		}
+	}
+	return c
+}
+
+var defaultCompressor = NewCompressor(nil)
+
+// Middleware compresses responses with the best encoding that both the
+// client and the server support
+func (c *Compressor) Middleware(handler http.Handler) http.Handler {
 	f := func(w http.ResponseWriter, r *http.Request) {
-		crw := NewCompressResponseWriter(w, r)
+		crw := c.NewResponseWriter(w, r)
 		handler.ServeHTTP(crw, r)
 		crw.Close()
 	}
 	return http.HandlerFunc(f)
 }
 
+func CompressMiddleware(handler http.Handler) http.Handler {
+	return defaultCompressor.Middleware(handler)
+}
+
+// ParseAcceptEncoding returns the q-value of each coding in an
+// Accept-Encoding header.  Codings with a malformed q-value are ignored.
+func ParseAcceptEncoding(header string) map[string]float64 {
+	accept := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(strings.TrimSpace(kv[0])) == "q" {
+				v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+				if err != nil || v < 0 || v > 1 {
+					q = -1
+				} else {
+					q = v
+				}
+			}
+		}
+		if q >= 0 {
+			accept[coding] = q
+		}
+	}
+	return accept
+}
+
+// Negotiate picks the encoding for a request: the one with the highest
+// q-value in its Accept-Encoding header, with ties going to the server's
+// preference.  It returns "" if the response shouldn't be compressed.
+func (c *Compressor) Negotiate(r *http.Request) string {
+	enc := c.negotiate(r)
+	if enc == nil {
+		return ""
+	}
+	return enc.name
+}
+
+func (c *Compressor) negotiate(r *http.Request) *compressEncoding {
+	header := r.Header.Get("Accept-Encoding")
+	if header == "" || len(c.encodings) == 0 {
+		return nil
+	}
+	accept := ParseAcceptEncoding(header)
+	wildcard, hasWildcard := accept["*"]
+	type candidate struct {
+		enc *compressEncoding
+		q float64
+		pref int
+	}
+	candidates := []candidate{}
+	for i, enc := range c.encodings {
+		q, ok := accept[enc.name]
+		if !ok && enc.name == "gzip" {
+			q, ok = accept["x-gzip"]
+		}
+		if !ok && hasWildcard {
+			q, ok = wildcard, true
+		}
+		if ok && q > 0 {
+			candidates = append(candidates, candidate{enc, q, i})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].q != candidates[j].q {
+			return candidates[i].q > candidates[j].q
+		}
+		return candidates[i].pref < candidates[j].pref
+	})
+	return candidates[0].enc
+}
+
+func (c *Compressor) compressible(ct string) bool {
+	ct = strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
+	if ct == "" || ct == "text/event-stream" {
+		return false
+	}
+	for _, pattern := range c.mimeTypes {
+		if pattern == ct {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(ct, pattern[:len(pattern) - 1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, k := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(k), name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
 type CompressResponseWriter struct {
 	headerWritten bool
 	statusCode int
 	w http.ResponseWriter
 	buf []byte
-	compressor func() compressor
+	c *Compressor
+	enc *compressEncoding
 	cw compressor
 }
 
 func NewCompressResponseWriter(w http.ResponseWriter, r *http.Request) *CompressResponseWriter {
+	return defaultCompressor.NewResponseWriter(w, r)
+}
+
+func (c *Compressor) NewResponseWriter(w http.ResponseWriter, r *http.Request) *CompressResponseWriter {
 	crw := &CompressResponseWriter{
 		headerWritten: false,
 		statusCode: 0,
 		w: w,
 		buf: []byte{},
+		c: c,
 		cw: nil,
 	}
-	crw.compressor = crw.getCompressor(r)
-	return crw
-}
-
-func (w *CompressResponseWriter) getCompressor(r *http.Request) func() compressor {
-	if r.Header.Get("Range") != "" {
-		return nil
-	}
-	if strings.ToLower(strings.TrimSpace(r.Header.Get("Connection"))) == "upgrade" {
-		return nil
-	}
-	encs := strings.Split(r.Header.Get("Accept-Encoding"), ",")
-	for _, enc := range encs {
-		switch strings.ToLower(strings.TrimSpace(enc)) {
-		case "gzip":
-			return func() compressor {
-				w.Header().Del("Content-Length")
-				w.Header().Set("Content-Encoding", "gzip")
-				w.Header().Add("Vary", "Accept-Encoding")
-				return gzip.NewWriter(w.w)
-			}
-		case "deflate":
-			return func() compressor {
-				w.Header().Del("Content-Length")
-				w.Header().Set("Content-Encoding", "deflate")
-				w.Header().Add("Vary", "Accept-Encoding")
-				cw, err := flate.NewWriter(w.w, flate.DefaultCompression)
-				if err == nil {
-					return cw
-				}
-				return nil
-			}
-		}
+	if r.Header.Get("Range") == "" && strings.ToLower(strings.TrimSpace(r.Header.Get("Connection"))) != "upgrade" {
+		crw.enc = c.negotiate(r)
 	}
-	return nil
+	return crw
 }
 
 func (w *CompressResponseWriter) canCompress() bool {
-	if w.compressor == nil {
+	if w.enc == nil {
+		return false
+	}
+	if w.statusCode == http.StatusNotModified || w.statusCode == http.StatusNoContent {
 		return false
 	}
 	h := w.w.Header()
 	if h.Get("Content-Encoding") != "" {
 		return false
 	}
-	ct := strings.Split(h.Get("Content-Type"), ";")[0]
-	if strings.HasPrefix(ct, "text/") {
-		return true
-	}
-	switch ct {
-	case "application/javascript":
-		return true
-	case "application/json":
-		return true
-	case "application/manifest+json":
-		return true
-	case "image/svg+xml":
-		return true
+	return w.c.compressible(h.Get("Content-Type"))
+}
+
+func (w *CompressResponseWriter) startCompressor() {
+	w.cw = w.enc.get(w.w)
+	if w.cw == nil {
+		return
 	}
-	return false
+	h := w.w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", w.enc.name)
+	addVary(h, "Accept-Encoding")
 }
 
 func (w *CompressResponseWriter) Header() http.Header {
@@ -118,21 +354,23 @@ func (w *CompressResponseWriter) writeHeader() (int, error) {
 		if w.statusCode == 0 {
 			w.statusCode = http.StatusOK
 		}
-		if w.cw == nil && w.canCompress() {
-			w.cw = w.compressor()
+		if w.cw == nil && w.canCompress() && len(w.buf) > 0 {
+			w.startCompressor()
 		}
 		w.w.WriteHeader(w.statusCode)
 		w.headerWritten = true
 	}
 	if w.buf != nil && len(w.buf) > 0 {
-		return w.write(w.buf)
+		buf := w.buf
+		w.buf = nil
+		return w.write(buf)
 	}
 	return 0, nil
 }
 
 func (w *CompressResponseWriter) WriteHeader(statusCode int) {
 	w.statusCode = statusCode
-	if statusCode != http.StatusOK || !w.canCompress() {
+	if !w.canCompress() {
 		w.writeHeader()
 	}
 }
@@ -148,26 +386,32 @@ func (w *CompressResponseWriter) Write(data []byte) (int, error) {
 	if w.headerWritten {
 		return w.write(data)
 	}
-	if len(w.buf) + len(data) <= MinCompressSize {
+	if len(w.buf) + len(data) < w.c.minSize {
 		w.buf = append(w.buf, data...)
 		return len(data), nil
 	}
+	w.buf = append(w.buf, data...)
 	_, err := w.writeHeader()
 	if err != nil {
 		return 0, err
 	}
-	return w.write(data)
+	return len(data), nil
 }
 
 func (w *CompressResponseWriter) Close() error {
 	if !w.headerWritten {
+		// short responses aren't worth compressing
+		w.enc = nil
 		_, err := w.writeHeader()
 		if err != nil {
 			return err
 		}
 	}
 	if w.cw != nil {
-		err := w.cw.Close()
+		cw := w.cw
+		w.cw = nil
+		err := cw.Close()
+		w.enc.put(cw)
 		if err != nil {
 			return err
 		}
@@ -179,8 +423,17 @@ func (w *CompressResponseWriter) Close() error {
 	return nil
 }
 
-func (w *CompressResponseWriter) Flush() error {
+func (w *CompressResponseWriter) Flush() {
+	w.FlushError()
+}
+
+func (w *CompressResponseWriter) FlushError() error {
 	if !w.headerWritten {
+		if w.canCompress() {
+			// a flushed response is a stream, so compress it even if
+			// the first chunk is small
+			w.startCompressor()
+		}
 		_, err := w.writeHeader()
 		if err != nil {
 			return err
@@ -206,4 +459,3 @@ func (w *CompressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	}
 	return hj.Hijack()
 }
-
@@ -0,0 +1,157 @@
+package httpserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	. "gopkg.in/check.v1"
+)
+
+type CompressSuite struct {}
+
+var _ = Suite(&CompressSuite{})
+
+var compressBody = []byte(strings.Repeat(`{"name":"compressible","value":12345},`, 200))
+
+func compressHandler(body []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
+
+func (s *CompressSuite) TestNegotiate(c *C) {
+	comp := NewCompressor(nil)
+	check := func(accept, exp string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		c.Check(comp.Negotiate(req), Equals, exp, Commentf("Accept-Encoding: %s", accept))
+	}
+	check("", "")
+	check("gzip, deflate, br", "br")
+	check("gzip, zstd", "zstd")
+	check("br;q=0, gzip", "gzip")
+	check("br;q=0.5, gzip;q=0.8", "gzip")
+	check("*", "br")
+	check("*;q=0.5, br;q=0", "zstd")
+	check("identity", "")
+	check("gzip;q=0", "")
+	check("gzip;q=bogus, deflate", "deflate")
+	comp = NewCompressor(&CompressionConfig{Encodings: []string{"gzip", "br"}})
+	check("br, gzip", "gzip")
+	check("zstd", "")
+}
+
+func (s *CompressSuite) TestEncodings(c *C) {
+	for _, enc := range []string{"br", "zstd", "gzip", "deflate"} {
+		h := NewCompressor(nil).Middleware(compressHandler(compressBody))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", enc)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		c.Check(w.Header().Get("Content-Encoding"), Equals, enc)
+		c.Check(w.Header().Get("Vary"), Equals, "Accept-Encoding")
+		c.Check(w.Body.Len() < len(compressBody), Equals, true)
+		var data []byte
+		var err error
+		switch enc {
+		case "br":
+			data, err = ioutil.ReadAll(brotli.NewReader(w.Body))
+		case "zstd":
+			var zr *zstd.Decoder
+			zr, err = zstd.NewReader(w.Body)
+			c.Assert(err, IsNil)
+			data, err = ioutil.ReadAll(zr)
+			zr.Close()
+		case "gzip":
+			var gr *gzip.Reader
+			gr, err = gzip.NewReader(w.Body)
+			c.Assert(err, IsNil)
+			data, err = ioutil.ReadAll(gr)
+		case "deflate":
+			data, err = ioutil.ReadAll(flate.NewReader(w.Body))
+		}
+		c.Check(err, IsNil)
+		c.Check(bytes.Equal(data, compressBody), Equals, true, Commentf("encoding %s", enc))
+	}
+}
+
+func (s *CompressSuite) TestSkipped(c *C) {
+	serve := func(comp *Compressor, h http.Handler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		comp.Middleware(h).ServeHTTP(w, req)
+		return w
+	}
+	// too small
+	w := serve(NewCompressor(nil), compressHandler([]byte(`{"small":true}`)))
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "")
+	c.Check(w.Body.String(), Equals, `{"small":true}`)
+	// not a compressible type
+	w = serve(NewCompressor(nil), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(compressBody)
+	}))
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "")
+	// configured min size and types
+	w = serve(NewCompressor(&CompressionConfig{MinSize: 4, MIMETypes: []string{"image/*"}}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("12345"))
+	}))
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "gzip")
+}
+
+func benchmarkCompress(b *testing.B, h http.Handler, enc string) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", enc)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+	}
+}
+
+// BenchmarkCompressUnpooled measures the old approach of allocating a
+// new gzip writer for every response, for comparison with the pooled
+// benchmarks below
+func BenchmarkCompressUnpooled(b *testing.B) {
+	h := compressHandler(compressBody)
+	unpooled := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		h.ServeHTTP(&unpooledWriter{w, gw}, r)
+		gw.Close()
+	})
+	benchmarkCompress(b, unpooled, "gzip")
+}
+
+type unpooledWriter struct {
+	http.ResponseWriter
+	gw *gzip.Writer
+}
+
+func (w *unpooledWriter) Write(data []byte) (int, error) {
+	return w.gw.Write(data)
+}
+
+func BenchmarkCompressGzip(b *testing.B) {
+	benchmarkCompress(b, NewCompressor(nil).Middleware(compressHandler(compressBody)), "gzip")
+}
+
+func BenchmarkCompressBrotli(b *testing.B) {
+	benchmarkCompress(b, NewCompressor(nil).Middleware(compressHandler(compressBody)), "br")
+}
+
+func BenchmarkCompressZstd(b *testing.B) {
+	benchmarkCompress(b, NewCompressor(nil).Middleware(compressHandler(compressBody)), "zstd")
+}
@@ -2,21 +2,21 @@ package httpserver
 
 import (
 	"bytes"
-	"crypto/sha1"
-	"encoding/hex"
+	"crypto/sha256"
 	"encoding/json"
-	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/rclancey/logging"
 )
 
 type ProxyURL string
 
+// ProxyUpstream is the name of an upstream pool to proxy the request to
+type ProxyUpstream string
+
 type Redirect string
 
 type StaticFile string
@@ -44,10 +44,19 @@ func SetDefaultContentType(w http.ResponseWriter, ct string) {
 }
 
 func GenEtag(f io.Reader) string {
-	h := sha1.New()
+	h := sha256.New()
 	io.Copy(h, f)
-	sum := h.Sum([]byte{})
-	return fmt.Sprintf(`"%s"`, hex.EncodeToString(sum))
+	return strongETag(h.Sum([]byte{}))
+}
+
+func setValidators(w http.ResponseWriter, modTime time.Time, etag string) {
+	h := w.Header()
+	if etag != "" && h.Get("ETag") == "" {
+		h.Set("ETag", etag)
+	}
+	if !isZeroTime(modTime) && h.Get("Last-Modified") == "" {
+		h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
 }
 
 type HandlerFunc func(w http.ResponseWriter, req *http.Request) (interface{}, error)
@@ -62,28 +71,37 @@ func (h HandlerFunc) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		switch tobj := obj.(type) {
 		case ProxyURL:
 			Proxy(w, req, string(tobj))
+		case ProxyUpstream:
+			var up *Upstream
+			if srv := contextServer(req.Context()); srv != nil {
+				up = srv.Upstream(string(tobj))
+			}
+			if up == nil {
+				sendError(w, req, InternalServerError.Errorf("no upstream named %s", string(tobj)))
+				return
+			}
+			up.ServeHTTP(w, req)
 		case Redirect:
 			http.Redirect(w, req, string(tobj), http.StatusFound)
 		case StaticFile:
-			f, err := os.Open(string(tobj))
+			etag, err := FileETag(string(tobj))
 			if err == nil {
-				w.Header().Set("Etag", GenEtag(f))
-				f.Close()
+				w.Header().Set("ETag", etag)
 			}
 			http.ServeFile(w, req, string(tobj))
 		case io.ReadSeeker:
-			w.Header().Set("Etag", GenEtag(tobj))
-			tobj.Seek(0, io.SeekStart)
-			http.ServeContent(w, req, req.URL.Path, time.Now(), tobj)
+			etag, modTime := readSeekerETag(tobj)
+			w.Header().Set("ETag", etag)
+			http.ServeContent(w, req, req.URL.Path, modTime, tobj)
 			closer, isa := tobj.(io.Closer)
 			if isa {
 				defer closer.Close()
 			}
 		case []byte:
-			w.Header().Set("Etag", GenEtag(bytes.NewReader(tobj)))
+			w.Header().Set("ETag", GenEtag(bytes.NewReader(tobj)))
 			http.ServeContent(w, req, req.URL.Path, time.Now(), bytes.NewReader(tobj))
 		case WebSocket:
-			log.Println("handling websocket")
+			logging.FromContext(req.Context()).Debugln("handling websocket")
 			conn, err := upgrader.Upgrade(w, req, nil)
 			if err != nil {
 				tobj.Close()
@@ -92,7 +110,7 @@ func (h HandlerFunc) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			}
 			err = tobj.Open(conn)
 			if err != nil {
-				log.Println("error opening websocket service:", err)
+				logging.FromContext(req.Context()).Errorln("error opening websocket service:", err)
 				tobj.Close()
 				sendError(w, req, err)
 				return
@@ -107,26 +125,38 @@ func (h HandlerFunc) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			}
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(tobj.StatusCode())
-			w.Write(data)
-		case *ObjectStream:
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			tobj.stream(w)
-		default:
-			var modTime time.Time
-			var etag string
-			dobj, isa := obj.(Datable)
-			if isa {
-				modTime = dobj.LastModified()
-			}
-			eobj, isa := obj.(ETaggable)
-			if isa {
-				etag = eobj.ETag()
+			w.Write(withRequestID(req, data))
+		case View:
+			err := renderView(w, req, &tobj)
+			if err != nil {
+				sendError(w, req, err)
 			}
-			err := CheckPreconditions(req, modTime, etag)
+		case *View:
+			err := renderView(w, req, tobj)
 			if err != nil {
 				sendError(w, req, err)
-				return
+			}
+		case *EventStream:
+			err := tobj.serve(w, req)
+			if err != nil && err != req.Context().Err() {
+				logging.FromContext(req.Context()).Errorln("error writing event stream:", err)
+			}
+		case *ObjectStream:
+			err := tobj.serve(w, req)
+			if err != nil && err != ErrClientGone {
+				logging.FromContext(req.Context()).Errorln("error writing object stream:", err)
+			}
+		default:
+			modTime, etag := validators(obj)
+			setValidators(w, modTime, etag)
+			if !isUnsafeMethod(req.Method) {
+				// for unsafe methods obj is the updated resource, and
+				// preconditions were checked against its old state
+				err := CheckPreconditions(req, modTime, etag)
+				if err != nil {
+					sendError(w, req, err)
+					return
+				}
 			}
 			SendJSON(w, obj)
 		}
@@ -0,0 +1,421 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	HealthOK = "ok"
+	HealthDegraded = "degraded"
+	HealthFailing = "failing"
+	HealthDraining = "draining"
+)
+
+// DefaultDrainDelay is how many seconds Shutdown fails readiness before
+// closing the listeners, when HealthConfig doesn't say
+const DefaultDrainDelay = 5
+
+// HealthConfig sets up the liveness, health and readiness endpoints.
+// Times are in seconds; a negative DrainDelay shuts down without waiting.
+// CertExpiry is the number of days before the certificate expires that
+// its check starts failing.  The public endpoints only report the
+// overall status; the admin endpoints report each check.
+type HealthConfig struct {
+	Disabled   bool   `json:"disabled"    arg:"disable"`
+	LivePath   string `json:"live_path"   arg:"live-path"`
+	HealthPath string `json:"health_path" arg:"health-path"`
+	ReadyPath  string `json:"ready_path"  arg:"ready-path"`
+	CacheTTL   int    `json:"cache_ttl"   arg:"cache-ttl"`
+	Timeout    int    `json:"timeout"     arg:"timeout"`
+	DrainDelay int    `json:"drain_delay" arg:"drain-delay"`
+	CertExpiry int    `json:"cert_expiry" arg:"cert-expiry"`
+}
+
+func (cfg *HealthConfig) Init() error {
+	if cfg.LivePath == "" {
+		cfg.LivePath = "/livez"
+	}
+	if cfg.HealthPath == "" {
+		cfg.HealthPath = "/healthz"
+	}
+	if cfg.ReadyPath == "" {
+		cfg.ReadyPath = "/readyz"
+	}
+	if cfg.DrainDelay == 0 {
+		cfg.DrainDelay = DefaultDrainDelay
+	}
+	if cfg.CacheTTL < 0 || cfg.Timeout < 0 || cfg.CertExpiry < 0 {
+		return errors.New("health check times can't be negative")
+	}
+	return nil
+}
+
+// HealthCheckFunc returns an error if whatever it checks is unhealthy.
+// It should give up when ctx is done.
+type HealthCheckFunc func(ctx context.Context) error
+
+type healthCheck struct {
+	name string
+	check HealthCheckFunc
+	timeout time.Duration
+	critical bool
+}
+
+// HealthResult is the outcome of one check
+type HealthResult struct {
+	Status   string  `json:"status"`
+	Critical bool    `json:"critical"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+// HealthReport is the outcome of all the checks.  A failing critical
+// check makes the server failing; a failing non-critical one makes it
+// degraded.
+type HealthReport struct {
+	Status string                   `json:"status"`
+	Time   time.Time                `json:"time"`
+	Checks map[string]*HealthResult `json:"checks"`
+}
+
+// healthChecks runs the registered checks and caches the report for a
+// short time, so aggressive probes don't hammer the things being checked
+type healthChecks struct {
+	cfg *HealthConfig
+	metrics *Metrics
+	mutex *sync.Mutex
+	checks []*healthCheck
+	report *HealthReport
+	running chan bool
+	draining bool
+}
+
+func newHealthChecks(cfg *HealthConfig, metrics *Metrics) (*healthChecks, error) {
+	err := metrics.RegisterGauge("health_check_status", "check")
+	if err != nil {
+		return nil, err
+	}
+	err = metrics.RegisterGauge("health_ready")
+	if err != nil {
+		return nil, err
+	}
+	return &healthChecks{
+		cfg: cfg,
+		metrics: metrics,
+		mutex: &sync.Mutex{},
+		checks: []*healthCheck{},
+	}, nil
+}
+
+func (hc *healthChecks) add(name string, check HealthCheckFunc, timeout time.Duration, critical bool) {
+	if timeout <= 0 {
+		timeout = time.Duration(orDefault(hc.cfg.Timeout, 5)) * time.Second
+	}
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	for i, c := range hc.checks {
+		if c.name == name {
+			hc.checks = append(hc.checks[:i], hc.checks[i+1:]...)
+			break
+		}
+	}
+	hc.checks = append(hc.checks, &healthCheck{name, check, timeout, critical})
+	hc.report = nil
+}
+
+func (hc *healthChecks) drain() {
+	hc.mutex.Lock()
+	hc.draining = true
+	hc.mutex.Unlock()
+	hc.metrics.Measure("health_ready", nil, 0)
+}
+
+func (hc *healthChecks) isDraining() bool {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	return hc.draining
+}
+
+func runHealthCheck(ctx context.Context, c *healthCheck) *HealthResult {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	start := time.Now()
+	ch := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ch <- errors.Errorf("check panicked: %v", r)
+			}
+		}()
+		ch <- c.check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-ch:
+	case <-ctx.Done():
+		err = errors.Errorf("timed out after %s", c.timeout)
+	}
+	res := &HealthResult{Status: HealthOK, Critical: c.critical, Duration: time.Since(start).Seconds()}
+	if err != nil {
+		res.Status = HealthFailing
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Report runs the checks, or returns the cached report if it's recent
+// enough.  Concurrent callers share a single run.
+func (hc *healthChecks) Report() *HealthReport {
+	ttl := time.Duration(orDefault(hc.cfg.CacheTTL, 2)) * time.Second
+	hc.mutex.Lock()
+	for {
+		if hc.report != nil && time.Since(hc.report.Time) < ttl {
+			report := hc.report
+			hc.mutex.Unlock()
+			return report
+		}
+		if hc.running == nil {
+			break
+		}
+		running := hc.running
+		hc.mutex.Unlock()
+		<-running
+		hc.mutex.Lock()
+	}
+	running := make(chan bool)
+	hc.running = running
+	checks := make([]*healthCheck, len(hc.checks))
+	copy(checks, hc.checks)
+	hc.mutex.Unlock()
+
+	report := &HealthReport{Status: HealthOK, Time: time.Now(), Checks: map[string]*HealthResult{}}
+	results := make([]*HealthResult, len(checks))
+	wg := &sync.WaitGroup{}
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *healthCheck) {
+			// not a request context, since the result is shared
+			results[i] = runHealthCheck(context.Background(), c)
+			wg.Done()
+		}(i, c)
+	}
+	wg.Wait()
+	for i, c := range checks {
+		res := results[i]
+		report.Checks[c.name] = res
+		if res.Status == HealthOK {
+			hc.metrics.Measure("health_check_status", map[string]string{"check": c.name}, 1)
+			continue
+		}
+		hc.metrics.Measure("health_check_status", map[string]string{"check": c.name}, 0)
+		if c.critical {
+			report.Status = HealthFailing
+		} else if report.Status == HealthOK {
+			report.Status = HealthDegraded
+		}
+	}
+
+	hc.mutex.Lock()
+	hc.report = report
+	hc.running = nil
+	draining := hc.draining
+	hc.mutex.Unlock()
+	close(running)
+	if !draining {
+		if report.Status == HealthFailing {
+			hc.metrics.Measure("health_ready", nil, 0)
+		} else {
+			hc.metrics.Measure("health_ready", nil, 1)
+		}
+	}
+	return report
+}
+
+func sendHealth(w http.ResponseWriter, status int, obj interface{}) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data = []byte(`{"status":"failing"}`)
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (hc *healthChecks) liveHandler(w http.ResponseWriter, r *http.Request) {
+	sendHealth(w, http.StatusOK, map[string]string{"status": HealthOK})
+}
+
+// healthHandler reports just the overall status, since the checks'
+// errors can say a lot about the server's insides
+func (hc *healthChecks) healthHandler(w http.ResponseWriter, r *http.Request) {
+	report := hc.Report()
+	status := http.StatusOK
+	if report.Status == HealthFailing {
+		status = http.StatusServiceUnavailable
+	}
+	sendHealth(w, status, map[string]string{"status": report.Status})
+}
+
+// reportHandler reports each check, for the admin endpoints
+func (hc *healthChecks) reportHandler(w http.ResponseWriter, r *http.Request) {
+	report := hc.Report()
+	status := http.StatusOK
+	if report.Status == HealthFailing {
+		status = http.StatusServiceUnavailable
+	}
+	sendHealth(w, status, report)
+}
+
+func (hc *healthChecks) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if hc.isDraining() {
+		// don't bother running the checks; we're going away
+		sendHealth(w, http.StatusServiceUnavailable, map[string]string{"status": HealthDraining})
+		return
+	}
+	hc.healthHandler(w, r)
+}
+
+func (hc *healthChecks) AttachEndpoints(router Router) {
+	router.GET(hc.cfg.LivePath, http.HandlerFunc(hc.liveHandler))
+	router.GET(hc.cfg.HealthPath, http.HandlerFunc(hc.healthHandler))
+	router.GET(hc.cfg.ReadyPath, http.HandlerFunc(hc.readyHandler))
+}
+
+// attachReportEndpoint adds a GET /health endpoint to router, reporting
+// each check.  It should only be attached to a router that's protected.
+func (hc *healthChecks) attachReportEndpoint(router Router) {
+	router.GET("/health", http.HandlerFunc(hc.reportHandler))
+}
+
+// RegisterHealthCheck adds a named check to the health and readiness
+// reports, replacing any existing check with the same name.  A zero
+// timeout uses the configured default.  A failing critical check fails
+// readiness; a failing non-critical one only degrades the report.
+func (srv *Server) RegisterHealthCheck(name string, check HealthCheckFunc, timeout time.Duration, critical bool) {
+	if srv.health == nil {
+		return
+	}
+	srv.health.add(name, check, timeout, critical)
+}
+
+// HealthReport runs the health checks, or returns recently cached results
+func (srv *Server) HealthReport() *HealthReport {
+	if srv.health == nil {
+		return nil
+	}
+	return srv.health.Report()
+}
+
+// UpstreamHealthCheck fails when none of the pool's backends are
+// available or its circuit breaker is open
+func UpstreamHealthCheck(u *Upstream) HealthCheckFunc {
+	return func(ctx context.Context) error {
+		u.breaker.mutex.Lock()
+		state := u.breaker.state
+		u.breaker.mutex.Unlock()
+		if state == breakerOpen {
+			return errors.Errorf("upstream %s circuit breaker is open", u.Name)
+		}
+		now := time.Now()
+		for _, b := range u.backends {
+			if b.available(now) {
+				return nil
+			}
+		}
+		return errors.Errorf("upstream %s has no available backends", u.Name)
+	}
+}
+
+// WritableDirHealthCheck fails when a file can't be created in dn
+func WritableDirHealthCheck(dn string) HealthCheckFunc {
+	return func(ctx context.Context) error {
+		err := checkWritableDir(dn)
+		if err != nil {
+			return err
+		}
+		f, err := ioutil.TempFile(dn, ".healthcheck-")
+		if err != nil {
+			return errors.Wrap(err, "can't write to " + dn)
+		}
+		f.Close()
+		os.Remove(f.Name())
+		return nil
+	}
+}
+
+// CertExpiryHealthCheck fails when the certificate in certFile expires
+// within the given time
+func CertExpiryHealthCheck(certFile, keyFile string, within time.Duration) HealthCheckFunc {
+	return func(ctx context.Context) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return errors.Wrap(err, "can't load certificate " + certFile)
+		}
+		if len(cert.Certificate) == 0 {
+			return errors.New("no certificates in " + certFile)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return errors.Wrap(err, "can't parse certificate " + certFile)
+		}
+		left := time.Until(leaf.NotAfter)
+		if left <= 0 {
+			return errors.Errorf("certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+		}
+		if left < within {
+			return errors.Errorf("certificate expires at %s", leaf.NotAfter.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
+
+func (srv *Server) setupHealth() error {
+	cfg := &srv.cfg.Health
+	if cfg.Disabled {
+		return nil
+	}
+	var err error
+	srv.health, err = newHealthChecks(cfg, srv.metrics)
+	if err != nil {
+		return err
+	}
+	srv.health.AttachEndpoints(srv.router)
+	names := make([]string, 0, len(srv.upstreams))
+	for name := range srv.upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		srv.RegisterHealthCheck("upstream:" + name, UpstreamHealthCheck(srv.upstreams[name]), 0, false)
+	}
+	dirs := map[string]string{
+		"log_dir": srv.cfg.Logging.Directory,
+		"cache_dir": srv.cfg.CacheDirectory,
+		"response_cache_dir": srv.cfg.Cache.Directory,
+	}
+	for name, dn := range dirs {
+		if dn != "" {
+			srv.RegisterHealthCheck(name, WritableDirHealthCheck(dn), 0, true)
+		}
+	}
+	ssl := srv.cfg.Bind.SSL
+	if ssl.Enabled() {
+		within := time.Duration(orDefault(cfg.CertExpiry, 7)) * 24 * time.Hour
+		srv.RegisterHealthCheck("certificate", CertExpiryHealthCheck(ssl.CertFile, ssl.KeyFile, within), 0, false)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type HealthSuite struct {}
+
+var _ = Suite(&HealthSuite{})
+
+func newHealthServer(c *C) *Server {
+	srv := newTestServer(c, &ServerConfig{
+		Admin: AdminConfig{Enabled: true, Port: 9999, NoAuth: true},
+		Health: HealthConfig{DrainDelay: -1},
+	})
+	srv.Prefix("/").Compile(nil)
+	srv.adminRoot.Compile(nil)
+	return srv
+}
+
+func getHealth(c *C, h http.Handler, path string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	obj := map[string]interface{}{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &obj), IsNil)
+	return w.Code, obj
+}
+
+func (s *HealthSuite) TestReport(c *C) {
+	srv := newHealthServer(c)
+	dbDown := int32(0)
+	calls := int32(0)
+	srv.RegisterHealthCheck("db", func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&dbDown) != 0 {
+			return os.ErrClosed
+		}
+		return nil
+	}, 0, true)
+	srv.RegisterHealthCheck("search", func(ctx context.Context) error {
+		return nil
+	}, 0, false)
+	srv.RegisterHealthCheck("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, 10 * time.Millisecond, false)
+
+	code, obj := getHealth(c, srv, "/readyz")
+	c.Check(code, Equals, http.StatusOK)
+	c.Check(obj, DeepEquals, map[string]interface{}{"status": HealthDegraded})
+
+	// the details are only on the admin endpoints
+	admin := &routerHandler{router: srv.adminRoot}
+	code, obj = getHealth(c, admin, "/admin/health")
+	c.Check(code, Equals, http.StatusOK)
+	c.Check(obj["status"], Equals, HealthDegraded)
+	checks := obj["checks"].(map[string]interface{})
+	c.Check(checks["db"].(map[string]interface{})["status"], Equals, HealthOK)
+	c.Check(checks["slow"].(map[string]interface{})["error"], Matches, "timed out.*")
+	c.Check(checks["log_dir"].(map[string]interface{})["status"], Equals, HealthOK)
+
+	// cached
+	atomic.StoreInt32(&dbDown, 1)
+	code, _ = getHealth(c, srv, "/healthz")
+	c.Check(code, Equals, http.StatusOK)
+	c.Check(atomic.LoadInt32(&calls), Equals, int32(1))
+
+	srv.health.report.Time = time.Now().Add(-time.Minute)
+	code, obj = getHealth(c, srv, "/healthz")
+	c.Check(code, Equals, http.StatusServiceUnavailable)
+	c.Check(obj, DeepEquals, map[string]interface{}{"status": HealthFailing})
+	code, obj = getHealth(c, admin, "/admin/health")
+	c.Check(code, Equals, http.StatusServiceUnavailable)
+	c.Check(obj["checks"].(map[string]interface{})["db"].(map[string]interface{})["error"], Equals, os.ErrClosed.Error())
+	code, _ = getHealth(c, srv, "/livez")
+	c.Check(code, Equals, http.StatusOK)
+
+	metrics := httptest.NewRecorder()
+	srv.metrics.Handler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	c.Check(strings.Contains(metrics.Body.String(), `health_check_status{check="db"} 0`), Equals, true)
+	c.Check(strings.Contains(metrics.Body.String(), `health_check_status{check="search"} 1`), Equals, true)
+	c.Check(strings.Contains(metrics.Body.String(), "health_ready 0"), Equals, true)
+}
+
+func (s *HealthSuite) TestDrain(c *C) {
+	cfg := &HealthConfig{}
+	c.Assert(cfg.Init(), IsNil)
+	c.Check(cfg.DrainDelay, Equals, DefaultDrainDelay)
+
+	srv := newHealthServer(c)
+	code, _ := getHealth(c, srv, "/readyz")
+	c.Check(code, Equals, http.StatusOK)
+	srv.servers = make([]*http.Server, 4)
+	c.Assert(srv.Shutdown(), IsNil)
+	code, obj := getHealth(c, srv, "/readyz")
+	c.Check(code, Equals, http.StatusServiceUnavailable)
+	c.Check(obj["status"], Equals, HealthDraining)
+	code, _ = getHealth(c, srv, "/livez")
+	c.Check(code, Equals, http.StatusOK)
+}
+
+func (s *HealthSuite) TestBuiltins(c *C) {
+	ctx := context.Background()
+	dn := c.MkDir()
+	c.Check(WritableDirHealthCheck(dn)(ctx), IsNil)
+	files, _ := ioutil.ReadDir(dn)
+	c.Check(files, HasLen, 0)
+	fn := filepath.Join(dn, "file")
+	c.Assert(ioutil.WriteFile(fn, []byte{}, 0644), IsNil)
+	c.Check(WritableDirHealthCheck(fn)(ctx), NotNil)
+
+	up, err := NewUpstream(&UpstreamConfig{Name: "api", Backends: []string{"http://localhost:1"}}, nil)
+	c.Assert(err, IsNil)
+	c.Check(UpstreamHealthCheck(up)(ctx), IsNil)
+	up.Backends()[0].healthy = false
+	c.Check(UpstreamHealthCheck(up)(ctx), ErrorMatches, "upstream api has no available backends")
+
+	certFile, keyFile := writeTestCert(c, dn, 3 * 24 * time.Hour)
+	check := CertExpiryHealthCheck(certFile, keyFile, 7 * 24 * time.Hour)
+	c.Check(check(ctx), ErrorMatches, "certificate expires at .*")
+	check = CertExpiryHealthCheck(certFile, keyFile, 24 * time.Hour)
+	c.Check(check(ctx), IsNil)
+}
+
+func writeTestCert(c *C, dn string, valid time.Duration) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "localhost"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(valid),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	certFile := filepath.Join(dn, "cert.pem")
+	keyFile := filepath.Join(dn, "key.pem")
+	c.Assert(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600), IsNil)
+	return certFile, keyFile
+}
@@ -0,0 +1,437 @@
+package httpserver
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/logging"
+	"github.com/rclancey/logrotate"
+)
+
+// LogFile is a rotating log file that can be reopened, for when an
+// external tool like logrotate has moved it out of the way
+type LogFile struct {
+	mutex *sync.Mutex
+	fn string
+	maxAge time.Duration
+	maxSize int64
+	count int
+	file *logrotate.RotateFile
+}
+
+func OpenLogFile(fn string, maxAge time.Duration, maxSize int64, count int) (*LogFile, error) {
+	file, err := logrotate.Open(fn, maxAge, maxSize, count)
+	if err != nil {
+		return nil, err
+	}
+	return &LogFile{
+		mutex: &sync.Mutex{},
+		fn: fn,
+		maxAge: maxAge,
+		maxSize: maxSize,
+		count: count,
+		file: file,
+	}, nil
+}
+
+func (lf *LogFile) Name() string {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	return lf.file.Name()
+}
+
+func (lf *LogFile) Write(data []byte) (int, error) {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	return lf.file.Write(data)
+}
+
+// Reopen closes the file and opens it again by name
+func (lf *LogFile) Reopen() error {
+	file, err := logrotate.Open(lf.fn, lf.maxAge, lf.maxSize, lf.count)
+	if err != nil {
+		return errors.Wrapf(err, "can't reopen log file %s", lf.fn)
+	}
+	lf.mutex.Lock()
+	old := lf.file
+	lf.file = file
+	lf.mutex.Unlock()
+	return old.Close()
+}
+
+func (lf *LogFile) Close() error {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	return lf.file.Close()
+}
+
+// logLevels keeps a registry of error loggers, one for each package that
+// asked for its own, and sets their levels as they're changed.  Package
+// levels are for import paths; a path ending in "/..." covers everything
+// under it, and the longest match wins.
+type logLevels struct {
+	mutex *sync.Mutex
+	root *logging.Logger
+	level logging.LogLevel
+	packages map[string]logging.LogLevel
+	loggers map[string]*logging.Logger
+}
+
+func newLogLevels(root *logging.Logger) *logLevels {
+	return &logLevels{
+		mutex: &sync.Mutex{},
+		root: root,
+		level: root.Level(),
+		packages: map[string]logging.LogLevel{},
+		loggers: map[string]*logging.Logger{},
+	}
+}
+
+// levelFor finds the level for a package.  The caller must hold the
+// mutex.
+func (ll *logLevels) levelFor(pkg string) logging.LogLevel {
+	level := ll.level
+	best := -1
+	for k, v := range ll.packages {
+		match := k == pkg
+		if prefix := strings.TrimSuffix(k, "..."); prefix != k {
+			match = strings.HasPrefix(pkg, prefix)
+		}
+		if match && len(k) > best {
+			level = v
+			best = len(k)
+		}
+	}
+	return level
+}
+
+// apply pushes the levels out to the loggers.  The caller must hold the
+// mutex.
+func (ll *logLevels) apply() {
+	ll.root.SetLevel(ll.level)
+	logging.SetLevel(ll.level)
+	for pkg, l := range ll.loggers {
+		l.SetLevel(ll.levelFor(pkg))
+	}
+}
+
+func (ll *logLevels) logger(pkg string) *logging.Logger {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+	l, ok := ll.loggers[pkg]
+	if !ok {
+		l = ll.root.WithLevel(ll.levelFor(pkg))
+		ll.loggers[pkg] = l
+	}
+	return l
+}
+
+func (ll *logLevels) setLevel(pkg string, level logging.LogLevel) {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+	if pkg == "" {
+		ll.level = level
+	} else {
+		ll.packages[pkg] = level
+	}
+	ll.apply()
+}
+
+func (ll *logLevels) clearLevel(pkg string) {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+	delete(ll.packages, pkg)
+	ll.apply()
+}
+
+func (ll *logLevels) levels() (logging.LogLevel, map[string]logging.LogLevel) {
+	ll.mutex.Lock()
+	defer ll.mutex.Unlock()
+	pkgs := map[string]logging.LogLevel{}
+	for k, v := range ll.packages {
+		pkgs[k] = v
+	}
+	return ll.level, pkgs
+}
+
+// Reopen reopens the log files, for when they've been moved by an
+// external log rotator
+func (cfg *LogConfig) Reopen() error {
+	if cfg.errfile != nil {
+		err := cfg.errfile.Reopen()
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.acclog != nil {
+		err := cfg.acclog.Reopen()
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.capfile != nil {
+		err := cfg.capfile.Reopen()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PackageLogger returns the error logger for the package with import
+// path pkg.  Its level follows the one set for the package, or for a
+// prefix covering it, and otherwise the default level.
+func (cfg *LogConfig) PackageLogger(pkg string) (*logging.Logger, error) {
+	_, err := cfg.ErrorLogger()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.levels.logger(pkg), nil
+}
+
+// SetLevel changes the error log level for a package or package prefix
+// like "github.com/rclancey/...", or the default level if pkg is ""
+func (cfg *LogConfig) SetLevel(pkg string, level logging.LogLevel) error {
+	_, err := cfg.ErrorLogger()
+	if err != nil {
+		return err
+	}
+	cfg.levels.setLevel(pkg, level)
+	return nil
+}
+
+// ClearLevel makes a package use the default level again
+func (cfg *LogConfig) ClearLevel(pkg string) {
+	if cfg.levels != nil {
+		cfg.levels.clearLevel(pkg)
+	}
+}
+
+// Levels returns the default error log level and any per-package ones
+func (cfg *LogConfig) Levels() (logging.LogLevel, map[string]logging.LogLevel) {
+	if cfg.levels == nil {
+		return cfg.LogLevel, map[string]logging.LogLevel{}
+	}
+	return cfg.levels.levels()
+}
+
+// enableDebug makes l, a request's own logger, log everything
+func (cfg *LogConfig) enableDebug(l *logging.Logger) {
+	l.SetLevel(logging.DEBUG)
+}
+
+// DebugRule turns on debug logging for requests that match all of its
+// non-empty criteria, until it expires
+type DebugRule struct {
+	ID      string    `json:"id"`
+	Header  string    `json:"header,omitempty"`
+	Value   string    `json:"value,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+func (rule *DebugRule) match(r *http.Request, user string) bool {
+	if rule.Header != "" {
+		v := r.Header.Get(rule.Header)
+		if v == "" || (rule.Value != "" && v != rule.Value) {
+			return false
+		}
+	}
+	if rule.Path != "" && !strings.HasPrefix(r.URL.Path, rule.Path) {
+		return false
+	}
+	if rule.User != "" && rule.User != user {
+		return false
+	}
+	return true
+}
+
+type debugRules struct {
+	mutex *sync.Mutex
+	rules map[string]*DebugRule
+	next int
+}
+
+func newDebugRules() *debugRules {
+	return &debugRules{
+		mutex: &sync.Mutex{},
+		rules: map[string]*DebugRule{},
+	}
+}
+
+func (dr *debugRules) add(rule *DebugRule) *DebugRule {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	dr.next++
+	rule.ID = strconv.Itoa(dr.next)
+	dr.rules[rule.ID] = rule
+	return rule
+}
+
+func (dr *debugRules) remove(id string) bool {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	_, ok := dr.rules[id]
+	delete(dr.rules, id)
+	return ok
+}
+
+func (dr *debugRules) list() []*DebugRule {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	dr.expire()
+	rules := make([]*DebugRule, 0, len(dr.rules))
+	for _, rule := range dr.rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		a, _ := strconv.Atoi(rules[i].ID)
+		b, _ := strconv.Atoi(rules[j].ID)
+		return a < b
+	})
+	return rules
+}
+
+func (dr *debugRules) expire() {
+	now := time.Now()
+	for id, rule := range dr.rules {
+		if now.After(rule.Expires) {
+			delete(dr.rules, id)
+		}
+	}
+}
+
+// match says whether r should get debug logging.  user is "" until the
+// request has been authenticated, and rules for a user never match
+// before then.
+func (dr *debugRules) match(r *http.Request, user string) bool {
+	if dr == nil {
+		return false
+	}
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	if len(dr.rules) == 0 {
+		return false
+	}
+	dr.expire()
+	for _, rule := range dr.rules {
+		if rule.match(r, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultDebugDuration is how long request debug logging stays on if
+// the rule doesn't say
+const DefaultDebugDuration = 10 * time.Minute
+
+type logLevelRequest struct {
+	Package string            `json:"package"`
+	Level   *logging.LogLevel `json:"level"`
+}
+
+type debugRuleRequest struct {
+	Header   string `json:"header"`
+	Value    string `json:"value"`
+	Path     string `json:"path"`
+	User     string `json:"user"`
+	Duration int    `json:"duration"`
+}
+
+func (srv *Server) logStatus() map[string]interface{} {
+	level, pkgs := srv.cfg.Logging.Levels()
+	return map[string]interface{}{
+		"level": level,
+		"packages": pkgs,
+		"debug": srv.debugRules.list(),
+	}
+}
+
+func (srv *Server) adminLogStatus(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return srv.logStatus(), nil
+}
+
+// adminLogLevel sets a log level from a body like
+// {"package": "github.com/rclancey/...", "level": "DEBUG"}.  A null level
+// clears the package's level.
+func (srv *Server) adminLogLevel(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	lreq := &logLevelRequest{}
+	err := ReadJSON(r, lreq)
+	if err != nil {
+		return nil, err
+	}
+	log := logging.FromContext(r.Context())
+	if lreq.Level == nil {
+		if lreq.Package == "" {
+			return nil, BadRequest.New("no log level")
+		}
+		srv.cfg.Logging.ClearLevel(lreq.Package)
+		log.Warnln("cleared log level for", lreq.Package)
+	} else {
+		err = srv.cfg.Logging.SetLevel(lreq.Package, *lreq.Level)
+		if err != nil {
+			return nil, err
+		}
+		log.Warnf("log level for %q set to %s", lreq.Package, lreq.Level.String())
+	}
+	return srv.logStatus(), nil
+}
+
+func (srv *Server) adminLogReopen(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	err := srv.cfg.Logging.Reopen()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]bool{"reopened": true}, nil
+}
+
+func (srv *Server) adminDebugRules(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return srv.debugRules.list(), nil
+}
+
+func (srv *Server) adminAddDebugRule(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	dreq := &debugRuleRequest{}
+	err := ReadJSON(r, dreq)
+	if err != nil {
+		return nil, err
+	}
+	if dreq.Header == "" && dreq.Path == "" && dreq.User == "" {
+		return nil, BadRequest.New("debug rule needs a header, path or user")
+	}
+	dur := DefaultDebugDuration
+	if dreq.Duration > 0 {
+		dur = time.Duration(dreq.Duration) * time.Second
+	}
+	rule := srv.debugRules.add(&DebugRule{
+		Header: dreq.Header,
+		Value: dreq.Value,
+		Path: dreq.Path,
+		User: dreq.User,
+		Expires: time.Now().Add(dur),
+	})
+	return rule, nil
+}
+
+func (srv *Server) adminRemoveDebugRule(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	id := ContextRequestVars(r.Context())["id"]
+	if !srv.debugRules.remove(id) {
+		return nil, NotFound.Errorf("no debug rule %s", id)
+	}
+	return srv.debugRules.list(), nil
+}
+
+func (srv *Server) attachLogEndpoints(router Router) {
+	router.GET("/log", HandlerFunc(srv.adminLogStatus))
+	router.PUT("/log/level", HandlerFunc(srv.adminLogLevel))
+	router.POST("/log/reopen", HandlerFunc(srv.adminLogReopen))
+	router.GET("/log/debug", HandlerFunc(srv.adminDebugRules))
+	router.POST("/log/debug", HandlerFunc(srv.adminAddDebugRule))
+	router.DELETE("/log/debug/:id", HandlerFunc(srv.adminRemoveDebugRule))
+}
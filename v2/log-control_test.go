@@ -0,0 +1,131 @@
+package httpserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rclancey/logging"
+	. "gopkg.in/check.v1"
+)
+
+type LogControlSuite struct {}
+
+var _ = Suite(&LogControlSuite{})
+
+func readLog(c *C, fn string) string {
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *LogControlSuite) TestReopen(c *C) {
+	dn := c.MkDir()
+	fn := filepath.Join(dn, "access.log")
+	lf, err := OpenLogFile(fn, 0, 0, 0)
+	c.Assert(err, IsNil)
+	defer lf.Close()
+	lf.Write([]byte("one\n"))
+	// what logrotate does before signalling
+	c.Assert(os.Rename(fn, fn + ".1"), IsNil)
+	lf.Write([]byte("two\n"))
+	c.Assert(lf.Reopen(), IsNil)
+	lf.Write([]byte("three\n"))
+	c.Check(readLog(c, fn + ".1"), Equals, "one\ntwo\n")
+	c.Check(readLog(c, fn), Equals, "three\n")
+}
+
+func (s *LogControlSuite) TestLevels(c *C) {
+	cfg := &LogConfig{ErrorLog: filepath.Join(c.MkDir(), "error.log"), LogLevel: logging.WARNING}
+	l, err := cfg.ErrorLogger()
+	c.Assert(err, IsNil)
+	pl, err := cfg.PackageLogger("github.com/rclancey/httpserver/v2")
+	c.Assert(err, IsNil)
+	// levels don't depend on how lines are formatted
+	pl.SetTimeFormat("")
+	pl.SetPrefix(">>")
+	l.Debugln("hidden")
+	l.Warnln("shown")
+	c.Assert(cfg.SetLevel("github.com/other/...", logging.DEBUG), IsNil)
+	pl.Debugln("still hidden")
+	c.Assert(cfg.SetLevel("github.com/rclancey/httpserver/...", logging.DEBUG), IsNil)
+	c.Check(pl.Level(), Equals, logging.DEBUG)
+	pl.Debugln("now shown")
+	l.Debugln("root stays hidden")
+	cfg.ClearLevel("github.com/rclancey/httpserver/...")
+	pl.Debugln("hidden again")
+	other, err := cfg.PackageLogger("github.com/other/pkg")
+	c.Assert(err, IsNil)
+	other.Debugln("other shown")
+	out := readLog(c, cfg.ErrorLog)
+	c.Check(strings.Contains(out, "hidden"), Equals, false)
+	c.Check(out, Matches, "(?s).*WARNING.*shown\n.*DEBUG +>> .*now shown\n.*DEBUG .*other shown\n")
+	level, pkgs := cfg.Levels()
+	c.Check(level, Equals, logging.WARNING)
+	c.Check(pkgs, DeepEquals, map[string]logging.LogLevel{"github.com/other/...": logging.DEBUG})
+	c.Assert(cfg.SetLevel("", logging.INFO), IsNil)
+	c.Check(l.Level(), Equals, logging.INFO)
+	c.Check(pl.Level(), Equals, logging.INFO)
+	c.Check(other.Level(), Equals, logging.DEBUG)
+}
+
+func (s *LogControlSuite) TestAdmin(c *C) {
+	cfg := &ServerConfig{Admin: AdminConfig{Enabled: true}}
+	cfg.Logging.ErrorLog = filepath.Join(c.MkDir(), "error.log")
+	cfg.Logging.LogLevel = logging.ERROR
+	srv := newTestServer(c, cfg)
+	srv.SetAuthMiddleware(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer admin" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			SetRequestUser(r, "admin")
+			h.ServeHTTP(w, r)
+		})
+	})
+	srv.router.GET("/api/:x", HandlerFunc(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		logging.FromContext(r.Context()).Debugln("debugging", r.URL.Path)
+		return map[string]string{}, nil
+	}))
+	srv.Prefix("/").Compile(nil)
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	req := httptest.NewRequest("GET", "/admin/log", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusUnauthorized)
+	w = call("GET", "/admin/log", "")
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Body.String(), Matches, `.*"level":"ERROR".*`)
+
+	w = call("POST", "/admin/log/debug", `{"path": "/api/trace", "duration": 60}`)
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Body.String(), Matches, `.*"id":"1".*`)
+	call("GET", "/api/quiet", "")
+	call("GET", "/api/trace", "")
+	out := readLog(c, cfg.Logging.ErrorLog)
+	c.Check(strings.Contains(out, "debugging /api/trace"), Equals, true)
+	c.Check(strings.Contains(out, "debugging /api/quiet"), Equals, false)
+	c.Check(call("DELETE", "/admin/log/debug/1", "").Code, Equals, http.StatusOK)
+	c.Check(call("DELETE", "/admin/log/debug/1", "").Code, Equals, http.StatusNotFound)
+
+	w = call("PUT", "/admin/log/level", `{"level": "DEBUG"}`)
+	c.Check(w.Code, Equals, http.StatusOK)
+	call("GET", "/api/loud", "")
+	c.Check(strings.Contains(readLog(c, cfg.Logging.ErrorLog), "debugging /api/loud"), Equals, true)
+	c.Check(call("PUT", "/admin/log/level", `{"level": "LOUD"}`).Code, Equals, http.StatusBadRequest)
+	c.Check(call("POST", "/admin/log/reopen", "").Code, Equals, http.StatusOK)
+}
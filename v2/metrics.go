@@ -3,251 +3,451 @@ package httpserver
 import (
 	"bufio"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type Metrics struct {
-	mutex *sync.Mutex
-	reg *prometheus.Registry
-	collectors map[string]prometheus.Collector
-	labels map[string][]string
-}
+// DefaultResponseTimeBuckets are the histogram buckets, in seconds, for
+// response times when MetricsConfig doesn't specify any
+var DefaultResponseTimeBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
 
-type MetricsWriter struct {
-	w http.ResponseWriter
-	status int
-	bytesWritten int
-	startTime time.Time
-	firstWriteTime time.Time
-	lastWriteTime time.Time
+// MetricsConfig configures the metrics endpoint.  It's served on its own
+// Port if there is one, otherwise on the admin endpoints, and only on
+// the main listener if it's explicitly made Public.
+type MetricsConfig struct {
+	Disabled bool      `json:"disabled" arg:"disable"`
+	Path     string    `json:"path"     arg:"path"`
+	Port     int       `json:"port"     arg:"port"`
+	Public   bool      `json:"public"   arg:"public"`
+	Auth     bool      `json:"auth"     arg:"auth"`
+	Buckets  []float64 `json:"buckets"  arg:"buckets"`
 }
 
-func NewMetricsWriter(w http.ResponseWriter) *MetricsWriter {
-	return &MetricsWriter{
-		w: w,
-		startTime: time.Now(),
+func (cfg *MetricsConfig) Init() error {
+	if cfg.Path == "" {
+		cfg.Path = "/metrics"
 	}
-}
-
-func (mw *MetricsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	hw, ok := mw.w.(http.Hijacker)
-	if ok {
-		return hw.Hijack()
+	if len(cfg.Buckets) == 0 {
+		cfg.Buckets = DefaultResponseTimeBuckets
 	}
-	return nil, nil, fmt.Errorf("underlying ResponseWriter %T doesn't support hijacking", mw.w)
+	if !sort.Float64sAreSorted(cfg.Buckets) {
+		return fmt.Errorf("metrics buckets must be in increasing order")
+	}
+	return nil
 }
 
-func (mw *MetricsWriter) Header() http.Header {
-	return mw.w.Header()
+// metric is a registered collector along with its label schema, which
+// is fixed the first time the metric is used
+type metric struct {
+	collector prometheus.Collector
+	labels []string
 }
 
-func (mw *MetricsWriter) Write(data []byte) (int, error) {
-	if mw.firstWriteTime.IsZero() {
-		mw.firstWriteTime = time.Now()
+func (mt *metric) values(labels map[string]string) []string {
+	vals := make([]string, len(mt.labels))
+	for i, k := range mt.labels {
+		vals[i] = labels[k]
 	}
-	n, err := mw.w.Write(data)
-	mw.lastWriteTime = time.Now()
-	mw.bytesWritten += n
-	return n, err
+	return vals
 }
 
-func (mw *MetricsWriter) WriteHeader(status int) {
-	mw.status = status
-	mw.w.WriteHeader(status)
+type Metrics struct {
+	mutex *sync.Mutex
+	reg *prometheus.Registry
+	metrics *sync.Map
+	buckets []float64
 }
 
-func (mw *MetricsWriter) Measure(route string) {
-	m := metricsSingleton
-	labels := map[string]string{
-		"route": route,
-		"status": strconv.Itoa(mw.status),
-	}
-	m.Count("http_request_count", labels)
-	m.Summarize("http_response_size", labels, float64(mw.bytesWritten))
-	if !mw.lastWriteTime.IsZero() {
-		m.Summarize("http_response_first_write", labels, mw.firstWriteTime.Sub(mw.startTime).Seconds())
-		m.Summarize("http_response_time", labels, mw.lastWriteTime.Sub(mw.startTime).Seconds())
+// NewMetrics creates an empty registry with the standard Go runtime and
+// process collectors, and an uptime gauge
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		mutex: &sync.Mutex{},
+		reg: prometheus.NewRegistry(),
+		metrics: &sync.Map{},
+		buckets: DefaultResponseTimeBuckets,
 	}
+	m.reg.MustRegister(collectors.NewGoCollector())
+	m.reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	start := time.Now()
+	m.reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "uptime"}, func() float64 {
+		return time.Since(start).Seconds()
+	}))
+	return m
 }
 
-var metricsSingleton = &Metrics{
-	mutex: &sync.Mutex{},
-	reg: prometheus.NewRegistry(),
-	collectors: map[string]prometheus.Collector{},
-	labels: map[string][]string{},
+var metricsSingleton = NewMetrics()
+
+// DefaultMetrics returns the registry used by the package level
+// Measure, Summarize, Increment and Count functions
+func DefaultMetrics() *Metrics {
+	return metricsSingleton
 }
 
-func init() {
-	start := time.Now()
-	go func() {
-		ticker := time.NewTicker(time.Second)
-		for {
-			<-ticker.C
-			Measure("uptime", nil, time.Since(start).Seconds())
-		}
-	}()
-	metricsSingleton.reg.Register(collectors.NewGoCollector())
-	metricsSingleton.reg.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+// SetBuckets sets the histogram buckets for response time metrics that
+// haven't been registered yet
+func (m *Metrics) SetBuckets(buckets []float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.buckets = buckets
+}
+
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.reg
 }
 
 func (m *Metrics) Handler() http.Handler {
-	return promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{Registry: m.reg}).(http.HandlerFunc)
+	return promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{Registry: m.reg})
 }
 
 func (m *Metrics) AttachEndpoint(router Router) {
 	router.GET("/metrics", m.Handler())
 }
 
-func Measure(name string, labels map[string]string, value float64) {
-	m := metricsSingleton
-	m.Measure(name, labels, value)
+func labelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-func (m *Metrics) Measure(name string, labels map[string]string, value float64) {
+// register returns the named metric, creating it with the label keys
+// given on first use.  Only registration takes the lock; once a metric
+// exists, observations go straight to the prometheus collector.  A
+// collector that's already in the registry, say one registered directly
+// through Registry(), is reused.  If registration fails, the metric is
+// remembered without a collector, so later observations are dropped
+// instead of going to a collector that's never exported.
+func (m *Metrics) register(name string, labels map[string]string, create func(keys []string) prometheus.Collector) (*metric, error) {
+	if v, ok := m.metrics.Load(name); ok {
+		return v.(*metric), nil
+	}
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	collector, ok := m.collectors[name]
-	if !ok {
-		var labelKeys []string
-		if labels == nil || len(labels) == 0 {
-			collector = prometheus.NewGauge(prometheus.GaugeOpts{Name: name})
+	if v, ok := m.metrics.Load(name); ok {
+		return v.(*metric), nil
+	}
+	keys := labelKeys(labels)
+	mt := &metric{
+		collector: create(keys),
+		labels: keys,
+	}
+	err := m.reg.Register(mt.collector)
+	if err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			mt.collector = are.ExistingCollector
 		} else {
-			for k := range labels {
-				labelKeys = append(labelKeys, k)
-			}
-			collector = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name}, labelKeys)
+			mt.collector = nil
+			m.metrics.Store(name, mt)
+			return mt, errors.Wrap(err, "can't register metric " + name)
 		}
-		m.collectors[name] = collector
-		m.labels[name] = labelKeys
-		m.reg.Register(collector)
-	}
-	labelKeys := m.labels[name]
-	if labelKeys == nil {
-		gauge, ok := collector.(prometheus.Gauge)
-		if !ok {
-			return
+	}
+	m.metrics.Store(name, mt)
+	return mt, nil
+}
+
+// observe returns the named metric for an observation, logging the
+// error the first time it can't be registered
+func (m *Metrics) observe(name string, labels map[string]string, create func(keys []string) prometheus.Collector) *metric {
+	mt, err := m.register(name, labels, create)
+	if err != nil {
+		log.Println(err)
+	}
+	return mt
+}
+
+// RegisterCounter, RegisterGauge, RegisterSummary and RegisterHistogram
+// declare a metric's label schema up front.  Labels passed to later
+// observations that aren't in the schema are ignored, and missing ones
+// are recorded as empty.  They fail if the registry already has a
+// different metric by that name.
+func (m *Metrics) RegisterCounter(name string, labels ...string) error {
+	_, err := m.register(name, schema(labels), func(keys []string) prometheus.Collector {
+		if len(keys) == 0 {
+			return prometheus.NewCounter(prometheus.CounterOpts{Name: name})
 		}
-		gauge.Set(value)
-	} else {
-		gauge, ok := collector.(*prometheus.GaugeVec)
-		if !ok {
-			return
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name}, keys)
+	})
+	return err
+}
+
+func (m *Metrics) RegisterGauge(name string, labels ...string) error {
+	_, err := m.register(name, schema(labels), func(keys []string) prometheus.Collector {
+		if len(keys) == 0 {
+			return prometheus.NewGauge(prometheus.GaugeOpts{Name: name})
 		}
-		labelVals := make([]string, len(labelKeys))
-		for i, k := range labelKeys {
-			labelVals[i] = labels[k]
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name}, keys)
+	})
+	return err
+}
+
+func (m *Metrics) RegisterSummary(name string, labels ...string) error {
+	_, err := m.register(name, schema(labels), m.newSummary(name))
+	return err
+}
+
+func (m *Metrics) RegisterHistogram(name string, buckets []float64, labels ...string) error {
+	_, err := m.register(name, schema(labels), func(keys []string) prometheus.Collector {
+		opts := prometheus.HistogramOpts{Name: name, Buckets: buckets}
+		if len(keys) == 0 {
+			return prometheus.NewHistogram(opts)
 		}
-		gauge.WithLabelValues(labelVals...).Set(value)
-	}
+		return prometheus.NewHistogramVec(opts, keys)
+	})
+	return err
 }
 
-func Summarize(name string, labels map[string]string, value float64) {
-	m := metricsSingleton
-	m.Summarize(name, labels, value)
+func schema(labels []string) map[string]string {
+	m := make(map[string]string, len(labels))
+	for _, k := range labels {
+		m[k] = ""
+	}
+	return m
 }
 
-func (m *Metrics) Summarize(name string, labels map[string]string, value float64) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	collector, ok := m.collectors[name]
-	if !ok {
-		var labelKeys []string
-		if labels == nil || len(labels) == 0 {
-			collector = prometheus.NewSummary(prometheus.SummaryOpts{
-				Name: name,
-				MaxAge: 10 * time.Minute,
-				Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
-			})
-		} else {
-			for k := range labels {
-				labelKeys = append(labelKeys, k)
-			}
-			collector = prometheus.NewSummaryVec(prometheus.SummaryOpts{
-				Name: name,
-				MaxAge: 10 * time.Minute,
-				Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
-			}, labelKeys)
+func (m *Metrics) newSummary(name string) func([]string) prometheus.Collector {
+	return func(keys []string) prometheus.Collector {
+		opts := prometheus.SummaryOpts{
+			Name: name,
+			MaxAge: 10 * time.Minute,
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
 		}
-		m.collectors[name] = collector
-		m.labels[name] = labelKeys
-		m.reg.Register(collector)
-	}
-	labelKeys := m.labels[name]
-	if labelKeys == nil {
-		summary, ok := collector.(prometheus.Summary)
-		if !ok {
-			return
+		if len(keys) == 0 {
+			return prometheus.NewSummary(opts)
 		}
-		summary.Observe(value)
-	} else {
-		summary, ok := collector.(*prometheus.SummaryVec)
-		if !ok {
-			return
+		return prometheus.NewSummaryVec(opts, keys)
+	}
+}
+
+func Measure(name string, labels map[string]string, value float64) {
+	metricsSingleton.Measure(name, labels, value)
+}
+
+func (m *Metrics) gauge(name string, labels map[string]string) prometheus.Gauge {
+	mt := m.observe(name, labels, func(keys []string) prometheus.Collector {
+		if len(keys) == 0 {
+			return prometheus.NewGauge(prometheus.GaugeOpts{Name: name})
 		}
-		labelVals := make([]string, len(labelKeys))
-		for i, k := range labelKeys {
-			labelVals[i] = labels[k]
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name}, keys)
+	})
+	switch c := mt.collector.(type) {
+	case prometheus.Gauge:
+		return c
+	case *prometheus.GaugeVec:
+		return c.WithLabelValues(mt.values(labels)...)
+	}
+	return nil
+}
+
+// Measure sets a gauge
+func (m *Metrics) Measure(name string, labels map[string]string, value float64) {
+	g := m.gauge(name, labels)
+	if g != nil {
+		g.Set(value)
+	}
+}
+
+// Add adds to a gauge, which may go down as well as up
+func (m *Metrics) Add(name string, labels map[string]string, value float64) {
+	g := m.gauge(name, labels)
+	if g != nil {
+		g.Add(value)
+	}
+}
+
+func Summarize(name string, labels map[string]string, value float64) {
+	metricsSingleton.Summarize(name, labels, value)
+}
+
+func (m *Metrics) Summarize(name string, labels map[string]string, value float64) {
+	mt := m.observe(name, labels, m.newSummary(name))
+	switch c := mt.collector.(type) {
+	case prometheus.Summary:
+		c.Observe(value)
+	case *prometheus.SummaryVec:
+		c.WithLabelValues(mt.values(labels)...).Observe(value)
+	}
+}
+
+// Observe records a value in a histogram.  Histograms that haven't been
+// registered with RegisterHistogram use the registry's response time
+// buckets.
+func (m *Metrics) Observe(name string, labels map[string]string, value float64) {
+	mt := m.observe(name, labels, func(keys []string) prometheus.Collector {
+		opts := prometheus.HistogramOpts{Name: name, Buckets: m.buckets}
+		if len(keys) == 0 {
+			return prometheus.NewHistogram(opts)
 		}
-		summary.WithLabelValues(labelVals...).Observe(value)
+		return prometheus.NewHistogramVec(opts, keys)
+	})
+	switch c := mt.collector.(type) {
+	case prometheus.Histogram:
+		c.Observe(value)
+	case *prometheus.HistogramVec:
+		c.WithLabelValues(mt.values(labels)...).Observe(value)
 	}
 }
 
 func Increment(name string, labels map[string]string, value float64) {
-	m := metricsSingleton
-	m.Increment(name, labels, value)
+	metricsSingleton.Increment(name, labels, value)
 }
 
 func (m *Metrics) Increment(name string, labels map[string]string, value float64) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	collector, ok := m.collectors[name]
-	if !ok {
-		var labelKeys []string
-		if labels == nil || len(labels) == 0 {
-			collector = prometheus.NewCounter(prometheus.CounterOpts{Name: name})
-		} else {
-			for k := range labels {
-				labelKeys = append(labelKeys, k)
-			}
-			collector = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name}, labelKeys)
-		}
-		m.collectors[name] = collector
-		m.labels[name] = labelKeys
-		m.reg.Register(collector)
-	}
-	labelKeys := m.labels[name]
-	if labelKeys == nil {
-		counter, ok := collector.(prometheus.Counter)
-		if !ok {
-			return
-		}
-		counter.Add(value)
-	} else {
-		counter, ok := collector.(*prometheus.CounterVec)
-		if !ok {
-			return
+	mt := m.observe(name, labels, func(keys []string) prometheus.Collector {
+		if len(keys) == 0 {
+			return prometheus.NewCounter(prometheus.CounterOpts{Name: name})
 		}
-		labelVals := make([]string, len(labelKeys))
-		for i, k := range labelKeys {
-			labelVals[i] = labels[k]
-		}
-		counter.WithLabelValues(labelVals...).Add(value)
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name}, keys)
+	})
+	switch c := mt.collector.(type) {
+	case prometheus.Counter:
+		c.Add(value)
+	case *prometheus.CounterVec:
+		c.WithLabelValues(mt.values(labels)...).Add(value)
 	}
 }
 
 func Count(name string, labels map[string]string) {
-	m := metricsSingleton
-	m.Count(name, labels)
+	metricsSingleton.Count(name, labels)
 }
 
 func (m *Metrics) Count(name string, labels map[string]string) {
 	m.Increment(name, labels, 1.0)
 }
+
+// registerHTTP declares the request metrics recorded by MetricsWriter
+func (m *Metrics) registerHTTP() error {
+	errs := []error{
+		m.RegisterCounter("http_request_count", "method", "route", "status"),
+		m.RegisterGauge("http_requests_in_flight", "method"),
+		m.RegisterSummary("http_response_size", "method", "route", "status"),
+		m.RegisterHistogram("http_response_first_write", m.buckets, "method", "route", "status"),
+		m.RegisterHistogram("http_response_time", m.buckets, "method", "route", "status"),
+		m.RegisterCounter("http_upgraded_bytes", "direction", "route"),
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type MetricsWriter struct {
+	w http.ResponseWriter
+	m *Metrics
+	method string
+	status int
+	bytesWritten int
+	startTime time.Time
+	firstWriteTime time.Time
+	lastWriteTime time.Time
+	hijacked *countingConn
+}
+
+// NewMetricsWriter creates a MetricsWriter that reports to the default
+// registry
+func NewMetricsWriter(w http.ResponseWriter) *MetricsWriter {
+	return metricsSingleton.NewWriter(w, nil)
+}
+
+// NewWriter wraps w to record metrics about the response to r, counting
+// it as in flight until Measure is called
+func (m *Metrics) NewWriter(w http.ResponseWriter, r *http.Request) *MetricsWriter {
+	mw := &MetricsWriter{
+		w: w,
+		m: m,
+		startTime: time.Now(),
+	}
+	if r != nil {
+		mw.method = r.Method
+		m.Add("http_requests_in_flight", map[string]string{"method": mw.method}, 1)
+	}
+	return mw
+}
+
+func (mw *MetricsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hw, ok := mw.w.(http.Hijacker)
+	if ok {
+		conn, rw, err := hw.Hijack()
+		if err != nil {
+			return nil, nil, err
+		}
+		if mw.status == 0 {
+			mw.status = http.StatusSwitchingProtocols
+		}
+		mw.hijacked = newCountingConn(conn)
+		// count the same bytes the access log does
+		atomic.AddInt64(&mw.hijacked.read, int64(rw.Reader.Buffered()))
+		rw = bufio.NewReadWriter(rw.Reader, bufio.NewWriter(mw.hijacked))
+		return mw.hijacked, rw, nil
+	}
+	return nil, nil, fmt.Errorf("underlying ResponseWriter %T doesn't support hijacking", mw.w)
+}
+
+func (mw *MetricsWriter) Flush() {
+	f, ok := mw.w.(http.Flusher)
+	if ok {
+		f.Flush()
+	}
+}
+
+func (mw *MetricsWriter) Header() http.Header {
+	return mw.w.Header()
+}
+
+func (mw *MetricsWriter) Write(data []byte) (int, error) {
+	if mw.firstWriteTime.IsZero() {
+		mw.firstWriteTime = time.Now()
+	}
+	if mw.status == 0 {
+		mw.status = http.StatusOK
+	}
+	n, err := mw.w.Write(data)
+	mw.lastWriteTime = time.Now()
+	mw.bytesWritten += n
+	return n, err
+}
+
+func (mw *MetricsWriter) WriteHeader(status int) {
+	mw.status = status
+	mw.w.WriteHeader(status)
+}
+
+func (mw *MetricsWriter) Measure(route string) {
+	m := mw.m
+	if mw.method != "" {
+		m.Add("http_requests_in_flight", map[string]string{"method": mw.method}, -1)
+	}
+	labels := map[string]string{
+		"method": mw.method,
+		"route": route,
+		"status": strconv.Itoa(mw.status),
+	}
+	m.Count("http_request_count", labels)
+	m.Summarize("http_response_size", labels, float64(mw.bytesWritten))
+	if mw.hijacked != nil {
+		rx, tx := mw.hijacked.Counts()
+		m.Increment("http_upgraded_bytes", map[string]string{"route": route, "direction": "in"}, float64(rx))
+		m.Increment("http_upgraded_bytes", map[string]string{"route": route, "direction": "out"}, float64(tx))
+	}
+	if !mw.lastWriteTime.IsZero() {
+		m.Observe("http_response_first_write", labels, mw.firstWriteTime.Sub(mw.startTime).Seconds())
+		m.Observe("http_response_time", labels, mw.lastWriteTime.Sub(mw.startTime).Seconds())
+	} else {
+		m.Observe("http_response_time", labels, time.Since(mw.startTime).Seconds())
+	}
+}
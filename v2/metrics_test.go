@@ -0,0 +1,133 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	. "gopkg.in/check.v1"
+)
+
+type MetricsSuite struct {}
+
+var _ = Suite(&MetricsSuite{})
+
+func gather(c *C, m *Metrics, name string) *dto.MetricFamily {
+	families, err := m.Registry().Gather()
+	c.Assert(err, IsNil)
+	for _, f := range families {
+		if f.GetName() == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func metricLabels(mt *dto.Metric) string {
+	parts := []string{}
+	for _, lp := range mt.GetLabel() {
+		parts = append(parts, lp.GetName() + "=" + lp.GetValue())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *MetricsSuite) TestLabels(c *C) {
+	a, b := NewMetrics(), NewMetrics()
+	for i := 0; i < 50; i++ {
+		// label order in a map literal mustn't matter
+		a.Count("jobs", map[string]string{"queue": "mail", "result": "ok", "worker": "w1"})
+		a.Count("jobs", map[string]string{"worker": "w1", "result": "ok", "queue": "mail"})
+	}
+	f := gather(c, a, "jobs")
+	c.Assert(f, NotNil)
+	c.Assert(f.GetMetric(), HasLen, 1)
+	c.Check(metricLabels(f.GetMetric()[0]), Equals, "queue=mail,result=ok,worker=w1")
+	c.Check(f.GetMetric()[0].GetCounter().GetValue(), Equals, 100.0)
+	c.Check(gather(c, b, "jobs"), IsNil)
+
+	// the schema is fixed when the metric is registered
+	a.RegisterGauge("depth", "queue")
+	a.Measure("depth", map[string]string{"queue": "mail", "extra": "x"}, 3)
+	f = gather(c, a, "depth")
+	c.Assert(f, NotNil)
+	c.Check(metricLabels(f.GetMetric()[0]), Equals, "queue=mail")
+	c.Check(f.GetMetric()[0].GetGauge().GetValue(), Equals, 3.0)
+}
+
+func (s *MetricsSuite) TestServer(c *C) {
+	srv := newTestServer(c, &ServerConfig{Metrics: MetricsConfig{Buckets: []float64{0.1, 1}}})
+	inFlight := -1.0
+	srv.router.POST("/api/jobs/:id", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := gather(c, srv.metrics, "http_requests_in_flight")
+		inFlight = f.GetMetric()[0].GetGauge().GetValue()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	srv.Prefix("/").Compile(nil)
+	for i := 0; i < 3; i++ {
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/jobs/" + string(rune('a' + i)), nil))
+	}
+	c.Check(inFlight, Equals, 1.0)
+	f := gather(c, srv.metrics, "http_request_count")
+	c.Assert(f, NotNil)
+	c.Assert(f.GetMetric(), HasLen, 1)
+	c.Check(metricLabels(f.GetMetric()[0]), Equals, "method=POST,route=/api/jobs/:id,status=201")
+	c.Check(f.GetMetric()[0].GetCounter().GetValue(), Equals, 3.0)
+	f = gather(c, srv.metrics, "http_response_time")
+	c.Assert(f, NotNil)
+	h := f.GetMetric()[0].GetHistogram()
+	c.Check(h.GetSampleCount(), Equals, uint64(3))
+	c.Assert(h.GetBucket(), HasLen, 2)
+	c.Check(h.GetBucket()[1].GetUpperBound(), Equals, 1.0)
+	f = gather(c, srv.metrics, "http_requests_in_flight")
+	c.Check(f.GetMetric()[0].GetGauge().GetValue(), Equals, 0.0)
+
+	// nothing leaks into the default registry
+	f = gather(c, DefaultMetrics(), "http_request_count")
+	if f != nil {
+		for _, mt := range f.GetMetric() {
+			c.Check(metricLabels(mt), Not(Matches), ".*route=/api/jobs/:id.*")
+		}
+	}
+}
+
+func (s *MetricsSuite) TestRegister(c *C) {
+	m := NewMetrics()
+	c.Check(m.RegisterCounter("jobs", "queue"), IsNil)
+	c.Check(m.RegisterCounter("jobs", "queue"), IsNil)
+	c.Check(m.RegisterGauge("go_goroutines", "extra"), ErrorMatches, "can't register metric go_goroutines.*")
+	// observations on a metric that couldn't be registered are dropped
+	m.Measure("go_goroutines", map[string]string{"extra": "x"}, 1)
+
+	// a collector registered directly is reused
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "direct"})
+	c.Assert(m.Registry().Register(counter), IsNil)
+	m.Count("direct", nil)
+	f := gather(c, m, "direct")
+	c.Assert(f, NotNil)
+	c.Check(f.GetMetric()[0].GetCounter().GetValue(), Equals, 1.0)
+}
+
+func (s *MetricsSuite) TestEndpoint(c *C) {
+	get := func(h http.Handler, path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	// not public unless asked
+	srv := newTestServer(c, &ServerConfig{})
+	srv.Prefix("/").Compile(nil)
+	c.Check(get(srv, "/metrics"), Equals, http.StatusNotFound)
+
+	srv = newTestServer(c, &ServerConfig{Admin: AdminConfig{Enabled: true, Port: 9999, NoAuth: true}})
+	srv.Prefix("/").Compile(nil)
+	srv.adminRoot.Compile(nil)
+	c.Check(get(srv, "/metrics"), Equals, http.StatusNotFound)
+	c.Check(get(&routerHandler{router: srv.adminRoot}, "/admin/metrics"), Equals, http.StatusOK)
+
+	srv = newTestServer(c, &ServerConfig{Metrics: MetricsConfig{Public: true}})
+	srv.Prefix("/").Compile(nil)
+	c.Check(get(srv, "/metrics"), Equals, http.StatusOK)
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 )
@@ -237,3 +238,36 @@ func interfaceIps(iface *net.Interface) ([]net.IP, error) {
 	return ips, nil
 }
 
+
+// countingConn tallies the traffic over a hijacked connection, so that
+// upgraded requests still show up in access logs and metrics
+type countingConn struct {
+	net.Conn
+	read int64
+	written int64
+}
+
+func newCountingConn(conn net.Conn) *countingConn {
+	return &countingConn{Conn: conn}
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// Counts returns the number of bytes read from and written to the
+// connection so far
+func (c *countingConn) Counts() (int64, int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&c.read), atomic.LoadInt64(&c.written)
+}
@@ -0,0 +1,381 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	MergePatchContentType = "application/merge-patch+json"
+	JSONPatchContentType = "application/json-patch+json"
+)
+
+// ReadPatch reads a PATCH request body and applies it to target, which
+// should be a pointer to the current state of the resource, as it would
+// be passed to ReadJSON.  The patch format is chosen by the request's
+// Content-Type: application/merge-patch+json (RFC 7396) or
+// application/json-patch+json (RFC 6902).
+func ReadPatch(req *http.Request, target interface{}) error {
+	ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if ct != MergePatchContentType && ct != JSONPatchContentType {
+		return UnsupportedMediaType.Wrapf(errors.Errorf("unsupported patch content type %q", ct), "Patch content type must be %s or %s", MergePatchContentType, JSONPatchContentType)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return BadRequest.Wrap(err, "Failed to read request payload")
+	}
+	if ct == MergePatchContentType {
+		return ApplyMergePatch(target, body)
+	}
+	return ApplyJSONPatch(target, body)
+}
+
+// ApplyMergePatch applies an RFC 7396 JSON Merge Patch to target, which
+// must be a pointer.  Fields set to null in the patch are reset to their
+// zero values.
+func ApplyMergePatch(target interface{}, patch []byte) error {
+	var p interface{}
+	err := json.Unmarshal(patch, &p)
+	if err != nil {
+		return BadRequest.Wrap(err, "Malformed JSON merge patch")
+	}
+	return patchTarget(target, func(doc interface{}) (interface{}, error) {
+		return mergePatch(doc, p), nil
+	})
+}
+
+// ApplyJSONPatch applies an RFC 6902 JSON Patch to target, which must be
+// a pointer.  The patch is applied atomically: if any operation fails,
+// target is left unchanged.
+func ApplyJSONPatch(target interface{}, patch []byte) error {
+	ops := []*patchOp{}
+	err := json.Unmarshal(patch, &ops)
+	if err != nil {
+		return BadRequest.Wrap(err, "Malformed JSON patch")
+	}
+	return patchTarget(target, func(doc interface{}) (interface{}, error) {
+		var err error
+		for i, op := range ops {
+			doc, err = op.apply(doc)
+			if err != nil {
+				msg := fmt.Sprintf("JSON patch operation %d (%s %s) failed: %s", i, op.Op, op.Path, err.Error())
+				herr, isa := err.(HTTPError)
+				if isa {
+					return nil, herr.Wrap(err, msg)
+				}
+				return nil, Conflict.Wrap(err, msg)
+			}
+		}
+		return doc, nil
+	})
+}
+
+// patchTarget round-trips target through JSON so that patches can be
+// applied to the generic decoded form, then decodes the result into a
+// fresh value of the target's type.
+func patchTarget(target interface{}, f func(interface{}) (interface{}, error)) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return InternalServerError.Errorf("patch target must be a non-nil pointer, not %T", target)
+	}
+	data, err := json.Marshal(target)
+	if err != nil {
+		return InternalServerError.Wrap(err, "Error serializing patch target")
+	}
+	var doc interface{}
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return InternalServerError.Wrap(err, "Error serializing patch target")
+	}
+	doc, err = f(doc)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return InternalServerError.Wrap(err, "Error serializing patched document")
+	}
+	fresh := reflect.New(rv.Elem().Type())
+	err = json.Unmarshal(data, fresh.Interface())
+	if err != nil {
+		return BadRequest.Wrap(err, "Patched document is invalid")
+	}
+	rv.Elem().Set(fresh.Elem())
+	return nil
+}
+
+func mergePatch(doc, patch interface{}) interface{} {
+	pobj, isa := patch.(map[string]interface{})
+	if !isa {
+		return patch
+	}
+	dobj, isa := doc.(map[string]interface{})
+	if !isa {
+		dobj = map[string]interface{}{}
+	}
+	for k, v := range pobj {
+		if v == nil {
+			delete(dobj, k)
+		} else {
+			dobj[k] = mergePatch(dobj[k], v)
+		}
+	}
+	return dobj
+}
+
+type patchOp struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+func (op *patchOp) value() (interface{}, error) {
+	if op.Value == nil {
+		return nil, BadRequest.Errorf("%s operation requires a value", op.Op)
+	}
+	var v interface{}
+	err := json.Unmarshal(*op.Value, &v)
+	if err != nil {
+		return nil, BadRequest.Wrap(err, "Malformed JSON patch value")
+	}
+	return v, nil
+}
+
+func (op *patchOp) apply(doc interface{}) (interface{}, error) {
+	switch op.Op {
+	case "add":
+		v, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, op.Path, v)
+	case "remove":
+		doc, _, err := pointerRemove(doc, op.Path)
+		return doc, err
+	case "replace":
+		v, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		doc, _, err = pointerRemove(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, op.Path, v)
+	case "move":
+		if op.Path != op.From && strings.HasPrefix(op.Path, op.From + "/") {
+			return nil, errors.New("can't move a value into one of its children")
+		}
+		doc, v, err := pointerRemove(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, op.Path, v)
+	case "copy":
+		v, err := pointerGet(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, op.Path, deepCopy(v))
+	case "test":
+		v, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		cur, err := pointerGet(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(cur, v) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	}
+	return nil, BadRequest.Errorf("unknown JSON patch operation %q", op.Op)
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(tv))
+		for k, x := range tv {
+			c[k] = deepCopy(x)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(tv))
+		for i, x := range tv {
+			c[i] = deepCopy(x)
+		}
+		return c
+	}
+	return v
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its unescaped tokens
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, BadRequest.Errorf("invalid JSON pointer %q", ptr)
+	}
+	parts := strings.Split(ptr[1:], "/")
+	for i, part := range parts {
+		parts[i] = strings.Replace(strings.Replace(part, "~1", "/", -1), "~0", "~", -1)
+	}
+	return parts, nil
+}
+
+func arrayIndex(arr []interface{}, token string, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return len(arr), nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, errors.Errorf("invalid array index %q", token)
+	}
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 {
+		return 0, errors.Errorf("invalid array index %q", token)
+	}
+	max := len(arr) - 1
+	if allowEnd {
+		max = len(arr)
+	}
+	if idx > max {
+		return 0, errors.Errorf("array index %d out of range", idx)
+	}
+	return idx, nil
+}
+
+func pointerGet(doc interface{}, ptr string) (interface{}, error) {
+	tokens, err := parsePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	cur := doc
+	for _, token := range tokens {
+		switch tcur := cur.(type) {
+		case map[string]interface{}:
+			v, ok := tcur[token]
+			if !ok {
+				return nil, errors.Errorf("path %s does not exist", ptr)
+			}
+			cur = v
+		case []interface{}:
+			idx, err := arrayIndex(tcur, token, false)
+			if err != nil {
+				return nil, err
+			}
+			cur = tcur[idx]
+		default:
+			return nil, errors.Errorf("path %s does not exist", ptr)
+		}
+	}
+	return cur, nil
+}
+
+// pointerUpdate replaces the parent of the location ptr refers to with
+// the result of f, rebuilding the containers above it as needed
+func pointerUpdate(doc interface{}, tokens []string, f func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return f(doc, tokens[0])
+	}
+	token := tokens[0]
+	switch tdoc := doc.(type) {
+	case map[string]interface{}:
+		child, ok := tdoc[token]
+		if !ok {
+			return nil, errors.Errorf("path element %q does not exist", token)
+		}
+		child, err := pointerUpdate(child, tokens[1:], f)
+		if err != nil {
+			return nil, err
+		}
+		tdoc[token] = child
+		return tdoc, nil
+	case []interface{}:
+		idx, err := arrayIndex(tdoc, token, false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := pointerUpdate(tdoc[idx], tokens[1:], f)
+		if err != nil {
+			return nil, err
+		}
+		tdoc[idx] = child
+		return tdoc, nil
+	}
+	return nil, errors.Errorf("path element %q does not exist", token)
+}
+
+func pointerAdd(doc interface{}, ptr string, value interface{}) (interface{}, error) {
+	tokens, err := parsePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch tparent := parent.(type) {
+		case map[string]interface{}:
+			tparent[token] = value
+			return tparent, nil
+		case []interface{}:
+			idx, err := arrayIndex(tparent, token, true)
+			if err != nil {
+				return nil, err
+			}
+			tparent = append(tparent, nil)
+			copy(tparent[idx + 1:], tparent[idx:])
+			tparent[idx] = value
+			return tparent, nil
+		}
+		return nil, errors.Errorf("can't add to a non-container at %s", ptr)
+	})
+}
+
+func pointerRemove(doc interface{}, ptr string) (interface{}, interface{}, error) {
+	tokens, err := parsePointer(ptr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+	var removed interface{}
+	doc, err = pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch tparent := parent.(type) {
+		case map[string]interface{}:
+			v, ok := tparent[token]
+			if !ok {
+				return nil, errors.Errorf("path %s does not exist", ptr)
+			}
+			removed = v
+			delete(tparent, token)
+			return tparent, nil
+		case []interface{}:
+			idx, err := arrayIndex(tparent, token, false)
+			if err != nil {
+				return nil, err
+			}
+			removed = tparent[idx]
+			return append(tparent[:idx], tparent[idx + 1:]...), nil
+		}
+		return nil, errors.Errorf("path %s does not exist", ptr)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, removed, nil
+}
@@ -0,0 +1,116 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type PatchSuite struct {}
+
+var _ = Suite(&PatchSuite{})
+
+type patchDoc struct {
+	Name  string            `json:"name"`
+	Tags  []string          `json:"tags"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+	Count int               `json:"count"`
+}
+
+func (s *PatchSuite) TestMergePatch(c *C) {
+	doc := &patchDoc{Name: "a", Tags: []string{"x"}, Attrs: map[string]string{"k": "v", "j": "w"}, Count: 3}
+	err := ApplyMergePatch(doc, []byte(`{"name":"b","attrs":{"k":null,"l":"z"},"count":null}`))
+	c.Assert(err, IsNil)
+	c.Check(doc, DeepEquals, &patchDoc{Name: "b", Tags: []string{"x"}, Attrs: map[string]string{"j": "w", "l": "z"}})
+}
+
+func (s *PatchSuite) TestJSONPatch(c *C) {
+	doc := &patchDoc{Name: "a", Tags: []string{"x", "y"}, Count: 3}
+	patch := `[
+		{"op": "test", "path": "/name", "value": "a"},
+		{"op": "add", "path": "/tags/1", "value": "new"},
+		{"op": "add", "path": "/tags/-", "value": "end"},
+		{"op": "remove", "path": "/tags/0"},
+		{"op": "replace", "path": "/count", "value": 4},
+		{"op": "copy", "from": "/name", "path": "/attrs"},
+		{"op": "replace", "path": "/attrs", "value": {"a~b/c": "d"}},
+		{"op": "move", "from": "/attrs/a~0b~1c", "path": "/name"}
+	]`
+	err := ApplyJSONPatch(doc, []byte(patch))
+	c.Assert(err, IsNil)
+	c.Check(doc, DeepEquals, &patchDoc{Name: "d", Tags: []string{"new", "y", "end"}, Attrs: map[string]string{}, Count: 4})
+
+	// failed operations leave the target untouched
+	err = ApplyJSONPatch(doc, []byte(`[{"op": "replace", "path": "/name", "value": "e"}, {"op": "test", "path": "/count", "value": 5}]`))
+	c.Assert(err, NotNil)
+	c.Check(err.(HTTPError).StatusCode(), Equals, http.StatusConflict)
+	c.Check(doc.Name, Equals, "d")
+	err = ApplyJSONPatch(doc, []byte(`[{"op": "frobnicate", "path": "/name"}]`))
+	c.Assert(err, NotNil)
+	c.Check(err.(HTTPError).StatusCode(), Equals, http.StatusBadRequest)
+}
+
+func (s *PatchSuite) TestReadPatch(c *C) {
+	doc := &patchDoc{Name: "a"}
+	req := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(`{"count":2}`))
+	req.Header.Set("Content-Type", "application/json")
+	err := ReadPatch(req, doc)
+	c.Assert(err, NotNil)
+	c.Check(err.(HTTPError).StatusCode(), Equals, http.StatusUnsupportedMediaType)
+	req = httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(`{"count":2}`))
+	req.Header.Set("Content-Type", MergePatchContentType)
+	c.Assert(ReadPatch(req, doc), IsNil)
+	c.Check(doc.Count, Equals, 2)
+}
+
+type versioned struct {
+	Version int `json:"version"`
+}
+
+func (v *versioned) ETag() string {
+	return `"v` + strings.Repeat("i", v.Version) + `"`
+}
+
+func (s *PatchSuite) TestMutate(c *C) {
+	current := &versioned{Version: 1}
+	h := RequirePreconditions(HandlerFunc(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		return Mutate(r, func() (interface{}, error) {
+			return current, nil
+		}, func(obj interface{}) (interface{}, error) {
+			current = &versioned{Version: obj.(*versioned).Version + 1}
+			return current, nil
+		})
+	}))
+	req := httptest.NewRequest(http.MethodPut, "/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusPreconditionRequired)
+
+	req = httptest.NewRequest(http.MethodPut, "/", nil)
+	req.Header.Set("If-Match", `"vii"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusPreconditionFailed)
+
+	req = httptest.NewRequest(http.MethodPut, "/", nil)
+	req.Header.Set("If-Match", `"vi"`)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Header().Get("ETag"), Equals, `"vii"`)
+	c.Check(w.Body.String(), Equals, `{"version":2}`)
+}
+
+func (s *PatchSuite) TestCheckMutationMissing(c *C) {
+	var missing *versioned
+	req := httptest.NewRequest(http.MethodPut, "/", nil)
+	c.Check(CheckMutation(req, missing), IsNil)
+	req.Header.Set("If-None-Match", "*")
+	c.Check(CheckMutation(req, missing), IsNil)
+	req.Header.Set("If-Match", `"vi"`)
+	c.Check(CheckMutation(req, missing), Equals, PreconditionFailed)
+	req.Header.Del("If-None-Match")
+	c.Check(CheckMutation(req, &versioned{Version: 1}), IsNil)
+}
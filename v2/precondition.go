@@ -0,0 +1,99 @@
+package httpserver
+
+import (
+	"net/http"
+	"reflect"
+	"time"
+)
+
+func isUnsafeMethod(method string) bool {
+	switch method {
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func validators(obj interface{}) (time.Time, string) {
+	var modTime time.Time
+	var etag string
+	dobj, isa := obj.(Datable)
+	if isa {
+		modTime = dobj.LastModified()
+	}
+	eobj, isa := obj.(ETaggable)
+	if isa {
+		etag = eobj.ETag()
+	}
+	return modTime, etag
+}
+
+// isNil reports whether obj is nil, including a nil pointer, map or slice
+// stored in an interface, as a loader that returns a typed nil would give
+func isNil(obj interface{}) bool {
+	if obj == nil {
+		return true
+	}
+	v := reflect.ValueOf(obj)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// CheckMutation checks the If-Match and If-Unmodified-Since headers of an
+// unsafe request against the current state of the resource, which should
+// implement ETaggable and/or Datable.  A nil current means the resource
+// doesn't exist, which only satisfies If-None-Match: *.
+func CheckMutation(r *http.Request, current interface{}) error {
+	if isNil(current) {
+		if r.Header.Get("If-Match") != "" {
+			return PreconditionFailed
+		}
+		return nil
+	}
+	modTime, etag := validators(current)
+	ch := CheckIfMatch(r, etag)
+	if ch == nil {
+		ch = CheckIfUnmodifiedSince(r, modTime)
+	}
+	if ch != nil && *ch == false {
+		return PreconditionFailed
+	}
+	ch = CheckIfNoneMatch(r, etag)
+	if ch != nil && *ch == false {
+		return PreconditionFailed
+	}
+	return nil
+}
+
+// Mutate implements the optimistic concurrency workflow for PUT, PATCH
+// and DELETE handlers: it loads the current resource, checks the
+// request's preconditions against it, and then applies the change.  The
+// updated resource is returned so that HandlerFunc sends its new ETag.
+func Mutate(r *http.Request, load func() (interface{}, error), apply func(current interface{}) (interface{}, error)) (interface{}, error) {
+	current, err := load()
+	if err != nil {
+		return nil, err
+	}
+	err = CheckMutation(r, current)
+	if err != nil {
+		return nil, err
+	}
+	return apply(current)
+}
+
+// RequirePreconditions wraps a route's handler so that PUT, PATCH and
+// DELETE requests without an If-Match or If-Unmodified-Since header are
+// rejected with 428 Precondition Required, as described in RFC 6585.
+func RequirePreconditions(handler http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if isUnsafeMethod(r.Method) && r.Header.Get("If-Match") == "" && r.Header.Get("If-Unmodified-Since") == "" {
+			sendError(w, r, PreconditionRequired)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(f)
+}
@@ -0,0 +1,270 @@
+package httpserver
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var proxyRouteMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+type HeaderRules struct {
+	Set    map[string]string `json:"set"`
+	Remove []string          `json:"remove"`
+}
+
+func (hr *HeaderRules) apply(h http.Header) {
+	for _, k := range hr.Remove {
+		h.Del(k)
+	}
+	for k, v := range hr.Set {
+		h.Set(k, v)
+	}
+}
+
+type RewriteRule struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+	re      *regexp.Regexp
+}
+
+// ProxyRouteConfig declares a route that is proxied to an upstream pool
+// or URL.  The path is rewritten in order: the prefix is stripped, then
+// AddPrefix is prepended, then each rewrite rule is applied.
+type ProxyRouteConfig struct {
+	Prefix          string        `json:"prefix"`
+	Host            string        `json:"host"`
+	Methods         []string      `json:"methods"`
+	Upstream        string        `json:"upstream"`
+	URL             string        `json:"url"`
+	StripPrefix     bool          `json:"strip_prefix"`
+	AddPrefix       string        `json:"add_prefix"`
+	Rewrite         []RewriteRule `json:"rewrite"`
+	RequestHeaders  HeaderRules   `json:"request_headers"`
+	ResponseHeaders HeaderRules   `json:"response_headers"`
+	Auth            bool          `json:"auth"`
+	PreserveHost    bool          `json:"preserve_host"`
+	Timeout         int           `json:"timeout"`
+	target          *url.URL
+}
+
+func (cfg *ProxyRouteConfig) Init() error {
+	if cfg.Prefix == "" {
+		cfg.Prefix = "/"
+	}
+	if !strings.HasPrefix(cfg.Prefix, "/") {
+		cfg.Prefix = "/" + cfg.Prefix
+	}
+	if (cfg.Upstream == "") == (cfg.URL == "") {
+		return errors.Errorf("proxy route %s needs exactly one of upstream or url", cfg.Prefix)
+	}
+	if cfg.URL != "" {
+		u, err := url.Parse(cfg.URL)
+		if err != nil {
+			return errors.Wrapf(err, "proxy route %s has invalid url", cfg.Prefix)
+		}
+		if u.Host == "" {
+			return errors.Errorf("proxy route %s url %s has no host", cfg.Prefix, cfg.URL)
+		}
+		cfg.target = u
+	}
+	for i, method := range cfg.Methods {
+		cfg.Methods[i] = strings.ToUpper(method)
+	}
+	cfg.Host = strings.ToLower(cfg.Host)
+	for i := range cfg.Rewrite {
+		re, err := regexp.Compile(cfg.Rewrite[i].Match)
+		if err != nil {
+			return errors.Wrapf(err, "proxy route %s has invalid rewrite", cfg.Prefix)
+		}
+		cfg.Rewrite[i].re = re
+	}
+	return nil
+}
+
+func (cfg *ProxyRouteConfig) matchHost(r *http.Request) bool {
+	if cfg.Host == "" {
+		return true
+	}
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.HasPrefix(cfg.Host, "*.") {
+		return strings.HasSuffix(host, cfg.Host[1:])
+	}
+	return host == cfg.Host
+}
+
+func (cfg *ProxyRouteConfig) rewritePath(p string) string {
+	if cfg.StripPrefix {
+		prefix := strings.TrimSuffix(cfg.Prefix, "/")
+		p = strings.TrimPrefix(p, prefix)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+	}
+	if cfg.AddPrefix != "" {
+		trailing := strings.HasSuffix(p, "/")
+		p = path.Join("/", cfg.AddPrefix, p)
+		if trailing && !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+	}
+	for _, rule := range cfg.Rewrite {
+		p = rule.re.ReplaceAllString(p, rule.Replace)
+	}
+	return p
+}
+
+// proxyRoute is the handler for one configured proxy route
+type proxyRoute struct {
+	cfg *ProxyRouteConfig
+	srv *Server
+	handler http.Handler
+	serve http.Handler
+}
+
+func (srv *Server) newProxyRoute(cfg *ProxyRouteConfig) (*proxyRoute, error) {
+	pr := &proxyRoute{
+		cfg: cfg,
+		srv: srv,
+	}
+	if cfg.Upstream != "" {
+		up := srv.Upstream(cfg.Upstream)
+		if up == nil {
+			return nil, errors.Errorf("proxy route %s refers to unknown upstream %s", cfg.Prefix, cfg.Upstream)
+		}
+		pr.handler = up
+	} else {
+		p := srv.NewReverseProxy(cfg.target)
+		p.PreserveHost = cfg.PreserveHost
+		p.Timeout = time.Duration(cfg.Timeout) * time.Second
+		pr.handler = p
+	}
+	pr.serve = http.HandlerFunc(pr.proxy)
+	if cfg.Auth {
+		// never proxy a protected route without checking auth
+		pr.serve = srv.requireAuth(pr.serve, "proxy route " + cfg.Prefix)
+	}
+	return pr, nil
+}
+
+func (pr *proxyRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pr.serve.ServeHTTP(w, r)
+}
+
+func (pr *proxyRoute) proxy(w http.ResponseWriter, r *http.Request) {
+	xr := r.Clone(r.Context())
+	xr.URL.Path = pr.cfg.rewritePath(r.URL.Path)
+	xr.URL.RawPath = ""
+	pr.cfg.RequestHeaders.apply(xr.Header)
+	if len(pr.cfg.ResponseHeaders.Set) > 0 || len(pr.cfg.ResponseHeaders.Remove) > 0 {
+		w = &headerRuleWriter{ResponseWriter: w, rules: &pr.cfg.ResponseHeaders}
+	}
+	pr.handler.ServeHTTP(w, xr)
+}
+
+// proxyHostRouter picks among the proxy routes registered for the same
+// prefix and method by their Host, taking the first match in the order
+// they were configured
+type proxyHostRouter struct {
+	routes []*proxyRoute
+}
+
+func (phr *proxyHostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, route := range phr.routes {
+		if route.cfg.matchHost(r) {
+			route.ServeHTTP(w, r)
+			return
+		}
+	}
+	sendError(w, r, NotFound.Errorf("no proxy route for host %s", r.Host))
+}
+
+type headerRuleWriter struct {
+	http.ResponseWriter
+	rules *HeaderRules
+	applied bool
+}
+
+func (w *headerRuleWriter) applyRules() {
+	if !w.applied {
+		w.applied = true
+		w.rules.apply(w.ResponseWriter.Header())
+	}
+}
+
+func (w *headerRuleWriter) WriteHeader(status int) {
+	w.applyRules()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerRuleWriter) Write(data []byte) (int, error) {
+	w.applyRules()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *headerRuleWriter) Flush() {
+	w.applyRules()
+	f, ok := w.ResponseWriter.(http.Flusher)
+	if ok {
+		f.Flush()
+	}
+}
+
+func (w *headerRuleWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.Errorf("underlying ResponseWriter %T doesn't support hijacking", w.ResponseWriter)
+	}
+	return hj.Hijack()
+}
+
+// addProxyRoutes registers the configured proxy routes with the router
+func (srv *Server) addProxyRoutes() error {
+	type routeKey struct {
+		prefix string
+		method string
+	}
+	hostRouters := map[routeKey]*proxyHostRouter{}
+	for _, cfg := range srv.cfg.ProxyRoutes {
+		route, err := srv.newProxyRoute(cfg)
+		if err != nil {
+			return err
+		}
+		methods := cfg.Methods
+		if len(methods) == 0 {
+			methods = proxyRouteMethods
+		}
+		for _, method := range methods {
+			key := routeKey{path.Clean(cfg.Prefix), method}
+			phr, ok := hostRouters[key]
+			if !ok {
+				phr = &proxyHostRouter{routes: []*proxyRoute{}}
+				hostRouters[key] = phr
+				err = srv.router.Handle(method, cfg.Prefix, phr)
+				if err != nil {
+					return errors.Wrapf(err, "can't add proxy route %s %s", method, cfg.Prefix)
+				}
+			}
+			phr.routes = append(phr.routes, route)
+		}
+	}
+	return nil
+}
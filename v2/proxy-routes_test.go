@@ -0,0 +1,87 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProxyRoutesSuite struct {}
+
+var _ = Suite(&ProxyRoutesSuite{})
+
+func (s *ProxyRoutesSuite) TestRoutes(c *C) {
+	echo := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", name)
+			w.Header().Set("X-Powered-By", "php")
+			w.Write([]byte(name + " " + r.Method + " " + r.URL.Path + " " + r.Header.Get("X-Team") + "|" + r.Header.Get("Cookie")))
+		}))
+	}
+	users, orders, admin := echo("users"), echo("orders"), echo("admin")
+	defer users.Close()
+	defer orders.Close()
+	defer admin.Close()
+	cfg := &ServerConfig{
+		Upstreams: []*UpstreamConfig{
+			&UpstreamConfig{Name: "orders", Backends: []string{orders.URL}},
+		},
+		ProxyRoutes: []*ProxyRouteConfig{
+			&ProxyRouteConfig{
+				Prefix: "/api/users/",
+				URL: users.URL,
+				StripPrefix: true,
+				AddPrefix: "/v2",
+				Rewrite: []RewriteRule{{Match: `^/v2/(\d+)$`, Replace: "/v2/user/$1"}},
+				RequestHeaders: HeaderRules{Set: map[string]string{"X-Team": "web"}, Remove: []string{"Cookie"}},
+				ResponseHeaders: HeaderRules{Remove: []string{"X-Powered-By"}},
+			},
+			&ProxyRouteConfig{Prefix: "/api/orders", Host: "shop.example.com", Upstream: "orders", Methods: []string{"get"}},
+			&ProxyRouteConfig{Prefix: "/api/orders", URL: admin.URL, Methods: []string{"GET", "POST"}},
+			&ProxyRouteConfig{Prefix: "/admin", URL: admin.URL, Auth: true},
+		},
+	}
+	srv := newTestServer(c, cfg)
+	srv.Prefix("/").Compile(nil)
+	get := func(method, host, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://" + host + path, nil)
+		req.Header.Set("Cookie", "session=secret")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("GET", "www.example.com", "/api/users/42")
+	c.Check(w.Body.String(), Equals, "users GET /v2/user/42 web|")
+	c.Check(w.Header().Get("X-Backend"), Equals, "users")
+	c.Check(w.Header().Get("X-Powered-By"), Equals, "")
+	w = get("DELETE", "www.example.com", "/api/users/42/roles")
+	c.Check(w.Body.String(), Equals, "users DELETE /v2/42/roles web|")
+
+	c.Check(get("GET", "shop.example.com:8080", "/api/orders/7").Body.String(), Equals, "orders GET /api/orders/7 |session=secret")
+	c.Check(get("GET", "www.example.com", "/api/orders/7").Body.String(), Equals, "admin GET /api/orders/7 |session=secret")
+	c.Check(get("POST", "www.example.com", "/api/orders").Body.String(), Equals, "admin POST /api/orders |session=secret")
+	c.Check(get("POST", "shop.example.com", "/api/orders").Body.String(), Equals, "admin POST /api/orders |session=secret")
+	c.Check(get("DELETE", "www.example.com", "/api/orders/7").Code, Equals, http.StatusNotFound)
+
+	// protected routes fail closed until there's auth middleware
+	c.Check(get("GET", "www.example.com", "/admin").Code, Equals, http.StatusServiceUnavailable)
+	srv.SetAuthMiddleware(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	req := httptest.NewRequest("GET", "/admin/x", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusUnauthorized)
+	req.Header.Set("Authorization", "Bearer x")
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	c.Check(w.Body.String(), Equals, "admin GET /admin/x |")
+}
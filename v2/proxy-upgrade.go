@@ -0,0 +1,266 @@
+package httpserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultUpgradeIdleTimeout = 5 * time.Minute
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isUpgradeRequest(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && r.Header.Get("Upgrade") != ""
+}
+
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, k := range strings.Split(v, ",") {
+			k = strings.TrimSpace(k)
+			if k != "" {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+func (p *ReverseProxy) dialUpstream(ctx context.Context, u *url.URL) (net.Conn, error) {
+	t, _ := p.Transport.(*http.Transport)
+	addr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" || u.Scheme == "wss" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	var conn net.Conn
+	var err error
+	if t != nil && t.DialContext != nil {
+		conn, err = t.DialContext(ctx, "tcp", addr)
+	} else {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "wss" {
+		return conn, nil
+	}
+	cfg := &tls.Config{}
+	if t != nil && t.TLSClientConfig != nil {
+		cfg = t.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	// an upgrade can't happen over HTTP/2
+	cfg.NextProtos = []string{"http/1.1"}
+	tconn := tls.Client(conn, cfg)
+	if deadline, ok := ctx.Deadline(); ok {
+		tconn.SetDeadline(deadline)
+	}
+	err = tconn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// serveUpgrade proxies a request that asks to switch protocols, such as a
+// WebSocket handshake.  If the upstream server agrees, the client's
+// connection is hijacked and bytes are copied in both directions until
+// either side closes or the connection sits idle for IdleTimeout.
+func (p *ReverseProxy) serveUpgrade(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	preq := r.Clone(ctx)
+	preq.RequestURI = ""
+	proto := r.Header.Get("Upgrade")
+	removeHopHeaders(preq.Header)
+	preq.Header.Set("Connection", "Upgrade")
+	preq.Header.Set("Upgrade", proto)
+	p.direct(preq)
+	ip := parseAddr(r.RemoteAddr)
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 && p.trusts(r) {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	preq.Header.Set("X-Forwarded-For", ip)
+	dialCtx := ctx
+	if p.Timeout > 0 {
+		// Timeout only covers the handshake; the connection itself is
+		// bounded by IdleTimeout
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	uconn, err := p.dialUpstream(dialCtx, preq.URL)
+	if err != nil {
+		p.handleError(w, preq.WithContext(dialCtx), err)
+		return
+	}
+	defer uconn.Close()
+	if deadline, ok := dialCtx.Deadline(); ok {
+		uconn.SetDeadline(deadline)
+	}
+	err = preq.Write(uconn)
+	if err != nil {
+		p.handleError(w, preq.WithContext(dialCtx), err)
+		return
+	}
+	ubuf := bufio.NewReader(uconn)
+	res, err := http.ReadResponse(ubuf, preq)
+	if err != nil {
+		p.handleError(w, preq.WithContext(dialCtx), err)
+		return
+	}
+	defer res.Body.Close()
+	uconn.SetDeadline(time.Time{})
+	err = p.modifyResponse(res)
+	if err != nil {
+		p.handleError(w, preq.WithContext(dialCtx), err)
+		return
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		// upstream declined; pass its answer along like any other
+		// response
+		removeHopHeaders(res.Header)
+		h := w.Header()
+		for k, vs := range res.Header {
+			h[k] = vs
+		}
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+		return
+	}
+	if !strings.EqualFold(res.Header.Get("Upgrade"), proto) {
+		p.handleError(w, preq, errors.Errorf("upstream switched to %q instead of %q", res.Header.Get("Upgrade"), proto))
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		sendError(w, r, InternalServerError.Wrap(errors.Errorf("%T doesn't support hijacking", w), "Can't upgrade connection"))
+		return
+	}
+	cconn, cbuf, err := hj.Hijack()
+	if err != nil {
+		sendError(w, r, InternalServerError.Wrap(err, "Can't upgrade connection"))
+		return
+	}
+	defer cconn.Close()
+	res.Body = nil
+	err = res.Write(cconn)
+	if err != nil {
+		return
+	}
+	// either side may have sent data right behind its headers
+	if cbuf != nil && cbuf.Reader.Buffered() > 0 {
+		data, _ := cbuf.Reader.Peek(cbuf.Reader.Buffered())
+		if _, err := uconn.Write(data); err != nil {
+			return
+		}
+	}
+	if ubuf.Buffered() > 0 {
+		data, _ := ubuf.Peek(ubuf.Buffered())
+		if _, err := cconn.Write(data); err != nil {
+			return
+		}
+	}
+	idle := p.IdleTimeout
+	if idle == 0 {
+		idle = DefaultUpgradeIdleTimeout
+	}
+	pipeConns(cconn, uconn, idle)
+}
+
+// pipeConns copies data between a and b until either one closes.  The
+// connections are closed once they've been idle in both directions for
+// longer than idle; a negative idle never times out.
+func pipeConns(a, b net.Conn, idle time.Duration) {
+	last := time.Now().UnixNano()
+	touch := func() {
+		atomic.StoreInt64(&last, time.Now().UnixNano())
+	}
+	active := func() bool {
+		return time.Since(time.Unix(0, atomic.LoadInt64(&last))) < idle
+	}
+	copyConn := func(dst, src net.Conn) {
+		buf := make([]byte, 32 * 1024)
+		for {
+			if idle > 0 {
+				src.SetReadDeadline(time.Now().Add(idle))
+			}
+			n, err := src.Read(buf)
+			if n > 0 {
+				touch()
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				nerr, isa := err.(net.Error)
+				if isa && nerr.Timeout() && active() {
+					// the other direction is still busy
+					continue
+				}
+				return
+			}
+		}
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	once := &sync.Once{}
+	closeBoth := func() {
+		once.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+	go func() {
+		copyConn(a, b)
+		closeBoth()
+		wg.Done()
+	}()
+	go func() {
+		copyConn(b, a)
+		closeBoth()
+		wg.Done()
+	}()
+	wg.Wait()
+}
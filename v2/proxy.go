@@ -1,12 +1,19 @@
 package httpserver
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/logging"
 )
 
 var fwdRe = regexp.MustCompile(`([^\s,;=]+)=([^\s,;=]+|"[^"]*")([;,]|$)`)
@@ -19,14 +26,14 @@ func parseForwarded(h string) [][]string {
 	idx := 0
 	ms := fwdRe.FindAllStringSubmatch(strings.TrimSpace(h), -1)
 	for _, m := range ms {
-		fwd[idx] = append(fwd[idx], fmt.Sprintf("%s=%s", m[0], m[1]))
-		if m[2] == "," {
+		fwd[idx] = append(fwd[idx], fmt.Sprintf("%s=%s", m[1], m[2]))
+		if m[3] == "," {
 			fwd = append(fwd, []string{})
 			idx += 1
 		}
 	}
 	if len(fwd[idx]) == 0 {
-		fwd = fwd[:idx - 1]
+		fwd = fwd[:idx]
 	}
 	return fwd
 }
@@ -40,55 +47,400 @@ func formatForwarded(fwd [][]string) string {
 }
 
 func parseAddr(addr string) string {
-	parts := strings.Split(addr, ":")
-	parts = parts[:len(parts) - 1]
-	return strings.Join(parts, ":")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
 }
 
-func Proxy(w http.ResponseWriter, req *http.Request, proxyUrl string) {
-	client := &http.Client{ Timeout: 30 * time.Second }
-	defer client.CloseIdleConnections()
-	preq, err := http.NewRequest(req.Method, proxyUrl, req.Body)
-	if err != nil {
-		sendError(w, req, BadRequest.Wrap(err, "Invalid downstream server"))
+// ProxyTransportConfig configures the server's reverse proxies.
+// TrustedProxies lists the addresses or CIDR networks of proxies in front
+// of this server whose Forwarded and X-Forwarded-* headers are passed on.
+type ProxyTransportConfig struct {
+	DialTimeout           int      `json:"dial_timeout"            arg:"dial-timeout"`
+	TLSHandshakeTimeout   int      `json:"tls_handshake_timeout"   arg:"tls-handshake-timeout"`
+	ResponseHeaderTimeout int      `json:"response_header_timeout" arg:"response-header-timeout"`
+	IdleConnTimeout       int      `json:"idle_conn_timeout"       arg:"idle-conn-timeout"`
+	MaxIdleConns          int      `json:"max_idle_conns"          arg:"max-idle-conns"`
+	MaxIdleConnsPerHost   int      `json:"max_idle_conns_per_host" arg:"max-idle-conns-per-host"`
+	UpgradeIdleTimeout    int      `json:"upgrade_idle_timeout"    arg:"upgrade-idle-timeout"`
+	InsecureSkipVerify    bool     `json:"insecure_skip_verify"    arg:"insecure"`
+	TrustedProxies        []string `json:"trusted_proxies"         arg:"trusted-proxies"`
+	trusted               []*net.IPNet
+}
+
+func (cfg *ProxyTransportConfig) Init() error {
+	cfg.trusted = make([]*net.IPNet, len(cfg.TrustedProxies))
+	for i, addr := range cfg.TrustedProxies {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return errors.Errorf("bad trusted proxy address %s", addr)
+			}
+			cfg.trusted[i] = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip) * 8, len(ip) * 8)}
+			continue
+		}
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return errors.Wrap(err, "bad trusted proxy network " + addr)
+		}
+		cfg.trusted[i] = n
+	}
+	return nil
+}
+
+func seconds(n int, def time.Duration) time.Duration {
+	if n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return def
+}
+
+// NewProxyTransport creates a transport meant to be shared by every
+// proxied request to keep connections to upstream servers alive.  Timeouts
+// are in seconds; there's deliberately no overall timeout, since proxied
+// responses may be long downloads or event streams.
+func NewProxyTransport(cfg *ProxyTransportConfig) *http.Transport {
+	if cfg == nil {
+		cfg = &ProxyTransportConfig{}
+	}
+	dialer := &net.Dialer{
+		Timeout: seconds(cfg.DialTimeout, 10 * time.Second),
+		KeepAlive: 30 * time.Second,
+	}
+	maxIdle := cfg.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = 100
+	}
+	maxIdlePerHost := cfg.MaxIdleConnsPerHost
+	if maxIdlePerHost <= 0 {
+		maxIdlePerHost = 32
+	}
+	t := &http.Transport{
+		Proxy: nil,
+		DialContext: dialer.DialContext,
+		ForceAttemptHTTP2: true,
+		MaxIdleConns: maxIdle,
+		MaxIdleConnsPerHost: maxIdlePerHost,
+		IdleConnTimeout: seconds(cfg.IdleConnTimeout, 90 * time.Second),
+		TLSHandshakeTimeout: seconds(cfg.TLSHandshakeTimeout, 10 * time.Second),
+		ResponseHeaderTimeout: seconds(cfg.ResponseHeaderTimeout, 0),
+		ExpectContinueTimeout: time.Second,
+	}
+	if cfg.InsecureSkipVerify {
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return t
+}
+
+var DefaultProxyTransport = NewProxyTransport(nil)
+
+type proxyCtxKey string
+
+// proxyResult records how the upstream request went, for its trace span
+type proxyResult struct {
+	status int
+	err error
+}
+
+func contextProxyResult(ctx context.Context) *proxyResult {
+	res, ok := ctx.Value(proxyCtxKey("result")).(*proxyResult)
+	if !ok {
+		return &proxyResult{}
+	}
+	return res
+}
+
+// ReverseProxy forwards requests to an upstream server.  Requests are
+// sent to Target with the incoming path appended to Target's path, unless
+// an exact URL is given with ServeURL.
+type ReverseProxy struct {
+	Target *url.URL
+	Transport http.RoundTripper
+	// FlushInterval is how often to flush the response to the client
+	// while copying it.  Zero means to buffer normally, and negative
+	// values flush after every write.  Event streams and responses of
+	// unknown length are always flushed immediately.
+	FlushInterval time.Duration
+	// Timeout bounds the whole request, including the response body.
+	// Zero means no limit.  For upgraded connections it only covers the
+	// handshake.
+	Timeout time.Duration
+	// IdleTimeout closes upgraded connections, such as WebSockets, after
+	// no data has passed in either direction for this long.  Zero means
+	// DefaultUpgradeIdleTimeout; negative means never.
+	IdleTimeout time.Duration
+	// TrustedProxies are the networks whose Forwarded and X-Forwarded-*
+	// headers are believed.  Those headers on requests from anywhere
+	// else are replaced with ones describing just this hop.
+	TrustedProxies []*net.IPNet
+	// PreserveHost sends the incoming Host header upstream instead of the
+	// target's host
+	PreserveHost bool
+	// RewriteLocation makes redirects to the upstream host point back at
+	// this server instead
+	RewriteLocation bool
+	// CookieDomains maps the Domain attribute of upstream Set-Cookie
+	// headers to new values.  An empty value removes the attribute,
+	// making the cookie host-only.  If nil, cookies scoped to the
+	// upstream host are made host-only.
+	CookieDomains map[string]string
+	ModifyRequest func(*http.Request)
+	ModifyResponse func(*http.Response) error
+	// ErrorHandler is called instead of sending a 502 or 504 to the client
+	// when the upstream request fails
+	ErrorHandler func(http.ResponseWriter, *http.Request, error)
+}
+
+func NewReverseProxy(target *url.URL) *ReverseProxy {
+	return &ReverseProxy{
+		Target: target,
+		Transport: DefaultProxyTransport,
+		RewriteLocation: true,
+	}
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// joinURL appends the request's path and query to target's
+func joinURL(target *url.URL, r *http.Request) *url.URL {
+	u := *target
+	u.Path = singleJoiningSlash(target.Path, r.URL.Path)
+	if target.RawQuery == "" || r.URL.RawQuery == "" {
+		u.RawQuery = target.RawQuery + r.URL.RawQuery
+	} else {
+		u.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
+	}
+	return &u
+}
+
+func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.ServeURL(w, r, joinURL(p.Target, r))
+}
+
+// ServeURL proxies the request to exactly u
+func (p *ReverseProxy) ServeURL(w http.ResponseWriter, r *http.Request, u *url.URL) {
+	ctx := context.WithValue(r.Context(), proxyCtxKey("url"), u)
+	ctx = context.WithValue(ctx, proxyCtxKey("request"), r)
+	result := &proxyResult{}
+	ctx = context.WithValue(ctx, proxyCtxKey("result"), result)
+	ctx, endSpan := startClientSpan(ctx, r.Method, u)
+	start := time.Now()
+	defer func() {
+		recordUpstream(ctx, u.Host, result.status, time.Since(start))
+		endSpan(result.status, result.err)
+	}()
+	if isUpgradeRequest(r) {
+		p.serveUpgrade(w, r.WithContext(ctx))
 		return
 	}
-	fwd := parseForwarded(req.Header.Get("Forwarded"))
-	ip := parseAddr(req.RemoteAddr)
-	fwd = append(fwd, []string{
-		fmt.Sprintf(`for="%s"`, ip),
-		fmt.Sprintf(`host="%s"`, req.Host),
-		fmt.Sprintf(`proto=%s`, req.URL.Scheme),
-	})
-	preq.Header.Set("X-Forwarded-Host", req.Host)
-	preq.Header.Set("X-Forwarded-Proto", req.URL.Scheme)
-	preq.Header.Set("X-Real-IP", ip)
-	for k, vs := range req.Header {
-		switch k {
-		case "Host":
-		case "Forwarded":
-		default:
-			preq.Header[k] = vs
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	rp := &httputil.ReverseProxy{
+		Director: p.direct,
+		Transport: p.Transport,
+		FlushInterval: p.FlushInterval,
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler: p.handleError,
+	}
+	rp.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func hopScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func quoteForwarded(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// trusts reports whether r came straight from one of TrustedProxies
+func (p *ReverseProxy) trusts(r *http.Request) bool {
+	ip := net.ParseIP(parseAddr(r.RemoteAddr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.TrustedProxies {
+		if n.Contains(ip) {
+			return true
 		}
 	}
-	xff := preq.Header.Get("X-Forwarded-For")
-	if xff == "" {
-		preq.Header.Set("X-Forwarded-For", ip)
+	return false
+}
+
+// external returns the scheme and host the client asked for, going by
+// the forwarding headers only if they came from a trusted proxy
+func (p *ReverseProxy) external(r *http.Request) (string, string) {
+	if p.trusts(r) {
+		return ExternalScheme(r), ExternalHostname(r)
+	}
+	return hopScheme(r), r.Host
+}
+
+// direct points the outgoing request at the upstream server and records
+// where it came from.  httputil strips the hop-by-hop headers and appends
+// the client address to X-Forwarded-For.
+func (p *ReverseProxy) direct(preq *http.Request) {
+	in := p.incoming(preq)
+	preq.URL = preq.Context().Value(proxyCtxKey("url")).(*url.URL)
+	if !p.PreserveHost {
+		preq.Host = ""
+	}
+	ip := parseAddr(in.RemoteAddr)
+	fwd := [][]string{}
+	if p.trusts(in) {
+		fwd = parseForwarded(in.Header.Get("Forwarded"))
 	} else {
-		preq.Header.Set("X-Forwarded-For", fmt.Sprintf("%s, %s", xff, ip))
+		preq.Header.Del("X-Forwarded-For")
 	}
+	fwd = append(fwd, []string{
+		"for=" + quoteForwarded(ip),
+		"host=" + quoteForwarded(in.Host),
+		"proto=" + hopScheme(in),
+	})
+	scheme, host := p.external(in)
 	preq.Header.Set("Forwarded", formatForwarded(fwd))
-	res, err := client.Do(preq)
-	if err != nil {
-		sendError(w, req, BadGateway.Wrap(err, "Downstream server error"))
+	preq.Header.Set("X-Forwarded-Host", host)
+	preq.Header.Set("X-Forwarded-Proto", scheme)
+	preq.Header.Set("X-Real-IP", ip)
+	injectTraceContext(preq.Context(), preq.Header)
+	if reqId := ContextRequestId(in.Context()); reqId != "" {
+		preq.Header.Set(contextRequestIDHeader(in.Context()), reqId)
+	}
+	if p.ModifyRequest != nil {
+		p.ModifyRequest(preq)
+	}
+}
+
+func (p *ReverseProxy) incoming(preq *http.Request) *http.Request {
+	r, ok := preq.Context().Value(proxyCtxKey("request")).(*http.Request)
+	if !ok {
+		return preq
+	}
+	return r
+}
+
+func (p *ReverseProxy) rewriteLocation(res *http.Response) {
+	loc := res.Header.Get("Location")
+	if loc == "" {
+		return
+	}
+	u, err := url.Parse(loc)
+	if err != nil || u.Host == "" {
+		return
+	}
+	upstream := res.Request.URL
+	if !strings.EqualFold(u.Host, upstream.Host) {
+		return
+	}
+	u.Scheme, u.Host = p.external(p.incoming(res.Request))
+	res.Header.Set("Location", u.String())
+}
+
+var cookieDomainRe = regexp.MustCompile(`(?i);\s*domain=([^;]*)`)
+
+func (p *ReverseProxy) rewriteCookies(res *http.Response) {
+	cookies := res.Header.Values("Set-Cookie")
+	if len(cookies) == 0 {
 		return
 	}
-	wh := w.Header()
-	for k, vs := range res.Header {
-		wh[k] = vs
+	upstreamHost := res.Request.URL.Hostname()
+	rewritten := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		rewritten[i] = cookieDomainRe.ReplaceAllStringFunc(cookie, func(attr string) string {
+			m := cookieDomainRe.FindStringSubmatch(attr)
+			domain := strings.TrimPrefix(strings.TrimSpace(m[1]), ".")
+			if p.CookieDomains != nil {
+				repl, ok := p.CookieDomains[domain]
+				if !ok {
+					return attr
+				}
+				if repl == "" {
+					return ""
+				}
+				return "; Domain=" + repl
+			}
+			if strings.EqualFold(domain, upstreamHost) {
+				return ""
+			}
+			return attr
+		})
+	}
+	res.Header["Set-Cookie"] = rewritten
+}
+
+func (p *ReverseProxy) modifyResponse(res *http.Response) error {
+	contextProxyResult(res.Request.Context()).status = res.StatusCode
+	if p.RewriteLocation {
+		p.rewriteLocation(res)
+	}
+	p.rewriteCookies(res)
+	if p.ModifyResponse != nil {
+		return p.ModifyResponse(res)
 	}
-	w.WriteHeader(res.StatusCode)
-	io.Copy(w, res.Body)
-	res.Body.Close()
+	return nil
 }
 
+func (p *ReverseProxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	contextProxyResult(r.Context()).err = err
+	if p.ErrorHandler != nil {
+		p.ErrorHandler(w, r, err)
+		return
+	}
+	proxyError(w, r, err)
+}
+
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() == context.Canceled {
+		// client went away; nobody to tell
+		return
+	}
+	if r.Context().Err() == context.DeadlineExceeded {
+		sendError(w, r, GatewayTimeout.Wrap(err, "Downstream server timed out"))
+		return
+	}
+	nerr, isa := err.(net.Error)
+	if isa && nerr.Timeout() {
+		sendError(w, r, GatewayTimeout.Wrap(err, "Downstream server timed out"))
+		return
+	}
+	logging.FromContext(r.Context()).Warnln("proxy error:", err)
+	sendError(w, r, BadGateway.Wrap(err, "Downstream server error"))
+}
+
+var defaultReverseProxy = NewReverseProxy(&url.URL{})
+
+// Proxy forwards req to proxyUrl, with the settings of the server
+// handling req, or the shared default transport outside of one
+func Proxy(w http.ResponseWriter, req *http.Request, proxyUrl string) {
+	u, err := url.Parse(proxyUrl)
+	if err != nil || u.Host == "" {
+		if err == nil {
+			err = fmt.Errorf("no host in proxy url %s", proxyUrl)
+		}
+		sendError(w, req, BadRequest.Wrap(err, "Invalid downstream server"))
+		return
+	}
+	p := defaultReverseProxy
+	if srv := contextServer(req.Context()); srv != nil && srv.proxy != nil {
+		p = srv.proxy
+	}
+	p.ServeURL(w, req, u)
+}
@@ -0,0 +1,245 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "gopkg.in/check.v1"
+)
+
+type ProxySuite struct {}
+
+var _ = Suite(&ProxySuite{})
+
+func (s *ProxySuite) TestHeaders(c *C) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("Connection", "X-Private")
+		w.Header().Set("X-Private", "secret")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Add("Set-Cookie", "a=1; Path=/; Domain=" + r.Host[:strings.Index(r.Host, ":")])
+		w.Header().Add("Set-Cookie", "b=2; Path=/; Domain=example.org")
+		http.Redirect(w, r, "http://" + r.Host + "/login?next=%2F", http.StatusFound)
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL + "/app")
+	p := NewReverseProxy(target)
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/account?x=1", nil)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Forwarded", `for=198.51.100.7;proto=https`)
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	c.Assert(got, NotNil)
+	c.Check(got.URL.Path, Equals, "/app/account")
+	c.Check(got.URL.RawQuery, Equals, "x=1")
+	c.Check(got.Header.Get("X-Hop"), Equals, "")
+	// the client isn't a trusted proxy, so its forwarding headers are dropped
+	c.Check(got.Header.Get("X-Forwarded-For"), Equals, "192.0.2.1")
+	c.Check(got.Header.Get("X-Forwarded-Host"), Equals, "www.example.com")
+	c.Check(got.Header.Get("X-Forwarded-Proto"), Equals, "http")
+	c.Check(got.Header.Get("Forwarded"), Equals, `for="192.0.2.1";host="www.example.com";proto=http`)
+	c.Check(ExternalHostname(got), Equals, "www.example.com")
+	c.Check(w.Header().Get("Location"), Equals, "http://www.example.com/login?next=%2F")
+
+	req.Header.Set("X-Forwarded-Host", "evil.com")
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	c.Check(got.Header.Get("X-Forwarded-Host"), Equals, "www.example.com")
+
+	cfg := &ProxyTransportConfig{TrustedProxies: []string{"10.0.0.1", "192.0.2.0/24"}}
+	c.Assert(cfg.Init(), IsNil)
+	p.TrustedProxies = cfg.trusted
+	req.Header.Del("X-Forwarded-Host")
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	c.Check(got.Header.Get("X-Forwarded-For"), Equals, "198.51.100.7, 192.0.2.1")
+	c.Check(got.Header.Get("X-Forwarded-Proto"), Equals, "https")
+	c.Check(got.Header.Get("Forwarded"), Equals, `for=198.51.100.7;proto=https, for="192.0.2.1";host="www.example.com";proto=http`)
+
+	// redirects go to the client rather than being followed
+	c.Check(w.Code, Equals, http.StatusFound)
+	c.Check(w.Header().Get("Location"), Equals, "https://www.example.com/login?next=%2F")
+	c.Check(w.Header().Get("X-Private"), Equals, "")
+	c.Check(w.Header().Get("Keep-Alive"), Equals, "")
+	c.Check(w.Header()["Set-Cookie"], DeepEquals, []string{"a=1; Path=/", "b=2; Path=/; Domain=example.org"})
+}
+
+func (s *ProxySuite) TestStreaming(c *C) {
+	release := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: one\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("data: two\n\n"))
+	}))
+	defer upstream.Close()
+	defer close(release)
+	target, _ := url.Parse(upstream.URL)
+	front := httptest.NewServer(NewReverseProxy(target))
+	defer front.Close()
+	res, err := http.Get(front.URL + "/events")
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	line := make(chan string, 1)
+	go func() {
+		s, _ := bufio.NewReader(res.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		c.Check(s, Equals, "data: one\n")
+	case <-time.After(5 * time.Second):
+		c.Fatal("first event wasn't flushed to the client")
+	}
+}
+
+func (s *ProxySuite) TestErrors(c *C) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	target, _ := url.Parse(slow.URL)
+	p := NewReverseProxy(target)
+	p.Timeout = 20 * time.Millisecond
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Check(w.Code, Equals, http.StatusGatewayTimeout)
+
+	target, _ = url.Parse("http://127.0.0.1:1")
+	w = httptest.NewRecorder()
+	NewReverseProxy(target).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Check(w.Code, Equals, http.StatusBadGateway)
+}
+
+func (s *ProxySuite) TestWebSocket(c *C) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, append([]byte("echo: "), msg...))
+		}
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+	p := NewReverseProxy(target)
+	p.IdleTimeout = 100 * time.Millisecond
+	logs := make(chan string, 1)
+	m := NewMetrics()
+	var rl *ResponseLogger
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl = NewResponseLogger(w, r)
+		mw := m.NewWriter(rl, r)
+		p.ServeHTTP(mw, r)
+		mw.Measure("/ws")
+		buf := &bytes.Buffer{}
+		rl.WriteLog(buf)
+		logs <- buf.String()
+	}))
+	defer front.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws" + strings.TrimPrefix(front.URL, "http") + "/ws", nil)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(conn.WriteMessage(websocket.TextMessage, []byte("hello")), IsNil)
+	_, msg, err := conn.ReadMessage()
+	c.Assert(err, IsNil)
+	c.Check(string(msg), Equals, "echo: hello")
+
+	// the proxy hangs up once the connection goes idle
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	c.Check(err, NotNil)
+	select {
+	case line := <-logs:
+		c.Check(line, Matches, `.*"GET /ws" 101 [1-9][0-9]* .* rx=[1-9][0-9]*\n`)
+	case <-time.After(5 * time.Second):
+		c.Fatal("upgraded request never finished")
+	}
+
+	// the metrics count the same bytes as the log
+	upgraded := func() map[string]float64 {
+		f := gather(c, m, "http_upgraded_bytes")
+		c.Assert(f, NotNil)
+		counts := map[string]float64{}
+		for _, mt := range f.GetMetric() {
+			counts[metricLabels(mt)] = mt.GetCounter().GetValue()
+		}
+		return counts
+	}
+	rx, tx := rl.hijacked.Counts()
+	c.Check(upgraded(), DeepEquals, map[string]float64{
+		"direction=in,route=/ws": float64(rx),
+		"direction=out,route=/ws": float64(tx),
+	})
+
+	// including a frame the client sent right behind its headers, which
+	// the server had already read when the connection was hijacked
+	raw, err := net.Dial("tcp", front.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	defer raw.Close()
+	raw.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n\x81\x85\x00\x00\x00\x00hello"))
+	data, _ := ioutil.ReadAll(raw)
+	c.Check(strings.HasPrefix(string(data), "HTTP/1.1 101 "), Equals, true)
+	c.Check(strings.HasSuffix(string(data), "\r\n\r\n\x81\x0becho: hello"), Equals, true)
+	select {
+	case <-logs:
+	case <-time.After(5 * time.Second):
+		c.Fatal("upgraded request never finished")
+	}
+	rx2, tx2 := rl.hijacked.Counts()
+	c.Check(rx2 > int64(len("hello")), Equals, true)
+	c.Check(tx2, Equals, int64(len(data)))
+	c.Check(upgraded(), DeepEquals, map[string]float64{
+		"direction=in,route=/ws": float64(rx + rx2),
+		"direction=out,route=/ws": float64(tx + tx2),
+	})
+}
+
+func (s *ProxySuite) TestServerProxy(c *C) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Host")))
+	}))
+	defer upstream.Close()
+	get := func(srv *Server) string {
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com/p", nil)
+		req.Header.Set("X-Forwarded-Host", "shop.example.com")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	proxied := HandlerFunc(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		return ProxyURL(upstream.URL + "/x"), nil
+	})
+
+	// Proxy uses the settings of the server handling the request
+	srv := newTestServer(c, &ServerConfig{ProxyTransport: ProxyTransportConfig{TrustedProxies: []string{"192.0.2.1"}}})
+	srv.GET("/p", proxied)
+	srv.Prefix("/").Compile(nil)
+	c.Check(srv.proxy.Transport, Equals, http.RoundTripper(srv.transport))
+	c.Check(get(srv), Equals, "shop.example.com")
+	srv = newTestServer(c, &ServerConfig{})
+	srv.GET("/p", proxied)
+	srv.Prefix("/").Compile(nil)
+	c.Check(get(srv), Equals, "www.example.com")
+
+	c.Check((&ProxyTransportConfig{TrustedProxies: []string{"10.0.0.0/33"}}).Init(), ErrorMatches, "bad trusted proxy network.*")
+	c.Check((&ProxyTransportConfig{TrustedProxies: []string{"proxy.local"}}).Init(), ErrorMatches, "bad trusted proxy address.*")
+}
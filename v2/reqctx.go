@@ -3,26 +3,61 @@ package httpserver
 import (
 	"context"
 	"net/http"
+	"sync"
 
 	//"github.com/gorilla/mux"
 	"github.com/rclancey/logging"
-	"github.com/gofrs/uuid"
 )
 
 type reqCtxKey string
 
-func CreateRequestContext(srv *Server, req *http.Request) *http.Request {
-	reqId, err := uuid.NewV1()
-	if err != nil {
-		return req
+type requestCleanup struct {
+	mutex *sync.Mutex
+	funcs []func()
+}
+
+func (rc *requestCleanup) add(f func()) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.funcs = append(rc.funcs, f)
+}
+
+func (rc *requestCleanup) run() {
+	rc.mutex.Lock()
+	funcs := rc.funcs
+	rc.funcs = nil
+	rc.mutex.Unlock()
+	for i := len(funcs) - 1; i >= 0; i-- {
+		funcs[i]()
 	}
+}
+
+// CreateRequestContext attaches the request ID, server, logger and
+// cleanup hooks to the request's context.  It never fails: if the error
+// log can't be opened, the default logger is used instead, and the
+// problem is logged there.
+func CreateRequestContext(srv *Server, req *http.Request) *http.Request {
+	reqId, idErr := srv.cfg.RequestID.requestID(req)
 	log, err := srv.cfg.Logging.ErrorLogger()
 	if err != nil {
-		return req
+		log = logging.FromContext(req.Context())
+		log.Errorln("can't get error logger for request", reqId + ":", err)
+	}
+	if idErr != nil {
+		log.Warnln("can't generate request id, using", reqId + ":", idErr)
 	}
-	log = log.WithPrefix(reqId.String())
 	ctx := req.Context()
-	ctx = context.WithValue(ctx, reqCtxKey("reqId"), reqId.String())
+	prefix := reqId
+	if traceId := ContextTraceID(ctx); traceId != "" {
+		prefix += " trace=" + traceId
+	}
+	log = log.WithPrefix(prefix)
+	if srv.debugRules.match(req, "") {
+		srv.cfg.Logging.enableDebug(log)
+	}
+	ctx = context.WithValue(ctx, reqCtxKey("reqId"), reqId)
+	ctx = context.WithValue(ctx, reqCtxKey("server"), srv)
+	ctx = context.WithValue(ctx, reqCtxKey("cleanup"), &requestCleanup{mutex: &sync.Mutex{}})
 	ctx = logging.NewContext(ctx, log)
 	return req.Clone(ctx)
 }
@@ -42,3 +77,39 @@ func ContextRequestVars(ctx context.Context) map[string]string {
 	}
 	return v
 }
+
+func contextServer(ctx context.Context) *Server {
+	srv, ok := ctx.Value(reqCtxKey("server")).(*Server)
+	if !ok {
+		return nil
+	}
+	return srv
+}
+
+func ContextServerConfig(ctx context.Context) *ServerConfig {
+	srv := contextServer(ctx)
+	if srv == nil {
+		return nil
+	}
+	return srv.cfg
+}
+
+// OnRequestDone registers f to be called once the request has been fully
+// handled.  It returns false if the request wasn't created by
+// CreateRequestContext, in which case the caller is responsible for
+// cleaning up on its own.
+func OnRequestDone(req *http.Request, f func()) bool {
+	rc, ok := req.Context().Value(reqCtxKey("cleanup")).(*requestCleanup)
+	if !ok {
+		return false
+	}
+	rc.add(f)
+	return true
+}
+
+func runRequestCleanup(req *http.Request) {
+	rc, ok := req.Context().Value(reqCtxKey("cleanup")).(*requestCleanup)
+	if ok {
+		rc.run()
+	}
+}
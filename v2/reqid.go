@@ -0,0 +1,127 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+)
+
+const DefaultRequestIDHeader = "X-Request-ID"
+
+// RequestIDConfig controls how requests are identified.  An ID that
+// arrives in Header is used as is if it looks sane, otherwise a new one
+// is generated in the given format: "uuid4" (the default), "uuid1" or
+// "ulid".
+type RequestIDConfig struct {
+	Header string `json:"header" arg:"header"`
+	Format string `json:"format" arg:"format"`
+}
+
+func (cfg *RequestIDConfig) Init() error {
+	if cfg.Header == "" {
+		cfg.Header = DefaultRequestIDHeader
+	}
+	cfg.Header = http.CanonicalHeaderKey(cfg.Header)
+	switch cfg.Format {
+	case "":
+		cfg.Format = "uuid4"
+	case "uuid4", "uuid1", "ulid":
+	default:
+		return errors.Errorf("unknown request id format %s", cfg.Format)
+	}
+	return nil
+}
+
+func (cfg *RequestIDConfig) header() string {
+	if cfg == nil || cfg.Header == "" {
+		return DefaultRequestIDHeader
+	}
+	return cfg.Header
+}
+
+// incoming IDs end up in logs and response headers, so only accept ones
+// that can't mess with either
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$`)
+
+func validRequestID(id string) bool {
+	return requestIDPattern.MatchString(id)
+}
+
+func (cfg *RequestIDConfig) generate() (string, error) {
+	format := ""
+	if cfg != nil {
+		format = cfg.Format
+	}
+	switch format {
+	case "uuid1":
+		id, err := uuid.NewV1()
+		if err != nil {
+			return "", errors.Wrap(err, "can't generate uuid")
+		}
+		return id.String(), nil
+	case "ulid":
+		id, err := ulid.New(ulid.Now(), rand.Reader)
+		if err != nil {
+			return "", errors.Wrap(err, "can't generate ulid")
+		}
+		return id.String(), nil
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", errors.Wrap(err, "can't generate uuid")
+	}
+	return id.String(), nil
+}
+
+// requestID returns the ID the client sent, or a new one.  It always
+// returns an ID; if one can't be generated the error says why and the
+// ID falls back to the current time.
+func (cfg *RequestIDConfig) requestID(req *http.Request) (string, error) {
+	id := req.Header.Get(cfg.header())
+	if validRequestID(id) {
+		return id, nil
+	}
+	id, err := cfg.generate()
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36), err
+	}
+	return id, nil
+}
+
+func contextRequestIDHeader(ctx context.Context) string {
+	cfg := ContextServerConfig(ctx)
+	if cfg == nil {
+		return DefaultRequestIDHeader
+	}
+	return cfg.RequestID.header()
+}
+
+// withRequestID adds the request's ID to a JSON error body
+func withRequestID(req *http.Request, data []byte) []byte {
+	if req == nil {
+		return data
+	}
+	reqId := ContextRequestId(req.Context())
+	if reqId == "" {
+		return data
+	}
+	obj := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &obj)
+	if err != nil {
+		return data
+	}
+	obj["request_id"], _ = json.Marshal(reqId)
+	xdata, err := json.Marshal(obj)
+	if err != nil {
+		return data
+	}
+	return xdata
+}
@@ -0,0 +1,71 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type RequestIDSuite struct {}
+
+var _ = Suite(&RequestIDSuite{})
+
+func (s *RequestIDSuite) TestRequestID(c *C) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("X-Correlation-Id")
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	cfg := &ServerConfig{RequestID: RequestIDConfig{Header: "x-correlation-id", Format: "ulid"}}
+	cfg.Logging.ErrorLog = filepath.Join(c.MkDir(), "error.log")
+	srv := newTestServer(c, cfg)
+	var seen string
+	srv.router.GET("/proxy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = ContextRequestId(r.Context())
+		srv.NewReverseProxy(target).ServeHTTP(w, r)
+	}))
+	srv.router.GET("/fail", HandlerFunc(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		return nil, NewAPIError(BadRequest.New("nope"), http.StatusBadRequest)
+	}))
+	srv.Prefix("/").Compile(nil)
+
+	// a well formed incoming ID is kept, echoed and forwarded
+	req := httptest.NewRequest("GET", "/proxy", nil)
+	req.Header.Set("X-Correlation-Id", "edge-1234.abc")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	c.Check(seen, Equals, "edge-1234.abc")
+	c.Check(w.Header().Get("X-Correlation-Id"), Equals, "edge-1234.abc")
+	c.Check(forwarded, Equals, "edge-1234.abc")
+
+	// anything else is replaced
+	req.Header.Set("X-Correlation-Id", "bad id\r\nX-Evil: 1")
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	c.Check(seen, Matches, "[0-9A-HJKMNP-TV-Z]{26}")
+	c.Check(w.Header().Get("X-Correlation-Id"), Equals, seen)
+	c.Check(forwarded, Equals, seen)
+
+	// error bodies say which request failed
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/fail", nil))
+	c.Check(w.Code, Equals, http.StatusBadRequest)
+	obj := map[string]interface{}{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &obj), IsNil)
+	c.Check(obj["request_id"], Equals, w.Header().Get("X-Correlation-Id"))
+	c.Check(obj["request_id"], Not(Equals), "")
+
+	cfg.RequestID = RequestIDConfig{}
+	c.Assert(cfg.RequestID.Init(), IsNil)
+	c.Check(cfg.RequestID.Header, Equals, "X-Request-Id")
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/proxy", nil))
+	c.Check(w.Header().Get("X-Request-ID"), Matches, "[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[0-9a-f]{4}-[0-9a-f]{12}")
+	c.Check((&RequestIDConfig{Format: "uuid7"}).Init(), NotNil)
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -36,6 +37,12 @@ func (r *Route) URL(params map[string]string) string {
 	return "/" + strings.Join(parts, "/")
 }
 
+// URLFor fills in the :params of a route path pattern
+func URLFor(pattern string, params map[string]string) string {
+	r := &Route{Path: pattern}
+	return r.URL(params)
+}
+
 type Router interface {
 	Use(mw Middleware)
 	Prefix(path string) Router
@@ -115,6 +122,15 @@ func (pr *prefixRouter) Compile(mws []Middleware) {
 		}
 		handlers[method] = h
 	}
+	if _, ok := pr.handlers[http.MethodOptions]; !ok && len(pr.handlers) > 0 {
+		// answer OPTIONS automatically, through the middlewares, so
+		// CORS preflight requests get to the CORS middleware
+		var h http.Handler = optionsHandler(pr.handlers)
+		for i := n - 1; i >= 0; i-- {
+			h = mymws[i](h)
+		}
+		handlers[http.MethodOptions] = h
+	}
 	pr.compiled = handlers
 	for _, sub := range pr.staticRoutes {
 		sub.Compile(mymws)
@@ -124,6 +140,19 @@ func (pr *prefixRouter) Compile(mws []Middleware) {
 	}
 }
 
+func optionsHandler(handlers map[string]http.Handler) http.HandlerFunc {
+	methods := []string{http.MethodOptions}
+	for method := range handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
 func (pr *prefixRouter) Routes() []*Route {
 	routes := []*Route{}
 	for method := range pr.handlers {
@@ -201,3 +201,24 @@ func (s *RouteSuite) TestCompile(c *C) {
 		}
 	}
 }
+
+func (s *RouteSuite) TestAutoOptions(c *C) {
+	r := NewRouter()
+	r.GET("/foo/:id", NamedHandler("get"))
+	r.DELETE("/foo/:id", NamedHandler("delete"))
+	r.GET("/bar", NamedHandler("bar"))
+	r.OPTIONS("/bar", NamedHandler("options"))
+	r.Compile([]Middleware{})
+	h, _ := r.LookupPath(http.MethodOptions, "/foo/12")
+	c.Assert(h, NotNil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/foo/12", nil))
+	c.Check(w.Code, Equals, http.StatusNoContent)
+	c.Check(w.Header().Get("Allow"), Equals, "DELETE, GET, OPTIONS")
+	h, _ = r.LookupPath(http.MethodOptions, "/bar")
+	c.Assert(h, NotNil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/bar", nil))
+	c.Check(w.Body.String(), Equals, "options")
+	c.Check(ValidateRouter(r), IsNil)
+}
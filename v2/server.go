@@ -3,16 +3,25 @@ package httpserver
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"path"
 	"strings"
 	"sync"
+	"time"
 
 	//"github.com/gorilla/mux"
 	//"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
+	"github.com/rclancey/logging"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Middleware func(http.Handler) http.Handler
@@ -21,6 +30,25 @@ type Server struct {
 	cfg *ServerConfig
 	router Router
 	docroot http.Handler
+	views *TemplateLoader
+	cache *ResponseCache
+	transport *http.Transport
+	proxy *ReverseProxy
+	upstreams map[string]*Upstream
+	authMiddleware Middleware
+	authMutex sync.RWMutex
+	authVersion int
+	metrics *Metrics
+	tracerProvider *sdktrace.TracerProvider
+	accessLog *asyncWriter
+	debugRules *debugRules
+	capture *BodyCapture
+	health *healthChecks
+	hubs []Hub
+	hubMutex *sync.Mutex
+	started time.Time
+	adminRoot Router
+	adminRouter Router
 	middlewares []Middleware
 	servers []*http.Server
 }
@@ -34,21 +62,96 @@ func NewServer(cfg *ServerConfig) (*Server, error) {
 	srv := &Server{
 		cfg: cfg,
 		router: router,
+		metrics: NewMetrics(),
 		docroot: nil,
 		middlewares: []Middleware{},
 		servers: nil,
+		hubMutex: &sync.Mutex{},
+		started: time.Now(),
+	}
+	if srv.cfg.DocumentRoot != "" {
+		roots := []fs.FS{}
+		for _, dn := range srv.cfg.Static.Overlays {
+			roots = append(roots, os.DirFS(dn))
+		}
+		roots = append(roots, os.DirFS(srv.cfg.DocumentRoot))
+		err = srv.SetStaticFS(roots...)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		srv.docroot = NewFileServer(http.Dir(srv.cfg.DocumentRoot))
+	}
+	srv.views = NewTemplateLoader(&srv.cfg.Views)
+	initDefaultTemplateLoader(srv.views)
+	srv.cache = NewResponseCache(&srv.cfg.Cache)
+	srv.transport = NewProxyTransport(&srv.cfg.ProxyTransport)
+	srv.proxy = srv.NewReverseProxy(&url.URL{})
+	srv.metrics.SetBuckets(srv.cfg.Metrics.Buckets)
+	err = srv.metrics.registerHTTP()
+	if err != nil {
+		return nil, err
+	}
+	srv.upstreams = map[string]*Upstream{}
+	for _, upcfg := range srv.cfg.Upstreams {
+		up, err := srv.NewUpstream(upcfg)
+		if err != nil {
+			return nil, err
+		}
+		srv.upstreams[up.Name] = up
+	}
+	err = srv.addProxyRoutes()
+	if err != nil {
+		return nil, err
 	}
-	srv.docroot = http.FileServer(http.Dir(srv.cfg.DocumentRoot))
 	if srv.cfg.DefaultProxy != "" {
 		err := srv.SetDefaultProxy(srv.cfg.DefaultProxy)
 		if err != nil {
 			return nil, err
 		}
 	}
-	srv.Use(srv.AccessLoggerMiddleware())
+	srv.tracerProvider, err = NewTracerProvider(&srv.cfg.Tracing)
+	if err != nil {
+		return nil, err
+	}
+	if srv.tracerProvider != nil {
+		srv.Use(TracingMiddleware(srv.tracerProvider))
+	} else {
+		// still pick up trace IDs from incoming requests
+		srv.Use(TracingMiddleware(trace.NewNoopTracerProvider()))
+	}
+	// the request context comes first so the access log has its ID
 	srv.Use(srv.ContextMiddleware())
-	srv.Use(CompressMiddleware)
-	metricsSingleton.AttachEndpoint(router)
+	srv.Use(srv.AccessLoggerMiddleware())
+	if srv.cfg.CORS.Enabled() {
+		srv.Use(NewCORS(&srv.cfg.CORS).Middleware)
+	}
+	if srv.cfg.CSRF.Enabled {
+		srv.Use(NewCSRF(&srv.cfg.CSRF).Middleware)
+	}
+	srv.Use(NewCompressor(&srv.cfg.Compression).Middleware)
+	if srv.cfg.Logging.Capture.Enabled {
+		out, err := srv.cfg.Logging.CaptureLogger()
+		if err != nil {
+			return nil, err
+		}
+		// inside the compressor, so bodies are captured uncompressed
+		srv.capture = NewBodyCapture(&srv.cfg.Logging.Capture, out)
+		srv.Use(srv.capture.Middleware)
+	}
+	if !srv.cfg.Metrics.Disabled && srv.cfg.Metrics.Port == 0 && srv.cfg.Metrics.Public {
+		path := srv.cfg.Metrics.Path
+		if path == "" {
+			path = "/metrics"
+		}
+		router.GET(path, srv.metricsHandler())
+	}
+	err = srv.setupHealth()
+	if err != nil {
+		return nil, err
+	}
+	srv.debugRules = newDebugRules()
+	srv.setupAdmin()
 
 	return srv, nil
 }
@@ -57,19 +160,140 @@ func (srv *Server) SetDefaultHandler(h http.Handler) {
 	srv.docroot = h
 }
 
+// SetDefaultProxy sends requests that don't match any route to u, which
+// is either a URL or the name of an upstream pool
 func (srv *Server) SetDefaultProxy(u string) error {
+	if up := srv.Upstream(u); up != nil {
+		if srv.cfg.Cache.DefaultProxy {
+			srv.SetDefaultHandler(srv.cache.Middleware(up))
+		} else {
+			srv.SetDefaultHandler(up)
+		}
+		return nil
+	}
 	base, err := url.Parse(u)
 	if err != nil {
 		return err
 	}
+	proxy := srv.NewReverseProxy(base)
 	h := func(w http.ResponseWriter, r *http.Request) {
-		u := base.ResolveReference(r.URL)
-		Proxy(w, r, u.String())
+		proxy.ServeURL(w, r, base.ResolveReference(r.URL))
+	}
+	if srv.cfg.Cache.DefaultProxy {
+		srv.SetDefaultHandler(srv.cache.Middleware(http.HandlerFunc(h)))
+	} else {
+		srv.SetDefaultHandler(http.HandlerFunc(h))
+	}
+	return nil
+}
+
+// NewReverseProxy creates a proxy to target that shares the server's
+// upstream connection pool
+func (srv *Server) NewReverseProxy(target *url.URL) *ReverseProxy {
+	p := NewReverseProxy(target)
+	if srv.transport != nil {
+		p.Transport = srv.transport
+	}
+	p.TrustedProxies = srv.cfg.ProxyTransport.trusted
+	if srv.cfg.ProxyTransport.UpgradeIdleTimeout > 0 {
+		p.IdleTimeout = time.Duration(srv.cfg.ProxyTransport.UpgradeIdleTimeout) * time.Second
+	}
+	return p
+}
+
+// SetAuthMiddleware sets the middleware that protects proxy routes and
+// endpoints configured with auth, usually an auth.Authenticator's
+// MakeMiddleware()
+func (srv *Server) SetAuthMiddleware(mw Middleware) {
+	srv.authMutex.Lock()
+	srv.authMiddleware = mw
+	srv.authVersion++
+	srv.authMutex.Unlock()
+}
+
+// requireAuth protects h with the server's auth middleware.  The
+// middleware is looked up on each request, since it's usually set after
+// the server is created, and requests fail while there isn't one.  The
+// wrapped handler is kept until the middleware changes.
+func (srv *Server) requireAuth(h http.Handler, what string) http.Handler {
+	mutex := &sync.Mutex{}
+	version := 0
+	var authed http.Handler
+	f := func(w http.ResponseWriter, r *http.Request) {
+		srv.authMutex.RLock()
+		mw, current := srv.authMiddleware, srv.authVersion
+		srv.authMutex.RUnlock()
+		if mw == nil {
+			sendError(w, r, ServiceUnavailable.Errorf("%s requires auth, but the server has no auth middleware", what))
+			return
+		}
+		mutex.Lock()
+		if version != current {
+			authed = mw(h)
+			version = current
+		}
+		handler := authed
+		mutex.Unlock()
+		handler.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(f)
+}
+
+// CaptureMiddleware captures the bodies of every request to the routes
+// it's used on, if body capture is enabled
+func (srv *Server) CaptureMiddleware() Middleware {
+	if srv.capture == nil {
+		return Middleware(func(h http.Handler) http.Handler { return h })
+	}
+	return Middleware(srv.capture.CaptureAll)
+}
+
+// Views returns the server's template loader, which renders the Views
+// returned by its handlers
+func (srv *Server) Views() *TemplateLoader {
+	return srv.views
+}
+
+// Metrics returns the server's metrics registry
+func (srv *Server) Metrics() *Metrics {
+	if srv.metrics == nil {
+		return metricsSingleton
+	}
+	return srv.metrics
+}
+
+func (srv *Server) metricsHandler() http.Handler {
+	h := srv.Metrics().Handler()
+	if srv.cfg.Metrics.Auth {
+		return srv.requireAuth(h, "metrics endpoint")
+	}
+	return h
+}
+
+// Upstream returns the named upstream pool, or nil if there's no such
+// pool.  Upstreams are http.Handlers, so they can be mounted on routes.
+func (srv *Server) Upstream(name string) *Upstream {
+	return srv.upstreams[name]
+}
+
+// SetStaticFS replaces the default handler with a static file server
+// over the given roots, configured by the server's StaticConfig.  Use it
+// with an embed.FS to serve files compiled into the binary.
+func (srv *Server) SetStaticFS(roots ...fs.FS) error {
+	h, err := NewStaticHandler(&srv.cfg.Static, roots...)
+	if err != nil {
+		return errors.Wrap(err, "can't create static file handler")
 	}
-	srv.SetDefaultHandler(http.HandlerFunc(h))
+	srv.SetDefaultHandler(h)
 	return nil
 }
 
+// Cache returns the server's shared response cache, for use with
+// Router.Use
+func (srv *Server) Cache() *ResponseCache {
+	return srv.cache
+}
+
 func (srv *Server) Use(mw Middleware) {
 	srv.router.Use(mw)
 	srv.middlewares = append(srv.middlewares, mw)
@@ -111,6 +335,8 @@ func (srv *Server) ContextMiddleware() Middleware {
 	mwf := func(handler http.Handler) http.Handler {
 		f := func(w http.ResponseWriter, r *http.Request) {
 			r = CreateRequestContext(srv, r)
+			defer runRequestCleanup(r)
+			w.Header().Set(srv.cfg.RequestID.header(), ContextRequestId(r.Context()))
 			handler.ServeHTTP(w, r)
 		}
 		return http.HandlerFunc(f)
@@ -130,11 +356,28 @@ func (srv *Server) AccessLoggerMiddleware() Middleware {
 		}
 		return Middleware(mwf)
 	}
+	cfg := &srv.cfg.AccessLog
+	var out io.Writer = accessLog
+	if cfg.Async {
+		srv.accessLog = newAsyncWriter(accessLog, cfg.BufferSize, func() {
+			if srv.metrics != nil {
+				srv.metrics.Count("access_log_dropped", nil)
+			}
+		})
+		out = srv.accessLog
+	}
+	format := cfg.getFormat()
 	mwf := func(handler http.Handler) http.Handler {
 		f := func(w http.ResponseWriter, r *http.Request) {
 			rl := NewResponseLogger(w, r)
-			handler.ServeHTTP(w, r)
-			rl.WriteLog(accessLog)
+			handler.ServeHTTP(rl, rl.Request())
+			if !cfg.shouldLog(rl) {
+				return
+			}
+			err := rl.WriteLogFormat(out, format)
+			if err != nil {
+				logging.FromContext(r.Context()).Errorln("can't write access log:", err)
+			}
 		}
 		return http.HandlerFunc(f)
 	}
@@ -155,7 +398,7 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		parts = strings.Split(strings.TrimPrefix(path.Clean(r.URL.Path), "/"), "/")
 	}
 	handler, params := srv.router.Lookup(r.Method, parts)
-	mw := NewMetricsWriter(w)
+	mw := srv.Metrics().NewWriter(w, r)
 	route := "/" + strings.Join(parts, "/")
 	if handler != nil {
 		route = params["route"]
@@ -174,12 +417,28 @@ func (srv *Server) ListenAndServe() error {
 	if srv.servers != nil {
 		return errors.New("server already running")
 	}
-	servers := make([]*http.Server, 2)
+	servers := make([]*http.Server, 4)
 	srv.servers = servers
 	err := ValidateRouter(srv.router)
 	if err != nil {
 		return err
 	}
+	srv.authMutex.RLock()
+	noAuth := srv.authMiddleware == nil
+	srv.authMutex.RUnlock()
+	if noAuth {
+		for _, route := range srv.cfg.ProxyRoutes {
+			if route.Auth {
+				return errors.Errorf("proxy route %s requires auth, but no auth middleware is set", route.Prefix)
+			}
+		}
+		if srv.cfg.Metrics.Auth && !srv.cfg.Metrics.Disabled {
+			return errors.New("metrics endpoint requires auth, but no auth middleware is set")
+		}
+		if srv.adminRouter != nil && !srv.cfg.Admin.NoAuth {
+			return errors.New("admin endpoints require auth, but no auth middleware is set")
+		}
+	}
 	srv.router.Compile([]Middleware{})
 	h := srv.docroot
 	for i := len(srv.middlewares) - 1; i >= 0; i-- {
@@ -199,6 +458,29 @@ func (srv *Server) ListenAndServe() error {
 		return errors.Wrap(err, "can't write pid file")
 	}
 	defer removePidfile(srv.cfg)
+	for _, up := range srv.upstreams {
+		up.Start()
+		defer up.Stop()
+	}
+	if srv.accessLog != nil {
+		defer srv.accessLog.Close()
+	}
+	stopSignals := srv.handleLogSignals(l)
+	defer stopSignals()
+	if srv.tracerProvider != nil {
+		// flush any spans still waiting to be exported
+		defer srv.tracerProvider.Shutdown(context.Background())
+	}
+	var adminLn net.Listener
+	if srv.adminRoot != nil {
+		// before the other listeners, so there's nothing to clean up if
+		// it fails
+		srv.adminRoot.Compile([]Middleware{})
+		adminLn, err = srv.cfg.Admin.listen()
+		if err != nil {
+			return err
+		}
+	}
 	wg := &sync.WaitGroup{}
 	errch := make(chan error, 10)
 	if srv.cfg.Bind.SSL.Enabled() {
@@ -246,6 +528,53 @@ func (srv *Server) ListenAndServe() error {
 			wg.Done()
 		}()
 	}
+	if srv.cfg.Metrics.Port != 0 && !srv.cfg.Metrics.Disabled {
+		// metrics get their own listener, so they can be firewalled off
+		// from the public one
+		addr := fmt.Sprintf(":%d", srv.cfg.Metrics.Port)
+		mux := http.NewServeMux()
+		mux.Handle(srv.cfg.Metrics.Path, srv.metricsHandler())
+		server := &http.Server{
+			Addr: addr,
+			Handler: mux,
+		}
+		servers[2] = server
+		wg.Add(1)
+		go func() {
+			if l == nil {
+				log.Println("listening for metrics on", addr)
+			} else {
+				l.Infoln("listening for metrics on", addr)
+			}
+			err := server.ListenAndServe()
+			servers[2] = nil
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errch <- err
+			}
+			wg.Done()
+		}()
+	}
+	if adminLn != nil {
+		server := &http.Server{
+			Handler: &routerHandler{router: srv.adminRoot},
+		}
+		servers[3] = server
+		wg.Add(1)
+		go func() {
+			if l == nil {
+				log.Println("listening for admin on", adminLn.Addr())
+			} else {
+				l.Infoln("listening for admin on", adminLn.Addr())
+			}
+			// closes the listener, which removes a unix socket
+			err := server.Serve(adminLn)
+			servers[3] = nil
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errch <- err
+			}
+			wg.Done()
+		}()
+	}
 	wg.Wait()
 	close(errch)
 	for {
@@ -262,7 +591,33 @@ func (srv *Server) ListenAndServe() error {
 	return nil
 }
 
+// handleLogSignals reopens the log files on SIGUSR1, until the returned
+// function is called
+func (srv *Server) handleLogSignals(l *logging.Logger) func() {
+	ch := make(chan os.Signal, 1)
+	notifyLogReopen(ch)
+	go func() {
+		for range ch {
+			err := srv.cfg.Logging.Reopen()
+			if err != nil {
+				if l == nil {
+					log.Println("can't reopen logs:", err)
+				} else {
+					l.Errorln("can't reopen logs:", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(ch)
+	}
+}
+
 func (srv *Server) RegisterWebSocketHub(hub Hub) {
+	srv.hubMutex.Lock()
+	srv.hubs = append(srv.hubs, hub)
+	srv.hubMutex.Unlock()
 	servers := srv.servers
 	if servers == nil {
 		return
@@ -282,6 +637,18 @@ func (srv *Server) Shutdown() error {
 	if servers == nil {
 		return nil
 	}
+	if srv.health != nil {
+		// fail readiness first, so load balancers stop sending requests
+		// before the listeners close
+		srv.health.drain()
+		delay := srv.cfg.Health.DrainDelay
+		if delay == 0 {
+			delay = DefaultDrainDelay
+		}
+		if delay > 0 {
+			time.Sleep(time.Duration(delay) * time.Second)
+		}
+	}
 	var hadErr error
 	for i, server := range srv.servers {
 		if server == nil {
@@ -0,0 +1,82 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+// newTestServer creates a server the way a program would, with the full
+// middleware stack, logging to a temporary directory.  Compile its router
+// after adding routes.
+func newTestServer(c *C, cfg *ServerConfig) *Server {
+	if cfg.ServerRoot == "" {
+		cfg.ServerRoot = c.MkDir()
+	}
+	if cfg.Logging.Directory == "" {
+		cfg.Logging.Directory = c.MkDir()
+	}
+	if cfg.Logging.AccessLog == "" {
+		cfg.Logging.AccessLog = "access.log"
+	}
+	c.Assert(cfg.Init(), IsNil)
+	srv, err := NewServer(cfg)
+	c.Assert(err, IsNil)
+	return srv
+}
+
+type ServerSuite struct {}
+
+var _ = Suite(&ServerSuite{})
+
+func (s *ServerSuite) TestMiddlewareOrder(c *C) {
+	cfg := &ServerConfig{
+		CORS: CORSConfig{Origins: []string{"https://app.example.com"}, Credentials: true},
+		CSRF: CSRFConfig{Enabled: true},
+		Compression: CompressionConfig{MinSize: 10},
+	}
+	cfg.Logging.Capture = CaptureConfig{Enabled: true, Routes: []string{"/api/echo"}}
+	srv := newTestServer(c, cfg)
+	capfile, err := cfg.Logging.CaptureLogger()
+	c.Assert(err, IsNil)
+	defer capfile.Close()
+	srv.POST("/api/echo", http.HandlerFunc(echoHandler))
+	srv.Prefix("/").Compile(nil)
+	send := func(method, body string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://api.example.com/api/echo", strings.NewReader(body))
+		for i := 0; i + 1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	// cors answers preflights before csrf sees them
+	w := send("OPTIONS", "",
+		"Origin", "https://app.example.com",
+		"Access-Control-Request-Method", "POST",
+		"Access-Control-Request-Headers", "content-type, x-csrf-token")
+	c.Check(w.Code, Equals, http.StatusNoContent)
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+
+	// and csrf failures still carry the cors and request id headers, so
+	// the page can read them
+	w = send("POST", "{}", "Origin", "https://app.example.com", "Cookie", "session=x", "Content-Type", "application/json")
+	c.Check(w.Code, Equals, http.StatusForbidden)
+	c.Check(w.Header().Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+	c.Check(w.Header().Get("X-Request-Id"), Not(Equals), "")
+
+	// capture sees the response before it's compressed
+	body := strings.Repeat(`{"hello": "world"}`, 20)
+	w = send("POST", body, "Accept-Encoding", "gzip", "Content-Type", "application/json")
+	c.Check(w.Code, Equals, http.StatusCreated)
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "gzip")
+	caps := srv.capture.Recent(1)
+	c.Assert(caps, HasLen, 1)
+	c.Check(caps[0].RequestID, Equals, w.Header().Get("X-Request-Id"))
+	c.Assert(caps[0].ResponseBody, NotNil)
+	c.Check(caps[0].ResponseBody.Data, Equals, body)
+}
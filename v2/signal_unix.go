@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package httpserver
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func notifyLogReopen(ch chan os.Signal) {
+	signal.Notify(ch, syscall.SIGUSR1)
+}
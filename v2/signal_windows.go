@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package httpserver
+
+import (
+	"os"
+)
+
+// there's no SIGUSR1 on windows; use the admin endpoint to reopen logs
+func notifyLogReopen(ch chan os.Signal) {
+}
@@ -0,0 +1,407 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHeartbeat = 15 * time.Second
+	DefaultEventBufferSize = 256
+)
+
+var ErrStreamClosed = errors.New("event stream closed")
+
+type Event struct {
+	ID    string
+	Event string
+	Data  interface{}
+	Retry time.Duration
+	topic string
+}
+
+func (evt *Event) data() ([]byte, error) {
+	switch tdata := evt.Data.(type) {
+	case nil:
+		return []byte{}, nil
+	case string:
+		return []byte(tdata), nil
+	case []byte:
+		return tdata, nil
+	}
+	return json.Marshal(evt.Data)
+}
+
+// WriteTo writes the event in text/event-stream format
+func (evt *Event) WriteTo(w io.Writer) (int64, error) {
+	buf := &bytes.Buffer{}
+	if evt.ID != "" {
+		buf.WriteString("id: " + evt.ID + "\n")
+	}
+	if evt.Event != "" {
+		buf.WriteString("event: " + evt.Event + "\n")
+	}
+	if evt.Retry > 0 {
+		buf.WriteString("retry: " + strconv.FormatInt(evt.Retry.Milliseconds(), 10) + "\n")
+	}
+	data, err := evt.data()
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > 0 || evt.Retry == 0 {
+		lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+		for _, line := range lines {
+			buf.WriteString("data: " + line + "\n")
+		}
+	}
+	buf.WriteString("\n")
+	return buf.WriteTo(w)
+}
+
+// EventBuffer keeps the most recent events, so that reconnecting clients
+// can replay what they missed using Last-Event-ID.
+type EventBuffer struct {
+	mutex *sync.Mutex
+	events []*Event
+	size int
+	start int
+	seq uint64
+}
+
+func NewEventBuffer(size int) *EventBuffer {
+	if size <= 0 {
+		size = DefaultEventBufferSize
+	}
+	return &EventBuffer{
+		mutex: &sync.Mutex{},
+		events: make([]*Event, 0, size),
+		size: size,
+	}
+}
+
+// Add stores evt in the buffer, assigning it a sequential ID if it doesn't
+// already have one.
+func (b *EventBuffer) Add(evt *Event) *Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.seq += 1
+	if evt.ID == "" {
+		evt.ID = strconv.FormatUint(b.seq, 10)
+	}
+	if len(b.events) < b.size {
+		b.events = append(b.events, evt)
+	} else {
+		b.events[b.start] = evt
+		b.start = (b.start + 1) % b.size
+	}
+	return evt
+}
+
+// Since returns the buffered events that came after the event with the
+// given ID, or nil if that event is no longer in the buffer.
+func (b *EventBuffer) Since(lastID string) []*Event {
+	if lastID == "" {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	n := len(b.events)
+	for i := 0; i < n; i++ {
+		evt := b.events[(b.start + i) % n]
+		if evt.ID == lastID {
+			events := make([]*Event, 0, n - i - 1)
+			for j := i + 1; j < n; j++ {
+				events = append(events, b.events[(b.start + j) % n])
+			}
+			return events
+		}
+	}
+	return nil
+}
+
+type EventStream struct {
+	events chan *Event
+	heartbeat time.Duration
+	retry time.Duration
+	done chan bool
+	mutex *sync.Mutex
+	closed bool
+	onClose []func()
+}
+
+func NewEventStream() *EventStream {
+	return &EventStream{
+		events: make(chan *Event, DefaultEventBufferSize),
+		heartbeat: DefaultHeartbeat,
+		done: make(chan bool),
+		mutex: &sync.Mutex{},
+		onClose: []func(){},
+	}
+}
+
+// SetHeartbeat sets how often a comment is sent to keep idle connections
+// open through proxies.  Zero disables heartbeats.
+func (s *EventStream) SetHeartbeat(d time.Duration) {
+	s.heartbeat = d
+}
+
+// SetRetry tells the client how long to wait before reconnecting
+func (s *EventStream) SetRetry(d time.Duration) {
+	s.retry = d
+}
+
+// Done returns a channel that's closed when the stream ends, either by
+// Close() or because the client went away.
+func (s *EventStream) Done() <-chan bool {
+	return s.done
+}
+
+// Send queues an event for delivery.  It blocks if the stream's buffer is
+// full, and returns ErrStreamClosed once the stream has ended.
+func (s *EventStream) Send(evt *Event) error {
+	s.mutex.Lock()
+	closed := s.closed
+	s.mutex.Unlock()
+	if closed {
+		return ErrStreamClosed
+	}
+	select {
+	case s.events <- evt:
+		return nil
+	case <-s.done:
+		return ErrStreamClosed
+	}
+}
+
+func (s *EventStream) SendEvent(name string, data interface{}) error {
+	return s.Send(&Event{Event: name, Data: data})
+}
+
+func (s *EventStream) trySend(evt *Event) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.events <- evt:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *EventStream) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return ErrStreamClosed
+	}
+	s.closed = true
+	close(s.done)
+	onClose := s.onClose
+	s.onClose = nil
+	s.mutex.Unlock()
+	for _, f := range onClose {
+		f()
+	}
+	return nil
+}
+
+func (s *EventStream) OnClose(f func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		go f()
+		return
+	}
+	s.onClose = append(s.onClose, f)
+}
+
+func (s *EventStream) serve(w http.ResponseWriter, req *http.Request) error {
+	defer s.Close()
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if s.retry > 0 {
+		_, err := (&Event{Retry: s.retry}).WriteTo(w)
+		if err != nil {
+			return err
+		}
+	}
+	flush()
+	var heartbeat <-chan time.Time
+	if s.heartbeat > 0 {
+		ticker := time.NewTicker(s.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	ctx := req.Context()
+	for {
+		select {
+		case evt := <-s.events:
+			_, err := evt.WriteTo(w)
+			if err != nil {
+				return err
+			}
+			// drain anything else that's ready before flushing
+			n := len(s.events)
+			for i := 0; i < n; i++ {
+				_, err = (<-s.events).WriteTo(w)
+				if err != nil {
+					return err
+				}
+			}
+			flush()
+		case <-heartbeat:
+			_, err := w.Write([]byte(":\n\n"))
+			if err != nil {
+				return err
+			}
+			flush()
+		case <-s.done:
+			n := len(s.events)
+			for i := 0; i < n; i++ {
+				_, err := (<-s.events).WriteTo(w)
+				if err != nil {
+					return err
+				}
+			}
+			flush()
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SSEHub is the server-sent events counterpart of GenericHub.  Clients
+// subscribe to zero or more topics (zero meaning all of them), and
+// reconnecting clients are replayed any events they missed that are still
+// in the hub's buffer.
+type SSEHub struct {
+	mutex *sync.Mutex
+	buffer *EventBuffer
+	subscribers map[*EventStream][]string
+	closed bool
+}
+
+func NewSSEHub(bufferSize int) *SSEHub {
+	return &SSEHub{
+		mutex: &sync.Mutex{},
+		buffer: NewEventBuffer(bufferSize),
+		subscribers: map[*EventStream][]string{},
+	}
+}
+
+func subscribed(topics []string, topic string) bool {
+	if topic == "" || len(topics) == 0 {
+		return true
+	}
+	for _, t := range topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe creates an EventStream for the request, to be returned from a
+// HandlerFunc.  Topics may also be given in the request's topic query
+// parameter.
+func (h *SSEHub) Subscribe(req *http.Request, topics ...string) *EventStream {
+	topics = append(topics, req.URL.Query()["topic"]...)
+	stream := NewEventStream()
+	lastID := req.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = req.URL.Query().Get("lastEventId")
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		stream.Close()
+		return stream
+	}
+	for _, evt := range h.buffer.Since(lastID) {
+		if subscribed(topics, evt.topic) {
+			stream.trySend(evt)
+		}
+	}
+	h.subscribers[stream] = topics
+	stream.OnClose(func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		delete(h.subscribers, stream)
+	})
+	return stream
+}
+
+// Publish sends an event to every subscriber of topic.  If evt isn't
+// already an *Event, it's sent as JSON data in an event named after the
+// topic.
+func (h *SSEHub) Publish(topic string, evt interface{}) {
+	e, isa := evt.(*Event)
+	if !isa {
+		e = &Event{Event: topic, Data: evt}
+	}
+	e.topic = topic
+	h.mutex.Lock()
+	if h.closed {
+		h.mutex.Unlock()
+		return
+	}
+	h.buffer.Add(e)
+	toClose := []*EventStream{}
+	for stream, topics := range h.subscribers {
+		if !subscribed(topics, topic) {
+			continue
+		}
+		if !stream.trySend(e) {
+			toClose = append(toClose, stream)
+		}
+	}
+	h.mutex.Unlock()
+	for _, stream := range toClose {
+		stream.Close()
+	}
+}
+
+// BroadcastEvent sends an event to every subscriber regardless of topic,
+// like GenericHub.BroadcastEvent
+func (h *SSEHub) BroadcastEvent(evt interface{}) {
+	h.Publish("", evt)
+}
+
+func (h *SSEHub) Stop() {
+	h.mutex.Lock()
+	h.closed = true
+	streams := make([]*EventStream, 0, len(h.subscribers))
+	for stream := range h.subscribers {
+		streams = append(streams, stream)
+	}
+	h.mutex.Unlock()
+	for _, stream := range streams {
+		stream.Close()
+	}
+}
+
+func (h *SSEHub) Closed() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.closed
+}
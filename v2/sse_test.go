@@ -0,0 +1,68 @@
+package httpserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SSESuite struct {}
+
+var _ = Suite(&SSESuite{})
+
+func (s *SSESuite) TestEventFormat(c *C) {
+	buf := &bytes.Buffer{}
+	evt := &Event{ID: "7", Event: "update", Data: map[string]int{"n": 1}}
+	_, err := evt.WriteTo(buf)
+	c.Check(err, IsNil)
+	c.Check(buf.String(), Equals, "id: 7\nevent: update\ndata: {\"n\":1}\n\n")
+	buf.Reset()
+	evt = &Event{Data: "line one\nline two"}
+	evt.WriteTo(buf)
+	c.Check(buf.String(), Equals, "data: line one\ndata: line two\n\n")
+}
+
+func (s *SSESuite) TestEventBuffer(c *C) {
+	b := NewEventBuffer(3)
+	for i := 0; i < 5; i++ {
+		b.Add(&Event{Data: i})
+	}
+	c.Check(b.Since("1"), IsNil)
+	evts := b.Since("3")
+	c.Assert(evts, HasLen, 2)
+	c.Check(evts[0].ID, Equals, "4")
+	c.Check(evts[1].ID, Equals, "5")
+	c.Check(b.Since("5"), HasLen, 0)
+}
+
+func (s *SSESuite) TestHubReplay(c *C) {
+	hub := NewSSEHub(10)
+	hub.Publish("a", "first")
+	hub.Publish("b", "second")
+	hub.Publish("a", "third")
+	req := httptest.NewRequest(http.MethodGet, "/events?topic=a", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	stream := hub.Subscribe(req)
+	stream.SetHeartbeat(0)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		hub.BroadcastEvent("everyone")
+		hub.Publish("b", "ignored")
+		time.Sleep(10 * time.Millisecond)
+		hub.Stop()
+	}()
+	w := httptest.NewRecorder()
+	HandlerFunc(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		return stream, nil
+	}).ServeHTTP(w, req)
+	c.Check(w.Header().Get("Content-Type"), Equals, "text/event-stream")
+	body := w.Body.String()
+	c.Check(strings.Contains(body, "id: 3\nevent: a\ndata: third\n\n"), Equals, true)
+	c.Check(strings.Contains(body, "data: everyone\n\n"), Equals, true)
+	c.Check(strings.Contains(body, "second"), Equals, false)
+	c.Check(strings.Contains(body, "ignored"), Equals, false)
+}
@@ -0,0 +1,429 @@
+package httpserver
+
+import (
+	"bytes"
+	htmltpl "html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// precompressed lists the sibling file extensions FileServer looks for,
+// in order of preference
+var precompressed = []struct{
+	encoding string
+	ext string
+}{
+	{"br", ".br"},
+	{"zstd", ".zst"},
+	{"gzip", ".gz"},
+}
+
+type CacheRule struct {
+	Pattern      string `json:"pattern"`
+	CacheControl string `json:"cache_control"`
+}
+
+type StaticConfig struct {
+	SPAFallback     bool        `json:"spa_fallback"     arg:"spa"`
+	SPAIndex        string      `json:"spa_index"        arg:"spa-index"`
+	SPAExclude      []string    `json:"spa_exclude"      arg:"spa-exclude"`
+	DisableListings bool        `json:"disable_listings" arg:"no-listings"`
+	ListingTemplate string      `json:"listing_template" arg:"listing-template"`
+	AllowHidden     bool        `json:"allow_hidden"     arg:"allow-hidden"`
+	Overlays        []string    `json:"overlays"         arg:"overlays"`
+	CacheRules      []CacheRule `json:"cache_rules"      arg:"-"`
+}
+
+func (cfg *StaticConfig) Init(serverRoot string) error {
+	for i, dn := range cfg.Overlays {
+		abs, err := MakeRootAbs(serverRoot, dn)
+		if err != nil {
+			return errors.Wrap(err, "can't make abs path for static overlay " + dn)
+		}
+		cfg.Overlays[i] = abs
+	}
+	if cfg.ListingTemplate != "" {
+		fn, err := MakeRootAbs(serverRoot, cfg.ListingTemplate)
+		if err != nil {
+			return errors.Wrap(err, "can't make abs path for listing template " + cfg.ListingTemplate)
+		}
+		err = checkReadableFile(fn)
+		if err != nil {
+			return errors.Wrapf(err, "listing template %s not readable", fn)
+		}
+		cfg.ListingTemplate = fn
+	}
+	for _, rule := range cfg.CacheRules {
+		_, err := path.Match(rule.Pattern, "")
+		if err != nil {
+			return errors.Wrapf(err, "bad cache rule pattern %s", rule.Pattern)
+		}
+	}
+	return nil
+}
+
+var backupSuffixes = []string{"~", ".bak", ".swp", ".swo", ".orig", ".tmp"}
+
+// isHidden reports whether a path contains a dotfile or editor backup file.
+// /.well-known is allowed through, since it's meant to be public.
+func isHidden(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." || part == ".well-known" {
+			continue
+		}
+		if strings.HasPrefix(part, ".") || (strings.HasPrefix(part, "#") && strings.HasSuffix(part, "#")) {
+			return true
+		}
+		for _, suffix := range backupSuffixes {
+			if strings.HasSuffix(part, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// overlayFS searches each of its roots in turn, optionally hiding
+// dotfiles and backup files
+type overlayFS struct {
+	roots []http.FileSystem
+	allowHidden bool
+}
+
+func (ofs *overlayFS) Open(name string) (http.File, error) {
+	if !ofs.allowHidden && isHidden(name) {
+		return nil, os.ErrNotExist
+	}
+	var err error
+	for _, root := range ofs.roots {
+		var f http.File
+		f, err = root.Open(name)
+		if err == nil {
+			if ofs.allowHidden {
+				return f, nil
+			}
+			return &hidingFile{f}, nil
+		}
+	}
+	if err == nil {
+		err = os.ErrNotExist
+	}
+	return nil, err
+}
+
+type hidingFile struct {
+	http.File
+}
+
+func (f *hidingFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if !isHidden(info.Name()) {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
+
+type DirectoryEntry struct {
+	Name    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+type DirectoryListing struct {
+	Path    string
+	Entries []DirectoryEntry
+}
+
+// FileServer serves static files like http.FileServer, but if a file has
+// precompressed siblings (file.js.br, file.js.gz) that the client accepts,
+// it serves one of those instead.  NewStaticHandler adds the options in
+// StaticConfig.
+type FileServer struct {
+	cfg *StaticConfig
+	root http.FileSystem
+	fallback http.Handler
+	listing *htmltpl.Template
+}
+
+func NewFileServer(root http.FileSystem) *FileServer {
+	return &FileServer{
+		cfg: &StaticConfig{AllowHidden: true},
+		root: root,
+		fallback: http.FileServer(root),
+	}
+}
+
+// NewStaticHandler creates a FileServer over one or more roots, such as
+// os.DirFS or an embed.FS.  Files in earlier roots take precedence.
+func NewStaticHandler(cfg *StaticConfig, roots ...fs.FS) (*FileServer, error) {
+	if cfg == nil {
+		cfg = &StaticConfig{}
+	}
+	ofs := &overlayFS{
+		roots: make([]http.FileSystem, len(roots)),
+		allowHidden: cfg.AllowHidden,
+	}
+	for i, root := range roots {
+		ofs.roots[i] = http.FS(root)
+	}
+	fsrv := &FileServer{
+		cfg: cfg,
+		root: ofs,
+		fallback: http.FileServer(ofs),
+	}
+	if cfg.ListingTemplate != "" {
+		t, err := htmltpl.ParseFiles(cfg.ListingTemplate)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't load listing template " + cfg.ListingTemplate)
+		}
+		fsrv.listing = t
+	}
+	return fsrv, nil
+}
+
+func (fsrv *FileServer) contentType(name string, f http.File) string {
+	ct := mime.TypeByExtension(path.Ext(name))
+	if ct != "" {
+		return ct
+	}
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	return http.DetectContentType(buf[:n])
+}
+
+func (fsrv *FileServer) stat(name string) (os.FileInfo, error) {
+	f, err := fsrv.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (fsrv *FileServer) setCacheControl(w http.ResponseWriter, name string) {
+	h := w.Header()
+	if h.Get("Cache-Control") != "" {
+		return
+	}
+	for _, rule := range fsrv.cfg.CacheRules {
+		pattern := rule.Pattern
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(name)
+		}
+		ok, _ := path.Match(pattern, target)
+		if ok {
+			h.Set("Cache-Control", rule.CacheControl)
+			return
+		}
+	}
+}
+
+func (fsrv *FileServer) spaIndex() string {
+	if fsrv.cfg.SPAIndex != "" {
+		return "/" + strings.TrimPrefix(fsrv.cfg.SPAIndex, "/")
+	}
+	return "/index.html"
+}
+
+func (fsrv *FileServer) spaFallback(r *http.Request, name string) bool {
+	if !fsrv.cfg.SPAFallback {
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	// missing assets should still be 404s
+	if path.Ext(name) != "" {
+		return false
+	}
+	exclude := fsrv.cfg.SPAExclude
+	if exclude == nil {
+		exclude = []string{"/api/"}
+	}
+	for _, prefix := range exclude {
+		if strings.HasPrefix(name + "/", prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	if strings.HasSuffix(upath, "/index.html") {
+		// let http.FileServer redirect to the directory
+		fsrv.fallback.ServeHTTP(w, r)
+		return
+	}
+	name := path.Clean(upath)
+	st, err := fsrv.stat(name)
+	if err != nil {
+		if os.IsNotExist(err) && fsrv.spaFallback(r, name) {
+			fsrv.serveSPAIndex(w, r)
+			return
+		}
+		fsrv.fallback.ServeHTTP(w, r)
+		return
+	}
+	if st.IsDir() {
+		if !strings.HasSuffix(upath, "/") {
+			// redirect to the trailing slash
+			fsrv.fallback.ServeHTTP(w, r)
+			return
+		}
+		index := path.Join(name, "index.html")
+		ist, err := fsrv.stat(index)
+		if err != nil || ist.IsDir() {
+			fsrv.serveListing(w, r, name)
+			return
+		}
+		name = index
+	}
+	fsrv.setCacheControl(w, name)
+	if !fsrv.servePrecompressed(w, r, name) {
+		fsrv.fallback.ServeHTTP(w, r)
+	}
+}
+
+func (fsrv *FileServer) serveSPAIndex(w http.ResponseWriter, r *http.Request) {
+	index := fsrv.spaIndex()
+	f, err := fsrv.root.Open(index)
+	if err != nil {
+		sendError(w, r, NotFound)
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || st.IsDir() {
+		sendError(w, r, NotFound)
+		return
+	}
+	// the index is served under many URLs, so it always has to be checked
+	w.Header().Set("Cache-Control", "no-cache")
+	if !fsrv.servePrecompressed(w, r, index) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		http.ServeContent(w, r, index, st.ModTime(), f)
+	}
+}
+
+func (fsrv *FileServer) serveListing(w http.ResponseWriter, r *http.Request, name string) {
+	if fsrv.cfg.DisableListings {
+		sendError(w, r, NotFound)
+		return
+	}
+	if fsrv.listing == nil {
+		fsrv.fallback.ServeHTTP(w, r)
+		return
+	}
+	f, err := fsrv.root.Open(name)
+	if err != nil {
+		sendError(w, r, NotFound)
+		return
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		sendError(w, r, InternalServerError.Wrap(err, "Error reading directory"))
+		return
+	}
+	listing := &DirectoryListing{
+		Path: name,
+		Entries: make([]DirectoryEntry, len(infos)),
+	}
+	for i, info := range infos {
+		listing.Entries[i] = DirectoryEntry{
+			Name: info.Name(),
+			IsDir: info.IsDir(),
+			Size: info.Size(),
+			ModTime: info.ModTime(),
+		}
+	}
+	sort.Slice(listing.Entries, func(i, j int) bool {
+		return listing.Entries[i].Name < listing.Entries[j].Name
+	})
+	buf := &bytes.Buffer{}
+	err = fsrv.listing.Execute(buf, listing)
+	if err != nil {
+		sendError(w, r, InternalServerError.Wrap(err, "Error rendering directory listing"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		buf.WriteTo(w)
+	}
+}
+
+func (fsrv *FileServer) servePrecompressed(w http.ResponseWriter, r *http.Request, name string) bool {
+	f, err := fsrv.root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || st.IsDir() {
+		return false
+	}
+	accept := ParseAcceptEncoding(r.Header.Get("Accept-Encoding"))
+	wildcard, hasWildcard := accept["*"]
+	var best http.File
+	var bestEncoding string
+	var bestQ float64
+	found := false
+	for _, pc := range precompressed {
+		cf, err := fsrv.root.Open(name + pc.ext)
+		if err != nil {
+			continue
+		}
+		cst, err := cf.Stat()
+		if err != nil || cst.IsDir() {
+			cf.Close()
+			continue
+		}
+		found = true
+		q, ok := accept[pc.encoding]
+		if !ok && hasWildcard {
+			q, ok = wildcard, true
+		}
+		if !ok || q <= bestQ {
+			cf.Close()
+			continue
+		}
+		if best != nil {
+			best.Close()
+		}
+		best, bestEncoding, bestQ = cf, pc.encoding, q
+	}
+	if found {
+		// the response depends on Accept-Encoding even if this client
+		// gets the uncompressed file
+		addVary(w.Header(), "Accept-Encoding")
+	}
+	if best == nil {
+		return false
+	}
+	defer best.Close()
+	cst, _ := best.Stat()
+	h := w.Header()
+	h.Set("Content-Type", fsrv.contentType(name, f))
+	h.Set("Content-Encoding", bestEncoding)
+	http.ServeContent(w, r, name, cst.ModTime(), best)
+	return true
+}
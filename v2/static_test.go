@@ -0,0 +1,98 @@
+package httpserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing/fstest"
+
+	. "gopkg.in/check.v1"
+)
+
+type StaticSuite struct {}
+
+var _ = Suite(&StaticSuite{})
+
+func (s *StaticSuite) TestPrecompressed(c *C) {
+	dn := c.MkDir()
+	js := strings.Repeat("console.log('hello');\n", 200)
+	c.Assert(ioutil.WriteFile(filepath.Join(dn, "app.js"), []byte(js), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dn, "app.js.br"), []byte("BROTLI"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dn, "app.js.gz"), []byte("GZIPPED"), 0644), IsNil)
+	h := CompressMiddleware(NewFileServer(http.Dir(dn)))
+	get := func(accept string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/app.js", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		for i := 0; i + 1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i + 1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	w := get("gzip, br")
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "br")
+	c.Check(w.Header().Get("Content-Type"), Matches, "(text|application)/javascript.*")
+	c.Check(w.Header()["Vary"], DeepEquals, []string{"Accept-Encoding"})
+	c.Check(w.Body.String(), Equals, "BROTLI")
+	w = get("gzip, br;q=0.5")
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "gzip")
+	c.Check(w.Body.String(), Equals, "GZIPPED")
+	w = get("")
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "")
+	c.Check(w.Header().Get("Vary"), Equals, "Accept-Encoding")
+	c.Check(w.Body.String(), Equals, js)
+	w = get("gzip", "Range", "bytes=1-3")
+	c.Check(w.Code, Equals, http.StatusPartialContent)
+	c.Check(w.Header().Get("Content-Encoding"), Equals, "gzip")
+	c.Check(w.Body.String(), Equals, "ZIP")
+}
+
+func (s *StaticSuite) TestStaticOptions(c *C) {
+	base := fstest.MapFS{
+		"index.html": {Data: []byte("<html>app</html>")},
+		"about.txt": {Data: []byte("base about")},
+		".env": {Data: []byte("SECRET=1")},
+		"config.json.bak": {Data: []byte("{}")},
+		"assets/app.1234.js": {Data: []byte("js")},
+		"files/a.txt": {Data: []byte("a")},
+		".well-known/security.txt": {Data: []byte("contact")},
+	}
+	overlay := fstest.MapFS{
+		"about.txt": {Data: []byte("overlay about")},
+	}
+	cfg := &StaticConfig{
+		SPAFallback: true,
+		DisableListings: true,
+		CacheRules: []CacheRule{
+			{Pattern: "/assets/*", CacheControl: "public, max-age=31536000, immutable"},
+			{Pattern: "*.txt", CacheControl: "max-age=60"},
+		},
+	}
+	h, err := NewStaticHandler(cfg, overlay, base)
+	c.Assert(err, IsNil)
+	get := func(p string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, p, nil))
+		return w
+	}
+	w := get("/about.txt")
+	c.Check(w.Body.String(), Equals, "overlay about")
+	c.Check(w.Header().Get("Cache-Control"), Equals, "max-age=60")
+	w = get("/assets/app.1234.js")
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Header().Get("Cache-Control"), Equals, "public, max-age=31536000, immutable")
+	c.Check(get("/.env").Code, Equals, http.StatusNotFound)
+	c.Check(get("/config.json.bak").Code, Equals, http.StatusNotFound)
+	c.Check(get("/.well-known/security.txt").Code, Equals, http.StatusOK)
+	c.Check(get("/files/").Code, Equals, http.StatusNotFound)
+	w = get("/users/7/profile")
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Body.String(), Equals, "<html>app</html>")
+	c.Check(w.Header().Get("Cache-Control"), Equals, "no-cache")
+	c.Check(get("/api/users").Code, Equals, http.StatusNotFound)
+	c.Check(get("/missing.js").Code, Equals, http.StatusNotFound)
+	c.Check(get("/").Body.String(), Equals, "<html>app</html>")
+}
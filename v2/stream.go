@@ -1,10 +1,15 @@
 package httpserver
 
 import (
+	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"io"
+	"net/http"
 	"sync"
+	"time"
 )
 
 var (
@@ -12,6 +17,8 @@ var (
 	ErrNotClosed = errors.New("object stream still open")
 	ErrHeaderSent = errors.New("header already sent")
 	ErrFooterSent = errors.New("footer already sent")
+	ErrClientGone = errors.New("client went away")
+	ErrStreamStarted = errors.New("object stream already started")
 )
 
 var (
@@ -21,38 +28,173 @@ var (
 	closeBrace = []byte{'}'}
 	openBracket = []byte{':', '['}
 	closeBracket = []byte{']'}
+	recordSeparator = []byte{0x1e}
 )
 
+const (
+	DefaultStreamFlushInterval = time.Second
+)
+
+type StreamMode int
+
+const (
+	// StreamJSON wraps the objects in a single JSON object, along with
+	// any header and footer values:
+	// {"header1":...,"key":[obj1,obj2,...],"footer1":...}
+	StreamJSON = StreamMode(iota)
+	// StreamNDJSON writes one JSON object per line.  Headers and footers,
+	// if any, are written as {"header":{...}} and {"footer":{...}}
+	// records at the start and end of the stream.
+	StreamNDJSON
+	// StreamJSONSeq writes an RFC 7464 JSON text sequence, with the same
+	// header and footer records as StreamNDJSON.
+	StreamJSONSeq
+	// StreamCSV writes one CSV row per object, preceded by a row of column
+	// names.  Headers and footers are not written.
+	StreamCSV
+)
+
+func (mode StreamMode) ContentType() string {
+	switch mode {
+	case StreamNDJSON:
+		return "application/x-ndjson"
+	case StreamJSONSeq:
+		return "application/json-seq"
+	case StreamCSV:
+		return "text/csv; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// StreamError is how an error reported with Fail() appears at the end of
+// the stream: under an "error" key in the footer for StreamJSON, as an
+// {"error":{...}} record for StreamNDJSON and StreamJSONSeq, and as a
+// final "#error" row for StreamCSV.  The message is also sent in the
+// X-Stream-Error trailer.
+type StreamError struct {
+	Status  string `json:"status"`
+	Message string `json:"error"`
+}
+
 type ObjectStream struct {
 	key string
+	mode StreamMode
 	objects chan interface{}
+	flushInterval time.Duration
+	columns []string
 	header map[string]interface{}
 	headerKeys []string
 	footer map[string]interface{}
 	footerKeys []string
+	err error
 	mutex *sync.Mutex
+	sendMutex *sync.Mutex
 	closed bool
+	started bool
+	done chan bool
+	doneOnce *sync.Once
 }
 
 func NewObjectStream(key string) *ObjectStream {
 	return &ObjectStream{
 		key: key,
+		mode: StreamJSON,
 		objects: make(chan interface{}, 1),
+		flushInterval: DefaultStreamFlushInterval,
 		header: map[string]interface{}{},
 		footer: map[string]interface{}{},
 		mutex: &sync.Mutex{},
+		sendMutex: &sync.Mutex{},
 		closed: false,
+		done: make(chan bool),
+		doneOnce: &sync.Once{},
+	}
+}
+
+// SetMode selects the output format.  It must be called before returning
+// the ObjectStream from the handler.
+func (stream *ObjectStream) SetMode(mode StreamMode) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.started {
+		return ErrStreamStarted
+	}
+	stream.mode = mode
+	return nil
+}
+
+func (stream *ObjectStream) Mode() StreamMode {
+	return stream.mode
+}
+
+// SetBufferSize sets how many objects may be queued before Send blocks.
+// It must be called before the first Send.
+func (stream *ObjectStream) SetBufferSize(n int) error {
+	stream.sendMutex.Lock()
+	defer stream.sendMutex.Unlock()
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.started || stream.closed || len(stream.objects) > 0 {
+		return ErrStreamStarted
+	}
+	if n < 0 {
+		n = 0
+	}
+	stream.objects = make(chan interface{}, n)
+	return nil
+}
+
+// SetFlushInterval sets how often buffered output is flushed to the
+// client.  Zero flushes after every object.
+func (stream *ObjectStream) SetFlushInterval(d time.Duration) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.flushInterval = d
+}
+
+// SetColumns sets the CSV column names and order.  Without it, columns
+// are taken from the fields of the first object.
+func (stream *ObjectStream) SetColumns(columns ...string) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.started {
+		return ErrStreamStarted
 	}
+	stream.columns = columns
+	return nil
 }
 
 // Send should be called from a goroutine after returning the ObjectStream
-// from the handler
+// from the handler.  It returns ErrClientGone if the client disconnects
+// before the object can be queued.
 func (stream *ObjectStream) Send(obj interface{}) error {
-	if stream.closed {
+	return stream.SendContext(context.Background(), obj)
+}
+
+// SendContext is like Send, but also gives up when ctx is done
+func (stream *ObjectStream) SendContext(ctx context.Context, obj interface{}) error {
+	stream.sendMutex.Lock()
+	defer stream.sendMutex.Unlock()
+	stream.mutex.Lock()
+	closed := stream.closed
+	stream.mutex.Unlock()
+	if closed {
 		return ErrClosed
 	}
-	stream.objects <- obj
-	return nil
+	select {
+	case stream.objects <- obj:
+		return nil
+	case <-stream.done:
+		return ErrClientGone
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done returns a channel that's closed when the stream has finished
+// writing, either normally or because the client went away
+func (stream *ObjectStream) Done() <-chan bool {
+	return stream.done
 }
 
 // SetHeader() should be called before returning the ObjectStream from the
@@ -86,16 +228,43 @@ func (stream *ObjectStream) SetFooter(key string, val interface{}) error {
 // Close() must be called at the end of the goroutine in order flush the
 // stream to the client
 func (stream *ObjectStream) Close() error {
+	stream.sendMutex.Lock()
+	defer stream.sendMutex.Unlock()
 	stream.mutex.Lock()
-	defer stream.mutex.Unlock()
 	if stream.closed {
+		stream.mutex.Unlock()
 		return ErrClosed
 	}
 	stream.closed = true
+	stream.mutex.Unlock()
 	close(stream.objects)
 	return nil
 }
 
+// Fail closes the stream, reporting err to the client in place of a
+// normal footer
+func (stream *ObjectStream) Fail(err error) error {
+	stream.mutex.Lock()
+	if stream.closed {
+		stream.mutex.Unlock()
+		return ErrClosed
+	}
+	stream.err = err
+	stream.mutex.Unlock()
+	return stream.Close()
+}
+
+func (stream *ObjectStream) streamError() *StreamError {
+	if stream.err == nil {
+		return nil
+	}
+	herr, isa := stream.err.(HTTPError)
+	if isa {
+		return &StreamError{Status: "error", Message: herr.Message()}
+	}
+	return &StreamError{Status: "error", Message: stream.err.Error()}
+}
+
 func (stream *ObjectStream) writeKeyValue(w io.Writer, key string, val interface{}) error {
 	data, err := json.Marshal(key)
 	if err != nil {
@@ -120,22 +289,80 @@ func (stream *ObjectStream) writeKeyValue(w io.Writer, key string, val interface
 	return nil
 }
 
+func (stream *ObjectStream) writeRecord(w io.Writer, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if stream.mode == StreamJSONSeq {
+		_, err = w.Write(recordSeparator)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(newline)
+	return err
+}
+
+func orderedMap(keys []string, m map[string]interface{}) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(openBrace)
+	first := true
+	for _, k := range keys {
+		v, ok := m[k]
+		if !ok {
+			continue
+		}
+		if !first {
+			buf.Write(comma)
+		}
+		first = false
+		kdata, _ := json.Marshal(k)
+		vdata, err := json.Marshal(v)
+		if err != nil {
+			vdata = []byte("null")
+		}
+		buf.Write(kdata)
+		buf.Write(colon)
+		buf.Write(vdata)
+	}
+	buf.Write(closeBrace)
+	return buf.Bytes()
+}
+
 func (stream *ObjectStream) writeHeader(w io.Writer) error {
 	stream.mutex.Lock()
 	defer stream.mutex.Unlock()
 	if stream.header == nil {
 		return ErrHeaderSent
 	}
+	header := stream.header
+	headerKeys := stream.headerKeys
+	stream.header = nil
+	stream.headerKeys = nil
+	switch stream.mode {
+	case StreamNDJSON, StreamJSONSeq:
+		if len(header) == 0 {
+			return nil
+		}
+		return stream.writeRecord(w, map[string]json.RawMessage{"header": orderedMap(headerKeys, header)})
+	case StreamCSV:
+		return nil
+	}
 	_, err := w.Write(openBrace)
 	if err != nil {
 		return err
 	}
-	for _, k := range stream.headerKeys {
-		v, ok := stream.header[k]
+	for _, k := range headerKeys {
+		v, ok := header[k]
 		if !ok {
 			continue
 		}
-		delete(stream.header, k)
+		delete(header, k)
 		err = stream.writeKeyValue(w, k, v)
 		if err != nil {
 			return err
@@ -145,8 +372,6 @@ func (stream *ObjectStream) writeHeader(w io.Writer) error {
 			return err
 		}
 	}
-	stream.header = nil
-	stream.headerKeys = nil
 	data, err := json.Marshal(stream.key)
 	if err != nil {
 		return err
@@ -168,16 +393,49 @@ func (stream *ObjectStream) writeFooter(w io.Writer) error {
 	if stream.footer == nil {
 		return ErrFooterSent
 	}
+	footer := stream.footer
+	footerKeys := stream.footerKeys
+	stream.footer = nil
+	stream.footerKeys = nil
+	serr := stream.streamError()
+	if rw, isa := w.(http.ResponseWriter); isa && serr != nil {
+		rw.Header().Set("X-Stream-Error", serr.Message)
+	}
+	switch stream.mode {
+	case StreamNDJSON, StreamJSONSeq:
+		if len(footer) > 0 {
+			err := stream.writeRecord(w, map[string]json.RawMessage{"footer": orderedMap(footerKeys, footer)})
+			if err != nil {
+				return err
+			}
+		}
+		if serr != nil {
+			return stream.writeRecord(w, map[string]*StreamError{"error": serr})
+		}
+		return nil
+	case StreamCSV:
+		if serr != nil {
+			cw := csv.NewWriter(w)
+			cw.Write([]string{"#error", serr.Message})
+			cw.Flush()
+			return cw.Error()
+		}
+		return nil
+	}
 	_, err := w.Write(closeBracket)
 	if err != nil {
 		return err
 	}
-	for _, k := range stream.footerKeys {
-		v, ok := stream.footer[k]
+	if serr != nil {
+		footer["error"] = serr
+		footerKeys = append(footerKeys, "error")
+	}
+	for _, k := range footerKeys {
+		v, ok := footer[k]
 		if !ok {
 			continue
 		}
-		delete(stream.footer, k)
+		delete(footer, k)
 		_, err = w.Write(comma)
 		if err != nil {
 			return err
@@ -187,39 +445,193 @@ func (stream *ObjectStream) writeFooter(w io.Writer) error {
 			return err
 		}
 	}
-	stream.footer = nil
-	stream.footerKeys = nil
 	_, err = w.Write(closeBrace)
 	return err
 }
 
-func (stream *ObjectStream) stream(w io.Writer) error {
+func (stream *ObjectStream) writeObject(w io.Writer, cw *csvObjectWriter, obj interface{}, first bool) error {
+	switch stream.mode {
+	case StreamNDJSON, StreamJSONSeq:
+		return stream.writeRecord(w, obj)
+	case StreamCSV:
+		return cw.write(obj)
+	}
+	if !first {
+		_, err := w.Write(comma)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (stream *ObjectStream) finish() {
+	stream.doneOnce.Do(func() {
+		close(stream.done)
+	})
+}
+
+func (stream *ObjectStream) stream(ctx context.Context, w io.Writer) error {
+	defer stream.finish()
+	stream.mutex.Lock()
+	stream.started = true
+	flushInterval := stream.flushInterval
+	stream.mutex.Unlock()
+	var flush func()
+	if f, isa := w.(http.Flusher); isa {
+		flush = f.Flush
+	} else {
+		flush = func() {}
+	}
 	err := stream.writeHeader(w)
 	if err != nil {
 		return err
 	}
+	flush()
+	var cw *csvObjectWriter
+	if stream.mode == StreamCSV {
+		cw = newCSVObjectWriter(w, stream.columns)
+	}
+	var tick <-chan time.Time
+	if flushInterval > 0 {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	dirty := false
 	first := true
 	for {
-		obj, ok := <-stream.objects
-		if !ok {
-			break
-		}
-		if first {
-			first = false
-		} else {
-			_, err = w.Write(comma)
+		select {
+		case obj, ok := <-stream.objects:
+			if !ok {
+				err = stream.writeFooter(w)
+				flush()
+				return err
+			}
+			err = stream.writeObject(w, cw, obj, first)
 			if err != nil {
 				return err
 			}
+			first = false
+			if flushInterval > 0 {
+				dirty = true
+			} else {
+				flush()
+			}
+		case <-tick:
+			if dirty {
+				flush()
+				dirty = false
+			}
+		case <-ctx.Done():
+			return ErrClientGone
 		}
-		data, err := json.Marshal(obj)
+	}
+}
+
+type csvObjectWriter struct {
+	w *csv.Writer
+	columns []string
+	wroteHeader bool
+}
+
+func newCSVObjectWriter(w io.Writer, columns []string) *csvObjectWriter {
+	return &csvObjectWriter{
+		w: csv.NewWriter(w),
+		columns: columns,
+	}
+}
+
+// decodeObject turns obj into its JSON fields, preserving the order in
+// which they're serialized
+func decodeObject(obj interface{}) ([]string, map[string]json.RawMessage, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, nil, errors.New("csv stream objects must serialize to JSON objects")
+	}
+	keys := []string{}
+	vals := map[string]json.RawMessage{}
+	for dec.More() {
+		tok, err = dec.Token()
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		_, err = w.Write(data)
+		key, _ := tok.(string)
+		var val json.RawMessage
+		err = dec.Decode(&val)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+		vals[key] = val
+	}
+	return keys, vals, nil
+}
+
+func csvValue(val json.RawMessage) string {
+	if len(val) == 0 || string(val) == "null" {
+		return ""
+	}
+	if val[0] == '"' {
+		var s string
+		if json.Unmarshal(val, &s) == nil {
+			return s
+		}
+	}
+	return string(val)
+}
+
+func (cw *csvObjectWriter) write(obj interface{}) error {
+	var row []string
+	if strs, isa := obj.([]string); isa {
+		row = strs
+	} else {
+		keys, vals, err := decodeObject(obj)
 		if err != nil {
 			return err
 		}
+		if cw.columns == nil {
+			cw.columns = keys
+		}
+		row = make([]string, len(cw.columns))
+		for i, col := range cw.columns {
+			row[i] = csvValue(vals[col])
+		}
 	}
-	return stream.writeFooter(w)
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		if cw.columns != nil {
+			err := cw.w.Write(cw.columns)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := cw.w.Write(row)
+	if err != nil {
+		return err
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func (stream *ObjectStream) serve(w http.ResponseWriter, req *http.Request) error {
+	h := w.Header()
+	h.Set("Content-Type", stream.mode.ContentType())
+	h.Set("Trailer", "X-Stream-Error")
+	w.WriteHeader(http.StatusOK)
+	return stream.stream(req.Context(), w)
 }
@@ -2,6 +2,8 @@ package httpserver
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -34,8 +36,67 @@ func (s *ObjectStreamSuite) TestStream(c *C) {
 		stream.Close()
 	}()
 	buf := bytes.NewBuffer(nil)
-	err := stream.stream(buf)
+	err := stream.stream(context.Background(), buf)
 	c.Check(err, IsNil)
 	exp := `{"foo":"bar","baz":["a","b"],"test":[{"n":0,"t":1},{"n":1,"t":2},{"n":2,"t":3},{"n":3,"t":4},{"n":4,"t":5},{"n":5,"t":6},{"n":6,"t":7},{"n":7,"t":8},{"n":8,"t":9},{"n":9,"t":10}],"status":"ok","count":10}`
 	c.Check(string(buf.Bytes()), Equals, exp)
 }
+
+func (s *ObjectStreamSuite) TestModes(c *C) {
+	run := func(mode StreamMode, fail error) string {
+		stream := NewObjectStream("test")
+		stream.SetMode(mode)
+		stream.SetHeader("foo", "bar")
+		go func() {
+			for i := 0; i < 2; i++ {
+				stream.Send(&TestStreamObj{N: i, T: int64(i * 10)})
+			}
+			if fail != nil {
+				stream.Fail(fail)
+			} else {
+				stream.SetFooter("count", 2)
+				stream.Close()
+			}
+		}()
+		buf := bytes.NewBuffer(nil)
+		err := stream.stream(context.Background(), buf)
+		c.Check(err, IsNil)
+		return buf.String()
+	}
+	c.Check(run(StreamNDJSON, nil), Equals, "{\"header\":{\"foo\":\"bar\"}}\n{\"n\":0,\"t\":0}\n{\"n\":1,\"t\":10}\n{\"footer\":{\"count\":2}}\n")
+	c.Check(run(StreamJSONSeq, nil), Equals, "\x1e{\"header\":{\"foo\":\"bar\"}}\n\x1e{\"n\":0,\"t\":0}\n\x1e{\"n\":1,\"t\":10}\n\x1e{\"footer\":{\"count\":2}}\n")
+	c.Check(run(StreamCSV, nil), Equals, "n,t\n0,0\n1,10\n")
+	fail := errors.New("database went away")
+	c.Check(run(StreamJSON, fail), Equals, `{"foo":"bar","test":[{"n":0,"t":0},{"n":1,"t":10}],"error":{"status":"error","error":"database went away"}}`)
+	c.Check(run(StreamNDJSON, fail), Equals, "{\"header\":{\"foo\":\"bar\"}}\n{\"n\":0,\"t\":0}\n{\"n\":1,\"t\":10}\n{\"error\":{\"status\":\"error\",\"error\":\"database went away\"}}\n")
+	c.Check(run(StreamCSV, fail), Equals, "n,t\n0,0\n1,10\n#error,database went away\n")
+}
+
+func (s *ObjectStreamSuite) TestClientGone(c *C) {
+	stream := NewObjectStream("test")
+	ctx, cancel := context.WithCancel(context.Background())
+	errch := make(chan error, 1)
+	go func() {
+		for {
+			err := stream.Send(&TestStreamObj{})
+			if err != nil {
+				errch <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err := stream.stream(ctx, bytes.NewBuffer(nil))
+	c.Check(err, Equals, ErrClientGone)
+	select {
+	case err = <-errch:
+		c.Check(err, Equals, ErrClientGone)
+	case <-time.After(time.Second):
+		c.Error("Send didn't return after client went away")
+	}
+	c.Check(stream.Close(), IsNil)
+	c.Check(stream.Send(&TestStreamObj{}), Equals, ErrClosed)
+}
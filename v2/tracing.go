@@ -0,0 +1,234 @@
+package httpserver
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/rclancey/httpserver/v2"
+
+// TracingConfig selects where spans are exported.  With no exporter,
+// incoming trace context is still propagated, so trace IDs show up in
+// logs and proxied requests, but no spans are recorded.
+type TracingConfig struct {
+	Exporter    string            `json:"exporter"     arg:"exporter"`
+	Endpoint    string            `json:"endpoint"     arg:"endpoint"`
+	Insecure    bool              `json:"insecure"     arg:"insecure"`
+	Headers     map[string]string `json:"headers"      arg:"-"`
+	ServiceName string            `json:"service_name" arg:"service-name"`
+	SampleRate  float64           `json:"sample_rate"  arg:"sample-rate"`
+}
+
+func (cfg *TracingConfig) Init() error {
+	switch cfg.Exporter {
+	case "", "otlp", "stdout":
+	default:
+		return errors.Errorf("unknown trace exporter %s", cfg.Exporter)
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "httpserver"
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return errors.New("trace sample rate must be between 0 and 1")
+	}
+	return nil
+}
+
+var tracePropagator = propagation.TraceContext{}
+
+// NewTracerProvider creates a tracer provider that exports spans as
+// configured, or nil if tracing isn't configured
+func NewTracerProvider(cfg *TracingConfig) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "":
+		return nil, nil
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		err = errors.Errorf("unknown trace exporter %s", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create trace exporter")
+	}
+	rate := cfg.SampleRate
+	if rate == 0 {
+		rate = 1
+	}
+	name := cfg.ServiceName
+	if name == "" {
+		name = "httpserver"
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(rate))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", name))),
+	)
+	return tp, nil
+}
+
+// ContextTraceID returns the ID of the trace the context belongs to, or
+// "" if there isn't one
+func ContextTraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// StartSpan starts a child of the span in ctx, using the same tracer
+// provider as the request it belongs to.  Handlers use it to trace parts
+// of their work:
+//
+//	ctx, span := httpserver.StartSpan(r.Context(), "load user")
+//	defer span.End()
+func StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, opts...)
+}
+
+func spanName(r *http.Request) string {
+	route := ContextRequestVars(r.Context())["route"]
+	if route == "" {
+		return r.Method
+	}
+	return r.Method + " " + route
+}
+
+// TracingMiddleware starts a server span for each request, continuing
+// the trace from the request's traceparent header if it has one.  The
+// span is named after the matched route rather than the path, so that
+// requests for the same endpoint group together.
+func TracingMiddleware(tp trace.TracerProvider) Middleware {
+	tracer := tp.Tracer(tracerName)
+	mwf := func(handler http.Handler) http.Handler {
+		f := func(w http.ResponseWriter, r *http.Request) {
+			ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			route := ContextRequestVars(r.Context())["route"]
+			attrs := []attribute.KeyValue{
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.RequestURI()),
+				attribute.String("http.scheme", ExternalScheme(r)),
+				attribute.String("http.host", r.Host),
+				attribute.String("net.peer.ip", parseAddr(r.RemoteAddr)),
+				attribute.String("http.user_agent", r.UserAgent()),
+			}
+			if route != "" {
+				attrs = append(attrs, attribute.String("http.route", route))
+			}
+			ctx, span := tracer.Start(ctx, spanName(r), trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+			defer span.End()
+			tw := &traceWriter{ResponseWriter: w}
+			handler.ServeHTTP(tw, r.WithContext(ctx))
+			status := tw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttributes(attribute.Int("http.status_code", status))
+			if status >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+		}
+		return http.HandlerFunc(f)
+	}
+	return Middleware(mwf)
+}
+
+// traceWriter notes the response status for the server span
+type traceWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *traceWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *traceWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *traceWriter) Flush() {
+	f, ok := w.ResponseWriter.(http.Flusher)
+	if ok {
+		f.Flush()
+	}
+}
+
+func (w *traceWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.Errorf("underlying ResponseWriter %T doesn't support hijacking", w.ResponseWriter)
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
+// startClientSpan starts a span for a proxied request to u.  It ends
+// when the returned function is called with the upstream status, or 0 if
+// the request failed.
+func startClientSpan(ctx context.Context, method string, u *url.URL) (context.Context, func(int, error)) {
+	ctx, span := StartSpan(ctx, method + " " + u.Host, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.method", method),
+		attribute.String("http.url", u.Redacted()),
+		attribute.String("net.peer.name", u.Hostname()),
+	))
+	end := func(status int, err error) {
+		if status != 0 {
+			span.SetAttributes(attribute.Int("http.status_code", status))
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+	}
+	return ctx, end
+}
+
+// injectTraceContext adds traceparent and tracestate headers for the
+// span in ctx
+func injectTraceContext(ctx context.Context, h http.Header) {
+	h.Del("Traceparent")
+	h.Del("Tracestate")
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(h))
+}
+
@@ -0,0 +1,71 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	. "gopkg.in/check.v1"
+)
+
+type TracingSuite struct {}
+
+var _ = Suite(&TracingSuite{})
+
+func (s *TracingSuite) TestSpans(c *C) {
+	var upstreamParent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamParent = r.Header.Get("Traceparent")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	srv := newTestServer(c, &ServerConfig{})
+	srv.Use(TracingMiddleware(tp))
+	srv.router.GET("/api/items/:id", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := StartSpan(r.Context(), "load item")
+		span.End()
+		srv.NewReverseProxy(target).ServeHTTP(w, r.WithContext(ctx))
+	}))
+	srv.Prefix("/").Compile(nil)
+
+	req := httptest.NewRequest("GET", "/api/items/42", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	c.Check(w.Code, Equals, http.StatusAccepted)
+
+	spans := rec.Ended()
+	c.Assert(spans, HasLen, 3)
+	names := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spans {
+		names[span.Name()] = span
+		c.Check(span.SpanContext().TraceID().String(), Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	}
+	server := names["GET /api/items/:id"]
+	c.Assert(server, NotNil)
+	c.Check(server.SpanKind(), Equals, trace.SpanKindServer)
+	c.Check(server.Parent().SpanID().String(), Equals, "00f067aa0ba902b7")
+	c.Check(server.Parent().IsRemote(), Equals, true)
+	child := names["load item"]
+	c.Assert(child, NotNil)
+	c.Check(child.Parent().SpanID(), Equals, server.SpanContext().SpanID())
+	client := names["GET " + target.Host]
+	c.Assert(client, NotNil)
+	c.Check(client.SpanKind(), Equals, trace.SpanKindClient)
+	c.Check(client.Parent().SpanID(), Equals, child.SpanContext().SpanID())
+	c.Check(upstreamParent, Equals, "00-4bf92f3577b34da6a3ce929d0e0e4736-" + client.SpanContext().SpanID().String() + "-01")
+
+	// without an exporter, the incoming trace ID is still propagated
+	srv = newTestServer(c, &ServerConfig{})
+	srv.router.GET("/api/items/:id", srv.NewReverseProxy(target))
+	srv.Prefix("/").Compile(nil)
+	srv.ServeHTTP(httptest.NewRecorder(), req)
+	c.Check(upstreamParent, Equals, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+}
@@ -0,0 +1,203 @@
+package tus
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+var ErrUploadNotFound = errors.New("upload not found")
+
+type Upload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Offset    int64             `json:"offset"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Owner     string            `json:"owner,omitempty"`
+	Created   time.Time         `json:"created"`
+	Expires   time.Time         `json:"expires,omitempty"`
+	Completed bool              `json:"completed"`
+	Path      string            `json:"-"`
+}
+
+func (u *Upload) IsExpired() bool {
+	return !u.Expires.IsZero() && time.Now().After(u.Expires)
+}
+
+// Open opens the uploaded data for reading.
+func (u *Upload) Open() (*os.File, error) {
+	return os.Open(u.Path)
+}
+
+// MoveTo hands the finished upload's data off to the application.  The
+// upload's metadata is retained, so clients can still query its offset,
+// until it expires or is terminated.
+func (u *Upload) MoveTo(fn string) error {
+	if fn == u.Path {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(fn), 0775)
+	if err != nil {
+		return errors.Wrap(err, "can't make directory for " + fn)
+	}
+	err = os.Rename(u.Path, fn)
+	if err != nil {
+		return errors.Wrapf(err, "can't move upload %s to %s", u.ID, fn)
+	}
+	u.Path = fn
+	return nil
+}
+
+type store struct {
+	dir string
+	mutex *sync.Mutex
+	busy map[string]bool
+}
+
+func newStore(dir string) (*store, error) {
+	err := os.MkdirAll(dir, 0775)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create tus upload directory " + dir)
+	}
+	return &store{
+		dir: dir,
+		mutex: &sync.Mutex{},
+		busy: map[string]bool{},
+	}, nil
+}
+
+func (s *store) infoPath(id string) string {
+	return filepath.Join(s.dir, id + ".info")
+}
+
+func (s *store) dataPath(id string) string {
+	return filepath.Join(s.dir, id + ".bin")
+}
+
+func validID(id string) bool {
+	_, err := uuid.FromString(id)
+	return err == nil
+}
+
+func (s *store) create(length int64, metadata map[string]string, owner string, ttl time.Duration) (*Upload, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't generate upload id")
+	}
+	u := &Upload{
+		ID: id.String(),
+		Length: length,
+		Metadata: metadata,
+		Owner: owner,
+		Created: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		u.Expires = u.Created.Add(ttl)
+	}
+	u.Path = s.dataPath(u.ID)
+	f, err := os.OpenFile(u.Path, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0664)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create upload file")
+	}
+	f.Close()
+	err = s.save(u)
+	if err != nil {
+		os.Remove(u.Path)
+		return nil, err
+	}
+	return u, nil
+}
+
+// get reads an upload's info.  It doesn't touch the data, so it's safe
+// to call without the upload's lock, even while a chunk is being written.
+func (s *store) get(id string) (*Upload, error) {
+	if !validID(id) {
+		return nil, ErrUploadNotFound
+	}
+	data, err := ioutil.ReadFile(s.infoPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, errors.Wrap(err, "can't read upload info for " + id)
+	}
+	u := &Upload{}
+	err = json.Unmarshal(data, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decode upload info for " + id)
+	}
+	u.Path = s.dataPath(id)
+	return u, nil
+}
+
+func (s *store) save(u *Upload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return errors.Wrap(err, "can't encode upload info for " + u.ID)
+	}
+	fn := s.infoPath(u.ID)
+	tmp := fn + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0664)
+	if err != nil {
+		return errors.Wrap(err, "can't write upload info for " + u.ID)
+	}
+	return errors.Wrap(os.Rename(tmp, fn), "can't replace upload info for " + u.ID)
+}
+
+func (s *store) remove(u *Upload) error {
+	err := os.Remove(s.dataPath(u.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "can't remove upload data for " + u.ID)
+	}
+	err = os.Remove(s.infoPath(u.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "can't remove upload info for " + u.ID)
+	}
+	return nil
+}
+
+func (s *store) lock(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.busy[id] {
+		return false
+	}
+	s.busy[id] = true
+	return true
+}
+
+func (s *store) unlock(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.busy, id)
+}
+
+func (s *store) purge() error {
+	fns, err := filepath.Glob(filepath.Join(s.dir, "*.info"))
+	if err != nil {
+		return errors.Wrap(err, "can't list uploads")
+	}
+	for _, fn := range fns {
+		id := strings.TrimSuffix(filepath.Base(fn), ".info")
+		if !s.lock(id) {
+			continue
+		}
+		u, err := s.get(id)
+		if err == nil && u.IsExpired() {
+			err = s.remove(u)
+			if err != nil {
+				s.unlock(id)
+				return err
+			}
+		}
+		s.unlock(id)
+	}
+	return nil
+}
@@ -0,0 +1,425 @@
+package tus
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/httpserver/v2/auth"
+	"github.com/rclancey/logging"
+)
+
+const (
+	Version = "1.0.0"
+	Extensions = "creation,creation-with-upload,termination,checksum,expiration"
+	ChecksumAlgorithms = "sha1,sha256,md5"
+	OffsetContentType = "application/offset+octet-stream"
+	purgeInterval = time.Minute
+)
+
+const (
+	StatusChecksumMismatch = 460
+	StatusLocked = 423
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+var ErrUploadLocked = errors.New("upload is locked by another request")
+
+// CompleteFunc is called once all of an upload's data has been received.
+// The application may move the file out of the tus directory with
+// Upload.MoveTo.  An error is reported to the client that sent the final
+// chunk.
+type CompleteFunc func(r *http.Request, upload *Upload) error
+
+// Config is set up by ServerConfig.Init as its Tus field
+type Config = H.TusConfig
+
+type Handler struct {
+	cfg Config
+	store *store
+	onComplete CompleteFunc
+	mutex *sync.Mutex
+	lastPurge time.Time
+}
+
+// NewHandler creates a tus handler.  If cfg has no directory, tus uploads
+// are off, and it returns a nil handler that mounts nothing.
+func NewHandler(cfg Config, onComplete CompleteFunc) (*Handler, error) {
+	if cfg.Directory == "" {
+		return nil, nil
+	}
+	s, err := newStore(cfg.Directory)
+	if err != nil {
+		return nil, err
+	}
+	h := &Handler{
+		cfg: cfg,
+		store: s,
+		onComplete: onComplete,
+		mutex: &sync.Mutex{},
+	}
+	err = h.Purge()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Mount attaches the tus endpoints to router.  Uploads are created by
+// POSTing to the router's root and addressed as /:id beneath it.
+func (h *Handler) Mount(router H.Router) {
+	if h == nil {
+		return
+	}
+	router.OPTIONS("", h.wrap(h.options))
+	router.POST("", h.wrap(h.create))
+	router.Handle(http.MethodHead, "/:id", h.wrap(h.head))
+	router.PATCH("/:id", h.wrap(h.patch))
+	router.DELETE("/:id", h.wrap(h.terminate))
+	router.POST("/:id", h.wrap(h.override))
+}
+
+// Purge removes expired uploads
+func (h *Handler) Purge() error {
+	h.mutex.Lock()
+	h.lastPurge = time.Now()
+	h.mutex.Unlock()
+	return h.store.purge()
+}
+
+func (h *Handler) maybePurge(r *http.Request) {
+	h.mutex.Lock()
+	due := h.cfg.Expiration > 0 && time.Since(h.lastPurge) > purgeInterval
+	h.mutex.Unlock()
+	if due {
+		go func() {
+			err := h.Purge()
+			if err != nil {
+				logging.Errorln(r.Context(), "error purging expired tus uploads:", err)
+			}
+		}()
+	}
+}
+
+func (h *Handler) wrap(f H.HandlerFunc) H.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		w.Header().Set("Tus-Resumable", Version)
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != Version {
+			w.Header().Set("Tus-Version", Version)
+			return nil, H.PreconditionFailed.Wrap(errors.New("unsupported tus version " + r.Header.Get("Tus-Resumable")), "Unsupported tus version")
+		}
+		return f(w, r)
+	}
+}
+
+func (h *Handler) override(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	switch strings.ToUpper(r.Header.Get("X-HTTP-Method-Override")) {
+	case http.MethodPatch:
+		return h.patch(w, r)
+	case http.MethodDelete:
+		return h.terminate(w, r)
+	case http.MethodHead:
+		return h.head(w, r)
+	}
+	return nil, H.MethodNotAllowed.FromRequest(r)
+}
+
+func (h *Handler) options(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	hdr := w.Header()
+	hdr.Set("Tus-Version", Version)
+	hdr.Set("Tus-Extension", Extensions)
+	hdr.Set("Tus-Checksum-Algorithm", ChecksumAlgorithms)
+	if h.cfg.MaxSize > 0 {
+		hdr.Set("Tus-Max-Size", strconv.FormatInt(h.cfg.MaxSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil, nil
+}
+
+func owner(r *http.Request) string {
+	user := auth.UserFromRequest(r)
+	if user == nil {
+		return ""
+	}
+	return user.GetUsername()
+}
+
+func (h *Handler) getUpload(r *http.Request) (*Upload, error) {
+	id := H.ContextRequestVars(r.Context())["id"]
+	u, err := h.store.get(id)
+	if err != nil {
+		if err == ErrUploadNotFound {
+			return nil, H.NotFound.FromRequest(r)
+		}
+		return nil, err
+	}
+	if u.Owner != "" && u.Owner != owner(r) {
+		return nil, H.NotFound.FromRequest(r)
+	}
+	if u.IsExpired() {
+		return nil, H.Gone
+	}
+	return u, nil
+}
+
+func (h *Handler) setUploadHeaders(w http.ResponseWriter, u *Upload) {
+	hdr := w.Header()
+	hdr.Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	if !u.Expires.IsZero() {
+		hdr.Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+	}
+}
+
+func parseMetadata(s string) (map[string]string, error) {
+	md := map[string]string{}
+	if strings.TrimSpace(s) == "" {
+		return md, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if parts[0] == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		if len(parts) == 1 {
+			md[parts[0]] = ""
+			continue
+		}
+		val, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.Wrap(err, "bad metadata value for " + parts[0])
+		}
+		md[parts[0]] = string(val)
+	}
+	return md, nil
+}
+
+func formatMetadata(md map[string]string) string {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		if md[k] == "" {
+			pairs[i] = k
+		} else {
+			pairs[i] = k + " " + base64.StdEncoding.EncodeToString([]byte(md[k]))
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (h *Handler) create(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if r.Header.Get("X-HTTP-Method-Override") != "" {
+		return nil, H.MethodNotAllowed.FromRequest(r)
+	}
+	h.maybePurge(r)
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return nil, H.BadRequest.Wrap(err, "Missing or invalid Upload-Length")
+	}
+	if h.cfg.MaxSize > 0 && length > h.cfg.MaxSize {
+		return nil, H.RequestEntityTooLarge.Wrapf(errors.New("upload too large"), "Upload exceeds maximum size of %d bytes", h.cfg.MaxSize)
+	}
+	md, err := parseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return nil, H.BadRequest.Wrap(err, "Malformed Upload-Metadata")
+	}
+	u, err := h.store.create(length, md, owner(r), time.Duration(h.cfg.Expiration) * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	loc := H.ExternalURL(r)
+	loc.Path = path.Join(r.URL.Path, u.ID)
+	loc.RawPath = ""
+	loc.RawQuery = ""
+	w.Header().Set("Location", loc.String())
+	if length == 0 {
+		err = h.complete(r, u)
+		if err != nil {
+			return nil, err
+		}
+	} else if r.Header.Get("Content-Type") == OffsetContentType {
+		// creation-with-upload
+		if !h.store.lock(u.ID) {
+			return nil, H.NewAPIError(ErrUploadLocked, StatusLocked)
+		}
+		defer h.store.unlock(u.ID)
+		err = h.write(r, u)
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.setUploadHeaders(w, u)
+	w.WriteHeader(http.StatusCreated)
+	return nil, nil
+}
+
+func (h *Handler) head(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	u, err := h.getUpload(r)
+	if err != nil {
+		return nil, err
+	}
+	h.setUploadHeaders(w, u)
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if len(u.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatMetadata(u.Metadata))
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil, nil
+}
+
+func (h *Handler) patch(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if r.Header.Get("Content-Type") != OffsetContentType {
+		return nil, H.UnsupportedMediaType.Wrap(errors.New("bad content type " + r.Header.Get("Content-Type")), "Content-Type must be " + OffsetContentType)
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return nil, H.BadRequest.Wrap(err, "Missing or invalid Upload-Offset")
+	}
+	id := H.ContextRequestVars(r.Context())["id"]
+	if !h.store.lock(id) {
+		return nil, H.NewAPIError(ErrUploadLocked, StatusLocked)
+	}
+	defer h.store.unlock(id)
+	u, err := h.getUpload(r)
+	if err != nil {
+		return nil, err
+	}
+	if offset != u.Offset {
+		return nil, H.Conflict.Wrapf(errors.Errorf("offset %d != %d", offset, u.Offset), "Upload-Offset does not match current offset %d", u.Offset)
+	}
+	if u.Completed {
+		return nil, H.Forbidden.Wrap(errors.New("upload already complete"), "Upload already complete")
+	}
+	err = h.write(r, u)
+	if err != nil {
+		return nil, err
+	}
+	h.setUploadHeaders(w, u)
+	w.WriteHeader(http.StatusNoContent)
+	return nil, nil
+}
+
+func (h *Handler) terminate(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	id := H.ContextRequestVars(r.Context())["id"]
+	if !h.store.lock(id) {
+		return nil, H.NewAPIError(ErrUploadLocked, StatusLocked)
+	}
+	defer h.store.unlock(id)
+	u, err := h.getUpload(r)
+	if err != nil {
+		return nil, err
+	}
+	err = h.store.remove(u)
+	if err != nil {
+		return nil, err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil, nil
+}
+
+func checksumHash(header string) (hash.Hash, []byte, error) {
+	if header == "" {
+		return nil, nil, nil
+	}
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return nil, nil, H.BadRequest.Wrap(errors.New("malformed checksum " + header), "Malformed Upload-Checksum")
+	}
+	sum, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, H.BadRequest.Wrap(err, "Malformed Upload-Checksum")
+	}
+	switch strings.ToLower(parts[0]) {
+	case "sha1":
+		return sha1.New(), sum, nil
+	case "sha256":
+		return sha256.New(), sum, nil
+	case "md5":
+		return md5.New(), sum, nil
+	}
+	return nil, nil, H.BadRequest.Wrap(errors.New("unsupported checksum algorithm " + parts[0]), "Unsupported checksum algorithm")
+}
+
+// write appends the request body to the upload.  The caller must hold the
+// upload's lock.
+func (h *Handler) write(r *http.Request, u *Upload) error {
+	hasher, sum, err := checksumHash(r.Header.Get("Upload-Checksum"))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(u.Path, os.O_WRONLY, 0664)
+	if err != nil {
+		return errors.Wrap(err, "can't open upload file")
+	}
+	defer f.Close()
+	// the info file is written after the data, so after a crash or an
+	// interrupted chunk the data file may be ahead of the recorded offset
+	err = f.Truncate(u.Offset)
+	if err != nil {
+		return errors.Wrap(err, "can't truncate upload file")
+	}
+	_, err = f.Seek(u.Offset, io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "can't seek upload file")
+	}
+	var dst io.Writer = f
+	if hasher != nil {
+		dst = io.MultiWriter(f, hasher)
+	}
+	remaining := u.Length - u.Offset
+	n, err := io.Copy(dst, io.LimitReader(r.Body, remaining + 1))
+	if n > remaining {
+		f.Truncate(u.Offset)
+		return H.RequestEntityTooLarge.Wrap(errors.New("chunk exceeds upload length"), "Chunk exceeds Upload-Length")
+	}
+	if hasher != nil {
+		if err != nil || string(hasher.Sum(nil)) != string(sum) {
+			f.Truncate(u.Offset)
+			if err != nil {
+				return H.BadRequest.Wrap(err, "Failed to read chunk")
+			}
+			return H.NewAPIError(ErrChecksumMismatch, StatusChecksumMismatch)
+		}
+	}
+	if err != nil {
+		// keep whatever made it to disk; the client will resume from there
+		logging.Warnln(r.Context(), "tus upload", u.ID, "interrupted:", err)
+	}
+	u.Offset += n
+	if h.cfg.Expiration > 0 {
+		u.Expires = time.Now().UTC().Add(time.Duration(h.cfg.Expiration) * time.Second)
+	}
+	if u.Offset == u.Length {
+		return h.complete(r, u)
+	}
+	return h.store.save(u)
+}
+
+func (h *Handler) complete(r *http.Request, u *Upload) error {
+	u.Completed = true
+	err := h.store.save(u)
+	if err != nil {
+		return err
+	}
+	if h.onComplete == nil {
+		return nil
+	}
+	return h.onComplete(r, u)
+}
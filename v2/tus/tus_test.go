@@ -0,0 +1,195 @@
+package tus
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	H "github.com/rclancey/httpserver/v2"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TusSuite struct {
+	srv *H.Server
+	dir string
+	completed []string
+}
+
+var _ = Suite(&TusSuite{})
+
+func (s *TusSuite) SetUpTest(c *C) {
+	cfg := &H.ServerConfig{
+		ServerRoot: c.MkDir(),
+		CacheDirectory: "cache",
+		Tus: H.TusConfig{Directory: "tus", MaxSize: 100, Expiration: 3600},
+	}
+	c.Assert(cfg.Init(), IsNil)
+	c.Check(cfg.Tus.Directory, Equals, filepath.Join(cfg.ServerRoot, "cache", "tus"))
+	s.dir = cfg.Tus.Directory
+	srv, err := H.NewServer(cfg)
+	c.Assert(err, IsNil)
+	s.completed = nil
+	h, err := NewHandler(cfg.Tus, func(r *http.Request, u *Upload) error {
+		data, err := ioutil.ReadFile(u.Path)
+		s.completed = append(s.completed, u.Metadata["filename"] + ": " + string(data))
+		return err
+	})
+	c.Assert(err, IsNil)
+	h.Mount(srv.Prefix("/files"))
+	srv.Prefix("/").Compile(nil)
+	s.srv = srv
+}
+
+func (s *TusSuite) do(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://example.com" + path, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", Version)
+	for i := 0; i + 1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.srv.ServeHTTP(w, req)
+	return w
+}
+
+func (s *TusSuite) patch(path, body string, offset string, headers ...string) *httptest.ResponseRecorder {
+	return s.do(http.MethodPatch, path, body, append([]string{"Content-Type", OffsetContentType, "Upload-Offset", offset}, headers...)...)
+}
+
+func (s *TusSuite) create(c *C, length string) string {
+	w := s.do(http.MethodPost, "/files", "", "Upload-Length", length, "Upload-Metadata", "filename " + base64.StdEncoding.EncodeToString([]byte("hello.txt")))
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	u, err := url.Parse(w.Header().Get("Location"))
+	c.Assert(err, IsNil)
+	c.Check(u.Path, Matches, "/files/[-0-9a-f]{36}")
+	c.Check(w.Header().Get("Upload-Offset"), Equals, "0")
+	c.Check(w.Header().Get("Upload-Expires"), Not(Equals), "")
+	return u.Path
+}
+
+func (s *TusSuite) TestCreate(c *C) {
+	w := s.do(http.MethodOptions, "/files", "")
+	c.Check(w.Code, Equals, http.StatusNoContent)
+	c.Check(w.Header().Get("Tus-Max-Size"), Equals, "100")
+	c.Check(s.do(http.MethodPost, "/files", "", "Upload-Length", "101").Code, Equals, http.StatusRequestEntityTooLarge)
+	c.Check(s.do(http.MethodPost, "/files", "").Code, Equals, http.StatusBadRequest)
+	w = s.do(http.MethodPost, "/files", "", "Upload-Length", "11", "Tus-Resumable", "0.2.2")
+	c.Check(w.Code, Equals, http.StatusPreconditionFailed)
+	c.Check(w.Header().Get("Tus-Version"), Equals, Version)
+
+	loc := s.create(c, "11")
+	w = s.do(http.MethodHead, loc, "")
+	c.Check(w.Code, Equals, http.StatusOK)
+	c.Check(w.Header().Get("Upload-Offset"), Equals, "0")
+	c.Check(w.Header().Get("Upload-Length"), Equals, "11")
+	c.Check(w.Header().Get("Upload-Metadata"), Equals, "filename aGVsbG8udHh0")
+	c.Check(s.do(http.MethodHead, "/files/00000000-0000-0000-0000-000000000000", "").Code, Equals, http.StatusNotFound)
+
+	// an empty upload is complete as soon as it's made
+	s.create(c, "0")
+	c.Check(s.completed, DeepEquals, []string{"hello.txt: "})
+}
+
+func (s *TusSuite) TestResume(c *C) {
+	loc := s.create(c, "11")
+	w := s.patch(loc, "hello ", "0")
+	c.Check(w.Code, Equals, http.StatusNoContent)
+	c.Check(w.Header().Get("Upload-Offset"), Equals, "6")
+
+	// a client that lost track of where it was must ask first
+	w = s.patch(loc, "hello ", "0")
+	c.Check(w.Code, Equals, http.StatusConflict)
+	w = s.do(http.MethodHead, loc, "")
+	c.Check(w.Header().Get("Upload-Offset"), Equals, "6")
+	c.Check(s.patch(loc, "world", "6", "Content-Type", "text/plain").Code, Equals, http.StatusUnsupportedMediaType)
+	c.Check(s.patch(loc, "world!", "6").Code, Equals, http.StatusRequestEntityTooLarge)
+
+	c.Check(s.completed, HasLen, 0)
+	w = s.patch(loc, "world", "6")
+	c.Check(w.Code, Equals, http.StatusNoContent)
+	c.Check(w.Header().Get("Upload-Offset"), Equals, "11")
+	c.Check(s.completed, DeepEquals, []string{"hello.txt: hello world"})
+	c.Check(s.patch(loc, "", "11").Code, Equals, http.StatusForbidden)
+
+	c.Check(s.do(http.MethodDelete, loc, "").Code, Equals, http.StatusNoContent)
+	c.Check(s.do(http.MethodHead, loc, "").Code, Equals, http.StatusNotFound)
+}
+
+func (s *TusSuite) TestHeadDuringPatch(c *C) {
+	loc := s.create(c, "11")
+	fn := filepath.Join(s.dir, path.Base(loc) + ".bin")
+	body, bodyw := io.Pipe()
+	req := httptest.NewRequest(http.MethodPatch, "http://example.com" + loc, body)
+	req.Header.Set("Tus-Resumable", Version)
+	req.Header.Set("Content-Type", OffsetContentType)
+	req.Header.Set("Upload-Offset", "0")
+	w := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		s.srv.ServeHTTP(w, req)
+		close(done)
+	}()
+	bodyw.Write([]byte("hello "))
+	for i := 0; i < 100; i++ {
+		st, err := os.Stat(fn)
+		if err == nil && st.Size() == 6 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// polling while the chunk is still coming in reports the saved
+	// offset, and leaves the data alone
+	head := s.do(http.MethodHead, loc, "")
+	c.Check(head.Code, Equals, http.StatusOK)
+	c.Check(head.Header().Get("Upload-Offset"), Equals, "0")
+	st, err := os.Stat(fn)
+	c.Assert(err, IsNil)
+	c.Check(st.Size(), Equals, int64(6))
+	c.Check(s.patch(loc, "hello world", "0").Code, Equals, StatusLocked)
+
+	bodyw.Write([]byte("world"))
+	bodyw.Close()
+	<-done
+	c.Check(w.Code, Equals, http.StatusNoContent)
+	c.Check(w.Header().Get("Upload-Offset"), Equals, "11")
+	c.Check(s.completed, DeepEquals, []string{"hello.txt: hello world"})
+}
+
+func (s *TusSuite) TestChecksum(c *C) {
+	loc := s.create(c, "11")
+	sum := func(data string) string {
+		h := sha1.Sum([]byte(data))
+		return "sha1 " + base64.StdEncoding.EncodeToString(h[:])
+	}
+	w := s.patch(loc, "hello world", "0", "Upload-Checksum", sum("hello there"))
+	c.Check(w.Code, Equals, StatusChecksumMismatch)
+	w = s.do(http.MethodHead, loc, "")
+	c.Check(w.Header().Get("Upload-Offset"), Equals, "0")
+	c.Check(s.patch(loc, "hello world", "0", "Upload-Checksum", "crc32 AAAA").Code, Equals, http.StatusBadRequest)
+	c.Check(s.completed, HasLen, 0)
+
+	w = s.patch(loc, "hello world", "0", "Upload-Checksum", sum("hello world"))
+	c.Check(w.Code, Equals, http.StatusNoContent)
+	c.Check(s.completed, DeepEquals, []string{"hello.txt: hello world"})
+}
+
+func (s *TusSuite) TestDisabled(c *C) {
+	h, err := NewHandler(Config{}, nil)
+	c.Check(err, IsNil)
+	c.Check(h, IsNil)
+	router := H.NewRouter()
+	h.Mount(router)
+	c.Check(router.Routes(), HasLen, 0)
+}
@@ -0,0 +1,300 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/logging"
+)
+
+const (
+	sniffLen = 512
+	maxUploadValueSize = 1024 * 1024
+)
+
+var (
+	ErrUploadTooLarge = errors.New("upload too large")
+	ErrUploadType = errors.New("upload type not allowed")
+)
+
+type UploadConfig struct {
+	Directory    string   `json:"directory"      arg:"dir"`
+	MaxFileSize  int64    `json:"max_file_size"  arg:"max-file-size"`
+	MaxTotalSize int64    `json:"max_total_size" arg:"max-total-size"`
+	AllowedTypes []string `json:"allowed_types"  arg:"allowed-types"`
+}
+
+func (cfg *UploadConfig) Init(cacheDir string) error {
+	if cfg.Directory == "" {
+		return nil
+	}
+	dn, err := MakeRootAbs(cacheDir, cfg.Directory)
+	if err != nil {
+		return errors.Wrap(err, "can't make abs path for upload directory " + cfg.Directory)
+	}
+	err = checkWritableDir(dn)
+	if err != nil {
+		return errors.Wrapf(err, "upload directory %s not writable", dn)
+	}
+	cfg.Directory = dn
+	return nil
+}
+
+// TusConfig configures resumable uploads served by the tus package.  It
+// lives here so it can be part of ServerConfig.  Uploads are off if
+// there's no Directory.
+type TusConfig struct {
+	Directory  string `json:"directory"  arg:"dir"`
+	MaxSize    int64  `json:"max_size"   arg:"max-size"`
+	Expiration int    `json:"expiration" arg:"expiration"`
+}
+
+func (cfg *TusConfig) Init(cacheDir string) error {
+	if cfg.Directory == "" {
+		return nil
+	}
+	dn, err := MakeRootAbs(cacheDir, cfg.Directory)
+	if err != nil {
+		return errors.Wrap(err, "can't make abs path for tus directory " + cfg.Directory)
+	}
+	err = checkWritableDir(dn)
+	if err != nil {
+		return errors.Wrapf(err, "tus directory %s not writable", dn)
+	}
+	cfg.Directory = dn
+	return nil
+}
+
+func (cfg *UploadConfig) allowed(contentType string) bool {
+	if len(cfg.AllowedTypes) == 0 {
+		return true
+	}
+	for _, pattern := range cfg.AllowedTypes {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*/*" || pattern == contentType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, pattern[:len(pattern) - 1]) {
+			return true
+		}
+	}
+	return false
+}
+
+type UploadedFile struct {
+	FieldName   string `json:"field"`
+	FileName    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Path        string `json:"-"`
+	mutex       *sync.Mutex
+	claimed     bool
+}
+
+// Open opens the uploaded file for reading.
+func (f *UploadedFile) Open() (*os.File, error) {
+	return os.Open(f.Path)
+}
+
+// Claim takes ownership of the uploaded file, so it won't be removed when
+// the request ends.  The caller becomes responsible for the file at the
+// returned path.
+func (f *UploadedFile) Claim() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.claimed = true
+	return f.Path
+}
+
+// MoveTo moves the uploaded file to fn and claims it.
+func (f *UploadedFile) MoveTo(fn string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err := EnsureDir(fn)
+	if err != nil {
+		return errors.Wrap(err, "can't ensure directory for " + fn)
+	}
+	err = os.Rename(f.Path, fn)
+	if err != nil {
+		src, err := os.Open(f.Path)
+		if err != nil {
+			return errors.Wrap(err, "can't open upload " + f.Path)
+		}
+		_, err = CopyToFile(src, fn, true)
+		src.Close()
+		if err != nil {
+			return errors.Wrap(err, "can't copy upload to " + fn)
+		}
+		os.Remove(f.Path)
+	}
+	f.Path = fn
+	f.claimed = true
+	return nil
+}
+
+func (f *UploadedFile) remove() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.claimed && f.Path != "" {
+		os.Remove(f.Path)
+	}
+}
+
+type Uploads struct {
+	Files  []*UploadedFile
+	Values url.Values
+}
+
+// File returns the first file uploaded with the given form field name
+func (u *Uploads) File(field string) *UploadedFile {
+	for _, f := range u.Files {
+		if f.FieldName == field {
+			return f
+		}
+	}
+	return nil
+}
+
+func (u *Uploads) FilesFor(field string) []*UploadedFile {
+	files := []*UploadedFile{}
+	for _, f := range u.Files {
+		if f.FieldName == field {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// Cleanup removes any uploaded files that haven't been claimed.  It's
+// called automatically at the end of the request when the request went
+// through the server's context middleware.
+func (u *Uploads) Cleanup() {
+	for _, f := range u.Files {
+		f.remove()
+	}
+}
+
+// ReceiveUploads streams a multipart/form-data request body to temporary
+// files without buffering whole files in memory.  If cfg is nil, the
+// server's upload configuration is used.
+func ReceiveUploads(req *http.Request, cfg *UploadConfig) (*Uploads, error) {
+	if cfg == nil {
+		scfg := ContextServerConfig(req.Context())
+		if scfg != nil {
+			cfg = &scfg.Uploads
+		} else {
+			cfg = &UploadConfig{}
+		}
+	}
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return nil, BadRequest.Wrap(err, "Expected multipart/form-data payload")
+	}
+	uploads := &Uploads{
+		Files: []*UploadedFile{},
+		Values: url.Values{},
+	}
+	var total int64
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			uploads.Cleanup()
+			return nil, BadRequest.Wrap(err, "Malformed multipart payload")
+		}
+		var limit int64 = -1
+		if cfg.MaxTotalSize > 0 {
+			limit = cfg.MaxTotalSize - total
+		}
+		if part.FileName() == "" {
+			if limit < 0 || limit > maxUploadValueSize {
+				limit = maxUploadValueSize
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(part, limit + 1))
+			part.Close()
+			if err != nil {
+				uploads.Cleanup()
+				return nil, BadRequest.Wrap(err, "Failed to read form value")
+			}
+			if int64(len(data)) > limit {
+				uploads.Cleanup()
+				return nil, RequestEntityTooLarge.Wrapf(ErrUploadTooLarge, "Form value %s too large", part.FormName())
+			}
+			total += int64(len(data))
+			uploads.Values.Add(part.FormName(), string(data))
+			continue
+		}
+		if cfg.MaxFileSize > 0 && (limit < 0 || cfg.MaxFileSize < limit) {
+			limit = cfg.MaxFileSize
+		}
+		f, err := receiveUploadPart(part, cfg, limit)
+		part.Close()
+		if f != nil {
+			uploads.Files = append(uploads.Files, f)
+		}
+		if err != nil {
+			uploads.Cleanup()
+			return nil, err
+		}
+		total += f.Size
+	}
+	if !OnRequestDone(req, uploads.Cleanup) {
+		logging.Warnln(req.Context(), "uploads received outside of server request context; caller must call Cleanup()")
+	}
+	return uploads, nil
+}
+
+func receiveUploadPart(part *multipart.Part, cfg *UploadConfig, limit int64) (*UploadedFile, error) {
+	sniff := make([]byte, sniffLen)
+	n, err := io.ReadFull(part, sniff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, BadRequest.Wrap(err, "Failed to read uploaded file")
+	}
+	sniff = sniff[:n]
+	ct, _, _ := mime.ParseMediaType(http.DetectContentType(sniff))
+	if !cfg.allowed(ct) {
+		return nil, UnsupportedMediaType.Wrapf(ErrUploadType, "File type %s not allowed", ct)
+	}
+	dst, err := ioutil.TempFile(cfg.Directory, "upload-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create upload file")
+	}
+	f := &UploadedFile{
+		FieldName: part.FormName(),
+		FileName: part.FileName(),
+		ContentType: ct,
+		Path: dst.Name(),
+		mutex: &sync.Mutex{},
+	}
+	defer dst.Close()
+	h := sha256.New()
+	w := io.MultiWriter(dst, h)
+	var src io.Reader = io.MultiReader(bytes.NewReader(sniff), part)
+	if limit >= 0 {
+		src = io.LimitReader(src, limit + 1)
+	}
+	size, err := io.Copy(w, src)
+	if err != nil {
+		return f, BadRequest.Wrap(err, "Failed to receive uploaded file")
+	}
+	if limit >= 0 && size > limit {
+		return f, RequestEntityTooLarge.Wrapf(ErrUploadTooLarge, "File %s too large", f.FileName)
+	}
+	f.Size = size
+	f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return f, nil
+}
@@ -0,0 +1,95 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+type UploadSuite struct {
+	dir string
+}
+
+var _ = Suite(&UploadSuite{})
+
+func (s *UploadSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *UploadSuite) makeRequest(c *C, files map[string][]byte, values map[string]string) *http.Request {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	for k, v := range values {
+		mw.WriteField(k, v)
+	}
+	for name, data := range files {
+		w, err := mw.CreateFormFile(name, name + ".dat")
+		c.Assert(err, IsNil)
+		w.Write(data)
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func (s *UploadSuite) TestReceive(c *C) {
+	png := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), bytes.Repeat([]byte{0}, 2000)...)
+	req := s.makeRequest(c, map[string][]byte{"image": png}, map[string]string{"title": "hello"})
+	cfg := &UploadConfig{Directory: s.dir, AllowedTypes: []string{"image/*"}}
+	uploads, err := ReceiveUploads(req, cfg)
+	c.Assert(err, IsNil)
+	c.Check(uploads.Values.Get("title"), Equals, "hello")
+	f := uploads.File("image")
+	c.Assert(f, NotNil)
+	c.Check(f.FileName, Equals, "image.dat")
+	c.Check(f.ContentType, Equals, "image/png")
+	c.Check(f.Size, Equals, int64(len(png)))
+	sum := sha256.Sum256(png)
+	c.Check(f.SHA256, Equals, hex.EncodeToString(sum[:]))
+	data, err := ioutil.ReadFile(f.Path)
+	c.Check(err, IsNil)
+	c.Check(bytes.Equal(data, png), Equals, true)
+	uploads.Cleanup()
+	_, err = os.Stat(f.Path)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *UploadSuite) TestClaim(c *C) {
+	req := s.makeRequest(c, map[string][]byte{"doc": []byte("just some text")}, nil)
+	uploads, err := ReceiveUploads(req, &UploadConfig{Directory: s.dir})
+	c.Assert(err, IsNil)
+	f := uploads.File("doc")
+	c.Assert(f, NotNil)
+	fn := f.Claim()
+	uploads.Cleanup()
+	_, err = os.Stat(fn)
+	c.Check(err, IsNil)
+}
+
+func (s *UploadSuite) TestLimits(c *C) {
+	req := s.makeRequest(c, map[string][]byte{"doc": bytes.Repeat([]byte("x"), 1000)}, nil)
+	_, err := ReceiveUploads(req, &UploadConfig{Directory: s.dir, MaxFileSize: 999})
+	c.Check(err, NotNil)
+	c.Check(err.(HTTPError).StatusCode(), Equals, http.StatusRequestEntityTooLarge)
+	req = s.makeRequest(c, map[string][]byte{"a": bytes.Repeat([]byte("x"), 600), "b": bytes.Repeat([]byte("y"), 600)}, nil)
+	_, err = ReceiveUploads(req, &UploadConfig{Directory: s.dir, MaxFileSize: 1000, MaxTotalSize: 1000})
+	c.Check(err, NotNil)
+	c.Check(err.(HTTPError).StatusCode(), Equals, http.StatusRequestEntityTooLarge)
+	entries, _ := ioutil.ReadDir(s.dir)
+	c.Check(entries, HasLen, 0)
+}
+
+func (s *UploadSuite) TestSniffedType(c *C) {
+	req := s.makeRequest(c, map[string][]byte{"image": []byte("<html><body>not an image</body></html>")}, nil)
+	_, err := ReceiveUploads(req, &UploadConfig{Directory: s.dir, AllowedTypes: []string{"image/png", "image/jpeg"}})
+	c.Check(err, NotNil)
+	c.Check(err.(HTTPError).StatusCode(), Equals, http.StatusUnsupportedMediaType)
+}
@@ -0,0 +1,686 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/logging"
+)
+
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceLeastConn = "least-conn"
+	BalanceHash = "hash"
+)
+
+const DefaultMaxReplayBody = 1024 * 1024
+
+type HealthCheckConfig struct {
+	Path         string `json:"path"          arg:"path"`
+	Interval     int    `json:"interval"      arg:"interval"`
+	Timeout      int    `json:"timeout"       arg:"timeout"`
+	ExpectStatus int    `json:"expect_status" arg:"expect-status"`
+	Healthy      int    `json:"healthy"       arg:"healthy"`
+	Unhealthy    int    `json:"unhealthy"     arg:"unhealthy"`
+}
+
+// UpstreamConfig describes a named pool of backends that share traffic.
+// Times are in seconds.
+type UpstreamConfig struct {
+	Name               string            `json:"name"`
+	Backends           []string          `json:"backends"`
+	Balance            string            `json:"balance"`
+	HashBy             string            `json:"hash_by"`
+	HealthCheck        HealthCheckConfig `json:"health_check"`
+	MaxFails           int               `json:"max_fails"`
+	EjectTime          int               `json:"eject_time"`
+	BreakerThreshold   float64           `json:"breaker_threshold"`
+	BreakerMinRequests int               `json:"breaker_min_requests"`
+	BreakerWindow      int               `json:"breaker_window"`
+	BreakerTimeout     int               `json:"breaker_timeout"`
+	Retries            int               `json:"retries"`
+	MaxReplayBody      int64             `json:"max_replay_body"`
+	Timeout            int               `json:"timeout"`
+	backends           []*url.URL
+}
+
+func (cfg *UpstreamConfig) Init() error {
+	if cfg.Name == "" {
+		return errors.New("upstream has no name")
+	}
+	if len(cfg.Backends) == 0 {
+		return errors.Errorf("upstream %s has no backends", cfg.Name)
+	}
+	cfg.backends = make([]*url.URL, len(cfg.Backends))
+	for i, s := range cfg.Backends {
+		u, err := url.Parse(s)
+		if err != nil {
+			return errors.Wrapf(err, "upstream %s has invalid backend %s", cfg.Name, s)
+		}
+		if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.Errorf("upstream %s backend %s is not an http(s) url", cfg.Name, s)
+		}
+		cfg.backends[i] = u
+	}
+	switch cfg.Balance {
+	case "":
+		cfg.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn:
+	case BalanceHash:
+		if cfg.HashBy == "" {
+			cfg.HashBy = "ip"
+		}
+		if cfg.HashBy != "ip" && !strings.HasPrefix(cfg.HashBy, "header:") && !strings.HasPrefix(cfg.HashBy, "cookie:") {
+			return errors.Errorf("upstream %s can't hash by %s", cfg.Name, cfg.HashBy)
+		}
+	default:
+		return errors.Errorf("upstream %s has unknown balance method %s", cfg.Name, cfg.Balance)
+	}
+	if cfg.BreakerThreshold < 0 || cfg.BreakerThreshold > 1 {
+		return errors.Errorf("upstream %s breaker threshold must be between 0 and 1", cfg.Name)
+	}
+	if cfg.HealthCheck.Path != "" && !strings.HasPrefix(cfg.HealthCheck.Path, "/") {
+		cfg.HealthCheck.Path = "/" + cfg.HealthCheck.Path
+	}
+	return nil
+}
+
+func orDefault(n, def int) int {
+	if n > 0 {
+		return n
+	}
+	return def
+}
+
+// Backend is one server in an Upstream pool
+type Backend struct {
+	URL *url.URL
+	pool *Upstream
+	active int64
+	mutex *sync.Mutex
+	healthy bool
+	checkPassed int
+	checkFailed int
+	fails int
+	ejectedUntil time.Time
+}
+
+func (b *Backend) labels() map[string]string {
+	return map[string]string{"upstream": b.pool.Name, "backend": b.URL.String()}
+}
+
+// Healthy reports whether the backend is passing its health checks
+func (b *Backend) Healthy() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.healthy
+}
+
+// Ejected reports whether the backend has been taken out of rotation
+// for failing too many requests in a row
+func (b *Backend) Ejected() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return time.Now().Before(b.ejectedUntil)
+}
+
+// ActiveRequests returns the number of requests in flight to the backend
+func (b *Backend) ActiveRequests() int {
+	return int(atomic.LoadInt64(&b.active))
+}
+
+func (b *Backend) available(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.healthy && !now.Before(b.ejectedUntil)
+}
+
+func (b *Backend) begin() {
+	b.pool.metrics.Measure("upstream_backend_active", b.labels(), float64(atomic.AddInt64(&b.active, 1)))
+}
+
+func (b *Backend) end() {
+	b.pool.metrics.Measure("upstream_backend_active", b.labels(), float64(atomic.AddInt64(&b.active, -1)))
+}
+
+// record tracks consecutive failed requests, ejecting the backend after
+// too many
+func (b *Backend) record(success bool) {
+	labels := b.labels()
+	if success {
+		labels["outcome"] = "success"
+	} else {
+		labels["outcome"] = "failure"
+	}
+	b.pool.metrics.Count("upstream_requests", labels)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if success {
+		b.fails = 0
+		return
+	}
+	b.fails += 1
+	if b.fails >= orDefault(b.pool.cfg.MaxFails, 5) {
+		b.fails = 0
+		b.ejectedUntil = time.Now().Add(time.Duration(orDefault(b.pool.cfg.EjectTime, 30)) * time.Second)
+		b.pool.metrics.Measure("upstream_backend_ejected", b.labels(), 1)
+		time.AfterFunc(time.Until(b.ejectedUntil), func() {
+			b.pool.metrics.Measure("upstream_backend_ejected", b.labels(), 0)
+		})
+	}
+}
+
+func (b *Backend) recordCheck(ok bool) {
+	cfg := &b.pool.cfg.HealthCheck
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if ok {
+		b.checkFailed = 0
+		b.checkPassed += 1
+		if !b.healthy && b.checkPassed >= orDefault(cfg.Healthy, 2) {
+			b.healthy = true
+			b.pool.metrics.Measure("upstream_backend_healthy", b.labels(), 1)
+		}
+	} else {
+		b.checkPassed = 0
+		b.checkFailed += 1
+		if b.healthy && b.checkFailed >= orDefault(cfg.Unhealthy, 3) {
+			b.healthy = false
+			b.pool.metrics.Measure("upstream_backend_healthy", b.labels(), 0)
+		}
+	}
+}
+
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// circuitBreaker fails requests to a pool fast once too many of them are
+// failing, then lets a single probe request through now and then to see
+// whether it has recovered
+type circuitBreaker struct {
+	mutex *sync.Mutex
+	threshold float64
+	minRequests int
+	window time.Duration
+	timeout time.Duration
+	state int
+	openedAt time.Time
+	probing bool
+	windowStart time.Time
+	requests int
+	failures int
+	onChange func(int)
+}
+
+func (cb *circuitBreaker) setState(state int) {
+	if cb.state != state {
+		cb.state = state
+		if cb.onChange != nil {
+			cb.onChange(state)
+		}
+	}
+}
+
+func (cb *circuitBreaker) allow() (ok bool, probe bool) {
+	if cb.threshold <= 0 {
+		return true, false
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cb.timeout {
+			return false, false
+		}
+		cb.setState(breakerHalfOpen)
+		cb.probing = true
+		return true, true
+	case breakerHalfOpen:
+		if cb.probing {
+			return false, false
+		}
+		cb.probing = true
+		return true, true
+	}
+	return true, false
+}
+
+func (cb *circuitBreaker) record(success, probe bool) {
+	if cb.threshold <= 0 {
+		return
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	now := time.Now()
+	if probe {
+		cb.probing = false
+		if success {
+			cb.setState(breakerClosed)
+			cb.windowStart = now
+			cb.requests = 0
+			cb.failures = 0
+		} else {
+			cb.setState(breakerOpen)
+			cb.openedAt = now
+		}
+		return
+	}
+	if cb.state != breakerClosed {
+		return
+	}
+	if now.Sub(cb.windowStart) > cb.window {
+		cb.windowStart = now
+		cb.requests = 0
+		cb.failures = 0
+	}
+	cb.requests += 1
+	if !success {
+		cb.failures += 1
+	}
+	if cb.requests >= cb.minRequests && float64(cb.failures) / float64(cb.requests) >= cb.threshold {
+		cb.setState(breakerOpen)
+		cb.openedAt = now
+	}
+}
+
+// abandon gives up a probe slot without recording an outcome
+func (cb *circuitBreaker) abandon(probe bool) {
+	if !probe {
+		return
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.probing = false
+}
+
+type ringPoint struct {
+	hash uint32
+	backend *Backend
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// Upstream is a pool of backends that requests are balanced across.  It
+// is an http.Handler that proxies each request to one of them, retrying
+// idempotent requests on another backend when one fails.
+type Upstream struct {
+	Name string
+	cfg *UpstreamConfig
+	backends []*Backend
+	ring []ringPoint
+	next uint64
+	proxy *ReverseProxy
+	breaker *circuitBreaker
+	client *http.Client
+	stop chan bool
+	mutex *sync.Mutex
+	metrics *Metrics
+}
+
+// NewUpstream creates a pool that reports to the default metrics
+// registry.  Use Server.NewUpstream for a pool that shares a server's
+// transport settings and metrics.
+func NewUpstream(cfg *UpstreamConfig, transport http.RoundTripper) (*Upstream, error) {
+	proxy := NewReverseProxy(nil)
+	proxy.Transport = transport
+	return newUpstream(cfg, proxy, metricsSingleton)
+}
+
+// NewUpstream creates a pool that shares the server's upstream
+// connection pool, upgrade idle timeout and metrics registry.  It isn't
+// added to the server's named upstreams.
+func (srv *Server) NewUpstream(cfg *UpstreamConfig) (*Upstream, error) {
+	return newUpstream(cfg, srv.NewReverseProxy(nil), srv.Metrics())
+}
+
+func newUpstream(cfg *UpstreamConfig, proxy *ReverseProxy, metrics *Metrics) (*Upstream, error) {
+	if cfg.backends == nil {
+		err := cfg.Init()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if proxy.Transport == nil {
+		proxy.Transport = DefaultProxyTransport
+	}
+	u := &Upstream{
+		Name: cfg.Name,
+		cfg: cfg,
+		backends: make([]*Backend, len(cfg.backends)),
+		ring: []ringPoint{},
+		proxy: proxy,
+		client: &http.Client{
+			Transport: proxy.Transport,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		mutex: &sync.Mutex{},
+		metrics: metrics,
+	}
+	u.breaker = &circuitBreaker{
+		mutex: &sync.Mutex{},
+		threshold: cfg.BreakerThreshold,
+		minRequests: orDefault(cfg.BreakerMinRequests, 20),
+		window: time.Duration(orDefault(cfg.BreakerWindow, 10)) * time.Second,
+		timeout: time.Duration(orDefault(cfg.BreakerTimeout, 30)) * time.Second,
+		windowStart: time.Now(),
+		onChange: func(state int) {
+			metrics.Measure("upstream_breaker_state", map[string]string{"upstream": cfg.Name}, float64(state))
+		},
+	}
+	u.proxy.Timeout = time.Duration(cfg.Timeout) * time.Second
+	u.proxy.ModifyResponse = u.modifyResponse
+	u.proxy.ErrorHandler = u.handleError
+	for i, bu := range cfg.backends {
+		b := &Backend{
+			URL: bu,
+			pool: u,
+			mutex: &sync.Mutex{},
+			healthy: true,
+		}
+		u.backends[i] = b
+		metrics.Measure("upstream_backend_healthy", b.labels(), 1)
+		metrics.Measure("upstream_backend_active", b.labels(), 0)
+		for j := 0; j < 64; j++ {
+			u.ring = append(u.ring, ringPoint{hash32(bu.String() + "#" + strconv.Itoa(j)), b})
+		}
+	}
+	sort.Slice(u.ring, func(i, j int) bool { return u.ring[i].hash < u.ring[j].hash })
+	metrics.Measure("upstream_breaker_state", map[string]string{"upstream": cfg.Name}, breakerClosed)
+	return u, nil
+}
+
+// Backends returns the servers in the pool
+func (u *Upstream) Backends() []*Backend {
+	return u.backends
+}
+
+// Start begins active health checking, if the pool is configured for it
+func (u *Upstream) Start() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.stop != nil || u.cfg.HealthCheck.Path == "" {
+		return
+	}
+	u.stop = make(chan bool)
+	go u.healthCheckLoop(u.stop)
+}
+
+func (u *Upstream) Stop() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.stop != nil {
+		close(u.stop)
+		u.stop = nil
+	}
+}
+
+func (u *Upstream) healthCheckLoop(stop chan bool) {
+	ticker := time.NewTicker(time.Duration(orDefault(u.cfg.HealthCheck.Interval, 10)) * time.Second)
+	defer ticker.Stop()
+	for {
+		u.CheckHealth()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckHealth runs one round of health checks against every backend
+func (u *Upstream) CheckHealth() {
+	wg := &sync.WaitGroup{}
+	for _, b := range u.backends {
+		wg.Add(1)
+		go func(b *Backend) {
+			b.recordCheck(u.checkBackend(b))
+			wg.Done()
+		}(b)
+	}
+	wg.Wait()
+}
+
+func (u *Upstream) checkBackend(b *Backend) bool {
+	cfg := &u.cfg.HealthCheck
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(orDefault(cfg.Timeout, 5)) * time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL.ResolveReference(&url.URL{Path: cfg.Path}).String(), nil)
+	if err != nil {
+		return false
+	}
+	res, err := u.client.Do(req)
+	if err != nil {
+		return false
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64 * 1024))
+	res.Body.Close()
+	if cfg.ExpectStatus != 0 {
+		return res.StatusCode == cfg.ExpectStatus
+	}
+	return res.StatusCode >= 200 && res.StatusCode < 400
+}
+
+func (u *Upstream) hashKey(r *http.Request) string {
+	by := u.cfg.HashBy
+	switch {
+	case strings.HasPrefix(by, "header:"):
+		return r.Header.Get(strings.TrimPrefix(by, "header:"))
+	case strings.HasPrefix(by, "cookie:"):
+		c, err := r.Cookie(strings.TrimPrefix(by, "cookie:"))
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+	return parseAddr(r.RemoteAddr)
+}
+
+// pick chooses the backend for the next attempt, skipping backends that
+// are down or have already been tried
+func (u *Upstream) pick(r *http.Request, tried map[*Backend]bool) *Backend {
+	now := time.Now()
+	usable := func(b *Backend) bool {
+		return !tried[b] && b.available(now)
+	}
+	if u.cfg.Balance == BalanceHash {
+		key := u.hashKey(r)
+		if key != "" {
+			h := hash32(key)
+			start := sort.Search(len(u.ring), func(i int) bool { return u.ring[i].hash >= h })
+			for i := 0; i < len(u.ring); i++ {
+				b := u.ring[(start + i) % len(u.ring)].backend
+				if usable(b) {
+					return b
+				}
+			}
+			return nil
+		}
+	}
+	n := len(u.backends)
+	offset := int(atomic.AddUint64(&u.next, 1) % uint64(n))
+	var best *Backend
+	for i := 0; i < n; i++ {
+		b := u.backends[(offset + i) % n]
+		if !usable(b) {
+			continue
+		}
+		if u.cfg.Balance != BalanceLeastConn {
+			return b
+		}
+		if best == nil || b.ActiveRequests() < best.ActiveRequests() {
+			best = b
+		}
+	}
+	return best
+}
+
+type upstreamAttempt struct {
+	canRetry bool
+	retry bool
+	status int
+	err error
+}
+
+type upstreamCtxKey string
+
+func contextAttempt(ctx context.Context) *upstreamAttempt {
+	att, _ := ctx.Value(upstreamCtxKey("attempt")).(*upstreamAttempt)
+	return att
+}
+
+var errRetryableStatus = errors.New("retryable upstream status")
+
+func isGatewayFailure(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+func (u *Upstream) modifyResponse(res *http.Response) error {
+	att := contextAttempt(res.Request.Context())
+	if att == nil {
+		return nil
+	}
+	att.status = res.StatusCode
+	if att.canRetry && isGatewayFailure(res.StatusCode) {
+		// drop the response and try another backend
+		att.retry = true
+		return errRetryableStatus
+	}
+	return nil
+}
+
+func (u *Upstream) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	att := contextAttempt(r.Context())
+	if att == nil {
+		proxyError(w, r, err)
+		return
+	}
+	att.err = err
+	if att.canRetry && r.Context().Err() != context.Canceled {
+		att.retry = true
+		return
+	}
+	att.retry = false
+	proxyError(w, r, err)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// replayBody buffers the request body so that it can be sent again on a
+// retry.  It returns nil if the body is too large to buffer, in which case
+// r.Body still yields the whole body.
+func replayBody(r *http.Request, max int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return []byte{}, nil
+	}
+	if r.ContentLength > max {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, max + 1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > max {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, nil
+	}
+	return buf, nil
+}
+
+func (u *Upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ok, probe := u.breaker.allow()
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(u.breaker.timeout.Seconds())))
+		sendError(w, r, ServiceUnavailable.Wrapf(errors.Errorf("circuit breaker for upstream %s is open", u.Name), "Service temporarily unavailable"))
+		return
+	}
+	attempts := 1
+	var body []byte
+	if isIdempotent(r.Method) && !isUpgradeRequest(r) {
+		max := u.cfg.MaxReplayBody
+		if max == 0 {
+			max = DefaultMaxReplayBody
+		}
+		var err error
+		body, err = replayBody(r, max)
+		if err != nil {
+			u.breaker.abandon(probe)
+			sendError(w, r, BadRequest.Wrap(err, "Failed to read request payload"))
+			return
+		}
+		if body != nil {
+			attempts += orDefault(u.cfg.Retries, 0)
+		}
+	}
+	tried := map[*Backend]bool{}
+	var att *upstreamAttempt
+	for i := 0; i < attempts; i++ {
+		b := u.pick(r, tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+		if i > 0 {
+			u.metrics.Count("upstream_retries", map[string]string{"upstream": u.Name})
+			logging.FromContext(r.Context()).Infof("retrying %s %s on %s after %v", r.Method, r.URL.Path, b.URL, att.err)
+		}
+		att = &upstreamAttempt{canRetry: i + 1 < attempts}
+		ar := r.WithContext(context.WithValue(r.Context(), upstreamCtxKey("attempt"), att))
+		if body != nil && len(body) > 0 {
+			ar.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		b.begin()
+		u.proxy.ServeURL(w, ar, joinURL(b.URL, r))
+		b.end()
+		if r.Context().Err() == context.Canceled {
+			// the client gave up, which says nothing about the backend
+			u.breaker.abandon(probe)
+			return
+		}
+		success := att.err == nil && !isGatewayFailure(att.status)
+		b.record(success)
+		if !att.retry {
+			u.breaker.record(success, probe)
+			return
+		}
+		if att.err == errRetryableStatus {
+			att.err = errors.Errorf("status %d", att.status)
+		}
+	}
+	u.breaker.record(false, probe)
+	if att != nil && att.err != nil {
+		// every attempt failed before anything was sent to the client
+		proxyError(w, r, att.err)
+		return
+	}
+	sendError(w, r, ServiceUnavailable.Wrapf(errors.Errorf("no available backends in upstream %s", u.Name), "Service temporarily unavailable"))
+}
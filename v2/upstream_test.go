@@ -0,0 +1,187 @@
+package httpserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type UpstreamSuite struct {}
+
+var _ = Suite(&UpstreamSuite{})
+
+type testBackend struct {
+	*httptest.Server
+	hits int64
+	status int64
+}
+
+func newTestBackend(name string) *testBackend {
+	tb := &testBackend{status: http.StatusOK}
+	tb.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(int(atomic.LoadInt64(&tb.status)))
+			return
+		}
+		atomic.AddInt64(&tb.hits, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(int(atomic.LoadInt64(&tb.status)))
+		w.Write([]byte(name + ":" + string(body)))
+	}))
+	return tb
+}
+
+func (tb *testBackend) Hits() int {
+	return int(atomic.LoadInt64(&tb.hits))
+}
+
+func upstreamGet(u *Upstream, method, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/x", strings.NewReader(body))
+	for i := 0; i + 1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i + 1])
+	}
+	w := httptest.NewRecorder()
+	u.ServeHTTP(w, req)
+	return w
+}
+
+func (s *UpstreamSuite) TestBalance(c *C) {
+	a, b := newTestBackend("a"), newTestBackend("b")
+	defer a.Close()
+	defer b.Close()
+	u, err := NewUpstream(&UpstreamConfig{Name: "rr", Backends: []string{a.URL, b.URL}}, nil)
+	c.Assert(err, IsNil)
+	for i := 0; i < 10; i++ {
+		c.Check(upstreamGet(u, http.MethodGet, "").Code, Equals, http.StatusOK)
+	}
+	c.Check(a.Hits(), Equals, 5)
+	c.Check(b.Hits(), Equals, 5)
+
+	u, err = NewUpstream(&UpstreamConfig{Name: "hash", Backends: []string{a.URL, b.URL}, Balance: BalanceHash, HashBy: "header:X-User"}, nil)
+	c.Assert(err, IsNil)
+	first := upstreamGet(u, http.MethodGet, "", "X-User", "alice").Body.String()
+	for i := 0; i < 5; i++ {
+		c.Check(upstreamGet(u, http.MethodGet, "", "X-User", "alice").Body.String(), Equals, first)
+	}
+
+	u, err = NewUpstream(&UpstreamConfig{Name: "lc", Backends: []string{a.URL, b.URL}, Balance: BalanceLeastConn}, nil)
+	c.Assert(err, IsNil)
+	u.backends[0].begin()
+	defer u.backends[0].end()
+	for i := 0; i < 3; i++ {
+		c.Check(upstreamGet(u, http.MethodGet, "").Body.String(), Equals, "b:")
+	}
+
+	_, err = NewUpstream(&UpstreamConfig{Name: "bad", Backends: []string{a.URL}, Balance: "random"}, nil)
+	c.Check(err, NotNil)
+}
+
+func (s *UpstreamSuite) TestRetry(c *C) {
+	dead := newTestBackend("dead")
+	dead.Close()
+	live := newTestBackend("live")
+	defer live.Close()
+	u, err := NewUpstream(&UpstreamConfig{Name: "retry", Backends: []string{dead.URL, live.URL}, Retries: 1, MaxFails: 2}, nil)
+	c.Assert(err, IsNil)
+	// the body is replayed to the second backend
+	for i := 0; i < 4; i++ {
+		w := upstreamGet(u, http.MethodPut, "payload")
+		c.Check(w.Code, Equals, http.StatusOK)
+		c.Check(w.Body.String(), Equals, "live:payload")
+	}
+	c.Check(u.backends[0].Ejected(), Equals, true)
+	c.Check(u.backends[1].Ejected(), Equals, false)
+
+	// non-idempotent requests aren't retried
+	u, err = NewUpstream(&UpstreamConfig{Name: "noretry", Backends: []string{dead.URL}, Retries: 3}, nil)
+	c.Assert(err, IsNil)
+	c.Check(upstreamGet(u, http.MethodPost, "payload").Code, Equals, http.StatusBadGateway)
+
+	// gateway errors from a backend are retried elsewhere
+	atomic.StoreInt64(&live.status, http.StatusServiceUnavailable)
+	other := newTestBackend("other")
+	defer other.Close()
+	u, err = NewUpstream(&UpstreamConfig{Name: "status", Backends: []string{live.URL, other.URL}, Retries: 1}, nil)
+	c.Assert(err, IsNil)
+	for i := 0; i < 2; i++ {
+		w := upstreamGet(u, http.MethodGet, "")
+		c.Check(w.Code, Equals, http.StatusOK)
+		c.Check(w.Body.String(), Equals, "other:")
+	}
+}
+
+func (s *UpstreamSuite) TestHealthCheck(c *C) {
+	a, b := newTestBackend("a"), newTestBackend("b")
+	defer a.Close()
+	defer b.Close()
+	u, err := NewUpstream(&UpstreamConfig{
+		Name: "hc",
+		Backends: []string{a.URL, b.URL},
+		HealthCheck: HealthCheckConfig{Path: "health", Healthy: 1, Unhealthy: 2},
+	}, nil)
+	c.Assert(err, IsNil)
+	atomic.StoreInt64(&a.status, http.StatusInternalServerError)
+	u.CheckHealth()
+	c.Check(u.backends[0].Healthy(), Equals, true)
+	u.CheckHealth()
+	c.Check(u.backends[0].Healthy(), Equals, false)
+	for i := 0; i < 4; i++ {
+		c.Check(upstreamGet(u, http.MethodGet, "").Body.String(), Equals, "b:")
+	}
+	atomic.StoreInt64(&a.status, http.StatusOK)
+	u.CheckHealth()
+	c.Check(u.backends[0].Healthy(), Equals, true)
+}
+
+func (s *UpstreamSuite) TestCircuitBreaker(c *C) {
+	a := newTestBackend("a")
+	defer a.Close()
+	atomic.StoreInt64(&a.status, http.StatusBadGateway)
+	u, err := NewUpstream(&UpstreamConfig{
+		Name: "cb",
+		Backends: []string{a.URL},
+		MaxFails: 100,
+		BreakerThreshold: 0.5,
+		BreakerMinRequests: 2,
+	}, nil)
+	c.Assert(err, IsNil)
+	c.Check(upstreamGet(u, http.MethodGet, "").Code, Equals, http.StatusBadGateway)
+	c.Check(upstreamGet(u, http.MethodGet, "").Code, Equals, http.StatusBadGateway)
+	hits := a.Hits()
+	w := upstreamGet(u, http.MethodGet, "")
+	c.Check(w.Code, Equals, http.StatusServiceUnavailable)
+	c.Check(w.Header().Get("Retry-After"), Equals, "30")
+	c.Check(a.Hits(), Equals, hits)
+
+	// after the timeout, one probe goes through; its failure reopens
+	u.breaker.openedAt = time.Now().Add(-time.Minute)
+	c.Check(upstreamGet(u, http.MethodGet, "").Code, Equals, http.StatusBadGateway)
+	c.Check(upstreamGet(u, http.MethodGet, "").Code, Equals, http.StatusServiceUnavailable)
+
+	// and its success closes the breaker
+	atomic.StoreInt64(&a.status, http.StatusOK)
+	u.breaker.openedAt = time.Now().Add(-time.Minute)
+	c.Check(upstreamGet(u, http.MethodGet, "").Code, Equals, http.StatusOK)
+	c.Check(upstreamGet(u, http.MethodGet, "").Code, Equals, http.StatusOK)
+}
+
+func (s *UpstreamSuite) TestServerUpstream(c *C) {
+	a := newTestBackend("a")
+	defer a.Close()
+	srv := newTestServer(c, &ServerConfig{
+		ProxyTransport: ProxyTransportConfig{UpgradeIdleTimeout: 42},
+		Upstreams: []*UpstreamConfig{&UpstreamConfig{Name: "api", Backends: []string{a.URL}}},
+	})
+	u := srv.Upstream("api")
+	c.Assert(u, NotNil)
+	c.Check(u.proxy.Transport, Equals, http.RoundTripper(srv.transport))
+	c.Check(u.client.Transport, Equals, http.RoundTripper(srv.transport))
+	c.Check(u.proxy.IdleTimeout, Equals, 42 * time.Second)
+	c.Check(gather(c, srv.metrics, "upstream_breaker_state"), NotNil)
+	c.Check(upstreamGet(u, http.MethodGet, "").Body.String(), Equals, "a:")
+}
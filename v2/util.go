@@ -26,7 +26,7 @@ func sendError(w http.ResponseWriter, req *http.Request, err error) {
 		if xerr == nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(aerr.StatusCode())
-			w.Write(data)
+			w.Write(withRequestID(req, data))
 			return
 		}
 	}
@@ -238,7 +238,12 @@ func Forwarded(r *http.Request) []map[string]string {
 			if len(pair) != 2 {
 				continue
 			}
-			m[strings.ToLower(pair[0])] = pair[1]
+			k := strings.ToLower(strings.TrimSpace(pair[0]))
+			v := strings.TrimSpace(pair[1])
+			if len(v) >= 2 && v[0] == '"' && v[len(v) - 1] == '"' {
+				v = strings.Replace(v[1:len(v) - 1], `\"`, `"`, -1)
+			}
+			m[k] = v
 		}
 		ms[i] = m
 	}
@@ -0,0 +1,377 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	htmltpl "html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	texttpl "text/template"
+
+	"github.com/pkg/errors"
+)
+
+// View is a HandlerFunc return type that renders the named html template
+// from the server's views directory
+type View struct {
+	Name string
+	Data interface{}
+}
+
+type ViewConfig struct {
+	Directory string `json:"directory" arg:"dir"`
+	Layout    string `json:"layout"    arg:"layout"`
+	Partials  string `json:"partials"  arg:"partials"`
+	DevMode   bool   `json:"dev_mode"  arg:"dev"`
+}
+
+func (cfg *ViewConfig) Init(serverRoot string) error {
+	if cfg.Directory == "" {
+		return nil
+	}
+	dn, err := MakeRootAbs(serverRoot, cfg.Directory)
+	if err != nil {
+		return errors.Wrap(err, "can't make abs path for views directory " + cfg.Directory)
+	}
+	cfg.Directory = dn
+	return nil
+}
+
+type ViewHelper func(req *http.Request) interface{}
+
+var viewHelpersMutex = &sync.Mutex{}
+var viewHelpers = map[string]ViewHelper{
+	"requestId": func(req *http.Request) interface{} {
+		return ContextRequestId(req.Context())
+	},
+	"csrfToken": func(req *http.Request) interface{} {
+		return ContextCSRFToken(req.Context())
+	},
+	"csrfField": csrfField,
+}
+
+// RegisterViewHelper makes a request-dependent value available to view
+// templates as a function taking no arguments.  Packages that depend on
+// this one (such as auth) use it to provide their own helpers.
+func RegisterViewHelper(name string, f ViewHelper) {
+	viewHelpersMutex.Lock()
+	defer viewHelpersMutex.Unlock()
+	viewHelpers[name] = f
+}
+
+func getViewHelpers() map[string]ViewHelper {
+	viewHelpersMutex.Lock()
+	defer viewHelpersMutex.Unlock()
+	helpers := make(map[string]ViewHelper, len(viewHelpers))
+	for k, v := range viewHelpers {
+		helpers[k] = v
+	}
+	return helpers
+}
+
+func ContextCSRFToken(ctx context.Context) string {
+	token, ok := ctx.Value(reqCtxKey("csrf")).(string)
+	if !ok {
+		return ""
+	}
+	return token
+}
+
+func urlFor(pattern string, pairs ...interface{}) (string, error) {
+	if len(pairs) % 2 != 0 {
+		return "", errors.New("urlFor requires key/value pairs")
+	}
+	params := map[string]string{}
+	for i := 0; i < len(pairs); i += 2 {
+		params[fmt.Sprint(pairs[i])] = fmt.Sprint(pairs[i + 1])
+	}
+	return URLFor(pattern, params), nil
+}
+
+func viewFuncs(req *http.Request) htmltpl.FuncMap {
+	funcs := htmltpl.FuncMap{
+		"urlFor": urlFor,
+	}
+	for name, helper := range getViewHelpers() {
+		h := helper
+		if req == nil {
+			funcs[name] = func() interface{} { return nil }
+		} else {
+			funcs[name] = func() interface{} { return h(req) }
+		}
+	}
+	return funcs
+}
+
+// TemplateLoader loads and caches html and text templates.  Page
+// templates are parsed along with every partial and the layout, if one
+// is configured.  In dev mode, templates are re-read on every use.
+type TemplateLoader struct {
+	cfg *ViewConfig
+	mutex *sync.Mutex
+	cache map[string]interface{}
+}
+
+func NewTemplateLoader(cfg *ViewConfig) *TemplateLoader {
+	if cfg == nil {
+		cfg = &ViewConfig{}
+	}
+	return &TemplateLoader{
+		cfg: cfg,
+		mutex: &sync.Mutex{},
+		cache: map[string]interface{}{},
+	}
+}
+
+var defaultTemplateLoader = NewTemplateLoader(nil)
+var defaultTemplateLoaderSet = false
+
+// DefaultTemplateLoader returns the loader for views rendered outside of
+// a Server's requests, such as auth's email templates.  It's the first
+// Server's loader, unless it's been set with SetDefaultTemplateLoader,
+// or a loader with no views directory if there's no server.  Servers
+// render their own requests' views with their own loaders.
+func DefaultTemplateLoader() *TemplateLoader {
+	viewHelpersMutex.Lock()
+	defer viewHelpersMutex.Unlock()
+	return defaultTemplateLoader
+}
+
+func SetDefaultTemplateLoader(l *TemplateLoader) {
+	viewHelpersMutex.Lock()
+	defer viewHelpersMutex.Unlock()
+	defaultTemplateLoader = l
+	defaultTemplateLoaderSet = true
+}
+
+// initDefaultTemplateLoader sets the default loader if nothing has yet
+func initDefaultTemplateLoader(l *TemplateLoader) {
+	viewHelpersMutex.Lock()
+	defer viewHelpersMutex.Unlock()
+	if !defaultTemplateLoaderSet {
+		defaultTemplateLoader = l
+		defaultTemplateLoaderSet = true
+	}
+}
+
+func (l *TemplateLoader) cached(key string, load func() (interface{}, error)) (interface{}, error) {
+	if l.cfg.DevMode {
+		return load()
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	t, ok := l.cache[key]
+	if ok {
+		return t, nil
+	}
+	t, err := load()
+	if err != nil {
+		return nil, err
+	}
+	l.cache[key] = t
+	return t, nil
+}
+
+// Reload discards all cached templates
+func (l *TemplateLoader) Reload() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.cache = map[string]interface{}{}
+}
+
+func (l *TemplateLoader) path(name string) string {
+	return filepath.Join(l.cfg.Directory, filepath.FromSlash(name))
+}
+
+func (l *TemplateLoader) partials() ([]string, error) {
+	if l.cfg.Partials == "" {
+		return nil, nil
+	}
+	dn := l.path(l.cfg.Partials)
+	fns := []string{}
+	err := filepath.Walk(dn, func(fn string, st os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && fn == dn {
+				return nil
+			}
+			return err
+		}
+		if !st.IsDir() && !strings.HasPrefix(st.Name(), ".") {
+			fns = append(fns, fn)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list partials in " + dn)
+	}
+	sort.Strings(fns)
+	return fns, nil
+}
+
+func (l *TemplateLoader) templateName(fn string) string {
+	rel, err := filepath.Rel(l.cfg.Directory, fn)
+	if err != nil {
+		return fn
+	}
+	return filepath.ToSlash(rel)
+}
+
+func parseHTMLFile(t *htmltpl.Template, name, fn string) (*htmltpl.Template, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read template " + fn)
+	}
+	t, err = t.New(name).Parse(string(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse template " + fn)
+	}
+	return t, nil
+}
+
+// View returns the page template with the given name, relative to the
+// views directory, and the name of the template to execute
+func (l *TemplateLoader) View(name string) (*htmltpl.Template, string, error) {
+	key := "view:" + name
+	obj, err := l.cached(key, func() (interface{}, error) {
+		root := htmltpl.New("").Funcs(viewFuncs(nil))
+		partials, err := l.partials()
+		if err != nil {
+			return nil, err
+		}
+		for _, fn := range partials {
+			_, err = parseHTMLFile(root, l.templateName(fn), fn)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if l.cfg.Layout != "" {
+			_, err = parseHTMLFile(root, l.cfg.Layout, l.path(l.cfg.Layout))
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err = parseHTMLFile(root, name, l.path(name))
+		if err != nil {
+			return nil, err
+		}
+		return root, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	entry := name
+	if l.cfg.Layout != "" {
+		entry = l.cfg.Layout
+	}
+	return obj.(*htmltpl.Template), entry, nil
+}
+
+// Render executes the named view for req.  Request-dependent helpers are
+// bound to a clone of the cached template.
+func (l *TemplateLoader) Render(w io.Writer, req *http.Request, name string, data interface{}) error {
+	t, entry, err := l.View(name)
+	if err != nil {
+		return err
+	}
+	t, err = t.Clone()
+	if err != nil {
+		return errors.Wrap(err, "can't clone template " + name)
+	}
+	t = t.Funcs(viewFuncs(req))
+	return t.ExecuteTemplate(w, entry, data)
+}
+
+type Template interface {
+	Execute(io.Writer, interface{}) error
+}
+
+type fileTemplate struct {
+	loader *TemplateLoader
+	name string
+	fn string
+	html bool
+}
+
+func (t *fileTemplate) load() (Template, error) {
+	kind := "text"
+	if t.html {
+		kind = "html"
+	}
+	obj, err := t.loader.cached(kind + ":" + t.fn, func() (interface{}, error) {
+		data, err := ioutil.ReadFile(t.fn)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read template " + t.fn)
+		}
+		if t.html {
+			return htmltpl.New(t.name).Funcs(viewFuncs(nil)).Parse(string(data))
+		}
+		return texttpl.New(t.name).Funcs(texttpl.FuncMap(viewFuncs(nil))).Parse(string(data))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return obj.(Template), nil
+}
+
+func (t *fileTemplate) Execute(w io.Writer, data interface{}) error {
+	tpl, err := t.load()
+	if err != nil {
+		return err
+	}
+	return tpl.Execute(w, data)
+}
+
+// HTMLFile returns a standalone html template loaded from fn, which may
+// be absolute or relative to the views directory
+func (l *TemplateLoader) HTMLFile(name, fn string) (Template, error) {
+	return l.file(name, fn, true)
+}
+
+// TextFile returns a standalone text template loaded from fn, which may
+// be absolute or relative to the views directory
+func (l *TemplateLoader) TextFile(name, fn string) (Template, error) {
+	return l.file(name, fn, false)
+}
+
+func (l *TemplateLoader) file(name, fn string, html bool) (Template, error) {
+	if !filepath.IsAbs(fn) {
+		fn = l.path(fn)
+	}
+	t := &fileTemplate{
+		loader: l,
+		name: name,
+		fn: fn,
+		html: html,
+	}
+	_, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func renderView(w http.ResponseWriter, req *http.Request, view *View) error {
+	var loader *TemplateLoader
+	srv := contextServer(req.Context())
+	if srv != nil && srv.views != nil {
+		loader = srv.views
+	} else {
+		loader = DefaultTemplateLoader()
+	}
+	buf := &bytes.Buffer{}
+	err := loader.Render(buf, req, view.Name, view.Data)
+	if err != nil {
+		return err
+	}
+	SetDefaultContentType(w, "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err = buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,73 @@
+package httpserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type ViewSuite struct {}
+
+var _ = Suite(&ViewSuite{})
+
+func writeTemplate(c *C, dn, name, text string) {
+	fn := filepath.Join(dn, name)
+	c.Assert(os.MkdirAll(filepath.Dir(fn), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(fn, []byte(text), 0644), IsNil)
+}
+
+func (s *ViewSuite) TestRender(c *C) {
+	dn := c.MkDir()
+	writeTemplate(c, dn, "layout.html", `<title>{{block "title" .}}default{{end}}</title>{{template "partials/nav.html" .}}{{template "content" .}}`)
+	writeTemplate(c, dn, "partials/nav.html", `<a href="{{urlFor "/users/:id" "id" .ID}}">{{requestId}}</a>`)
+	writeTemplate(c, dn, "user.html", `{{define "title"}}{{.Name}}{{end}}{{define "content"}}<p>{{.Name}}</p>{{end}}`)
+	loader := NewTemplateLoader(&ViewConfig{Directory: dn, Layout: "layout.html", Partials: "partials"})
+	req := httptest.NewRequest(http.MethodGet, "/users/7", nil)
+	req = req.WithContext(context.WithValue(req.Context(), reqCtxKey("reqId"), "abc"))
+	data := map[string]interface{}{"ID": 7, "Name": "<bob>"}
+	w := httptest.NewRecorder()
+	c.Assert(loader.Render(w, req, "user.html", data), IsNil)
+	c.Check(w.Body.String(), Equals, `<title>&lt;bob&gt;</title><a href="/users/7">abc</a><p>&lt;bob&gt;</p>`)
+
+	// cached until reloaded, unless in dev mode
+	writeTemplate(c, dn, "user.html", `{{define "content"}}changed{{end}}`)
+	w = httptest.NewRecorder()
+	c.Assert(loader.Render(w, req, "user.html", data), IsNil)
+	c.Check(w.Body.String(), Equals, `<title>&lt;bob&gt;</title><a href="/users/7">abc</a><p>&lt;bob&gt;</p>`)
+	loader.cfg.DevMode = true
+	w = httptest.NewRecorder()
+	c.Assert(loader.Render(w, req, "user.html", data), IsNil)
+	c.Check(w.Body.String(), Equals, `<title>default</title><a href="/users/7">abc</a>changed`)
+}
+
+func (s *ViewSuite) TestServerViews(c *C) {
+	handler := HandlerFunc(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		return View{Name: "hello.html", Data: "world"}, nil
+	})
+	servers := make([]*Server, 2)
+	for i, greeting := range []string{"hello", "howdy"} {
+		dn := c.MkDir()
+		writeTemplate(c, dn, "hello.html", greeting + ` {{.}}`)
+		servers[i] = newTestServer(c, &ServerConfig{Views: ViewConfig{Directory: dn}})
+		servers[i].GET("/", handler)
+		servers[i].Prefix("/").Compile(nil)
+	}
+
+	// each server renders with its own views, and only the first one
+	// sets the default
+	dflt := DefaultTemplateLoader()
+	c.Check(dflt, Not(Equals), servers[1].Views())
+	for i, expect := range []string{"hello world", "howdy world"} {
+		w := httptest.NewRecorder()
+		servers[i].ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		c.Check(w.Body.String(), Equals, expect)
+	}
+	srv := newTestServer(c, &ServerConfig{})
+	c.Check(DefaultTemplateLoader(), Equals, dflt)
+	c.Check(dflt, Not(Equals), srv.Views())
+}
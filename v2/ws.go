@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -23,9 +24,7 @@ var newline = []byte{'\n'}
 var upgrader = websocket.Upgrader{
 	ReadBufferSize: 1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(req *http.Request) bool {
-		return true
-	},
+	CheckOrigin: checkOrigin,
 }
 
 type Hub interface {
@@ -38,8 +37,15 @@ type Hub interface {
 	BroadcastEvent(interface{})
 }
 
+// HubCounter is implemented by hubs that can say how many clients they
+// have, for the admin diagnostics
+type HubCounter interface {
+	ClientCount() int
+}
+
 type GenericHub struct {
 	clients map[*Client]bool
+	count int64
 	stopper chan bool
 	broadcast chan []byte
 	register chan *Client
@@ -86,7 +92,7 @@ func (h *GenericHub) Run() {
 				}
 			}
 			for _, client := range toClose {
-				log.Println("can't send to client", client, "closing")
+				log.Println("can't send to client", client.RequestId(), "closing")
 				close(client.Send)
 				delete(h.clients, client)
 			}
@@ -100,13 +106,14 @@ func (h *GenericHub) Run() {
 				}
 			}
 			for _, client := range toClose {
-				log.Println("can't send to client", client, "closing")
+				log.Println("can't send to client", client.RequestId(), "closing")
 				close(client.Send)
 				delete(h.clients, client)
 			}
 		case <-h.stopper:
 			stopped = true
 		}
+		atomic.StoreInt64(&h.count, int64(len(h.clients)))
 	}
 	h.closed = true
 	toClose := []*Client{}
@@ -117,6 +124,7 @@ func (h *GenericHub) Run() {
 		close(client.Send)
 		delete(h.clients, client)
 	}
+	atomic.StoreInt64(&h.count, 0)
 }
 
 func (h *GenericHub) Stop() {
@@ -127,6 +135,11 @@ func (h *GenericHub) Closed() bool {
 	return h.closed
 }
 
+// ClientCount returns the number of connected clients
+func (h *GenericHub) ClientCount() int {
+	return int(atomic.LoadInt64(&h.count))
+}
+
 func (h *GenericHub) Register(c *Client) {
 	h.register <- c
 }
@@ -150,6 +163,19 @@ type Client struct {
 	Send chan []byte
 	lock *sync.Mutex
 	isOpen bool
+	requestId string
+}
+
+// RequestId returns the ID of the request that opened the websocket
+func (c *Client) RequestId() string {
+	return c.requestId
+}
+
+func (c *Client) logln(args ...interface{}) {
+	if c.requestId != "" {
+		args = append([]interface{}{c.requestId}, args...)
+	}
+	log.Println(args...)
 }
 
 func (c *Client) Open(conn *websocket.Conn) error {
@@ -247,9 +273,9 @@ func (c *Client) ReadPump() {
 		_, message, err := c.ReadMessage()
 		if err != nil {
 			if err == websocket.ErrCloseSent {
-				log.Println("client closed websocket")
+				c.logln("client closed websocket")
 			} else {
-				log.Println("websocket read error:", err)
+				c.logln("websocket read error:", err)
 			}
 			return
 		}
@@ -271,12 +297,12 @@ func (c *Client) WritePump() {
 		case message, ok := <-c.Send:
 			c.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				log.Println("source channel closed, shutting down websocket")
+				c.logln("source channel closed, shutting down websocket")
 				return
 			}
 			w, err := c.NextWriter(websocket.TextMessage)
 			if err != nil {
-				log.Println("error getting websocket writer:", err)
+				c.logln("error getting websocket writer:", err)
 				return
 			}
 			w.Write(message)
@@ -288,14 +314,14 @@ func (c *Client) WritePump() {
 			}
 			err = w.Close()
 			if err != nil {
-				log.Println("websocket write error:", err)
+				c.logln("websocket write error:", err)
 				return
 			}
 		case <-ticker.C:
 			c.SetWriteDeadline(time.Now().Add(writeWait))
 			err := c.WriteMessage(websocket.PingMessage, nil);
 			if err != nil {
-				log.Println("websocket ping error:", err)
+				c.logln("websocket ping error:", err)
 				return
 			}
 		}
@@ -303,7 +329,12 @@ func (c *Client) WritePump() {
 }
 
 func ServeWS(hub Hub, w http.ResponseWriter, req *http.Request) (interface{}, error) {
-	client := &Client{hub: hub, Send: make(chan []byte, 256), lock: &sync.Mutex{}}
+	client := &Client{
+		hub: hub,
+		Send: make(chan []byte, 256),
+		lock: &sync.Mutex{},
+		requestId: ContextRequestId(req.Context()),
+	}
 	return client, nil
 }
 